@@ -1,7 +1,6 @@
 package main
 
 import (
-	"archive/zip"
 	"context"
 	"flag"
 	"fmt"
@@ -56,7 +55,7 @@ func main() {
 		fatalError(oaError)
 	}
 
-	file := findFileInZip(fileName, archive)
+	file := zipartifacts.FindEntry(archive, fileName)
 	if file == nil {
 		notFoundError(fmt.Errorf("find %q in %q: not found", fileName, scrubbedArchivePath))
 	}
@@ -76,15 +75,6 @@ func main() {
 	}
 }
 
-func findFileInZip(fileName string, archive *zip.Reader) *zip.File {
-	for _, file := range archive.File {
-		if file.Name == fileName {
-			return file
-		}
-	}
-	return nil
-}
-
 func printError(err error) {
 	fmt.Fprintf(os.Stderr, "%s: %v", progName, err)
 }
@@ -15,6 +15,13 @@ var Version = "unknown"
 
 var printVersion = flag.Bool("version", false, "Print version and exit")
 
+var limits zipartifacts.Limits
+
+func init() {
+	flag.Uint64Var(&limits.MaxCompressionRatio, "max-compression-ratio", 0, "Reject archives with entries compressed more than this many times, 0 means no limit")
+	flag.Uint64Var(&limits.MaxUncompressedSize, "max-uncompressed-size", 0, "Reject archives larger than this many bytes once uncompressed, 0 means no limit")
+}
+
 func main() {
 	flag.Parse()
 
@@ -24,19 +31,23 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s FILE.ZIP\n", progName)
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] FILE.ZIP\n", progName)
 		os.Exit(1)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	archive, err := zipartifacts.OpenArchive(ctx, os.Args[1])
+	archive, err := zipartifacts.OpenArchive(ctx, flag.Arg(0))
 	if err != nil {
 		fatalError(err)
 	}
 
+	if err := limits.Check(archive); err != nil {
+		fatalError(err)
+	}
+
 	if err := zipartifacts.GenerateZipMetadata(os.Stdout, archive); err != nil {
 		fatalError(err)
 	}
@@ -47,5 +58,8 @@ func fatalError(err error) {
 	if err == zipartifacts.ErrNotAZip {
 		os.Exit(zipartifacts.StatusNotZip)
 	}
+	if _, ok := err.(*zipartifacts.LimitError); ok {
+		os.Exit(zipartifacts.StatusLimitExceeded)
+	}
 	os.Exit(1)
 }
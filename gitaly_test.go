@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -24,8 +25,10 @@ import (
 	"google.golang.org/grpc/codes"
 
 	"gitlab.com/gitlab-org/gitaly-proto/go/gitalypb"
+	"gitlab.com/gitlab-org/gitaly/streamio"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
@@ -55,6 +58,32 @@ func TestFailedCloneNoGitaly(t *testing.T) {
 	assert.Error(t, err, "git clone should have failed")
 }
 
+func TestGetInfoRefsGitalyCircuitOpen(t *testing.T) {
+	threshold := 1
+	require.NoError(t, gitaly.Configure(&config.GitalyConfig{
+		CircuitBreakerThreshold: &threshold,
+		CircuitBreakerCooldown:  &config.TomlDuration{Duration: time.Hour},
+	}))
+	defer gitaly.Configure(nil)
+
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalyServer.Address = "unix:/nonexistent-circuit-breaker"
+
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	resource := "/gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack"
+
+	resp, _ := httpGet(t, ws.URL+resource, nil)
+	require.Equal(t, 500, resp.StatusCode, "the first failure opens the circuit")
+
+	resp, body := httpGet(t, ws.URL+resource, nil)
+	require.Equal(t, 503, resp.StatusCode, "requests fail fast while the circuit is open")
+	require.Contains(t, body, "temporarily unavailable")
+}
+
 func TestGetInfoRefsProxiedToGitalySuccessfully(t *testing.T) {
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
 	defer gitalyServer.Stop()
@@ -439,6 +468,133 @@ func TestGetArchiveProxiedToGitalySuccessfully(t *testing.T) {
 	}
 }
 
+func TestGetBundleProxiedToGitalySuccessfully(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+
+	bundlePath := path.Join(scratchDir, fmt.Sprintf("bundles/%d.bundle", rand.Int()))
+	expectedBody := testhelper.GitalyCreateBundleResponseMock
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"unix:%s","Token":""},"GitalyRepository":{"storage_name":"default","relative_path":"foo/bar.git"},"BundlePath":"%s"}`,
+		socketPath, bundlePath)
+
+	ts := sendDataResponder("git-bundle", jsonParams)
+	defer ts.Close()
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	resp, body := httpGet(t, ws.URL+"/foo/bar.git/gitlab-bundle", nil)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, expectedBody, body)
+
+	cachedBundle, err := ioutil.ReadFile(bundlePath)
+	require.NoError(t, err)
+	require.Equal(t, expectedBody, string(cachedBundle))
+
+	// Cached bundles are served without Gitaly, and support Range requests
+	gitalyServer.Stop()
+
+	resp, body = httpGet(t, ws.URL+"/foo/bar.git/gitlab-bundle", map[string]string{"Range": "bytes=10-19"})
+	require.Equal(t, 206, resp.StatusCode)
+	require.Equal(t, expectedBody[10:20], body)
+}
+
+func TestPostUploadPackBundleURICommand(t *testing.T) {
+	apiResponse := gitOkBody(t)
+	apiResponse.GitBundleURI = "https://gitlab.example.com/foo/bar.git/gitlab-bundle"
+
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	resource := "/gitlab-org/gitlab-test.git/git-upload-pack"
+	headers := map[string]string{
+		"Content-Type": "application/x-git-upload-pack-request",
+		"Git-Protocol": "version=2",
+	}
+
+	resp, body := httpPost(t, ws.URL+resource, headers, []byte("0017command=bundle-uri\n00010017object-format=sha1\n0000"))
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "0015bundle.version=1\n0014bundle.mode=all\n004bbundle.gitlab.uri=https://gitlab.example.com/foo/bar.git/gitlab-bundle\n0000", body)
+
+	// Other commands still go to Gitaly
+	resp, body = httpPost(t, ws.URL+resource, headers, testhelper.GitalyUploadPackResponseMock)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Len(t, strings.SplitN(body, "\000", 2), 2)
+}
+
+func TestDumbHTTPClone(t *testing.T) {
+	require.NoError(t, os.RemoveAll(scratchDir))
+
+	gitalyServer, socketPath := startUploadPackGitalyServer(t, path.Join(testRepoRoot, testRepo))
+	defer gitalyServer.Stop()
+
+	cachePath := path.Join(scratchDir, "dumb-http")
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+	apiResponse.GitDumbHTTPCachePath = cachePath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	cloneCmd := exec.Command("git", "clone", fmt.Sprintf("%s/%s", ws.URL, testRepo), checkoutDir)
+	cloneCmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	runOrFail(t, cloneCmd)
+
+	expectedHead, err := exec.Command("git", "--git-dir", path.Join(testRepoRoot, testRepo), "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+	head, err := exec.Command("git", "-C", checkoutDir, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+	require.Equal(t, string(expectedHead), string(head))
+
+	packs, err := filepath.Glob(path.Join(cachePath, "pack-*.pack"))
+	require.NoError(t, err)
+	require.Len(t, packs, 1, "cached packs")
+
+	// Cached packs are served without Gitaly, and support Range requests
+	gitalyServer.Stop()
+
+	resource := fmt.Sprintf("/%s/objects/pack/%s", testRepo, path.Base(packs[0]))
+	resp, body := httpGet(t, ws.URL+resource, map[string]string{"Range": "bytes=0-3"})
+	require.Equal(t, 206, resp.StatusCode)
+	require.Equal(t, "PACK", body)
+}
+
+func TestDumbHTTPNotFound(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+	ts := testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	for _, resource := range []string{"info/refs", "HEAD", "objects/info/packs"} {
+		resp, _ := httpGet(t, ws.URL+"/gitlab-org/gitlab-test.git/"+resource, nil)
+		require.Equal(t, 404, resp.StatusCode, "%s without opting in", resource)
+	}
+
+	apiResponse.GitDumbHTTPCachePath = path.Join(scratchDir, "dumb-http")
+	ts = testAuthServer(nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws = startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	// Loose objects are never served, clients fall back to packs
+	resp, _ := httpGet(t, ws.URL+"/gitlab-org/gitlab-test.git/objects/01/23456789012345678901234567890123456789", nil)
+	require.Equal(t, 404, resp.StatusCode, "loose object")
+}
+
 func TestGetArchiveProxiedToGitalyInterruptedStream(t *testing.T) {
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
 	defer gitalyServer.Stop()
@@ -670,3 +826,55 @@ func startGitalyServer(t *testing.T, finalMessageCode codes.Code) (*combinedServ
 
 	return &combinedServer{Server: server, GitalyTestServer: gitalyServer}, socketPath
 }
+
+// uploadPackGitalyServer answers the SmartHTTP RPCs for upload-pack with
+// the real git-upload-pack of repoPath.
+type uploadPackGitalyServer struct {
+	*testhelper.GitalyTestServer
+	repoPath string
+}
+
+func (s *uploadPackGitalyServer) InfoRefsUploadPack(in *gitalypb.InfoRefsRequest, stream gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+	out, err := exec.Command("git", "upload-pack", "--stateless-rpc", "--advertise-refs", s.repoPath).Output()
+	if err != nil {
+		return err
+	}
+
+	return stream.Send(&gitalypb.InfoRefsResponse{Data: out})
+}
+
+func (s *uploadPackGitalyServer) PostUploadPack(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+	// The first message only contains the repository
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "upload-pack", "--stateless-rpc", s.repoPath)
+	cmd.Stdin = streamio.NewReader(func() ([]byte, error) {
+		req, err := stream.Recv()
+		return req.GetData(), err
+	})
+	cmd.Stdout = streamio.NewWriter(func(p []byte) error {
+		return stream.Send(&gitalypb.PostUploadPackResponse{Data: p})
+	})
+
+	return cmd.Run()
+}
+
+func startUploadPackGitalyServer(t *testing.T, repoPath string) (*grpc.Server, string) {
+	require.NoError(t, os.MkdirAll(scratchDir, 0755))
+	socketPath := path.Join(scratchDir, fmt.Sprintf("gitaly-%d.sock", rand.Int()))
+	server := grpc.NewServer()
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	gitalyServer := &uploadPackGitalyServer{
+		GitalyTestServer: testhelper.NewGitalyServer(codes.OK),
+		repoPath:         repoPath,
+	}
+	gitalypb.RegisterSmartHTTPServiceServer(server, gitalyServer)
+
+	go server.Serve(listener)
+
+	return server, socketPath
+}
@@ -93,6 +93,16 @@ type RemoteObject struct {
 	MultipartUpload *MultipartUploadParams
 }
 
+// UploadDestination describes how the files of a multipart form field are
+// stored, instead of the TempPath, RemoteObject, MaximumSize and
+// AllowedContentTypes of the Response
+type UploadDestination struct {
+	TempPath            string
+	RemoteObject        RemoteObject
+	MaximumSize         int64
+	AllowedContentTypes []string
+}
+
 type Response struct {
 	// GL_ID is an environment variable used by gitlab-shell hooks during 'git
 	// push' and 'git pull'
@@ -119,6 +129,18 @@ type Response struct {
 	// RemoteObject is provided by the GitLab Rails application
 	// and defines a way to store object on remote storage
 	RemoteObject RemoteObject
+	// MaximumSize is the largest allowed size of an uploaded file in bytes.
+	// Zero means there is no limit.
+	MaximumSize int64
+	// ExpectedChecksums maps hash names (md5, sha1, sha256 or sha512) to
+	// the hex digest an uploaded file must have
+	ExpectedChecksums map[string]string
+	// AllowedContentTypes restricts the media types of uploaded files, as
+	// detected by gitlab-workhorse, e.g. ["image/*"] for avatars
+	AllowedContentTypes []string
+	// UploadFields maps multipart form field names, e.g. "file" or
+	// "files[]", to the destination of their files
+	UploadFields map[string]*UploadDestination
 	// Archive is the path where the artifacts archive is stored
 	Archive string `json:"archive"`
 	// Entry is a filename inside the archive point to file that needs to be extracted
@@ -131,6 +153,36 @@ type Response struct {
 	Repository gitalypb.Repository
 	// For git-http, does the requestor have the right to view all refs?
 	ShowAllRefs bool
+	// GitBundleURI is advertised to Git protocol v2 clients through the
+	// bundle-uri capability so that clones can start from a bundle
+	GitBundleURI string
+	// GitDumbHTTPCachePath enables the read-only 'dumb' Git HTTP protocol
+	// for the repository. Generated packs are cached in this directory.
+	GitDumbHTTPCachePath string
+}
+
+// ForField returns the response for storing the file of a multipart form
+// field, the destination of the first of names found in UploadFields
+// replaces the one of r. The MaximumSize of r applies unless the
+// destination has its own.
+func (r *Response) ForField(names ...string) *Response {
+	for _, name := range names {
+		dest := r.UploadFields[name]
+		if dest == nil {
+			continue
+		}
+
+		fieldResponse := *r
+		fieldResponse.TempPath = dest.TempPath
+		fieldResponse.RemoteObject = dest.RemoteObject
+		fieldResponse.AllowedContentTypes = dest.AllowedContentTypes
+		if dest.MaximumSize > 0 {
+			fieldResponse.MaximumSize = dest.MaximumSize
+		}
+		return &fieldResponse
+	}
+
+	return r
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
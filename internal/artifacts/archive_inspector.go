@@ -0,0 +1,122 @@
+package artifacts
+
+import (
+	"io"
+	"io/ioutil"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+// archiveInspector reads the archive written to it while it is uploaded.
+// The format is detected from the first bytes: the central directory of zip
+// archives is captured and the entries are hashed, tar archives and gzip
+// files are read in a goroutine.
+type archiveInspector struct {
+	head    []byte
+	started bool
+	format  string
+
+	capture    *zipartifacts.DirectoryCapture
+	zipDigests *zipartifacts.ZipDigests
+
+	pw         *io.PipeWriter
+	done       chan struct{}
+	tarArchive *zipartifacts.TarArchive
+	tarErr     error
+}
+
+func (a *archiveInspector) Write(p []byte) (int, error) {
+	if !a.started {
+		a.head = append(a.head, p...)
+		if len(a.head) < zipartifacts.DetectFormatLen {
+			return len(p), nil
+		}
+
+		n := len(p)
+		if err := a.start(); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	return a.write(p)
+}
+
+// start detects the format of the archive and writes the bytes read so far
+func (a *archiveInspector) start() error {
+	a.started = true
+	a.format = zipartifacts.DetectFormat(a.head)
+
+	switch a.format {
+	case zipartifacts.FormatZip:
+		a.capture = zipartifacts.NewDirectoryCapture(maxCapturedDirectorySize)
+		a.startReader(func(r io.Reader) error {
+			a.zipDigests = zipartifacts.ReadZipDigests(r, archiveLimits)
+			return nil
+		})
+	case zipartifacts.FormatTar:
+		a.startReader(func(r io.Reader) error {
+			a.tarArchive, a.tarErr = zipartifacts.ReadTarArchive(r, archiveLimits)
+			return a.tarErr
+		})
+	}
+
+	_, err := a.write(a.head)
+	a.head = nil
+	return err
+}
+
+// startReader calls read with the archive in a goroutine
+func (a *archiveInspector) startReader(read func(io.Reader) error) {
+	pr, pw := io.Pipe()
+	a.pw = pw
+	a.done = make(chan struct{})
+
+	go func() {
+		defer close(a.done)
+
+		err := read(pr)
+		if _, ok := err.(*zipartifacts.LimitError); ok {
+			archiveLimitRejections.Inc()
+			// Stop the upload
+			pr.CloseWithError(err)
+			return
+		}
+
+		// Invalid archives are stored without metadata
+		io.Copy(ioutil.Discard, pr)
+	}()
+}
+
+func (a *archiveInspector) write(p []byte) (int, error) {
+	if a.capture != nil {
+		a.capture.Write(p)
+	}
+	if a.pw != nil {
+		return a.pw.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// Close waits for the archive to be read. It fails only if the archive
+// exceeds the archive limits.
+func (a *archiveInspector) Close() error {
+	if !a.started {
+		if err := a.start(); err != nil {
+			return err
+		}
+	}
+
+	if a.pw == nil {
+		return nil
+	}
+
+	a.pw.Close()
+	<-a.done
+	if _, ok := a.tarErr.(*zipartifacts.LimitError); ok {
+		return a.tarErr
+	}
+
+	return nil
+}
@@ -138,6 +138,7 @@ func TestUploadHandlerSendingToExternalStorage(t *testing.T) {
 			response := testUploadArtifacts(contentType, &contentBuffer, t, ts)
 			testhelper.AssertResponseCode(t, response, http.StatusOK)
 			testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
+			testhelper.AssertResponseHeader(t, response, MetadataVersionKey, MetadataVersionZip)
 			assert.Equal(t, 1, storeServerCalled, "store should be called only once")
 			assert.Equal(t, 1, responseProcessorCalled, "response processor should be called only once")
 		})
@@ -1,37 +1,71 @@
 package artifacts
 
 import (
+	"archive/zip"
 	"context"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
-	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
-	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
 )
 
-type artifactsUploadProcessor struct {
-	opts   *filestore.SaveFileOpts
-	stored bool
+var (
+	archiveLimits zipartifacts.Limits
+
+	archiveLimitRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_artifacts_archive_limit_rejections",
+			Help: "How many artifacts archives gitlab-workhorse rejected because they exceed the compression ratio or uncompressed size limits.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(archiveLimitRejections)
 }
 
-func (a *artifactsUploadProcessor) generateMetadataFromZip(ctx context.Context, file *filestore.FileHandler) (*filestore.FileHandler, error) {
-	metaReader, metaWriter := io.Pipe()
-	defer metaWriter.Close()
+// SetArchiveLimits makes uploads of artifacts archives that exceed limits
+// fail
+func SetArchiveLimits(limits zipartifacts.Limits) {
+	archiveLimits = limits
+}
 
-	metaOpts := &filestore.SaveFileOpts{
-		LocalTempPath:  a.opts.LocalTempPath,
-		TempFilePrefix: "metadata.gz",
+// maxCapturedDirectorySize is how much of the end of an archive is kept
+// while it is uploaded, archives with larger central directories are read
+// again once stored
+var maxCapturedDirectorySize = 4 * 1024 * 1024
+
+type artifactsUploadProcessor struct {
+	opts      *filestore.SaveFileOpts
+	stored    bool
+	inspector *archiveInspector
+}
+
+func (a *artifactsUploadProcessor) InspectFile(_ context.Context, formName string) (io.WriteCloser, error) {
+	if formName != "file" {
+		return nil, fmt.Errorf("invalid form field: %q", formName)
 	}
-	if metaOpts.LocalTempPath == "" {
-		metaOpts.LocalTempPath = os.TempDir()
+
+	a.inspector = &archiveInspector{}
+	return a.inspector, nil
+}
+
+// openZipArchive reads the central directory captured during the upload
+// and falls back to the stored file if it is too large
+func (a *artifactsUploadProcessor) openZipArchive(ctx context.Context, file *filestore.FileHandler) (*zip.Reader, error) {
+	if a.inspector != nil && a.inspector.capture != nil {
+		archive, err := a.inspector.capture.Archive()
+		if err != zipartifacts.ErrDirectoryNotCaptured {
+			return archive, err
+		}
 	}
 
 	fileName := file.LocalPath
@@ -39,38 +73,74 @@ func (a *artifactsUploadProcessor) generateMetadataFromZip(ctx context.Context,
 		fileName = file.RemoteURL
 	}
 
-	zipMd := exec.CommandContext(ctx, "gitlab-zip-metadata", fileName)
-	zipMd.Stderr = os.Stderr
-	zipMd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	zipMd.Stdout = metaWriter
+	return zipartifacts.OpenArchive(ctx, fileName)
+}
 
-	if err := zipMd.Start(); err != nil {
-		return nil, err
+func (a *artifactsUploadProcessor) generateMetadata(ctx context.Context, file *filestore.FileHandler) (*filestore.FileHandler, error) {
+	format := zipartifacts.FormatZip
+	if a.inspector != nil {
+		format = a.inspector.format
 	}
-	defer helper.CleanUpProcessGroup(zipMd)
 
-	type saveResult struct {
-		error
-		*filestore.FileHandler
-	}
-	done := make(chan saveResult)
-	go func() {
-		var result saveResult
-		result.FileHandler, result.error = filestore.SaveFileFromReader(ctx, metaReader, -1, metaOpts)
+	switch format {
+	case zipartifacts.FormatZip:
+		archive, err := a.openZipArchive(ctx, file)
+		if err == zipartifacts.ErrNotAZip {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
 
-		done <- result
-	}()
+		if err := archiveLimits.Check(archive); err != nil {
+			archiveLimitRejections.Inc()
+			return nil, &upload.InvalidFileError{Err: err}
+		}
 
-	if err := zipMd.Wait(); err != nil {
-		if st, ok := helper.ExitStatus(err); ok && st == zipartifacts.StatusNotZip {
+		var digests *zipartifacts.ZipDigests
+		if a.inspector != nil {
+			digests = a.inspector.zipDigests
+		}
+
+		return a.saveMetadata(ctx, func(w io.Writer) error {
+			return zipartifacts.GenerateZipMetadataV3(w, archive, digests)
+		})
+
+	case zipartifacts.FormatTar:
+		// Limits were checked while the archive was uploaded
+		archive := a.inspector.tarArchive
+		if archive == nil {
 			return nil, nil
 		}
-		return nil, err
+
+		return a.saveMetadata(ctx, func(w io.Writer) error {
+			return zipartifacts.GenerateTarMetadata(w, archive)
+		})
+
+	default:
+		return nil, nil
 	}
+}
 
-	metaWriter.Close()
-	result := <-done
-	return result.FileHandler, result.error
+// saveMetadata stores the metadata written by generate
+func (a *artifactsUploadProcessor) saveMetadata(ctx context.Context, generate func(io.Writer) error) (*filestore.FileHandler, error) {
+	metaOpts := &filestore.SaveFileOpts{
+		LocalTempPath:  a.opts.LocalTempPath,
+		TempFilePrefix: "metadata.gz",
+	}
+	if metaOpts.LocalTempPath == "" {
+		metaOpts.LocalTempPath = os.TempDir()
+	}
+
+	metaReader, metaWriter := io.Pipe()
+	go func() {
+		metaWriter.CloseWithError(generate(metaWriter))
+	}()
+
+	fh, err := filestore.SaveFileFromReader(ctx, metaReader, -1, metaOpts)
+	// Stop the generator if the metadata couldn't be stored
+	metaReader.CloseWithError(err)
+
+	return fh, err
 }
 
 func (a *artifactsUploadProcessor) ProcessFile(ctx context.Context, formName string, file *filestore.FileHandler, writer *multipart.Writer) error {
@@ -90,13 +160,20 @@ func (a *artifactsUploadProcessor) ProcessFile(ctx context.Context, formName str
 
 	default:
 		// TODO: can we rely on disk for shipping metadata? Not if we split workhorse and rails in 2 different PODs
-		metadata, err := a.generateMetadataFromZip(ctx, file)
-		if err != nil {
-			return fmt.Errorf("generateMetadataFromZip: %v", err)
+		metadata, err := a.generateMetadata(ctx, file)
+		if _, ok := err.(*upload.InvalidFileError); ok {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("generateMetadata: %v", err)
 		}
 
 		if metadata != nil {
-			for k, v := range metadata.GitLabFinalizeFields("metadata") {
+			fields, err := metadata.GitLabFinalizeFields("metadata")
+			if err != nil {
+				return fmt.Errorf("finalize metadata field error: %v", err)
+			}
+
+			for k, v := range fields {
 				writer.WriteField(k, v)
 			}
 		}
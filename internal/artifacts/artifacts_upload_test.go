@@ -1,6 +1,7 @@
 package artifacts
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
@@ -14,6 +15,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
@@ -27,6 +30,12 @@ const (
 	MetadataHeaderKey     = "Metadata-Status"
 	MetadataHeaderPresent = "present"
 	MetadataHeaderMissing = "missing"
+
+	// MetadataVersionKey is the version of the metadata: 0.0.3 for zip
+	// archives, 0.0.2 for tar archives and gzip files
+	MetadataVersionKey = "Metadata-Version"
+	MetadataVersionZip = "0.0.3"
+	MetadataVersionTar = "0.0.2"
 )
 
 func testArtifactsUploadServer(t *testing.T, authResponse api.Response, bodyProcessor func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
@@ -85,7 +94,12 @@ func testArtifactsUploadServer(t *testing.T, authResponse api.Response, bodyProc
 				t.Fatal("Expected metadata to be valid")
 				return
 			}
-			if !bytes.HasPrefix(metadata, []byte(zipartifacts.MetadataHeaderPrefix+zipartifacts.MetadataHeader)) {
+			switch {
+			case bytes.HasPrefix(metadata, []byte(zipartifacts.MetadataHeaderPrefix+zipartifacts.MetadataHeaderV3)):
+				w.Header().Set(MetadataVersionKey, MetadataVersionZip)
+			case bytes.HasPrefix(metadata, []byte(zipartifacts.MetadataHeaderPrefix+zipartifacts.MetadataHeader)):
+				w.Header().Set(MetadataVersionKey, MetadataVersionTar)
+			default:
 				t.Fatal("Expected metadata to be of valid format")
 				return
 			}
@@ -151,6 +165,114 @@ func TestUploadHandlerAddingMetadata(t *testing.T) {
 	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
 	testhelper.AssertResponseCode(t, response, http.StatusOK)
 	testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
+	testhelper.AssertResponseHeader(t, response, MetadataVersionKey, MetadataVersionZip)
+}
+
+func TestUploadHandlerAddingMetadataFromStoredFile(t *testing.T) {
+	defer func(size int) { maxCapturedDirectorySize = size }(maxCapturedDirectorySize)
+	maxCapturedDirectorySize = 16
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	ts := testArtifactsUploadServer(t, api.Response{TempPath: tempPath}, nil)
+	defer ts.Close()
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "my.file")
+	require.NoError(t, err)
+
+	archive := zip.NewWriter(file)
+	fileInArchive, err := archive.Create("test.file")
+	require.NoError(t, err)
+	fmt.Fprint(fileInArchive, "test")
+	require.NoError(t, archive.Close())
+	require.NoError(t, writer.Close())
+
+	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
+	testhelper.AssertResponseHeader(t, response, MetadataVersionKey, MetadataVersionZip)
+}
+
+func TestUploadHandlerAddingMetadataForSelfExtractingArchive(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	ts := testArtifactsUploadServer(t, api.Response{TempPath: tempPath}, nil)
+	defer ts.Close()
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "my.file")
+	require.NoError(t, err)
+
+	// The archive starts with an extraction script
+	script := "#!/bin/sh\nexec unzip \"$0\"\n"
+	fmt.Fprint(file, script)
+	archive := zip.NewWriter(file)
+	archive.SetOffset(int64(len(script)))
+	fileInArchive, err := archive.Create("test.file")
+	require.NoError(t, err)
+	fmt.Fprint(fileInArchive, "test")
+	require.NoError(t, archive.Close())
+	require.NoError(t, writer.Close())
+
+	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
+	testhelper.AssertResponseHeader(t, response, MetadataVersionKey, MetadataVersionZip)
+}
+
+func TestUploadHandlerAddingMetadataForTarArchive(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	ts := testArtifactsUploadServer(t, api.Response{TempPath: tempPath}, nil)
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		limits   zipartifacts.Limits
+		size     int64
+		code     int
+		metadata string
+	}{
+		{name: "tar.gz", size: 4, code: http.StatusOK, metadata: MetadataHeaderPresent},
+		{name: "compression ratio", limits: zipartifacts.Limits{MaxCompressionRatio: 100}, size: 4 * 1024 * 1024, code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetArchiveLimits(tc.limits)
+			defer SetArchiveLimits(zipartifacts.Limits{})
+
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreateFormFile("file", "my.file")
+			require.NoError(t, err)
+
+			gz := gzip.NewWriter(file)
+			archive := tar.NewWriter(gz)
+			require.NoError(t, archive.WriteHeader(&tar.Header{Name: "test.file", Typeflag: tar.TypeReg, Mode: 0644, Size: tc.size}))
+			_, err = archive.Write(make([]byte, tc.size))
+			require.NoError(t, err)
+			require.NoError(t, archive.Close())
+			require.NoError(t, gz.Close())
+			require.NoError(t, writer.Close())
+
+			response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+			testhelper.AssertResponseCode(t, response, tc.code)
+			if tc.metadata != "" {
+				testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, tc.metadata)
+				testhelper.AssertResponseHeader(t, response, MetadataVersionKey, MetadataVersionTar)
+			}
+		})
+	}
 }
 
 func TestUploadHandlerForUnsupportedArchive(t *testing.T) {
@@ -203,7 +325,7 @@ func TestUploadHandlerForMultipleFiles(t *testing.T) {
 	writer.Close()
 
 	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
-	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+	testhelper.AssertResponseCode(t, response, http.StatusBadRequest)
 }
 
 func TestUploadFormProcessing(t *testing.T) {
@@ -228,3 +350,46 @@ func TestUploadFormProcessing(t *testing.T) {
 	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
 	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
 }
+
+func TestUploadHandlerForArchiveExceedingLimits(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	ts := testArtifactsUploadServer(t, api.Response{TempPath: tempPath}, nil)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		limits zipartifacts.Limits
+		code   int
+	}{
+		{name: "no limits", code: http.StatusOK},
+		{name: "compression ratio", limits: zipartifacts.Limits{MaxCompressionRatio: 100}, code: http.StatusUnprocessableEntity},
+		{name: "uncompressed size", limits: zipartifacts.Limits{MaxUncompressedSize: 1024 * 1024}, code: http.StatusUnprocessableEntity},
+		{name: "within limits", limits: zipartifacts.Limits{MaxCompressionRatio: 10000, MaxUncompressedSize: 4 * 1024 * 1024}, code: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetArchiveLimits(tc.limits)
+			defer SetArchiveLimits(zipartifacts.Limits{})
+
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreateFormFile("file", "my.file")
+			require.NoError(t, err)
+
+			archive := zip.NewWriter(file)
+			fileInArchive, err := archive.Create("zeros")
+			require.NoError(t, err)
+			_, err = fileInArchive.Write(make([]byte, 2*1024*1024))
+			require.NoError(t, err)
+			require.NoError(t, archive.Close())
+			require.NoError(t, writer.Close())
+
+			response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+			testhelper.AssertResponseCode(t, response, tc.code)
+		})
+	}
+}
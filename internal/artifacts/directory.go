@@ -0,0 +1,134 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+type directory struct{ senddata.Prefix }
+type directoryParams struct {
+	// Archive is the path of the zip archive on disk or its object
+	// storage URL
+	Archive string
+	// Directory is the base64 encoded path of the directory in the
+	// archive, like the Entry of SendEntry
+	Directory string
+}
+
+var SendDirectory = &directory{"artifacts-directory:"}
+
+// Inject streams a zip archive of the entries of a directory of an
+// artifacts archive. The compressed data of the entries is copied as it is.
+// The entries are named relative to the parent of the directory, so that
+// the archive extracts to a single directory.
+func (d *directory) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params directoryParams
+	if err := d.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDirectory: unpack sendData: %v", err))
+		return
+	}
+
+	log.WithFields(r.Context(), log.Fields{
+		"directory": params.Directory,
+		"archive":   helper.ScrubURLParams(params.Archive),
+		"path":      r.URL.Path,
+	}).Print("SendDirectory: sending")
+
+	if params.Archive == "" || params.Directory == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendDirectory: Archive or Directory is empty"))
+		return
+	}
+
+	dirName, err := zipartifacts.DecodeFileEntry(params.Directory)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDirectory: decode directory: %v", err))
+		return
+	}
+	dirName = strings.Trim(dirName, "/")
+	if dirName == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendDirectory: Directory is the archive root"))
+		return
+	}
+
+	archive, archiveData, err := zipartifacts.OpenArchiveReaderAt(r.Context(), params.Archive)
+	if err == zipartifacts.ErrArchiveNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDirectory: open archive: %v", err))
+		return
+	}
+
+	files := directoryFiles(archive, dirName)
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+escapeQuotes(path.Base(dirName))+".zip\"")
+
+	// The entries keep the name of the directory
+	parent := path.Dir(dirName) + "/"
+	if parent == "./" {
+		parent = ""
+	}
+
+	if err := writeDirectoryArchive(w, archiveData, files, parent); err != nil {
+		// The response has started, the client gets a truncated archive
+		helper.LogError(r, fmt.Errorf("SendDirectory: %v", err))
+	}
+}
+
+// directoryFiles returns the entries of archive in dirName. Entries with
+// names that could be extracted outside of the directory are skipped.
+func directoryFiles(archive *zip.Reader, dirName string) []*zip.File {
+	var files []*zip.File
+	for _, file := range archive.File {
+		if !strings.HasPrefix(file.Name, dirName+"/") {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name, "/")
+		if path.Clean(name) != name {
+			continue
+		}
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// writeDirectoryArchive writes a zip archive of files to w, without the
+// parent prefix in their names. The compressed data of files is read from
+// archive.
+func writeDirectoryArchive(w io.Writer, archive io.ReaderAt, files []*zip.File, parent string) error {
+	zw := zipartifacts.NewRawWriter(w)
+
+	for _, file := range files {
+		header := file.FileHeader
+		header.Name = strings.TrimPrefix(file.Name, parent)
+
+		offset, err := file.DataOffset()
+		if err != nil {
+			return fmt.Errorf("open %q: %v", file.Name, err)
+		}
+
+		data := io.NewSectionReader(archive, offset, int64(file.CompressedSize64))
+		if err := zw.CopyEntry(&header, data); err != nil {
+			return fmt.Errorf("copy %q: %v", file.Name, err)
+		}
+	}
+
+	return zw.Close()
+}
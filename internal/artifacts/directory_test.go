@@ -0,0 +1,127 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func createTestDirectoryArchive(t *testing.T, dir string) string {
+	files := map[string]string{"build/": ""}
+	for _, name := range []string{"build/stored.txt", "build/report/deflated.txt", "build/../escape.txt", "buildlog.txt", "other/file.txt"} {
+		files[name] = strings.Repeat("contents of "+name+" ", 100)
+	}
+
+	return testhelper.CreateZipArchive(t, filepath.Join(dir, "archive.zip"), files, "build/", "build/stored.txt", "build/../escape.txt")
+}
+
+func testDirectoryServer(t *testing.T, archive string, directory string) *httptest.ResponseRecorder {
+	params := &directoryParams{
+		Archive:   archive,
+		Directory: base64.StdEncoding.EncodeToString([]byte(directory)),
+	}
+	return testInjecterServer(t, SendDirectory, params, "/url/path", nil)
+}
+
+func TestDownloadingDirectoryFromArchive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := createTestDirectoryArchive(t, tempDir)
+	source, err := zip.OpenReader(archivePath)
+	require.NoError(t, err)
+	defer source.Close()
+
+	sourceFiles := make(map[string]*zip.File)
+	for _, file := range source.File {
+		sourceFiles[file.Name] = file
+	}
+
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	for _, archive := range []string{archivePath, fileServer.URL + "/archive.zip"} {
+		response := testDirectoryServer(t, archive, "build/")
+
+		testhelper.AssertResponseCode(t, response, 200)
+		testhelper.AssertResponseWriterHeader(t, response, "Content-Type", "application/zip")
+		testhelper.AssertResponseWriterHeader(t, response, "Content-Disposition", "attachment; filename=\"build.zip\"")
+
+		body := response.Body.Bytes()
+		result, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		require.NoError(t, err)
+
+		var names []string
+		for _, file := range result.File {
+			names = append(names, file.Name)
+
+			original := sourceFiles[file.Name]
+			require.NotNil(t, original)
+			require.Equal(t, original.Method, file.Method, "the data is copied without recompression")
+			require.Equal(t, original.CompressedSize64, file.CompressedSize64)
+
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := file.Open()
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(rc)
+			require.NoError(t, err)
+			rc.Close()
+			require.Equal(t, strings.Repeat("contents of "+file.Name+" ", 100), string(data))
+		}
+
+		sort.Strings(names)
+		require.Equal(t, []string{"build/", "build/report/deflated.txt", "build/stored.txt"}, names)
+	}
+}
+
+func TestDownloadingNestedDirectoryFromArchive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	response := testDirectoryServer(t, createTestDirectoryArchive(t, tempDir), "build/report")
+
+	testhelper.AssertResponseCode(t, response, 200)
+	testhelper.AssertResponseWriterHeader(t, response, "Content-Disposition", "attachment; filename=\"report.zip\"")
+
+	body := response.Body.Bytes()
+	result, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	require.Len(t, result.File, 1)
+	require.Equal(t, "report/deflated.txt", result.File[0].Name)
+}
+
+func TestDownloadingMissingDirectory(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := createTestDirectoryArchive(t, tempDir)
+
+	// A file and a name prefix are not directories
+	for _, directory := range []string{"missing", "buildlog.txt", "buil"} {
+		response := testDirectoryServer(t, archivePath, directory)
+		testhelper.AssertResponseCode(t, response, 404)
+	}
+
+	response := testDirectoryServer(t, filepath.Join(tempDir, "missing.zip"), "build")
+	testhelper.AssertResponseCode(t, response, 404)
+
+	response = testDirectoryServer(t, archivePath, "/")
+	testhelper.AssertResponseCode(t, response, 500)
+}
@@ -1,17 +1,24 @@
 package artifacts
 
 import (
+	"archive/tar"
 	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"mime"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
@@ -19,11 +26,24 @@ import (
 )
 
 type entry struct{ senddata.Prefix }
-type entryParams struct{ Archive, Entry string }
+type entryParams struct {
+	Archive, Entry string
+	// Format is the format of the archive, zipartifacts.FormatZip if empty
+	Format string
+	// Offset, Method, Zipped, Size, SHA256, CRC32 and Modified of the
+	// entry, as found in version 0.0.3 metadata, let zip entries be read
+	// with a single ranged request
+	Offset   int64
+	Method   string
+	Zipped   int64
+	Size     int64
+	SHA256   string
+	CRC32    *uint32
+	Modified time.Time
+}
 
 var SendEntry = &entry{"artifacts-entry:"}
 
-// Artifacts downloader doesn't support ranges when downloading a single file
 func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 	var params entryParams
 	if err := e.Unpack(&params, sendData); err != nil {
@@ -42,7 +62,20 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
-	err := unpackFileFromZip(params.Archive, params.Entry, w.Header(), w)
+	var err error
+	switch params.Format {
+	case "", zipartifacts.FormatZip:
+		// Range requests need the central directory of the archive
+		if params.Offset > 0 && params.Method != "" && params.CRC32 != nil && r.Header.Get("Range") == "" {
+			err = unpackFileFromRange(w, r, &params)
+		} else {
+			err = serveFileFromZip(w, r, params.Archive, params.Entry)
+		}
+	case zipartifacts.FormatTar:
+		err = unpackFileFromTar(r.Context(), params.Archive, params.Entry, w.Header(), w)
+	default:
+		err = fmt.Errorf("unknown archive format %q", params.Format)
+	}
 
 	if os.IsNotExist(err) {
 		http.NotFound(w, r)
@@ -51,69 +84,171 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 	}
 }
 
-func detectFileContentType(fileName string) string {
-	contentType := mime.TypeByExtension(filepath.Ext(fileName))
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
-	return contentType
+// setContentHeaders sets the Content-Type and Content-Disposition headers of
+// fileName from the first bytes of its contents. Only safe types are
+// displayed inline.
+func setContentHeaders(h http.Header, fileName string, head []byte) {
+	contentDisposition := "inline; filename=\"" + escapeQuotes(filepath.Base(fileName)) + "\""
+	contentType, contentDisposition := headers.SafeContentHeaders(head, contentDisposition)
+	h.Set(headers.ContentTypeHeader, contentType)
+	h.Set(headers.ContentDispositionHeader, contentDisposition)
 }
 
-func unpackFileFromZip(archivePath, encodedFilename string, headers http.Header, output io.Writer) error {
+// peekContentHeaders sets the content headers of fileName from the start of
+// contents, and returns a reader of the whole contents
+func peekContentHeaders(h http.Header, fileName string, contents io.Reader) io.Reader {
+	br := bufio.NewReaderSize(contents, headers.MaxDetectSize)
+	head, _ := br.Peek(headers.MaxDetectSize)
+	setContentHeaders(h, fileName, head)
+	return br
+}
+
+// serveFileFromZip serves an entry of a zip archive with support for range
+// and conditional requests
+func serveFileFromZip(w http.ResponseWriter, r *http.Request, archivePath, encodedFilename string) error {
 	fileName, err := zipartifacts.DecodeFileEntry(encodedFilename)
 	if err != nil {
 		return err
 	}
 
-	catFile := exec.Command("gitlab-zip-cat")
-	catFile.Env = append(os.Environ(),
-		"ARCHIVE_PATH="+archivePath,
-		"ENCODED_FILE_NAME="+encodedFilename,
-	)
-	catFile.Stderr = os.Stderr
-	catFile.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	stdout, err := catFile.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("create gitlab-zip-cat stdout pipe: %v", err)
+	archive, archiveData, err := zipartifacts.OpenArchiveReaderAt(r.Context(), archivePath)
+	if err == zipartifacts.ErrArchiveNotFound {
+		return os.ErrNotExist
+	} else if err != nil {
+		return fmt.Errorf("open archive: %v", err)
 	}
 
-	if err := catFile.Start(); err != nil {
-		return fmt.Errorf("start %v: %v", catFile.Args, err)
+	file := zipartifacts.FindEntry(archive, fileName)
+	if file == nil {
+		return os.ErrNotExist
 	}
-	defer helper.CleanUpProcessGroup(catFile)
 
-	basename := filepath.Base(fileName)
-	reader := bufio.NewReader(stdout)
-	contentLength, err := reader.ReadString('\n')
+	contents, err := zipartifacts.OpenEntry(archiveData, file)
 	if err != nil {
-		if catFileErr := waitCatFile(catFile); catFileErr != nil {
-			return catFileErr
-		}
-		return fmt.Errorf("read content-length: %v", err)
+		return fmt.Errorf("open %q in archive: %v", fileName, err)
 	}
-	contentLength = strings.TrimSuffix(contentLength, "\n")
+	defer contents.Close()
 
-	// Write http headers about the file
-	headers.Set("Content-Length", contentLength)
-	headers.Set("Content-Type", detectFileContentType(fileName))
-	headers.Set("Content-Disposition", "attachment; filename=\""+escapeQuotes(basename)+"\"")
-	// Copy file body to client
-	if _, err := io.Copy(output, reader); err != nil {
-		return fmt.Errorf("copy stdout of %v: %v", catFile.Args, err)
+	head, err := ioutil.ReadAll(io.LimitReader(contents, headers.MaxDetectSize))
+	if err != nil {
+		return fmt.Errorf("read %q from archive: %v", fileName, err)
+	}
+	if _, err := contents.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek %q in archive: %v", fileName, err)
 	}
 
-	return waitCatFile(catFile)
+	setContentHeaders(w.Header(), fileName, head)
+	w.Header().Set("ETag", entryETag(file.CRC32))
+
+	http.ServeContent(w, r, "", file.Modified, contents)
+	return nil
+}
+
+// entryETag returns the ETag of an entry with the CRC-32 crc
+func entryETag(crc uint32) string {
+	return fmt.Sprintf("\"%08x\"", crc)
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of
+// r like http.ServeContent does
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ifModifiedSince)
 }
 
-func waitCatFile(cmd *exec.Cmd) error {
-	err := cmd.Wait()
-	if err == nil {
+// unpackFileFromRange serves an entry of a zip archive from its compressed
+// data only, with the same ETag as serveFileFromZip
+func unpackFileFromRange(w http.ResponseWriter, r *http.Request, params *entryParams) error {
+	fileName, err := zipartifacts.DecodeFileEntry(params.Entry)
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+	etag := entryETag(*params.CRC32)
+	h.Set("ETag", etag)
+	h.Set("Accept-Ranges", "bytes")
+	if !params.Modified.IsZero() {
+		h.Set("Last-Modified", params.Modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, params.Modified) {
+		w.WriteHeader(http.StatusNotModified)
 		return nil
 	}
 
-	if st, ok := helper.ExitStatus(err); ok && st == zipartifacts.StatusEntryNotFound {
+	data, err := zipartifacts.OpenRange(r.Context(), params.Archive, params.Offset, params.Zipped)
+	if err == zipartifacts.ErrArchiveNotFound {
+		return os.ErrNotExist
+	} else if err != nil {
+		return fmt.Errorf("open entry data: %v", err)
+	}
+	defer data.Close()
+
+	var contents io.Reader
+	switch params.Method {
+	case zipartifacts.MethodStore:
+		contents = data
+	case zipartifacts.MethodDeflate:
+		inflater := flate.NewReader(data)
+		defer inflater.Close()
+		contents = inflater
+	default:
+		return fmt.Errorf("unknown compression method %q", params.Method)
+	}
+
+	contents = peekContentHeaders(h, fileName, contents)
+	h.Set("Content-Length", strconv.FormatInt(params.Size, 10))
+	if digest, err := hex.DecodeString(params.SHA256); err == nil && len(digest) == sha256.Size {
+		h.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest))
+	}
+
+	if _, err := io.Copy(w, contents); err != nil {
+		return fmt.Errorf("copy %q from archive: %v", fileName, err)
+	}
+	return nil
+}
+
+func unpackFileFromTar(ctx context.Context, archivePath, encodedFilename string, h http.Header, output io.Writer) error {
+	fileName, err := zipartifacts.DecodeFileEntry(encodedFilename)
+	if err != nil {
+		return err
+	}
+
+	archive, err := zipartifacts.OpenReader(ctx, archivePath)
+	if err == zipartifacts.ErrArchiveNotFound {
 		return os.ErrNotExist
+	} else if err != nil {
+		return fmt.Errorf("open archive: %v", err)
 	}
-	return fmt.Errorf("wait for %v to finish: %v", cmd.Args, err)
+	defer archive.Close()
+
+	return zipartifacts.FindTarEntry(archive, fileName, func(hdr *tar.Header, contents io.Reader) error {
+		contents = peekContentHeaders(h, fileName, contents)
+		// The size of a file in a gzip file is unknown
+		if hdr.Size >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(hdr.Size, 10))
+		}
 
+		if _, err := io.Copy(output, contents); err != nil {
+			return fmt.Errorf("copy %q from archive: %v", fileName, err)
+		}
+		return nil
+	})
 }
@@ -1,37 +1,61 @@
 package artifacts
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
 )
 
 func testEntryServer(t *testing.T, archive string, entry string) *httptest.ResponseRecorder {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/url/path", func(w http.ResponseWriter, r *http.Request) {
-		require.Equal(t, "GET", r.Method)
+	return testEntryServerWithFormat(t, archive, entry, "")
+}
 
-		encodedEntry := base64.StdEncoding.EncodeToString([]byte(entry))
-		jsonParams := fmt.Sprintf(`{"Archive":"%s","Entry":"%s"}`, archive, encodedEntry)
-		data := base64.URLEncoding.EncodeToString([]byte(jsonParams))
+func testEntryServerWithFormat(t *testing.T, archive string, entry string, format string) *httptest.ResponseRecorder {
+	encodedEntry := base64.StdEncoding.EncodeToString([]byte(entry))
+	return testEntryServerWithParams(t, &entryParams{Archive: archive, Entry: encodedEntry, Format: format})
+}
 
-		SendEntry.Inject(w, r, data)
-	})
+func testEntryServerWithParams(t *testing.T, params *entryParams) *httptest.ResponseRecorder {
+	return testEntryServerWithHeader(t, params, nil)
+}
+
+func testEntryServerWithHeader(t *testing.T, params *entryParams, header http.Header) *httptest.ResponseRecorder {
+	return testInjecterServer(t, SendEntry, params, "/url/path", header)
+}
 
-	httpRequest, err := http.NewRequest("GET", "/url/path", nil)
+// testInjecterServer injects params into a GET request for path with header,
+// like the senddata middleware does for the response of the API
+func testInjecterServer(t *testing.T, injecter senddata.Injecter, params interface{}, path string, header http.Header) *httptest.ResponseRecorder {
+	jsonParams, err := json.Marshal(params)
 	require.NoError(t, err)
+	data := base64.URLEncoding.EncodeToString(jsonParams)
+
+	httpRequest, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		httpRequest.Header[name] = values
+	}
 	response := httptest.NewRecorder()
-	mux.ServeHTTP(response, httpRequest)
+	injecter.Inject(response, httpRequest, data)
 	return response
 }
 
@@ -57,7 +81,7 @@ func TestDownloadingFromValidArchive(t *testing.T) {
 		"text/plain; charset=utf-8")
 	testhelper.AssertResponseWriterHeader(t, response,
 		"Content-Disposition",
-		"attachment; filename=\"test.txt\"")
+		"inline; filename=\"test.txt\"")
 
 	testhelper.AssertResponseBody(t, response, "testtest")
 }
@@ -91,7 +115,7 @@ func TestDownloadingFromValidHTTPArchive(t *testing.T) {
 		"text/plain; charset=utf-8")
 	testhelper.AssertResponseWriterHeader(t, response,
 		"Content-Disposition",
-		"attachment; filename=\"test.txt\"")
+		"inline; filename=\"test.txt\"")
 
 	testhelper.AssertResponseBody(t, response, "testtest")
 }
@@ -132,3 +156,212 @@ func TestDownloadingFromNonExistingHTTPArchive(t *testing.T) {
 
 	testhelper.AssertResponseCode(t, response, 404)
 }
+
+func TestDownloadingFromTarArchive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	f, err := os.Create(filepath.Join(tempDir, "archive.tar.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	require.NoError(t, archive.WriteHeader(&tar.Header{Name: "dir/test.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 8}))
+	fmt.Fprint(archive, "testtest")
+	require.NoError(t, archive.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	for _, archivePath := range []string{f.Name(), fileServer.URL + "/archive.tar.gz"} {
+		response := testEntryServerWithFormat(t, archivePath, "dir/test.txt", "tar")
+
+		testhelper.AssertResponseCode(t, response, 200)
+		testhelper.AssertResponseWriterHeader(t, response, "Content-Type", "text/plain; charset=utf-8")
+		testhelper.AssertResponseWriterHeader(t, response, "Content-Disposition", "inline; filename=\"test.txt\"")
+		testhelper.AssertResponseWriterHeader(t, response, "Content-Length", "8")
+		testhelper.AssertResponseBody(t, response, "testtest")
+
+		response = testEntryServerWithFormat(t, archivePath, "dir/missing.txt", "tar")
+		testhelper.AssertResponseCode(t, response, 404)
+	}
+
+	response := testEntryServerWithFormat(t, filepath.Join(tempDir, "missing.tar.gz"), "dir/test.txt", "tar")
+	testhelper.AssertResponseCode(t, response, 404)
+}
+
+func TestDownloadingEntryRange(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	f, err := os.Create(filepath.Join(tempDir, "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		fileInArchive, err := archive.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("dir/test%d.txt", method), Method: method})
+		require.NoError(t, err)
+		fmt.Fprint(fileInArchive, "testtest")
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, f.Close())
+
+	reader, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer reader.Close()
+
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	sum := sha256.Sum256([]byte("testtest"))
+	modified := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	methods := map[uint16]string{zip.Store: zipartifacts.MethodStore, zip.Deflate: zipartifacts.MethodDeflate}
+
+	for _, archivePath := range []string{f.Name(), fileServer.URL + "/archive.zip"} {
+		for _, file := range reader.File {
+			offset, err := file.DataOffset()
+			require.NoError(t, err)
+
+			crc := file.CRC32
+			params := &entryParams{
+				Archive:  archivePath,
+				Entry:    base64.StdEncoding.EncodeToString([]byte(file.Name)),
+				Offset:   offset,
+				Method:   methods[file.Method],
+				Zipped:   int64(file.CompressedSize64),
+				Size:     int64(file.UncompressedSize64),
+				SHA256:   hex.EncodeToString(sum[:]),
+				CRC32:    &crc,
+				Modified: modified,
+			}
+			response := testEntryServerWithParams(t, params)
+
+			testhelper.AssertResponseCode(t, response, 200)
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Type", "text/plain; charset=utf-8")
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Disposition", "inline; filename=\""+filepath.Base(file.Name)+"\"")
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Length", "8")
+			testhelper.AssertResponseWriterHeader(t, response, "Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+			testhelper.AssertResponseWriterHeader(t, response, "Accept-Ranges", "bytes")
+			testhelper.AssertResponseWriterHeader(t, response, "Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			testhelper.AssertResponseBody(t, response, "testtest")
+
+			// The same ETag as when the entry is found in the central directory
+			etag := response.Header().Get("ETag")
+			require.Equal(t, fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE([]byte("testtest"))), etag)
+
+			for _, header := range []http.Header{
+				{"If-None-Match": {etag}},
+				{"If-None-Match": {"\"00000000\", W/" + etag}},
+				{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			} {
+				response = testEntryServerWithHeader(t, params, header)
+				testhelper.AssertResponseCode(t, response, 304)
+				testhelper.AssertResponseBody(t, response, "")
+			}
+
+			response = testEntryServerWithHeader(t, params, http.Header{"If-None-Match": {"\"00000000\""}})
+			testhelper.AssertResponseCode(t, response, 200)
+			testhelper.AssertResponseBody(t, response, "testtest")
+		}
+	}
+
+	response := testEntryServerWithParams(t, &entryParams{
+		Archive: fileServer.URL + "/missing.zip",
+		Entry:   base64.StdEncoding.EncodeToString([]byte("dir/test0.txt")),
+		Offset:  100,
+		Method:  zipartifacts.MethodStore,
+		Zipped:  8,
+		Size:    8,
+	})
+	testhelper.AssertResponseCode(t, response, 404)
+}
+
+func TestDownloadingEntryWithRangeRequests(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	f, err := os.Create(filepath.Join(tempDir, "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		fileInArchive, err := archive.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("test%d.txt", method), Method: method})
+		require.NoError(t, err)
+		fmt.Fprint(fileInArchive, "0123456789")
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, f.Close())
+
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	for _, archivePath := range []string{f.Name(), fileServer.URL + "/archive.zip"} {
+		for _, method := range []uint16{zip.Store, zip.Deflate} {
+			params := &entryParams{
+				Archive: archivePath,
+				Entry:   base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("test%d.txt", method))),
+			}
+
+			response := testEntryServerWithHeader(t, params, http.Header{"Range": {"bytes=4-7"}})
+			testhelper.AssertResponseCode(t, response, 206)
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Range", "bytes 4-7/10")
+			testhelper.AssertResponseBody(t, response, "4567")
+
+			etag := response.Header().Get("ETag")
+			require.Equal(t, fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE([]byte("0123456789"))), etag)
+
+			response = testEntryServerWithHeader(t, params, http.Header{"If-None-Match": {etag}})
+			testhelper.AssertResponseCode(t, response, 304)
+		}
+	}
+}
+
+func TestDownloadingEntryContentHeaders(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "uploads")
+	require.NoError(t, err)
+	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	files := map[string]string{
+		"page.html":  "<html><script>alert(1)</script></html>",
+		"image.svg":  `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		"binary.bin": "\x00\x01\x02",
+	}
+
+	archive := zip.NewWriter(tempFile)
+	for name, contents := range files {
+		fileInArchive, err := archive.Create(name)
+		require.NoError(t, err)
+		fmt.Fprint(fileInArchive, contents)
+	}
+	require.NoError(t, archive.Close())
+
+	testCases := []struct {
+		name               string
+		contentType        string
+		contentDisposition string
+	}{
+		{"page.html", "text/plain; charset=utf-8", "inline; filename=\"page.html\""},
+		{"image.svg", "image/svg+xml", "attachment; filename=\"image.svg\""},
+		{"binary.bin", "application/octet-stream", "attachment; filename=\"binary.bin\""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := testEntryServer(t, tempFile.Name(), tc.name)
+
+			testhelper.AssertResponseCode(t, response, 200)
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Type", tc.contentType)
+			testhelper.AssertResponseWriterHeader(t, response, "Content-Disposition", tc.contentDisposition)
+			testhelper.AssertResponseBody(t, response, files[tc.name])
+		})
+	}
+}
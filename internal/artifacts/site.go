@@ -0,0 +1,138 @@
+package artifacts
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/urlprefix"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+type site struct{ senddata.Prefix }
+type siteParams struct {
+	// Archive is the path of the zip archive on disk or its object
+	// storage URL
+	Archive string
+	// Prefix is the part of the request path before the path of the file
+	// in the archive
+	Prefix string
+}
+
+const (
+	siteIndex = "index.html"
+
+	// The pages run in a sandbox with a unique origin, they can't reach
+	// GitLab with the cookies of the user
+	siteContentSecurityPolicy = "sandbox allow-scripts allow-popups allow-modals; " +
+		"default-src 'self' 'unsafe-inline' 'unsafe-eval' data: blob:; " +
+		"connect-src 'none'; form-action 'none'; base-uri 'none'; frame-ancestors 'self'"
+
+	siteCacheSize = 100
+	// The central directories of the cached archives take up to about
+	// 100 MiB
+	siteCacheEntries = 200000
+	siteCacheTTL     = 5 * time.Minute
+)
+
+var (
+	SendSite = &site{"artifacts-site:"}
+
+	// siteArchives keeps the central directory of the archives of which
+	// files were served recently, a page usually loads several of them
+	siteArchives = zipartifacts.NewArchiveCache(siteCacheSize, siteCacheEntries, siteCacheTTL)
+)
+
+// Inject serves the file of a website in an artifacts archive at the
+// request path below the prefix. The index.html file of directories is
+// served.
+func (s *site) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params siteParams
+	if err := s.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: unpack sendData: %v", err))
+		return
+	}
+
+	if params.Archive == "" || params.Prefix == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: Archive or Prefix is empty"))
+		return
+	}
+
+	if r.URL.Path+"/" == params.Prefix {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+		return
+	}
+
+	name := strings.TrimPrefix(urlprefix.Prefix(params.Prefix).Strip(r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += siteIndex
+	}
+
+	log.WithFields(r.Context(), log.Fields{
+		"file":    name,
+		"archive": helper.ScrubURLParams(params.Archive),
+		"path":    r.URL.Path,
+	}).Print("SendSite: sending")
+
+	archive, err := siteArchives.Open(r.Context(), params.Archive)
+	if err == zipartifacts.ErrArchiveNotFound || err == zipartifacts.ErrNotAZip {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: open archive: %v", err))
+		return
+	}
+
+	file := archive.File(name)
+	if file == nil || file.FileInfo().IsDir() {
+		if archive.IsDirectory(name + "/") {
+			// Relative links of the index page need the trailing slash
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	setSiteHeaders(w.Header(), name)
+	etag := fmt.Sprintf("\"%08x\"", file.CRC32)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	contents, err := archive.OpenFile(r.Context(), file)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: open %q: %v", name, err))
+		return
+	}
+	defer contents.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatUint(file.UncompressedSize64, 10))
+	if _, err := io.Copy(w, contents); err != nil {
+		helper.LogError(r, fmt.Errorf("SendSite: copy %q: %v", name, err))
+	}
+}
+
+func setSiteHeaders(h http.Header, name string) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h.Set(headers.ContentTypeHeader, contentType)
+	h.Set("Content-Security-Policy", siteContentSecurityPolicy)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Cache-Control", "private, no-cache")
+}
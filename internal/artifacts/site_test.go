@@ -0,0 +1,106 @@
+package artifacts
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const testSitePrefix = "/group/project/-/jobs/1/artifacts/site/"
+
+var testSiteFiles = map[string]string{
+	"public/index.html":        "<html>index</html>",
+	"public/css/style.css":     "body { color: red; }",
+	"public/docs/index.html":   "<html>docs</html>",
+	"public/assets/":           "",
+	"public/assets/script.js":  "alert(1)",
+	"public/data.unknownextxx": "data",
+}
+
+func testSiteServer(t *testing.T, archive string, path string, header http.Header) *httptest.ResponseRecorder {
+	return testInjecterServer(t, SendSite, &siteParams{Archive: archive, Prefix: testSitePrefix}, testSitePrefix+path, header)
+}
+
+func TestServingSiteFromArchive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "site")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := testhelper.CreateZipArchive(t, filepath.Join(tempDir, "site.zip"), testSiteFiles)
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	testCases := []struct {
+		desc        string
+		path        string
+		contents    string
+		contentType string
+	}{
+		{"index of the site", "public/", testSiteFiles["public/index.html"], "text/html; charset=utf-8"},
+		{"index of a directory", "public/docs/", testSiteFiles["public/docs/index.html"], "text/html; charset=utf-8"},
+		{"file", "public/css/style.css", testSiteFiles["public/css/style.css"], "text/css; charset=utf-8"},
+		{"cleaned path", "public/docs/../assets/script.js", testSiteFiles["public/assets/script.js"], "text/javascript; charset=utf-8"},
+		{"unknown extension", "public/data.unknownextxx", "data", "application/octet-stream"},
+	}
+
+	for _, archive := range []string{archivePath, fileServer.URL + "/site.zip"} {
+		for _, tc := range testCases {
+			t.Run(tc.desc, func(t *testing.T) {
+				response := testSiteServer(t, archive, tc.path, nil)
+
+				testhelper.AssertResponseCode(t, response, 200)
+				testhelper.AssertResponseBody(t, response, tc.contents)
+				testhelper.AssertResponseWriterHeader(t, response, "Content-Type", tc.contentType)
+				testhelper.AssertResponseWriterHeader(t, response, "Content-Length", fmt.Sprint(len(tc.contents)))
+				testhelper.AssertResponseWriterHeader(t, response, "Content-Security-Policy", siteContentSecurityPolicy)
+				testhelper.AssertResponseWriterHeader(t, response, "X-Content-Type-Options", "nosniff")
+
+				etag := fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE([]byte(tc.contents)))
+				testhelper.AssertResponseWriterHeader(t, response, "ETag", etag)
+
+				response = testSiteServer(t, archive, tc.path, http.Header{"If-None-Match": {etag}})
+				testhelper.AssertResponseCode(t, response, 304)
+			})
+		}
+	}
+}
+
+func TestServingSiteRedirectsDirectories(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "site")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := testhelper.CreateZipArchive(t, filepath.Join(tempDir, "site.zip"), testSiteFiles)
+
+	for _, path := range []string{"public", "public/docs", "public/assets"} {
+		response := testSiteServer(t, archivePath, path, nil)
+		testhelper.AssertResponseCode(t, response, 302)
+		testhelper.AssertResponseWriterHeader(t, response, "Location", testSitePrefix+path+"/")
+	}
+}
+
+func TestServingSiteNotFound(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "site")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := testhelper.CreateZipArchive(t, filepath.Join(tempDir, "site.zip"), testSiteFiles)
+
+	// The directory has no index
+	for _, path := range []string{"public/missing.html", "public/assets/", "public/../secret"} {
+		response := testSiteServer(t, archivePath, path, nil)
+		testhelper.AssertResponseCode(t, response, 404)
+	}
+
+	response := testSiteServer(t, filepath.Join(tempDir, "missing.zip"), "public/", nil)
+	testhelper.AssertResponseCode(t, response, 404)
+}
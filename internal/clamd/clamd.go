@@ -0,0 +1,350 @@
+/*
+Package clamd scans uploads for viruses by streaming them to a clamd daemon
+with the INSTREAM command.
+*/
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultTimeout = time.Minute
+
+	// defaultMaxScanSize is the default StreamMaxLength of clamd
+	defaultMaxScanSize = 25 * 1024 * 1024
+
+	// clamd rejects chunks larger than its StreamMaxLength
+	maxChunkSize = 1024 * 1024
+
+	// VerdictClean is sent to Rails for uploads that were scanned
+	VerdictClean = "clean"
+	// VerdictUnscanned is sent to Rails for uploads larger than the
+	// maximum scan size of Workhorse or clamd
+	VerdictUnscanned = "unscanned"
+)
+
+var (
+	settings = struct {
+		sync.RWMutex
+		network     string
+		address     string
+		timeout     time.Duration
+		maxScanSize int64
+	}{}
+
+	// ErrStreamTooLong means that clamd refused a stream longer than its
+	// StreamMaxLength
+	ErrStreamTooLong = errors.New("clamd: INSTREAM size limit exceeded")
+
+	// errScanSizeExceeded stops a BackgroundScan at the maximum scan size
+	errScanSizeExceeded = errors.New("clamd: maximum scan size exceeded")
+
+	scans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_clamd_scans",
+			Help: "How many uploads have been scanned with clamd, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scans)
+}
+
+// VirusFoundError is returned for infected uploads
+type VirusFoundError struct {
+	Signature string
+}
+
+func (e *VirusFoundError) Error() string {
+	return fmt.Sprintf("virus found: %s", e.Signature)
+}
+
+// IsInfected reports whether err is a VirusFoundError
+func IsInfected(err error) bool {
+	_, ok := err.(*VirusFoundError)
+	return ok
+}
+
+// Configure enables virus scanning. A nil cfg disables it.
+func Configure(cfg *config.ClamdConfig) error {
+	settings.Lock()
+	defer settings.Unlock()
+
+	settings.network, settings.address = "", ""
+	if cfg == nil {
+		return nil
+	}
+
+	switch cfg.URL.Scheme {
+	case "unix":
+		settings.network, settings.address = "unix", cfg.URL.Path
+	case "tcp":
+		settings.network, settings.address = "tcp", cfg.URL.Host
+	default:
+		return fmt.Errorf("clamd: unsupported URL %q", cfg.URL.String())
+	}
+
+	settings.timeout = defaultTimeout
+	if cfg.Timeout != nil {
+		settings.timeout = cfg.Timeout.Duration
+	}
+
+	settings.maxScanSize = defaultMaxScanSize
+	if cfg.MaxScanSize > 0 {
+		settings.maxScanSize = cfg.MaxScanSize
+	}
+
+	return nil
+}
+
+// Enabled reports whether uploads must be scanned
+func Enabled() bool {
+	settings.RLock()
+	defer settings.RUnlock()
+
+	return settings.address != ""
+}
+
+// Scanner is an io.WriteCloser that streams everything written to it to
+// clamd. Call Verdict once all data has been written.
+type Scanner struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// NewScanner connects to clamd and starts an INSTREAM scan
+func NewScanner(ctx context.Context) (*Scanner, error) {
+	settings.RLock()
+	network, address, timeout := settings.network, settings.address, settings.timeout
+	settings.RUnlock()
+
+	if address == "" {
+		return nil, errors.New("clamd: not configured")
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		scans.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("clamd: %v", err)
+	}
+
+	s := &Scanner{conn: conn, timeout: timeout}
+	if err := s.write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		scans.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Scanner) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(data); err != nil {
+		// clamd may have explained why it hung up, e.g. when the stream
+		// exceeds its StreamMaxLength
+		if reply, replyErr := s.readReply(); replyErr == nil {
+			return replyError(reply)
+		}
+		return fmt.Errorf("clamd: %v", err)
+	}
+
+	return nil
+}
+
+// Write sends p to clamd in chunks
+func (s *Scanner) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(chunk)))
+		if err := s.write(append(header, chunk...)); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Verdict ends the stream and waits for the result of the scan. It returns
+// a *VirusFoundError for infected data.
+func (s *Scanner) Verdict() error {
+	err := s.verdict()
+	switch {
+	case err == nil:
+		scans.WithLabelValues(VerdictClean).Inc()
+	case IsInfected(err):
+		scans.WithLabelValues("infected").Inc()
+	case err == ErrStreamTooLong:
+		scans.WithLabelValues(VerdictUnscanned).Inc()
+	default:
+		scans.WithLabelValues("error").Inc()
+	}
+
+	return err
+}
+
+func (s *Scanner) verdict() error {
+	if err := s.write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	reply, err := s.readReply()
+	if err != nil {
+		return fmt.Errorf("clamd: read reply: %v", err)
+	}
+
+	switch {
+	case reply == "stream: OK":
+		return nil
+	case strings.HasPrefix(reply, "stream: ") && strings.HasSuffix(reply, " FOUND"):
+		return &VirusFoundError{Signature: strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")}
+	default:
+		return replyError(reply)
+	}
+}
+
+// replyError returns the error for a reply of clamd that isn't a verdict
+func replyError(reply string) error {
+	if strings.HasPrefix(reply, "INSTREAM size limit exceeded") {
+		return ErrStreamTooLong
+	}
+
+	return fmt.Errorf("clamd: %s", reply)
+}
+
+func (s *Scanner) readReply() (string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	reply, err := bufio.NewReader(s.conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(bytes.TrimSuffix(reply, []byte{0}))), nil
+}
+
+// Close closes the connection to clamd
+func (s *Scanner) Close() error {
+	return s.conn.Close()
+}
+
+// BackgroundScan is an io.WriteCloser that streams what is written to it
+// to clamd from a goroutine through a pipe. Files larger than the maximum
+// scan size are not scanned, their verdict is VerdictUnscanned.
+type BackgroundScan struct {
+	scanner     *Scanner
+	writer      *io.PipeWriter
+	written     int64
+	maxScanSize int64
+	done        chan struct{}
+	verdict     string
+	err         error
+}
+
+// StartBackgroundScan connects to clamd and starts scanning in the
+// background. Call Verdict once all data has been written, or Close to
+// give up.
+func StartBackgroundScan(ctx context.Context) (*BackgroundScan, error) {
+	scanner, err := NewScanner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.RLock()
+	maxScanSize := settings.maxScanSize
+	settings.RUnlock()
+
+	reader, writer := io.Pipe()
+	b := &BackgroundScan{scanner: scanner, writer: writer, maxScanSize: maxScanSize, done: make(chan struct{})}
+	go b.scan(reader)
+
+	return b, nil
+}
+
+func (b *BackgroundScan) scan(reader *io.PipeReader) {
+	defer close(b.done)
+	defer b.scanner.Close()
+
+	_, err := io.Copy(b.scanner, reader)
+	if err == nil {
+		// Verdict counts the result itself
+		err = b.scanner.Verdict()
+	} else if err == ErrStreamTooLong || err == errScanSizeExceeded {
+		scans.WithLabelValues(VerdictUnscanned).Inc()
+	} else {
+		scans.WithLabelValues("error").Inc()
+	}
+
+	switch err {
+	case nil:
+		b.verdict = VerdictClean
+	case ErrStreamTooLong, errScanSizeExceeded:
+		b.verdict = VerdictUnscanned
+		// The upload goes on without waiting for clamd
+		io.Copy(ioutil.Discard, reader)
+	default:
+		b.err = err
+		reader.CloseWithError(err)
+	}
+}
+
+// Write passes p on to the scan, it only fails if clamd does
+func (b *BackgroundScan) Write(p []byte) (int, error) {
+	if b.written > b.maxScanSize {
+		return len(p), nil
+	}
+
+	b.written += int64(len(p))
+	if b.written > b.maxScanSize {
+		b.writer.CloseWithError(errScanSizeExceeded)
+		return len(p), nil
+	}
+
+	return b.writer.Write(p)
+}
+
+// Verdict waits for the end of the scan. It returns VerdictClean or
+// VerdictUnscanned, a *VirusFoundError for infected data or the error of
+// clamd.
+func (b *BackgroundScan) Verdict() (string, error) {
+	b.writer.Close()
+	<-b.done
+
+	return b.verdict, b.err
+}
+
+// Close stops the scan without waiting for clamd
+func (b *BackgroundScan) Close() error {
+	b.writer.CloseWithError(errors.New("clamd: scan canceled"))
+	b.scanner.Close()
+	<-b.done
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package clamd
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func scan(t *testing.T, data string) error {
+	s, err := NewScanner(context.Background())
+	require.NoError(t, err)
+	defer s.Close()
+
+	if _, err := s.Write([]byte(data)); err != nil {
+		return err
+	}
+
+	return s.Verdict()
+}
+
+func TestScan(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	defer server.Close()
+
+	require.NoError(t, Configure(server.Config()))
+	defer Configure(nil)
+	require.True(t, Enabled())
+
+	require.NoError(t, scan(t, "a harmless file"))
+
+	err := scan(t, "infected "+testhelper.ClamdTestVirus+" file")
+	require.True(t, IsInfected(err), "error: %v", err)
+	require.Equal(t, testhelper.ClamdTestSignature, err.(*VirusFoundError).Signature)
+
+	require.Equal(t, 2, server.Scans())
+}
+
+func TestScanLargeStream(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	defer server.Close()
+
+	require.NoError(t, Configure(server.Config()))
+	defer Configure(nil)
+
+	// The virus crosses a chunk boundary
+	padding := strings.Repeat("x", maxChunkSize-10)
+	err := scan(t, padding+testhelper.ClamdTestVirus)
+	require.True(t, IsInfected(err), "error: %v", err)
+}
+
+func TestScanStreamTooLong(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	server.StreamMaxLength = 10
+	defer server.Close()
+
+	require.NoError(t, Configure(server.Config()))
+	defer Configure(nil)
+
+	err := scan(t, "more than ten bytes")
+	require.Error(t, err)
+	require.False(t, IsInfected(err))
+	require.Contains(t, err.Error(), "size limit exceeded")
+}
+
+func backgroundScan(t *testing.T, data string) (string, error) {
+	b, err := StartBackgroundScan(context.Background())
+	require.NoError(t, err)
+	defer b.Close()
+
+	n, err := b.Write([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	return b.Verdict()
+}
+
+func TestBackgroundScan(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	defer server.Close()
+
+	cfg := server.Config()
+	cfg.MaxScanSize = 100
+	require.NoError(t, Configure(cfg))
+	defer Configure(nil)
+
+	verdict, err := backgroundScan(t, "a harmless file")
+	require.NoError(t, err)
+	require.Equal(t, VerdictClean, verdict)
+
+	_, err = backgroundScan(t, testhelper.ClamdTestVirus)
+	require.True(t, IsInfected(err), "error: %v", err)
+
+	verdict, err = backgroundScan(t, testhelper.ClamdTestVirus+strings.Repeat("x", 100))
+	require.NoError(t, err)
+	require.Equal(t, VerdictUnscanned, verdict, "files above the maximum scan size are not scanned")
+
+	require.Equal(t, 2, server.Scans())
+}
+
+func TestBackgroundScanStreamTooLong(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	server.StreamMaxLength = 10
+	defer server.Close()
+
+	require.NoError(t, Configure(server.Config()))
+	defer Configure(nil)
+
+	verdict, err := backgroundScan(t, "more than ten bytes")
+	require.NoError(t, err)
+	require.Equal(t, VerdictUnscanned, verdict)
+}
+
+func TestBackgroundScanClose(t *testing.T) {
+	server := testhelper.StartClamdServer(t)
+	defer server.Close()
+
+	require.NoError(t, Configure(server.Config()))
+	defer Configure(nil)
+
+	b, err := StartBackgroundScan(context.Background())
+	require.NoError(t, err)
+	_, err = b.Write([]byte("a harmless file"))
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	_, err = b.Write([]byte("more"))
+	require.Error(t, err, "writing after Close")
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure(nil)
+
+	unix := &config.ClamdConfig{URL: config.TomlURL{URL: url.URL{Scheme: "unix", Path: "/var/run/clamav/clamd.ctl"}}}
+	require.NoError(t, Configure(unix))
+	require.True(t, Enabled())
+	require.Equal(t, "/var/run/clamav/clamd.ctl", settings.address)
+	require.Equal(t, defaultTimeout, settings.timeout)
+	require.Equal(t, int64(defaultMaxScanSize), settings.maxScanSize)
+
+	http := &config.ClamdConfig{URL: config.TomlURL{URL: url.URL{Scheme: "http", Host: "localhost:3310"}}}
+	require.Error(t, Configure(http))
+	require.False(t, Enabled())
+
+	require.NoError(t, Configure(nil))
+	require.False(t, Enabled())
+
+	_, err := NewScanner(context.Background())
+	require.Error(t, err)
+}
@@ -21,7 +21,7 @@ type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
 	d.Duration = temp
 	return err
@@ -40,18 +40,62 @@ type RedisConfig struct {
 	MaxActive       *int
 }
 
+type GitalyTLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+type GitalyConfig struct {
+	TLS                     *GitalyTLSConfig `toml:"tls"`
+	HealthCheckInterval     *TomlDuration
+	HealthCheckTimeout      *TomlDuration
+	CircuitBreakerThreshold *int
+	CircuitBreakerCooldown  *TomlDuration
+}
+
+type ClamdConfig struct {
+	URL     TomlURL
+	Timeout *TomlDuration
+	// MaxScanSize is the size in bytes above which files are not scanned,
+	// zero means clamd's default StreamMaxLength of 25 MiB
+	MaxScanSize int64
+}
+
+// UploadLimitsConfig guards against decompression and image bombs and
+// multipart uploads with many files, zero values mean no limit
+type UploadLimitsConfig struct {
+	// ArchiveMaxCompressionRatio is the largest compression ratio of the
+	// entries of artifacts archives
+	ArchiveMaxCompressionRatio uint64
+	// ArchiveMaxUncompressedSize is the largest total uncompressed size of
+	// artifacts archives in bytes
+	ArchiveMaxUncompressedSize uint64
+	// ImageMaxWidth and ImageMaxHeight are the largest dimensions in pixels
+	// of images processed by the metadata cleaner
+	ImageMaxWidth  uint32
+	ImageMaxHeight uint32
+	// MultipartMaxFiles is the largest number of files in a multipart
+	// upload, zero means upload.DefaultMaxFileParts
+	MultipartMaxFiles int
+}
+
 type Config struct {
-	Redis                    *RedisConfig  `toml:"redis"`
-	Backend                  *url.URL      `toml:"-"`
-	Version                  string        `toml:"-"`
-	DocumentRoot             string        `toml:"-"`
-	DevelopmentMode          bool          `toml:"-"`
-	Socket                   string        `toml:"-"`
-	ProxyHeadersTimeout      time.Duration `toml:"-"`
-	APILimit                 uint          `toml:"-"`
-	APIQueueLimit            uint          `toml:"-"`
-	APIQueueTimeout          time.Duration `toml:"-"`
-	APICILongPollingDuration time.Duration `toml:"-"`
+	Redis                    *RedisConfig        `toml:"redis"`
+	Gitaly                   *GitalyConfig       `toml:"gitaly"`
+	Clamd                    *ClamdConfig        `toml:"clamd"`
+	UploadLimits             *UploadLimitsConfig `toml:"upload_limits"`
+	Backend                  *url.URL            `toml:"-"`
+	Version                  string              `toml:"-"`
+	DocumentRoot             string              `toml:"-"`
+	DevelopmentMode          bool                `toml:"-"`
+	Socket                   string              `toml:"-"`
+	ProxyHeadersTimeout      time.Duration       `toml:"-"`
+	APILimit                 uint                `toml:"-"`
+	APIQueueLimit            uint                `toml:"-"`
+	APIQueueTimeout          time.Duration       `toml:"-"`
+	APICILongPollingDuration time.Duration       `toml:"-"`
 }
 
 // LoadConfig from a file
@@ -8,7 +8,9 @@ import (
 	"strings"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/progress"
 )
 
 type PreAuthorizer interface {
@@ -49,8 +51,20 @@ func BodyUploader(rails PreAuthorizer, h http.Handler, p UploadPreparer) http.Ha
 			return
 		}
 
-		fh, err := SaveFileFromReader(r.Context(), r.Body, r.ContentLength, opts)
-		if err != nil {
+		fh, err := saveBody(r, opts)
+		if IsChecksumError(err) {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		} else if IsContentTypeError(err) {
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnsupportedMediaType)
+			return
+		} else if clamd.IsInfected(err) {
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		} else if err == ErrEntityTooLarge {
+			helper.RequestEntityTooLarge(w, r, err)
+			return
+		} else if err != nil {
 			helper.Fail500(w, r, fmt.Errorf("BodyUploader: upload failed: %v", err))
 			return
 		}
@@ -62,18 +76,42 @@ func BodyUploader(rails PreAuthorizer, h http.Handler, p UploadPreparer) http.Ha
 			}
 		}
 
-		data := url.Values{}
-		for k, v := range fh.GitLabFinalizeFields("file") {
-			data.Set(k, v)
+		if err := RewriteBody(r, fh); err != nil {
+			helper.Fail500(w, r, fmt.Errorf("BodyUploader: %v", err))
+			return
 		}
 
-		// Hijack body
-		body := data.Encode()
-		r.Body = ioutil.NopCloser(strings.NewReader(body))
-		r.ContentLength = int64(len(body))
-		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
 		// And proxy the request
 		h.ServeHTTP(w, r)
 	}, "/authorize")
 }
+
+func saveBody(r *http.Request, opts *SaveFileOpts) (*FileHandler, error) {
+	if err := opts.ExpectHeaderChecksums(r.Header); err != nil {
+		return nil, err
+	}
+	opts.ProgressID = progress.ID(r)
+
+	return SaveFileFromReader(r.Context(), r.Body, r.ContentLength, opts)
+}
+
+// RewriteBody hijacks the body of r, replacing it with a form containing the
+// fields GitLab Rails needs to finalize the upload of fh.
+func RewriteBody(r *http.Request, fh *FileHandler) error {
+	fields, err := fh.GitLabFinalizeFields("file")
+	if err != nil {
+		return fmt.Errorf("RewriteBody: %v", err)
+	}
+
+	data := url.Values{}
+	for k, v := range fields {
+		data.Set(k, v)
+	}
+
+	body := data.Encode()
+	r.Body = ioutil.NopCloser(strings.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return nil
+}
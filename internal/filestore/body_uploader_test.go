@@ -1,6 +1,8 @@
 package filestore_test
 
 import (
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,10 +13,13 @@ import (
 	"strings"
 	"testing"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 )
 
 const (
@@ -78,6 +83,49 @@ func TestBodyUploaderErrors(t *testing.T) {
 	}
 }
 
+func TestBodyUploaderVirusFound(t *testing.T) {
+	clamdServer := testhelper.StartClamdServer(t)
+	defer clamdServer.Close()
+
+	require.NoError(t, clamd.Configure(clamdServer.Config()))
+	defer clamd.Configure(nil)
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Fail(t, "request proxied upstream")
+	})
+
+	resp := testUpload(&rails{}, nil, proxy, strings.NewReader(testhelper.ClamdTestVirus))
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), testhelper.ClamdTestSignature)
+}
+
+func TestBodyUploaderMaximumSize(t *testing.T) {
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Fail(t, "request proxied upstream")
+	})
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{name: "known length", body: strings.NewReader(fileContent)},
+		{name: "unknown length", body: struct{ io.Reader }{strings.NewReader(fileContent)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := testUpload(&rails{maximumSize: int64(fileLen - 1)}, nil, proxy, test.body)
+			require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		})
+	}
+
+	resp := testUpload(&rails{maximumSize: int64(fileLen)}, nil, echoProxy(t, fileLen), strings.NewReader(fileContent))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
 func testNoProxyInvocation(t *testing.T, expectedStatus int, auth filestore.PreAuthorizer, preparer filestore.UploadPreparer) {
 	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Fail(t, "request proxied upstream")
@@ -88,6 +136,8 @@ func testNoProxyInvocation(t *testing.T, expectedStatus int, auth filestore.PreA
 }
 
 func testUpload(auth filestore.PreAuthorizer, preparer filestore.UploadPreparer, proxy http.Handler, body io.Reader) *http.Response {
+	testhelper.ConfigureSecret()
+
 	req := httptest.NewRequest("POST", "http://example.com/upload", body)
 	w := httptest.NewRecorder()
 
@@ -114,6 +164,11 @@ func echoProxy(t *testing.T, expectedBodyLength int) http.Handler {
 		require.Contains(r.PostForm, "file.size")
 		require.Equal(strconv.Itoa(expectedBodyLength), r.PostFormValue("file.size"))
 
+		token, err := jwt.ParseWithClaims(r.PostFormValue("file.gitlab-workhorse-upload"), &testhelper.UploadClaims{}, testhelper.ParseJWT)
+		require.NoError(err)
+		require.Equal(r.PostFormValue("file.path"), token.Claims.(*testhelper.UploadClaims).Upload["path"])
+		require.Equal(r.PostFormValue("file.size"), token.Claims.(*testhelper.UploadClaims).Upload["size"])
+
 		path := r.PostFormValue("file.path")
 		uploaded, err := os.Open(path)
 		require.NoError(err, "File not uploaded")
@@ -125,6 +180,7 @@ func echoProxy(t *testing.T, expectedBodyLength int) http.Handler {
 
 type rails struct {
 	unauthorized bool
+	maximumSize  int64
 }
 
 func (r *rails) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler {
@@ -134,8 +190,9 @@ func (r *rails) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler
 		})
 	}
 
+	maximumSize := r.maximumSize
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next(w, r, &api.Response{TempPath: os.TempDir()})
+		next(w, r, &api.Response{TempPath: os.TempDir(), MaximumSize: maximumSize})
 	})
 }
 
@@ -163,3 +220,44 @@ func (m *mockVerifier) Verify(handler *filestore.FileHandler) error {
 
 	return nil
 }
+
+func TestBodyUploaderChecksums(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	sum := md5.Sum([]byte(fileContent))
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+	wrongMD5 := base64.StdEncoding.EncodeToString(make([]byte, md5.Size))
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Fail(t, "request proxied upstream")
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{name: "Content-MD5", header: "Content-MD5", value: contentMD5, status: http.StatusOK},
+		{name: "Digest", header: "Digest", value: "MD5=" + contentMD5, status: http.StatusOK},
+		{name: "wrong Content-MD5", header: "Content-MD5", value: wrongMD5, status: http.StatusBadRequest},
+		{name: "wrong Digest", header: "Digest", value: "MD5=" + wrongMD5, status: http.StatusBadRequest},
+		{name: "invalid Digest", header: "Digest", value: "MD5=???", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "http://example.com/upload", strings.NewReader(fileContent))
+			req.Header.Set(test.header, test.value)
+			w := httptest.NewRecorder()
+
+			var h http.Handler = proxy
+			if test.status == http.StatusOK {
+				h = echoProxy(t, fileLen)
+			}
+			filestore.BodyUploader(&rails{}, h, nil).ServeHTTP(w, req)
+
+			require.Equal(t, test.status, w.Code)
+		})
+	}
+}
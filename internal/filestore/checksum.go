@@ -0,0 +1,110 @@
+package filestore
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ChecksumError means that the uploaded content does not have the checksum
+// the client or GitLab Rails expected, or that the expected checksum is
+// invalid
+type ChecksumError struct {
+	Hash     string
+	Expected string
+	// Actual is empty if Expected is not a valid checksum
+	Actual string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("invalid %s checksum %q", e.Hash, e.Expected)
+	}
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.Hash, e.Expected, e.Actual)
+}
+
+// IsChecksumError checks if err is a ChecksumError
+func IsChecksumError(err error) bool {
+	_, ok := err.(*ChecksumError)
+	return ok
+}
+
+// digestAlgorithms maps the RFC 3230 digest algorithms to our hash names
+var digestAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+}
+
+// ExpectChecksum makes the upload fail unless the file has the hex digest
+// for the named hash. Checksums for hashes we don't compute are ignored.
+func (s *SaveFileOpts) ExpectChecksum(name string, digest string) error {
+	if _, ok := hashFactories[name]; !ok {
+		return nil
+	}
+
+	digest = strings.ToLower(digest)
+	if _, err := hex.DecodeString(digest); err != nil || digest == "" {
+		return &ChecksumError{Hash: name, Expected: digest}
+	}
+
+	if expected, ok := s.ExpectedChecksums[name]; ok && expected != digest {
+		return &ChecksumError{Hash: name, Expected: expected, Actual: digest}
+	}
+
+	if s.ExpectedChecksums == nil {
+		s.ExpectedChecksums = make(map[string]string)
+	}
+	s.ExpectedChecksums[name] = digest
+
+	return nil
+}
+
+// ExpectHeaderChecksums adds the checksums in the Content-MD5 (RFC 1864)
+// and Digest (RFC 3230) headers to the expected checksums. Digest
+// algorithms we don't compute are ignored.
+func (s *SaveFileOpts) ExpectHeaderChecksums(h http.Header) error {
+	if contentMD5 := h.Get("Content-MD5"); contentMD5 != "" {
+		if err := s.expectBase64Checksum("md5", contentMD5); err != nil {
+			return err
+		}
+	}
+
+	for _, header := range h["Digest"] {
+		for _, instanceDigest := range strings.Split(header, ",") {
+			parts := strings.SplitN(strings.TrimSpace(instanceDigest), "=", 2)
+			name, ok := digestAlgorithms[strings.ToLower(parts[0])]
+			if !ok || len(parts) != 2 {
+				continue
+			}
+
+			if err := s.expectBase64Checksum(name, parts[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *SaveFileOpts) expectBase64Checksum(name string, digest string) error {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return &ChecksumError{Hash: name, Expected: digest}
+	}
+
+	return s.ExpectChecksum(name, hex.EncodeToString(decoded))
+}
+
+func verifyChecksums(hashes map[string]string, expected map[string]string) error {
+	for name, digest := range expected {
+		if actual := hashes[name]; actual != digest {
+			return &ChecksumError{Hash: name, Expected: digest, Actual: actual}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package filestore
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes DetectContentType considers
+const sniffLen = 512
+
+// ContentTypeError means that the detected content type of the uploaded
+// file is not allowed for this upload
+type ContentTypeError struct {
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("content type %q is not allowed", e.ContentType)
+}
+
+// IsContentTypeError checks if err is a ContentTypeError
+func IsContentTypeError(err error) bool {
+	_, ok := err.(*ContentTypeError)
+	return ok
+}
+
+// signatures are file types net/http does not detect
+var signatures = []struct {
+	magic       []byte
+	contentType string
+}{
+	{[]byte("II*\x00"), "image/tiff"},
+	{[]byte("MM\x00*"), "image/tiff"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+// DetectContentType returns the media type of data, without parameters,
+// based on its first bytes
+func DetectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	for _, s := range signatures {
+		if bytes.HasPrefix(data, s.magic) {
+			return s.contentType
+		}
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// contentTypeAllowed checks contentType against a list of media types,
+// which may end in a "/*" wildcard. An empty list allows everything.
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == contentType || a == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentSniffer detects the content type of the data written to it. The
+// write that completes the sniffed bytes fails with a ContentTypeError if
+// the type is not allowed, so uploads are rejected before they are stored.
+type contentSniffer struct {
+	allowed     []string
+	buf         []byte
+	contentType string
+}
+
+func (s *contentSniffer) Write(p []byte) (int, error) {
+	if s.contentType == "" {
+		n := sniffLen - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+
+		if len(s.buf) == sniffLen {
+			if err := s.detect(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// detect checks the sniffed bytes, it must be called once all data has
+// been written in case there were less than sniffLen bytes
+func (s *contentSniffer) detect() error {
+	if s.contentType == "" {
+		s.contentType = DetectContentType(s.buf)
+		s.buf = nil
+	}
+
+	if !contentTypeAllowed(s.contentType, s.allowed) {
+		return &ContentTypeError{ContentType: s.contentType}
+	}
+
+	return nil
+}
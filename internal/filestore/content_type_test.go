@@ -0,0 +1,48 @@
+package filestore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		data        string
+		contentType string
+	}{
+		{"\xff\xd8\xff\xe0", "image/jpeg"},
+		{"II*\x00", "image/tiff"},
+		{"MM\x00*", "image/tiff"},
+		{"<html><body>", "text/html"},
+		{"MZ\x90\x00", "application/x-msdownload"},
+		{"\x7fELF\x02\x01", "application/x-executable"},
+		{"#!/bin/sh\n", "text/x-shellscript"},
+		{"plain text", "text/plain"},
+		{"\x00\x01\x02", "application/octet-stream"},
+	}
+
+	for _, tc := range tests {
+		require.Equal(t, tc.contentType, DetectContentType([]byte(tc.data)), "data: %q", tc.data)
+	}
+}
+
+func TestContentTypeAllowed(t *testing.T) {
+	require.True(t, contentTypeAllowed("text/html", nil))
+	require.True(t, contentTypeAllowed("image/png", []string{"image/*"}))
+	require.True(t, contentTypeAllowed("image/png", []string{"text/plain", " Image/PNG "}))
+	require.True(t, contentTypeAllowed("text/html", []string{"*/*"}))
+	require.False(t, contentTypeAllowed("text/html", []string{"image/*", "text/plain"}))
+	require.False(t, contentTypeAllowed("imagex/png", []string{"image*"}))
+}
+
+func TestContentSnifferRejectsEarly(t *testing.T) {
+	s := &contentSniffer{allowed: []string{"image/*"}}
+
+	n, err := s.Write([]byte("<html>"))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	_, err = s.Write(make([]byte, sniffLen))
+	require.Equal(t, &ContentTypeError{ContentType: "text/html"}, err)
+}
@@ -9,7 +9,12 @@ import (
 	"os"
 	"strconv"
 
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/progress"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
 )
 
 type SizeError error
@@ -37,6 +42,12 @@ type FileHandler struct {
 
 	// a map containing different hashes
 	hashes map[string]string
+
+	// virusScan is the clamd verdict, empty if the file was not scanned
+	virusScan string
+
+	// contentType is detected from the first bytes of the file
+	contentType string
 }
 
 // SHA256 hash of the handled file
@@ -49,9 +60,21 @@ func (fh *FileHandler) MD5() string {
 	return fh.hashes["md5"]
 }
 
+// SignedFieldsKey is the finalize field with a JWT embedding all the other
+// finalize fields of a file
+const SignedFieldsKey = "gitlab-workhorse-upload"
+
+type uploadClaims struct {
+	Upload map[string]string `json:"upload"`
+	jwt.StandardClaims
+}
+
 // GitLabFinalizeFields returns a map with all the fields GitLab Rails needs in order to finalize the upload.
-func (fh *FileHandler) GitLabFinalizeFields(prefix string) map[string]string {
+// The fields are also signed in the SignedFieldsKey field, Rails should
+// only trust the signed values.
+func (fh *FileHandler) GitLabFinalizeFields(prefix string) (map[string]string, error) {
 	data := make(map[string]string)
+	signedData := make(map[string]string)
 	key := func(field string) string {
 		if prefix == "" {
 			return field
@@ -60,29 +83,60 @@ func (fh *FileHandler) GitLabFinalizeFields(prefix string) map[string]string {
 		return fmt.Sprintf("%s.%s", prefix, field)
 	}
 
+	set := func(field string, value string) {
+		data[key(field)] = value
+		signedData[field] = value
+	}
+
 	if fh.Name != "" {
-		data[key("name")] = fh.Name
+		set("name", fh.Name)
 	}
 	if fh.LocalPath != "" {
-		data[key("path")] = fh.LocalPath
+		set("path", fh.LocalPath)
 	}
 	if fh.RemoteURL != "" {
-		data[key("remote_url")] = fh.RemoteURL
+		set("remote_url", fh.RemoteURL)
 	}
 	if fh.RemoteID != "" {
-		data[key("remote_id")] = fh.RemoteID
+		set("remote_id", fh.RemoteID)
 	}
-	data[key("size")] = strconv.FormatInt(fh.Size, 10)
+	set("size", strconv.FormatInt(fh.Size, 10))
 	for hashName, hash := range fh.hashes {
-		data[key(hashName)] = hash
+		set(hashName, hash)
+	}
+	if fh.virusScan != "" {
+		set("virus_scan", fh.virusScan)
+	}
+	if fh.contentType != "" {
+		set("content_type", fh.contentType)
+	}
+
+	claims := uploadClaims{Upload: signedData, StandardClaims: secret.DefaultClaims}
+	jwtData, err := secret.JWTTokenString(claims)
+	if err != nil {
+		return nil, err
 	}
+	data[key(SignedFieldsKey)] = jwtData
 
-	return data
+	return data, nil
 }
 
 // SaveFileFromReader persists the provided reader content to all the location specified in opts. A cleanup will be performed once ctx is Done
 // Make sure the provided context will not expire before finalizing upload with GitLab Rails.
 func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts *SaveFileOpts) (fh *FileHandler, err error) {
+	if opts.err != nil {
+		return nil, opts.err
+	}
+
+	if opts.MaximumSize > 0 {
+		if size > opts.MaximumSize {
+			return nil, ErrEntityTooLarge
+		}
+
+		// The size may be unknown or wrong, don't store more than allowed
+		reader = &hardLimitReader{r: reader, n: opts.MaximumSize}
+	}
+
 	var remoteWriter objectstore.Upload
 	fh = &FileHandler{
 		Name:      opts.TempFilePrefix,
@@ -90,7 +144,8 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 		RemoteURL: opts.RemoteURL,
 	}
 	hashes := newMultiHash()
-	writers := []io.Writer{hashes.Writer}
+	sniffer := &contentSniffer{allowed: opts.AllowedContentTypes}
+	writers := []io.Writer{hashes.Writer, sniffer}
 	defer func() {
 		for _, w := range writers {
 			if closer, ok := w.(io.WriteCloser); ok {
@@ -124,22 +179,71 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 		writers = append(writers, fileWriter)
 	}
 
-	if len(writers) == 1 {
+	if len(writers) == 2 {
 		return nil, errors.New("missing upload destination")
 	}
 
+	if tracker := progress.NewTracker(ctx, opts.ProgressID, size); tracker != nil {
+		defer func() { tracker.Finish(err) }()
+		writers = append(writers, tracker)
+	}
+
+	var scan *clamd.BackgroundScan
+	if clamd.Enabled() {
+		scan, err = clamd.StartBackgroundScan(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		writers = append(writers, scan)
+	}
+
 	multiWriter := io.MultiWriter(writers...)
 	fh.Size, err = io.Copy(multiWriter, reader)
 	if err != nil {
+		if remoteWriter != nil {
+			// Don't leave a partial object behind
+			remoteWriter.Abort(err)
+		}
 		return nil, err
 	}
 
 	if size != -1 && size != fh.Size {
-		return nil, SizeError(fmt.Errorf("expected %d bytes but got only %d", size, fh.Size))
+		err := SizeError(fmt.Errorf("expected %d bytes but got only %d", size, fh.Size))
+		if remoteWriter != nil {
+			remoteWriter.Abort(err)
+		}
+		return nil, err
 	}
 
+	if err := sniffer.detect(); err != nil {
+		if remoteWriter != nil {
+			remoteWriter.Abort(err)
+		}
+		return nil, err
+	}
+	fh.contentType = sniffer.contentType
+
 	fh.hashes = hashes.finish()
 
+	if err := verifyChecksums(fh.hashes, opts.ExpectedChecksums); err != nil {
+		if remoteWriter != nil {
+			remoteWriter.Abort(err)
+		}
+		return nil, err
+	}
+
+	if scan != nil {
+		// The verdict must be known before the remote upload is completed
+		fh.virusScan, err = scan.Verdict()
+		if err != nil {
+			if remoteWriter != nil {
+				remoteWriter.Abort(err)
+			}
+			return nil, err
+		}
+	}
+
 	if opts.IsRemote() {
 		// we need to close the writer in order to get ETag header
 		err = remoteWriter.Close()
@@ -157,6 +261,23 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 	return fh, err
 }
 
+// hardLimitReader fails with ErrEntityTooLarge once more than n bytes are
+// read from r
+type hardLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (h *hardLimitReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.n -= int64(n)
+	if h.n < 0 {
+		return 0, ErrEntityTooLarge
+	}
+
+	return n, err
+}
+
 func (fh *FileHandler) uploadLocalFile(ctx context.Context, opts *SaveFileOpts) (io.WriteCloser, error) {
 	// make sure TempFolder exists
 	err := os.MkdirAll(opts.LocalTempPath, 0700)
@@ -11,11 +11,14 @@ import (
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 )
 
 func testDeadline() time.Time {
@@ -161,6 +164,8 @@ func TestSaveFile(t *testing.T) {
 		remoteMultipart
 	)
 
+	testhelper.ConfigureSecret()
+
 	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
 	require.NoError(t, err)
 	defer os.RemoveAll(tmpFolder)
@@ -256,7 +261,8 @@ func TestSaveFile(t *testing.T) {
 			assertFileGetsRemovedAsync(t, fh.LocalPath)
 
 			// checking generated fields
-			fields := fh.GitLabFinalizeFields("file")
+			fields, err := fh.GitLabFinalizeFields("file")
+			require.NoError(t, err)
 
 			assert.Equal(fh.Name, fields["file.name"])
 			assert.Equal(fh.LocalPath, fields["file.path"])
@@ -272,6 +278,15 @@ func TestSaveFile(t *testing.T) {
 			} else {
 				assert.Contains(fields, "file.etag")
 			}
+
+			// every other field is signed
+			var claims testhelper.UploadClaims
+			_, err = jwt.ParseWithClaims(fields["file."+filestore.SignedFieldsKey], &claims, testhelper.ParseJWT)
+			require.NoError(t, err)
+			assert.Equal(len(fields)-1, len(claims.Upload))
+			for k, v := range claims.Upload {
+				assert.Equal(fields["file."+k], v, "signed field %q", k)
+			}
 		})
 	}
 }
@@ -305,3 +320,219 @@ func TestSaveMultipartInBodyFailure(t *testing.T) {
 	require.Error(t, err)
 	assert.EqualError(err, test.MultipartUploadInternalError().Error())
 }
+
+func TestSaveFileVirusScan(t *testing.T) {
+	clamdServer := testhelper.StartClamdServer(t)
+	defer clamdServer.Close()
+
+	require.NoError(t, clamd.Configure(clamdServer.Config()))
+	defer clamd.Configure(nil)
+
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder}
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.NoError(t, err)
+	fields, err := fh.GitLabFinalizeFields("file")
+	require.NoError(t, err)
+	require.Equal(t, "clean", fields["file.virus_scan"])
+
+	_, err = filestore.SaveFileFromReader(ctx, strings.NewReader(testhelper.ClamdTestVirus), -1, opts)
+	require.True(t, clamd.IsInfected(err), "error: %v", err)
+	require.Equal(t, 2, clamdServer.Scans())
+}
+
+func TestSaveFileVirusScanUnscanned(t *testing.T) {
+	clamdServer := testhelper.StartClamdServer(t)
+	defer clamdServer.Close()
+
+	cfg := clamdServer.Config()
+	cfg.MaxScanSize = int64(len(testhelper.ClamdTestVirus))
+	require.NoError(t, clamd.Configure(cfg))
+	defer clamd.Configure(nil)
+
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := testhelper.ClamdTestVirus + " and more"
+	opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder}
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(content), -1, opts)
+	require.NoError(t, err, "files above the maximum scan size are stored")
+	require.Equal(t, int64(len(content)), fh.Size)
+
+	fields, err := fh.GitLabFinalizeFields("file")
+	require.NoError(t, err)
+	require.Equal(t, "unscanned", fields["file.virus_scan"])
+	require.Equal(t, 0, clamdServer.Scans())
+}
+
+func TestSaveFileVirusAbortsMultipartUpload(t *testing.T) {
+	clamdServer := testhelper.StartClamdServer(t)
+	defer clamdServer.Close()
+
+	require.NoError(t, clamd.Configure(clamdServer.Config()))
+	defer clamd.Configure(nil)
+
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := &filestore.SaveFileOpts{
+		RemoteID:                   "test-file",
+		RemoteURL:                  objectURL,
+		PartSize:                   int64(len(testhelper.ClamdTestVirus)),
+		PresignedParts:             []string{objectURL + "?partNumber=1"},
+		PresignedCompleteMultipart: objectURL + "?Signature=CompleteSig",
+		PresignedAbortMultipart:    objectURL + "?Signature=AbortSig",
+		Deadline:                   testDeadline(),
+	}
+
+	osStub.InitiateMultipartUpload(test.ObjectPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(testhelper.ClamdTestVirus), -1, opts)
+	require.True(t, clamd.IsInfected(err), "error: %v", err)
+	require.Nil(t, fh)
+
+	assertObjectStoreDeletedAsync(t, 1, osStub)
+	require.False(t, osStub.IsMultipartUpload(test.ObjectPath), "multipart upload was not aborted")
+}
+
+func TestSaveFileMaximumSize(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder, MaximumSize: test.ObjectSize}
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectSize, fh.Size)
+
+	opts.MaximumSize = test.ObjectSize - 1
+	for _, size := range []int64{test.ObjectSize, -1} {
+		fh, err = filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), size, opts)
+		require.Equal(t, filestore.ErrEntityTooLarge, err, "size %d", size)
+		require.Nil(t, fh)
+	}
+}
+
+func TestSaveFileMaximumSizeAbortsMultipartUpload(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := &filestore.SaveFileOpts{
+		RemoteID:                   "test-file",
+		RemoteURL:                  objectURL,
+		PartSize:                   test.ObjectSize,
+		PresignedParts:             []string{objectURL + "?partNumber=1"},
+		PresignedCompleteMultipart: objectURL + "?Signature=CompleteSig",
+		PresignedAbortMultipart:    objectURL + "?Signature=AbortSig",
+		MaximumSize:                test.ObjectSize - 1,
+		Deadline:                   testDeadline(),
+	}
+
+	osStub.InitiateMultipartUpload(test.ObjectPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The size is unknown, so the upload is aborted once too much was read
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), -1, opts)
+	require.Equal(t, filestore.ErrEntityTooLarge, err)
+	require.Nil(t, fh)
+
+	assertObjectStoreDeletedAsync(t, 1, osStub)
+	require.False(t, osStub.IsMultipartUpload(test.ObjectPath), "multipart upload was not aborted")
+}
+
+func TestSaveFileExpectedChecksums(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder}
+	require.NoError(t, opts.ExpectChecksum("md5", test.ObjectMD5))
+	require.NoError(t, opts.ExpectChecksum("sha512", strings.ToUpper(test.ObjectSHA512)))
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectMD5, fh.MD5())
+
+	opts = &filestore.SaveFileOpts{LocalTempPath: tmpFolder}
+	require.NoError(t, opts.ExpectChecksum("md5", test.ObjectMD5))
+
+	_, err = filestore.SaveFileFromReader(ctx, strings.NewReader("other content"), -1, opts)
+	require.Equal(t, &filestore.ChecksumError{Hash: "md5", Expected: test.ObjectMD5, Actual: "0c84751f0ca9c6886bb09f2dd1a66faa"}, err)
+}
+
+func TestSaveFileChecksumMismatchAbortsMultipartUpload(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := &filestore.SaveFileOpts{
+		RemoteID:                   "test-file",
+		RemoteURL:                  objectURL,
+		PartSize:                   test.ObjectSize,
+		PresignedParts:             []string{objectURL + "?partNumber=1"},
+		PresignedCompleteMultipart: objectURL + "?Signature=CompleteSig",
+		PresignedAbortMultipart:    objectURL + "?Signature=AbortSig",
+		Deadline:                   testDeadline(),
+	}
+	require.NoError(t, opts.ExpectChecksum("sha256", strings.Repeat("0", 64)))
+
+	osStub.InitiateMultipartUpload(test.ObjectPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.True(t, filestore.IsChecksumError(err), "error: %v", err)
+	require.Nil(t, fh)
+
+	assertObjectStoreDeletedAsync(t, 1, osStub)
+	require.False(t, osStub.IsMultipartUpload(test.ObjectPath), "multipart upload was not aborted")
+}
+
+func TestSaveFileAllowedContentTypes(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 1024)
+	opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder, AllowedContentTypes: []string{"image/*"}}
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(png), -1, opts)
+	require.NoError(t, err)
+	fields, err := fh.GitLabFinalizeFields("file")
+	require.NoError(t, err)
+	require.Equal(t, "image/png", fields["file.content_type"])
+
+	html := "<!DOCTYPE html><script>alert(1)</script>" + strings.Repeat(" ", 1024)
+	_, err = filestore.SaveFileFromReader(ctx, strings.NewReader(html), -1, opts)
+	require.Equal(t, &filestore.ContentTypeError{ContentType: "text/html"}, err)
+
+	_, err = filestore.SaveFileFromReader(ctx, strings.NewReader("\x7fELF"), -1, opts)
+	require.Equal(t, &filestore.ContentTypeError{ContentType: "application/x-executable"}, err)
+}
@@ -1,6 +1,7 @@
 package filestore
 
 import (
+	"fmt"
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -26,6 +27,19 @@ type SaveFileOpts struct {
 	// HTTP headers to be sent along with PUT request
 	PutHeaders map[string]string
 
+	// MaximumSize is the largest allowed file size, zero means no limit
+	MaximumSize int64
+	// ExpectedChecksums maps hash names to the hex digest the file must
+	// have, the upload fails otherwise
+	ExpectedChecksums map[string]string
+	// AllowedContentTypes are the media types the file may have, as
+	// detected from its first bytes. A type may end in "/*", an empty list
+	// allows any type.
+	AllowedContentTypes []string
+	// ProgressID is the upload ID the progress is published for, see
+	// package progress
+	ProgressID string
+
 	// Deadline it the S3 operation deadline, the upload will be aborted if not completed in time
 	Deadline time.Time
 
@@ -38,6 +52,10 @@ type SaveFileOpts struct {
 	PresignedCompleteMultipart string
 	// PresignedAbortMultipart is a presigned URL for AbortMultipartUpload
 	PresignedAbortMultipart string
+
+	// err is set if the api.Response the options were made from is
+	// invalid, saving the file fails with it
+	err error
 }
 
 // IsLocal checks if the options require the writing of the file on disk
@@ -69,7 +87,10 @@ func GetOpts(apiResponse *api.Response) *SaveFileOpts {
 		PresignedPut:    apiResponse.RemoteObject.StoreURL,
 		PresignedDelete: apiResponse.RemoteObject.DeleteURL,
 		PutHeaders:      apiResponse.RemoteObject.PutHeaders,
+		MaximumSize:     apiResponse.MaximumSize,
 		Deadline:        time.Now().Add(timeout),
+
+		AllowedContentTypes: apiResponse.AllowedContentTypes,
 	}
 
 	// Backwards compatibility to ensure API servers that do not include the
@@ -79,6 +100,13 @@ func GetOpts(apiResponse *api.Response) *SaveFileOpts {
 		opts.PutHeaders["Content-Type"] = "application/octet-stream"
 	}
 
+	for name, digest := range apiResponse.ExpectedChecksums {
+		if err := opts.ExpectChecksum(name, digest); err != nil {
+			// GitLab is misconfigured, this is not the fault of the client
+			opts.err = fmt.Errorf("GetOpts: expected checksums: %v", err)
+		}
+	}
+
 	if multiParams := apiResponse.RemoteObject.MultipartUpload; multiParams != nil {
 		opts.PartSize = multiParams.PartSize
 		opts.PresignedCompleteMultipart = multiParams.CompleteURL
@@ -1,13 +1,22 @@
 package filestore_test
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
 )
 
 func TestSaveFileOptsLocalAndRemote(t *testing.T) {
@@ -166,3 +175,89 @@ func TestGetOptsDefaultTimeout(t *testing.T) {
 
 	assert.WithinDuration(deadline, opts.Deadline, time.Minute)
 }
+
+func TestGetOptsExpectedChecksums(t *testing.T) {
+	opts := filestore.GetOpts(&api.Response{
+		ExpectedChecksums: map[string]string{"sha256": strings.ToUpper(test.ObjectSHA256), "crc32": "cbf43926"},
+	})
+
+	require.Equal(t, map[string]string{"sha256": test.ObjectSHA256}, opts.ExpectedChecksums)
+}
+
+func TestGetOptsInvalidExpectedChecksums(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	opts := filestore.GetOpts(&api.Response{
+		TempPath:          tmpFolder,
+		ExpectedChecksums: map[string]string{"sha256": "not a checksum"},
+	})
+
+	fh, err := filestore.SaveFileFromReader(context.Background(), strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.Error(t, err)
+	require.Nil(t, fh)
+	// It isn't the client's fault, the upload must not fail with 400
+	require.False(t, filestore.IsChecksumError(err))
+}
+
+func TestExpectHeaderChecksums(t *testing.T) {
+	md5Sum, err := hex.DecodeString(test.ObjectMD5)
+	require.NoError(t, err)
+	sha256Sum, err := hex.DecodeString(test.ObjectSHA256)
+	require.NoError(t, err)
+
+	md5Base64 := base64.StdEncoding.EncodeToString(md5Sum)
+	sha256Base64 := base64.StdEncoding.EncodeToString(sha256Sum)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected map[string]string
+		invalid  bool
+	}{
+		{
+			name:   "no checksums",
+			header: http.Header{},
+		},
+		{
+			name:     "Content-MD5",
+			header:   http.Header{"Content-Md5": {md5Base64}},
+			expected: map[string]string{"md5": test.ObjectMD5},
+		},
+		{
+			name:     "Digest",
+			header:   http.Header{"Digest": {"SHA-256=" + sha256Base64 + ", md5=" + md5Base64 + ", UNIXsum=30637"}},
+			expected: map[string]string{"md5": test.ObjectMD5, "sha256": test.ObjectSHA256},
+		},
+		{
+			name:     "Content-MD5 and Digest",
+			header:   http.Header{"Content-Md5": {md5Base64}, "Digest": {"MD5=" + md5Base64}},
+			expected: map[string]string{"md5": test.ObjectMD5},
+		},
+		{
+			name:    "conflicting checksums",
+			header:  http.Header{"Content-Md5": {md5Base64}, "Digest": {"MD5=" + sha256Base64}},
+			invalid: true,
+		},
+		{
+			name:    "invalid base64",
+			header:  http.Header{"Digest": {"SHA-256=not base64"}},
+			invalid: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &filestore.SaveFileOpts{}
+			err := opts.ExpectHeaderChecksums(tc.header)
+
+			if tc.invalid {
+				require.True(t, filestore.IsChecksumError(err), "error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, opts.ExpectedChecksums)
+		})
+	}
+}
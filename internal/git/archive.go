@@ -106,7 +106,7 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 
 	archiveReader, err = handleArchiveWithGitaly(r, params, format)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("operations.GetArchive: %v", err))
+		failGitaly(w, r, err, "operations.GetArchive")
 		return
 	}
 
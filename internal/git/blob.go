@@ -28,7 +28,7 @@ func (b *blob) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 
 	blobClient, err := gitaly.NewBlobClient(params.GitalyServer)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
+		failGitaly(w, r, err, "blob.GetBlob")
 		return
 	}
 
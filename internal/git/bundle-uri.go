@@ -0,0 +1,123 @@
+/*
+In this file we handle the bundle-uri capability of Git protocol v2
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+const (
+	bundleURICapability = "bundle-uri"
+	bundleURICommand    = "command=bundle-uri"
+
+	// A protocol v2 capability advertisement contains no refs so it is
+	// small enough to be buffered.
+	maxAdvertisementSize = 64 * 1024
+)
+
+func isProtocolV2(gitProtocol string) bool {
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func offerBundleURI(a *api.Response, rpc string, gitProtocol string) bool {
+	return a.GitBundleURI != "" && rpc == "git-upload-pack" && isProtocolV2(gitProtocol)
+}
+
+// withBundleURICapability adds the bundle-uri capability to the protocol
+// v2 capability advertisement in r. Anything it does not understand is
+// passed on unmodified.
+func withBundleURICapability(r io.Reader) (io.Reader, error) {
+	advertisement, err := ioutil.ReadAll(io.LimitReader(r, maxAdvertisementSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(advertisement) > maxAdvertisementSize {
+		return io.MultiReader(bytes.NewReader(advertisement), r), nil
+	}
+
+	if modified, err := addBundleURICapability(advertisement); err == nil {
+		advertisement = modified
+	}
+
+	return bytes.NewReader(advertisement), nil
+}
+
+func addBundleURICapability(advertisement []byte) ([]byte, error) {
+	versionTwo := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(advertisement))
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := string(bytes.TrimSuffix(scanner.Bytes(), []byte("\n")))
+
+		switch {
+		case line == "version 2":
+			versionTwo = true
+		case line == bundleURICapability || strings.HasPrefix(line, bundleURICapability+"="):
+			return advertisement, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush := []byte("0000")
+	if !versionTwo || !bytes.HasSuffix(advertisement, flush) {
+		return nil, errors.New("not a protocol v2 capability advertisement")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(advertisement[:len(advertisement)-len(flush)])
+	buf.Write(pktLine(bundleURICapability + "\n"))
+	buf.Write(flush)
+
+	return buf.Bytes(), nil
+}
+
+// isBundleURICommand reports whether the protocol v2 request in body is a
+// bundle-uri command. It rewinds body.
+func isBundleURICommand(body io.ReadSeeker) (bool, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+
+	isCommand := scanner.Scan() && string(bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))) == bundleURICommand
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	return isCommand, nil
+}
+
+// writeBundleURIList answers a bundle-uri command with a single bundle
+// that contains all refs.
+func writeBundleURIList(w io.Writer, uri string) error {
+	var buf bytes.Buffer
+	for _, line := range []string{
+		"bundle.version=1",
+		"bundle.mode=all",
+		"bundle.gitlab.uri=" + uri,
+	} {
+		buf.Write(pktLine(line + "\n"))
+	}
+	buf.WriteString("0000")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,78 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const v2Advertisement = "001e# service=git-upload-pack\n0000" +
+	"000eversion 2\n" +
+	"0013agent=git/2.22\n" +
+	"0013ls-refs=unborn\n" +
+	"0000"
+
+func TestWithBundleURICapability(t *testing.T) {
+	r, err := withBundleURICapability(strings.NewReader(v2Advertisement))
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSuffix(v2Advertisement, "0000")+"000fbundle-uri\n0000", string(data))
+}
+
+func TestWithBundleURICapabilityPassesOtherDataThrough(t *testing.T) {
+	examples := []string{
+		// Protocol v0 advertisement
+		"001e# service=git-upload-pack\n0000003f54fcc214b94e78d7a41a9a8fe6d87a5e59500e51 refs/heads/master\n0000",
+		// Already advertised
+		strings.TrimSuffix(v2Advertisement, "0000") + "000fbundle-uri\n0000",
+		"invalid data",
+		// Too large to be buffered
+		strings.Repeat("x", maxAdvertisementSize+10),
+	}
+
+	for _, example := range examples {
+		r, err := withBundleURICapability(strings.NewReader(example))
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, example, string(data))
+	}
+}
+
+func TestIsBundleURICommand(t *testing.T) {
+	examples := []struct {
+		input  string
+		output bool
+	}{
+		{"0017command=bundle-uri\n00010017object-format=sha1\n0000", true},
+		{"0016command=bundle-uri0000", true},
+		{"0012command=fetch\n0001000cdeepen 10000", false},
+		{"0032want 54fcc214b94e78d7a41a9a8fe6d87a5e59500e51\n0000", false},
+		{"invalid data", false},
+	}
+
+	for _, example := range examples {
+		body := bytes.NewReader([]byte(example.input))
+
+		isCommand, err := isBundleURICommand(body)
+		require.NoError(t, err)
+		require.Equal(t, example.output, isCommand, "input %q", example.input)
+
+		rest, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.Equal(t, example.input, string(rest), "body should be rewound")
+	}
+}
+
+func TestIsProtocolV2(t *testing.T) {
+	require.True(t, isProtocolV2("version=2"))
+	require.True(t, isProtocolV2("foo=bar:version=2"))
+	require.False(t, isProtocolV2("version=1"))
+	require.False(t, isProtocolV2(""))
+}
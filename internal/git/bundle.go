@@ -0,0 +1,122 @@
+/*
+In this file we handle git bundle downloads for the bundle-uri capability
+*/
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitaly-proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+)
+
+type bundle struct{ senddata.Prefix }
+type bundleParams struct {
+	BundlePath       string
+	GitalyServer     gitaly.Server
+	GitalyRepository gitalypb.Repository
+}
+
+var (
+	SendBundle     = &bundle{"git-bundle:"}
+	gitBundleCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_bundle_cache",
+			Help: "Cache hits and misses for git bundle downloads",
+		},
+		[]string{"result"},
+	)
+
+	// bundleGenerations lets concurrent requests for the same bundle wait
+	// for a single CreateBundle call.
+	bundleGenerations = newGenerations()
+)
+
+func init() {
+	prometheus.MustRegister(gitBundleCache)
+}
+
+func (b *bundle) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params bundleParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: unpack sendData: %v", err))
+		return
+	}
+
+	if params.BundlePath == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: missing BundlePath"))
+		return
+	}
+
+	if _, err := os.Stat(params.BundlePath); err == nil {
+		gitBundleCache.WithLabelValues("hit").Inc()
+	} else if os.IsNotExist(err) {
+		gitBundleCache.WithLabelValues("miss").Inc()
+
+		if err := waitForBundle(r.Context(), params); err != nil {
+			failGitaly(w, r, err, "SendBundle")
+			return
+		}
+	} else {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(params.BundlePath)))
+	w.Header().Set("Cache-Control", "private")
+	// The bundle is complete on disk, so clients can resume interrupted
+	// downloads with Range requests
+	sendfile.ServeFile(w, r, params.BundlePath)
+}
+
+// waitForBundle creates the bundle at params.BundlePath, or waits for a
+// concurrent request that is already creating it.
+func waitForBundle(ctx context.Context, params bundleParams) error {
+	return bundleGenerations.wait(ctx, params.BundlePath, func() error {
+		generationCtx, cancel := generationContext()
+		defer cancel()
+
+		return createBundle(generationCtx, params)
+	})
+}
+
+func createBundle(ctx context.Context, params bundleParams) error {
+	c, err := gitaly.NewRepositoryClient(params.GitalyServer)
+	if err != nil {
+		return err
+	}
+
+	request := &gitalypb.CreateBundleRequest{Repository: &params.GitalyRepository}
+	reader, err := c.BundleReader(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	// Like cached archives, the bundle is written to a tempfile next to its
+	// final location and linked into place once it is complete.
+	tempFile, err := prepareArchiveTempfile(path.Dir(params.BundlePath), path.Base(params.BundlePath))
+	if err != nil {
+		return fmt.Errorf("create tempfile: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, reader); err != nil {
+		return fmt.Errorf("copy bundle: %v", err)
+	}
+
+	return finalizeCachedArchive(tempFile, params.BundlePath)
+}
@@ -34,7 +34,7 @@ func (d *diff) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 
 	diffClient, err := gitaly.NewDiffClient(params.GitalyServer)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("diff.RawDiff: %v", err))
+		failGitaly(w, r, err, "diff.RawDiff")
 		return
 	}
 
@@ -0,0 +1,423 @@
+/*
+In this file we handle the read-only Git 'dumb HTTP' protocol
+
+Gitaly has no RPCs for single objects or existing packs, so all objects
+reachable from the refs are served as one pack. It is generated with
+PostUploadPack, indexed by gitlab-workhorse and cached per set of refs.
+Loose objects are never found, which makes clients fall back to the pack.
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+)
+
+type dumbRef struct {
+	oid  string
+	name string
+}
+
+var (
+	dumbHTTPPath     = regexp.MustCompile(`\.git/(HEAD|objects/.+)\z`)
+	dumbHTTPPackFile = regexp.MustCompile(`\Aobjects/pack/pack-([0-9a-f]{40})\.(pack|idx)\z`)
+
+	dumbHTTPPackCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_dumb_http_pack_cache",
+			Help: "Cache hits and misses for packs served over the dumb Git HTTP protocol",
+		},
+		[]string{"result"},
+	)
+
+	dumbHTTPPackGenerations = newGenerations()
+)
+
+func init() {
+	prometheus.MustRegister(dumbHTTPPackCache)
+}
+
+// DumbHTTP serves HEAD and objects/ of repositories for which the dumb
+// protocol is enabled. Dumb info/refs requests are passed on by
+// GetInfoRefsHandler.
+func DumbHTTP(a *api.API) http.Handler {
+	return repoPreAuthorizeHandler(a, func(w http.ResponseWriter, r *http.Request, ar *api.Response) {
+		match := dumbHTTPPath.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+
+		handleDumbHTTP(w, r, ar, match[1])
+	})
+}
+
+func handleDumbHTTP(rw http.ResponseWriter, r *http.Request, a *api.Response, file string) {
+	w := NewHttpResponseWriter(rw)
+	defer w.Log(r, 0)
+
+	if a.GitDumbHTTPCachePath == "" {
+		// The dumb protocol is opt-in
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	var err error
+	switch {
+	case file == "HEAD":
+		err = handleDumbHead(w, r, a)
+	case file == "info/refs":
+		err = handleDumbInfoRefs(w, r, a)
+	case file == "objects/info/packs":
+		err = handleDumbInfoPacks(w, r, a)
+	case dumbHTTPPackFile.MatchString(file):
+		m := dumbHTTPPackFile.FindStringSubmatch(file)
+		err = handleDumbPackFile(w, r, a, m[1], m[2])
+	default:
+		// Loose objects, alternates and anything else do not exist
+		http.Error(w, "Not Found", 404)
+	}
+
+	if err != nil {
+		failGitaly(w, r, err, "handleDumbHTTP")
+	}
+}
+
+func handleDumbHead(w http.ResponseWriter, r *http.Request, a *api.Response) error {
+	_, head, err := getDumbRefs(r.Context(), a)
+	if err != nil {
+		return err
+	}
+
+	if head == "" {
+		http.Error(w, "Not Found", 404)
+		return nil
+	}
+
+	setDumbTextHeaders(w)
+	_, err = io.WriteString(w, head+"\n")
+	return err
+}
+
+func handleDumbInfoRefs(w http.ResponseWriter, r *http.Request, a *api.Response) error {
+	refs, _, err := getDumbRefs(r.Context(), a)
+	if err != nil {
+		return err
+	}
+
+	setDumbTextHeaders(w)
+	_, err = w.Write(formatDumbInfoRefs(refs))
+	return err
+}
+
+func handleDumbInfoPacks(w http.ResponseWriter, r *http.Request, a *api.Response) error {
+	refs, _, err := getDumbRefs(r.Context(), a)
+	if err != nil {
+		return err
+	}
+
+	name, err := dumbHTTPPack(r.Context(), a, refs)
+	if err != nil {
+		return err
+	}
+
+	var packs bytes.Buffer
+	if name != "" {
+		fmt.Fprintf(&packs, "P pack-%s.pack\n", name)
+	}
+	packs.WriteString("\n")
+
+	setDumbTextHeaders(w)
+	_, err = w.Write(packs.Bytes())
+	return err
+}
+
+func handleDumbPackFile(w http.ResponseWriter, r *http.Request, a *api.Response, name string, extension string) error {
+	file := dumbHTTPPackPath(a.GitDumbHTTPCachePath, name, extension)
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		// The pack may have been generated by another gitlab-workhorse
+		// process or removed from the cache: generate it again if the
+		// refs did not change since the client listed the packs.
+		refs, _, err := getDumbRefs(r.Context(), a)
+		if err != nil {
+			return err
+		}
+
+		current, err := dumbHTTPPack(r.Context(), a, refs)
+		if err != nil {
+			return err
+		}
+
+		if current != name {
+			http.Error(w, "Not Found", 404)
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if extension == "pack" {
+		w.Header().Set("Content-Type", "application/x-git-packed-objects")
+	} else {
+		w.Header().Set("Content-Type", "application/x-git-packed-objects-toc")
+	}
+	w.Header().Set("Cache-Control", "private")
+	// Dumb clients resume interrupted pack downloads with Range requests
+	sendfile.ServeFile(w, r, file)
+	return nil
+}
+
+func setDumbTextHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// getDumbRefs returns the refs from the upload-pack advertisement of the
+// repository, and the contents of its HEAD file.
+func getDumbRefs(ctx context.Context, a *api.Response) ([]dumbRef, string, error) {
+	smarthttp, err := gitaly.NewSmartHTTPClient(a.GitalyServer)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// An empty Git-Protocol gets us a protocol v0 advertisement, which
+	// lists the refs.
+	advertisement, err := smarthttp.InfoRefsResponseReader(ctx, &a.Repository, "git-upload-pack", gitConfigOptions(a), "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	return parseAdvertisement(advertisement)
+}
+
+func parseAdvertisement(advertisement io.Reader) ([]dumbRef, string, error) {
+	var refs []dumbRef
+	var headOid, headTarget string
+
+	scanner := bufio.NewScanner(advertisement)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := string(bytes.TrimSuffix(scanner.Bytes(), []byte("\n")))
+		if line == "" || strings.HasPrefix(line, "# service=") {
+			continue
+		}
+
+		// The first ref is followed by the capabilities
+		line, capabilities := splitAt(line, "\x00")
+		for _, capability := range strings.Split(capabilities, " ") {
+			if strings.HasPrefix(capability, "symref=HEAD:") {
+				headTarget = strings.TrimPrefix(capability, "symref=HEAD:")
+			}
+		}
+
+		oid, name := splitAt(line, " ")
+		if len(oid) != 40 || name == "" {
+			return nil, "", fmt.Errorf("parseAdvertisement: invalid ref line %q", line)
+		}
+
+		switch name {
+		case "capabilities^{}":
+			// Empty repository
+		case "HEAD":
+			headOid = oid
+		default:
+			refs = append(refs, dumbRef{oid: oid, name: name})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+
+	head := headOid
+	if headTarget != "" {
+		head = "ref: " + headTarget
+	}
+
+	return refs, head, nil
+}
+
+func splitAt(s string, sep string) (string, string) {
+	parts := strings.SplitN(s, sep, 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func formatDumbInfoRefs(refs []dumbRef) []byte {
+	var buf bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&buf, "%s\t%s\n", ref.oid, ref.name)
+	}
+	return buf.Bytes()
+}
+
+func dumbHTTPPackPath(dir string, name string, extension string) string {
+	return path.Join(dir, fmt.Sprintf("pack-%s.%s", name, extension))
+}
+
+// dumbHTTPPack returns the name of the pack that contains all objects
+// reachable from refs, generating it if it is not cached yet. It returns
+// an empty name if there are no refs.
+func dumbHTTPPack(ctx context.Context, a *api.Response, refs []dumbRef) (string, error) {
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	refsDigest := sha1.Sum(formatDumbInfoRefs(refs))
+	refsPath := path.Join(a.GitDumbHTTPCachePath, "refs-"+hex.EncodeToString(refsDigest[:]))
+
+	if name, err := readDumbHTTPPackName(refsPath); err == nil {
+		dumbHTTPPackCache.WithLabelValues("hit").Inc()
+		return name, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	dumbHTTPPackCache.WithLabelValues("miss").Inc()
+	if err := dumbHTTPPackGenerations.wait(ctx, refsPath, func() error {
+		generationCtx, cancel := generationContext()
+		defer cancel()
+
+		return createDumbHTTPPack(generationCtx, a, refs, refsPath)
+	}); err != nil {
+		return "", err
+	}
+
+	return readDumbHTTPPackName(refsPath)
+}
+
+// readDumbHTTPPackName returns the name of the pack recorded in refsPath
+// if both the pack and its index are still cached.
+func readDumbHTTPPackName(refsPath string) (string, error) {
+	contents, err := ioutil.ReadFile(refsPath)
+	if err != nil {
+		return "", err
+	}
+
+	name := string(contents)
+	for _, extension := range []string{"pack", "idx"} {
+		if _, err := os.Stat(dumbHTTPPackPath(path.Dir(refsPath), name, extension)); err != nil {
+			return "", err
+		}
+	}
+
+	return name, nil
+}
+
+func createDumbHTTPPack(ctx context.Context, a *api.Response, refs []dumbRef, refsPath string) error {
+	dir := a.GitDumbHTTPCachePath
+
+	packFile, err := prepareArchiveTempfile(dir, "pack")
+	if err != nil {
+		return fmt.Errorf("create tempfile: %v", err)
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+
+	if err := fetchPack(ctx, a, refs, packFile); err != nil {
+		return fmt.Errorf("fetch pack: %v", err)
+	}
+
+	if _, err := packFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	indexFile, err := prepareArchiveTempfile(dir, "idx")
+	if err != nil {
+		return fmt.Errorf("create tempfile: %v", err)
+	}
+	defer os.Remove(indexFile.Name())
+	defer indexFile.Close()
+
+	checksum, err := indexPack(ctx, packFile, indexFile)
+	if err != nil {
+		return fmt.Errorf("index pack: %v", err)
+	}
+	name := hex.EncodeToString(checksum)
+
+	if err := finalizeCachedArchive(packFile, dumbHTTPPackPath(dir, name, "pack")); err != nil {
+		return err
+	}
+	if err := finalizeCachedArchive(indexFile, dumbHTTPPackPath(dir, name, "idx")); err != nil {
+		return err
+	}
+
+	refsFile, err := prepareArchiveTempfile(dir, "refs")
+	if err != nil {
+		return fmt.Errorf("create tempfile: %v", err)
+	}
+	defer os.Remove(refsFile.Name())
+	defer refsFile.Close()
+
+	if _, err := io.WriteString(refsFile, name); err != nil {
+		return err
+	}
+
+	return finalizeCachedArchive(refsFile, refsPath)
+}
+
+// fetchPack writes a pack with all objects reachable from refs to w, as
+// a clone without any local objects would receive it.
+func fetchPack(ctx context.Context, a *api.Response, refs []dumbRef, w io.Writer) error {
+	var request bytes.Buffer
+	wanted := make(map[string]bool)
+	for _, ref := range refs {
+		if wanted[ref.oid] {
+			continue
+		}
+
+		if len(wanted) == 0 {
+			request.Write(pktLine(fmt.Sprintf("want %s ofs-delta\n", ref.oid)))
+		} else {
+			request.Write(pktLine(fmt.Sprintf("want %s\n", ref.oid)))
+		}
+		wanted[ref.oid] = true
+	}
+	request.WriteString("0000")
+	request.Write(pktLine("done\n"))
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(handleUploadPackWithGitaly(ctx, a, &request, pw, ""))
+	}()
+
+	// Without side-band the pack follows the NAK right away
+	response := bufio.NewReader(pr)
+	scanner := bufio.NewScanner(io.LimitReader(response, 8))
+	scanner.Split(pktLineSplitter)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("empty upload-pack response")
+	}
+	if line := scanner.Text(); line != "NAK\n" {
+		return fmt.Errorf("unexpected upload-pack response %q", line)
+	}
+
+	_, err := io.Copy(w, response)
+	return err
+}
@@ -0,0 +1,64 @@
+package git
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	commitOid = "0123456789012345678901234567890123456789"
+	tagOid    = "abcdefabcdefabcdefabcdefabcdefabcdefabcd"
+	zeroOid   = "0000000000000000000000000000000000000000"
+)
+
+func TestParseAdvertisement(t *testing.T) {
+	advertisement := strings.Join([]string{
+		string(pktLine("# service=git-upload-pack\n")),
+		"0000",
+		string(pktLine(commitOid + " HEAD\x00multi_ack symref=HEAD:refs/heads/master agent=git/2.21.0\n")),
+		string(pktLine(commitOid + " refs/heads/master\n")),
+		string(pktLine(tagOid + " refs/tags/v1.0.0\n")),
+		string(pktLine(commitOid + " refs/tags/v1.0.0^{}\n")),
+		"0000",
+	}, "")
+
+	refs, head, err := parseAdvertisement(strings.NewReader(advertisement))
+	require.NoError(t, err)
+	require.Equal(t, "ref: refs/heads/master", head)
+	require.Equal(t, []dumbRef{
+		{oid: commitOid, name: "refs/heads/master"},
+		{oid: tagOid, name: "refs/tags/v1.0.0"},
+		{oid: commitOid, name: "refs/tags/v1.0.0^{}"},
+	}, refs)
+
+	expectedInfoRefs := commitOid + "\trefs/heads/master\n" +
+		tagOid + "\trefs/tags/v1.0.0\n" +
+		commitOid + "\trefs/tags/v1.0.0^{}\n"
+	require.Equal(t, expectedInfoRefs, string(formatDumbInfoRefs(refs)))
+}
+
+func TestParseAdvertisementDetachedHead(t *testing.T) {
+	advertisement := string(pktLine(commitOid+" HEAD\x00multi_ack\n")) + "0000"
+
+	refs, head, err := parseAdvertisement(strings.NewReader(advertisement))
+	require.NoError(t, err)
+	require.Equal(t, commitOid, head)
+	require.Empty(t, refs)
+}
+
+func TestParseAdvertisementEmptyRepository(t *testing.T) {
+	advertisement := string(pktLine(zeroOid+" capabilities^{}\x00multi_ack\n")) + "0000"
+
+	refs, head, err := parseAdvertisement(strings.NewReader(advertisement))
+	require.NoError(t, err)
+	require.Equal(t, "", head)
+	require.Empty(t, refs)
+}
+
+func TestParseAdvertisementInvalid(t *testing.T) {
+	_, _, err := parseAdvertisement(bytes.NewReader(pktLine("not a ref\n")))
+	require.Error(t, err)
+}
@@ -1,4 +1,25 @@
 package git
 
+import (
+	"fmt"
+	"net/http"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const gitalyUnavailableMessage = "The Git storage server is temporarily unavailable, please try again later"
+
 // For cosmetic purposes in Sentry
 type copyError struct{ error }
+
+// failGitaly responds with 503 Service Unavailable while the circuit
+// breaker of the Gitaly server is open, and with 500 otherwise.
+func failGitaly(w http.ResponseWriter, r *http.Request, err error, action string) {
+	if err == gitaly.ErrUnavailable {
+		helper.ServiceUnavailable(w, r, fmt.Errorf("%s: %v", action, err), gitalyUnavailableMessage)
+		return
+	}
+
+	helper.Fail500(w, r, fmt.Errorf("%s: %v", action, err))
+}
@@ -34,7 +34,7 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 
 	diffClient, err := gitaly.NewDiffClient(params.GitalyServer)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("diff.RawPatch: %v", err))
+		failGitaly(w, r, err, "diff.RawPatch")
 		return
 	}
 
@@ -0,0 +1,73 @@
+package git
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultGenerationTimeout is how long the generation of a cached file may
+// take unless SetGenerationTimeout is called
+const DefaultGenerationTimeout = 30 * time.Minute
+
+var generationTimeout = DefaultGenerationTimeout
+
+// SetGenerationTimeout sets how long the generation of a cached file may
+// take before it is canceled
+func SetGenerationTimeout(timeout time.Duration) {
+	generationTimeout = timeout
+}
+
+// generationContext returns the context of a generation. It doesn't end
+// with the request that triggered the generation but has a deadline, so
+// that a hung Gitaly call can't hold the generation forever.
+func generationContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), generationTimeout)
+}
+
+// generations lets concurrent requests for the same cached file wait for a
+// single generation.
+type generations struct {
+	sync.Mutex
+	inFlight map[string]*generation
+}
+
+type generation struct {
+	done chan struct{}
+	err  error
+}
+
+func newGenerations() *generations {
+	return &generations{inFlight: make(map[string]*generation)}
+}
+
+// wait runs generate for key, or waits for a concurrent call that is
+// already running it.
+func (g *generations) wait(ctx context.Context, key string, generate func() error) error {
+	g.Lock()
+	current := g.inFlight[key]
+	if current == nil {
+		current = &generation{done: make(chan struct{})}
+		g.inFlight[key] = current
+
+		go func() {
+			// Keep going when the client that triggered the generation
+			// disconnects: others may be waiting for the same file.
+			current.err = generate()
+
+			g.Lock()
+			delete(g.inFlight, key)
+			g.Unlock()
+
+			close(current.done)
+		}()
+	}
+	g.Unlock()
+
+	select {
+	case <-current.done:
+		return current.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,28 @@
+package git
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerationTimeout(t *testing.T) {
+	SetGenerationTimeout(10 * time.Millisecond)
+	defer SetGenerationTimeout(DefaultGenerationTimeout)
+
+	g := newGenerations()
+	err := g.wait(context.Background(), "key", func() error {
+		ctx, cancel := generationContext()
+		defer cancel()
+
+		// A hung call returns when the generation times out
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// The key can be generated again
+	require.NoError(t, g.wait(context.Background(), "key", func() error { return nil }))
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
@@ -61,6 +62,11 @@ func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *
 
 func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Handler {
 	return myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		if err := gitaly.CheckAvailable(a.GitalyServer); err != nil {
+			failGitaly(w, r, err, "repoPreAuthorizeHandler")
+			return
+		}
+
 		handleFunc(w, r, a)
 	}, "")
 }
@@ -16,13 +16,18 @@ func GetInfoRefsHandler(a *api.API) http.Handler {
 }
 
 func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+	rpc := getService(r)
+	if rpc == "" {
+		// The 'dumb' Git HTTP protocol
+		handleDumbHTTP(rw, r, a, "info/refs")
+		return
+	}
+
 	w := NewHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer w.Log(r, 0)
 
-	rpc := getService(r)
 	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
-		// The 'dumb' Git HTTP protocol is not supported
 		http.Error(w, "Not Found", 404)
 		return
 	}
@@ -50,6 +55,13 @@ func handleGetInfoRefsWithGitaly(ctx context.Context, w http.ResponseWriter, a *
 		return fmt.Errorf("GetInfoRefsHandler: %v", err)
 	}
 
+	if offerBundleURI(a, rpc, gitProtocol) {
+		infoRefsResponseReader, err = withBundleURICapability(infoRefsResponseReader)
+		if err != nil {
+			return fmt.Errorf("GetInfoRefsHandler: %v", err)
+		}
+	}
+
 	if _, err = io.Copy(w, infoRefsResponseReader); err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: copy Gitaly response: %v", err)
 	}
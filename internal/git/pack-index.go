@@ -0,0 +1,584 @@
+/*
+In this file we write version 2 pack index (.idx) files for packs served
+over the 'dumb' Git HTTP protocol
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+)
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var (
+	// Resolved delta bases are kept in memory up to this many bytes, the
+	// least recently used ones are dropped first
+	maxDeltaBaseCache = 64 * 1024 * 1024
+	// Objects and deltas larger than this are not resolved in memory,
+	// git index-pack indexes packs containing them instead
+	maxInMemoryObjectSize int64 = 16 * 1024 * 1024
+)
+
+var errObjectTooLarge = errors.New("object too large to resolve in memory")
+
+var objectTypeNames = map[int]string{
+	objCommit: "commit",
+	objTree:   "tree",
+	objBlob:   "blob",
+	objTag:    "tag",
+}
+
+type packEntry struct {
+	offset int64
+	crc32  uint32
+	oid    [sha1.Size]byte
+	// Delta entries are resolved after the whole pack has been read
+	resolved   bool
+	baseOffset int64
+	baseOid    [sha1.Size]byte
+}
+
+type packObject struct {
+	objectType int
+	data       []byte
+}
+
+// packReader reads a pack sequentially, keeping track of the offset, the
+// CRC32 of the current entry and the checksum of the whole pack. It
+// implements io.ByteReader so that zlib does not read past the end of an
+// entry.
+type packReader struct {
+	r        *bufio.Reader
+	offset   int64
+	crc      hash.Hash32
+	checksum hash.Hash
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.consume(b[:n])
+	return n, err
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.consume([]byte{c})
+	}
+	return c, err
+}
+
+func (p *packReader) consume(b []byte) {
+	p.offset += int64(len(b))
+	p.crc.Write(b)
+	p.checksum.Write(b)
+}
+
+// indexPack writes the version 2 index of the pack in f to w and returns
+// the pack checksum, which is also the name of the pack.
+func indexPack(ctx context.Context, f *os.File, w io.Writer) ([]byte, error) {
+	p := &packReader{r: bufio.NewReader(f), crc: crc32.NewIEEE(), checksum: sha1.New()}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(p, header); err != nil {
+		return nil, fmt.Errorf("read pack header: %v", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return nil, errors.New("not a pack file")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported pack version %d", version)
+	}
+
+	entries := make([]*packEntry, binary.BigEndian.Uint32(header[8:12]))
+	for i := range entries {
+		entry, err := readPackEntry(p)
+		if err != nil {
+			return nil, fmt.Errorf("read pack entry %d: %v", i, err)
+		}
+		entries[i] = entry
+	}
+
+	checksum := p.checksum.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(p.r, trailer); err != nil {
+		return nil, fmt.Errorf("read pack checksum: %v", err)
+	}
+	if !bytes.Equal(checksum, trailer) {
+		return nil, errors.New("pack checksum mismatch")
+	}
+
+	if err := resolveDeltas(f, entries); err == errObjectTooLarge {
+		return checksum, indexPackWithGit(ctx, f, w)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := writePackIndex(w, entries, checksum); err != nil {
+		return nil, err
+	}
+
+	return checksum, nil
+}
+
+// indexPackWithGit writes the index of the pack in f to w with git
+// index-pack, for packs with objects too large to resolve in memory
+func indexPackWithGit(ctx context.Context, f *os.File, w io.Writer) error {
+	dir, err := ioutil.TempDir(path.Dir(f.Name()), "index-pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	indexPath := path.Join(dir, "pack.idx")
+	cmd := exec.CommandContext(ctx, "git", "index-pack", "-o", indexPath, f.Name())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git index-pack: %v: %s", err, bytes.TrimSpace(output))
+	}
+
+	index, err := os.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	_, err = io.Copy(w, index)
+	return err
+}
+
+func readPackEntry(p *packReader) (*packEntry, error) {
+	p.crc.Reset()
+	entry := &packEntry{offset: p.offset}
+
+	objectType, size, err := readObjectHeader(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch objectType {
+	case objOfsDelta:
+		distance, err := readBaseDistance(p)
+		if err != nil {
+			return nil, err
+		}
+		if distance <= 0 || distance > entry.offset {
+			return nil, fmt.Errorf("invalid delta base distance %d", distance)
+		}
+		entry.baseOffset = entry.offset - distance
+	case objRefDelta:
+		if _, err := io.ReadFull(p, entry.baseOid[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	zr, err := zlib.NewReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if objectType == objOfsDelta || objectType == objRefDelta {
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return nil, err
+		}
+	} else {
+		name, ok := objectTypeNames[objectType]
+		if !ok {
+			return nil, fmt.Errorf("invalid object type %d", objectType)
+		}
+
+		h := sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", name, size)
+		n, err := io.Copy(h, zr)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, fmt.Errorf("object size mismatch: expected %d, got %d", size, n)
+		}
+
+		copy(entry.oid[:], h.Sum(nil))
+		entry.resolved = true
+	}
+
+	entry.crc32 = p.crc.Sum32()
+	return entry, nil
+}
+
+func readObjectHeader(r io.ByteReader) (objectType int, size int64, err error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	objectType = int(c>>4) & 7
+	size = int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return 0, 0, errors.New("object size overflow")
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	return objectType, size, nil
+}
+
+func readBaseDistance(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	distance := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if distance > math.MaxInt64>>7 {
+			return 0, errors.New("delta base distance overflow")
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		distance = ((distance + 1) << 7) | int64(c&0x7f)
+	}
+
+	return distance, nil
+}
+
+// deltaResolver inflates objects at random offsets of the pack and applies
+// their deltas.
+type deltaResolver struct {
+	f     *os.File
+	byOid map[[sha1.Size]byte]int64
+	cache *objectCache
+}
+
+func resolveDeltas(f *os.File, entries []*packEntry) error {
+	d := &deltaResolver{
+		f:     f,
+		byOid: make(map[[sha1.Size]byte]int64),
+		cache: newObjectCache(maxDeltaBaseCache),
+	}
+
+	for _, entry := range entries {
+		if entry.resolved {
+			d.byOid[entry.oid] = entry.offset
+		}
+	}
+
+	// Bases of ref deltas may be deltas themselves, so keep going until
+	// no more entries can be resolved.
+	for unresolved := len(entries); unresolved > 0; {
+		progress := false
+		unresolved = 0
+
+		for _, entry := range entries {
+			if entry.resolved {
+				continue
+			}
+
+			obj, err := d.object(entry.offset)
+			if err == errMissingBase {
+				unresolved++
+				continue
+			}
+			if err == errObjectTooLarge {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("resolve delta at offset %d: %v", entry.offset, err)
+			}
+
+			h := sha1.New()
+			fmt.Fprintf(h, "%s %d\x00", objectTypeNames[obj.objectType], len(obj.data))
+			h.Write(obj.data)
+			copy(entry.oid[:], h.Sum(nil))
+			entry.resolved = true
+			d.byOid[entry.oid] = entry.offset
+			progress = true
+		}
+
+		if unresolved > 0 && !progress {
+			return fmt.Errorf("%d deltas have a base outside the pack", unresolved)
+		}
+	}
+
+	return nil
+}
+
+var errMissingBase = errors.New("delta base not found")
+
+func (d *deltaResolver) object(offset int64) (*packObject, error) {
+	if obj := d.cache.get(offset); obj != nil {
+		return obj, nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(d.f, offset, math.MaxInt64-offset))
+	objectType, size, err := readObjectHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxInMemoryObjectSize {
+		return nil, errObjectTooLarge
+	}
+
+	var base *packObject
+	switch objectType {
+	case objOfsDelta:
+		distance, err := readBaseDistance(r)
+		if err != nil {
+			return nil, err
+		}
+		if base, err = d.object(offset - distance); err != nil {
+			return nil, err
+		}
+	case objRefDelta:
+		var oid [sha1.Size]byte
+		if _, err := io.ReadFull(r, oid[:]); err != nil {
+			return nil, err
+		}
+		baseOffset, ok := d.byOid[oid]
+		if !ok {
+			return nil, errMissingBase
+		}
+		if base, err = d.object(baseOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// Don't inflate more than the size of the object
+	data, err := ioutil.ReadAll(io.LimitReader(zr, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("object size mismatch: expected %d, got %d", size, len(data))
+	}
+
+	obj := &packObject{objectType: objectType, data: data}
+	if base != nil {
+		if obj.data, err = applyDelta(base.data, data); err != nil {
+			return nil, err
+		}
+		obj.objectType = base.objectType
+	}
+
+	d.cache.add(offset, obj)
+
+	return obj, nil
+}
+
+// objectCache keeps resolved objects up to a total size, dropping the least
+// recently used ones first
+type objectCache struct {
+	maxSize int
+	size    int
+	lru     *list.List
+	entries map[int64]*list.Element
+}
+
+type cachedObject struct {
+	offset int64
+	obj    *packObject
+}
+
+func newObjectCache(maxSize int) *objectCache {
+	return &objectCache{maxSize: maxSize, lru: list.New(), entries: make(map[int64]*list.Element)}
+}
+
+func (c *objectCache) get(offset int64) *packObject {
+	e, ok := c.entries[offset]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedObject).obj
+}
+
+func (c *objectCache) add(offset int64, obj *packObject) {
+	if _, ok := c.entries[offset]; ok || len(obj.data) > c.maxSize {
+		return
+	}
+
+	c.entries[offset] = c.lru.PushFront(&cachedObject{offset: offset, obj: obj})
+	c.size += len(obj.data)
+
+	for c.size > c.maxSize {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedObject)
+		delete(c.entries, oldest.offset)
+		c.size -= len(oldest.obj.data)
+	}
+}
+
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+
+	baseSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta base size mismatch: expected %d, got %d", baseSize, len(base))
+	}
+
+	resultSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if resultSize > uint64(maxInMemoryObjectSize) {
+		return nil, errObjectTooLarge
+	}
+
+	result := make([]byte, 0, resultSize)
+	for r.Len() > 0 {
+		cmd, _ := r.ReadByte()
+
+		switch {
+		case cmd&0x80 != 0:
+			// Copy from base
+			var offset, size uint64
+			for i := uint(0); i < 4; i++ {
+				if cmd&(1<<i) != 0 {
+					c, err := r.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					offset |= uint64(c) << (8 * i)
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if cmd&(0x10<<i) != 0 {
+					c, err := r.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					size |= uint64(c) << (8 * i)
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errors.New("delta copies beyond its base")
+			}
+			result = append(result, base[offset:offset+size]...)
+		case cmd != 0:
+			// Insert literal data
+			data := make([]byte, cmd)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			result = append(result, data...)
+		default:
+			return nil, errors.New("invalid delta instruction")
+		}
+	}
+
+	if uint64(len(result)) != resultSize {
+		return nil, fmt.Errorf("delta result size mismatch: expected %d, got %d", resultSize, len(result))
+	}
+
+	return result, nil
+}
+
+func readDeltaSize(r io.ByteReader) (uint64, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		if shift > 63 {
+			return 0, errors.New("delta size overflow")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		size |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return size, nil
+		}
+	}
+}
+
+func writePackIndex(w io.Writer, entries []*packEntry, packChecksum []byte) error {
+	sorted := make([]*packEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].oid[:], sorted[j].oid[:]) < 0
+	})
+
+	checksum := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	bw.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(bw, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, entry := range sorted {
+		fanout[entry.oid[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(bw, binary.BigEndian, fanout)
+
+	for _, entry := range sorted {
+		bw.Write(entry.oid[:])
+	}
+	for _, entry := range sorted {
+		binary.Write(bw, binary.BigEndian, entry.crc32)
+	}
+
+	// Offsets that do not fit in 31 bits go into a table of 64 bit offsets
+	var largeOffsets []uint64
+	for _, entry := range sorted {
+		if entry.offset < 0x80000000 {
+			binary.Write(bw, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+		binary.Write(bw, binary.BigEndian, uint32(0x80000000|len(largeOffsets)))
+		largeOffsets = append(largeOffsets, uint64(entry.offset))
+	}
+	for _, offset := range largeOffsets {
+		binary.Write(bw, binary.BigEndian, offset)
+	}
+
+	bw.Write(packChecksum)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(checksum.Sum(nil))
+	return err
+}
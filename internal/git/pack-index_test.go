@@ -0,0 +1,158 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPack(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		args          []string
+		maxObjectSize int64
+	}{
+		{desc: "ref deltas", args: nil},
+		{desc: "offset deltas", args: []string{"--delta-base-offset"}},
+		{desc: "objects too large to resolve in memory", args: []string{"--delta-base-offset"}, maxObjectSize: 100},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.maxObjectSize > 0 {
+				defer func(size int64) { maxInMemoryObjectSize = size }(maxInMemoryObjectSize)
+				maxInMemoryObjectSize = tc.maxObjectSize
+			}
+
+			dir, err := ioutil.TempDir("", "pack-index")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			packPath := path.Join(dir, "test.pack")
+			writeTestPack(t, packPath, tc.args...)
+
+			expectedIndexPath := path.Join(dir, "expected.idx")
+			indexPackCmd := exec.Command("git", "index-pack", "-o", expectedIndexPath, packPath)
+			expectedName, err := indexPackCmd.Output()
+			require.NoError(t, err)
+
+			pack, err := os.Open(packPath)
+			require.NoError(t, err)
+			defer pack.Close()
+
+			var index bytes.Buffer
+			checksum, err := indexPack(context.Background(), pack, &index)
+			require.NoError(t, err)
+
+			expectedIndex, err := ioutil.ReadFile(expectedIndexPath)
+			require.NoError(t, err)
+
+			require.Equal(t, string(bytes.TrimSpace(expectedName)), hex.EncodeToString(checksum))
+			require.Equal(t, expectedIndex, index.Bytes())
+		})
+	}
+}
+
+func TestObjectCache(t *testing.T) {
+	object := func(size int) *packObject {
+		return &packObject{objectType: objBlob, data: make([]byte, size)}
+	}
+
+	c := newObjectCache(100)
+	c.add(1, object(40))
+	c.add(2, object(40))
+	require.NotNil(t, c.get(1))
+
+	c.add(3, object(40))
+	require.NotNil(t, c.get(1), "recently used objects are kept")
+	require.Nil(t, c.get(2), "the least recently used object is dropped")
+	require.NotNil(t, c.get(3))
+	require.Equal(t, 80, c.size)
+
+	c.add(4, object(101))
+	require.Nil(t, c.get(4), "objects larger than the cache are not kept")
+	require.NotNil(t, c.get(1))
+}
+
+func TestIndexPackCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack-index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	packPath := path.Join(dir, "test.pack")
+	writeTestPack(t, packPath)
+
+	data, err := ioutil.ReadFile(packPath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(packPath, data, 0600))
+
+	pack, err := os.Open(packPath)
+	require.NoError(t, err)
+	defer pack.Close()
+
+	_, err = indexPack(context.Background(), pack, ioutil.Discard)
+	require.Error(t, err)
+}
+
+// writeTestPack writes a pack of a new repository with similar versions of
+// a file, so that the pack contains deltas.
+func writeTestPack(t *testing.T, packPath string, args ...string) {
+	repoPath := path.Join(path.Dir(packPath), "repo")
+	git := func(args ...string) *exec.Cmd {
+		return exec.Command("git", append([]string{"-C", repoPath, "-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	}
+
+	require.NoError(t, exec.Command("git", "init", "-q", repoPath).Run())
+
+	var content bytes.Buffer
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&content, "line %d\n", j*i)
+		}
+		require.NoError(t, ioutil.WriteFile(path.Join(repoPath, "file.txt"), content.Bytes(), 0644))
+		require.NoError(t, git("add", "file.txt").Run())
+		require.NoError(t, git("commit", "-q", "-m", fmt.Sprintf("commit %d", i)).Run())
+	}
+	require.NoError(t, git("tag", "-a", "-m", "tag", "v1").Run())
+
+	pack, err := os.Create(packPath)
+	require.NoError(t, err)
+	defer pack.Close()
+
+	packObjectsCmd := git(append([]string{"pack-objects", "--revs", "--all", "--stdout", "-q"}, args...)...)
+	packObjectsCmd.Stdout = pack
+	require.NoError(t, packObjectsCmd.Run())
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	delta := []byte{
+		// Base and result size
+		11, 13,
+		// Copy "world" from offset 6
+		0x91, 6, 5,
+		// Insert ", "
+		2, ',', ' ',
+		// Copy "hello" from offset 0
+		0x90, 5,
+		// Insert "!"
+		1, '!',
+	}
+
+	result, err := applyDelta(base, delta)
+	require.NoError(t, err)
+	require.Equal(t, "world, hello!", string(result))
+
+	_, err = applyDelta(base, []byte{11, 5, 0x91, 10, 5})
+	require.Error(t, err, "copy beyond the base")
+
+	_, err = applyDelta([]byte("short"), delta)
+	require.Error(t, err, "base size mismatch")
+}
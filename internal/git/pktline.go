@@ -28,8 +28,9 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 		return 0, nil, nil // want more data
 	}
 
-	if bytes.HasPrefix(data, []byte("0000")) {
-		// special case: "0000" terminator packet: return empty token
+	if bytes.HasPrefix(data, []byte("0000")) || bytes.HasPrefix(data, []byte("0001")) {
+		// special case: "0000" terminator packet and "0001" protocol v2
+		// delimiter packet: return empty token
 		return 4, data[:0], nil
 	}
 
@@ -43,7 +44,7 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// Cast is safe because we requested an int-size number from strconv.ParseInt
 	pktLength := int(pktLength64)
 
-	if pktLength < 0 {
+	if pktLength < 4 {
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
@@ -57,3 +58,7 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// return "pkt" token without length prefix
 	return pktLength, data[4:pktLength], nil
 }
+
+func pktLine(line string) []byte {
+	return []byte(fmt.Sprintf("%04x%s", len(line)+4, line))
+}
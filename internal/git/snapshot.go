@@ -41,7 +41,7 @@ func (s *snapshot) Inject(w http.ResponseWriter, r *http.Request, sendData strin
 
 	c, err := gitaly.NewRepositoryClient(params.GitalyServer)
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendSnapshot: gitaly.NewRepositoryClient: %v", err))
+		failGitaly(w, r, err, "SendSnapshot: gitaly.NewRepositoryClient")
 		return
 	}
 
@@ -29,6 +29,19 @@ func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) e
 
 	gitProtocol := r.Header.Get("Git-Protocol")
 
+	if offerBundleURI(a, action, gitProtocol) {
+		isBundleURI, err := isBundleURICommand(buffer)
+		if err != nil {
+			return fmt.Errorf("isBundleURICommand: %v", err)
+		}
+
+		// Gitaly does not know about the bundles, so we answer
+		// this command ourselves
+		if isBundleURI {
+			return writeBundleURIList(w, a.GitBundleURI)
+		}
+	}
+
 	return handleUploadPackWithGitaly(r.Context(), a, buffer, w, gitProtocol)
 }
 
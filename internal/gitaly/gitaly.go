@@ -1,8 +1,10 @@
 package gitaly
 
 import (
+	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
@@ -13,6 +15,8 @@ import (
 	gitalyclient "gitlab.com/gitlab-org/gitaly/client"
 	"google.golang.org/grpc"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+
 	grpccorrelation "gitlab.com/gitlab-org/labkit/correlation/grpc"
 	grpctracing "gitlab.com/gitlab-org/labkit/tracing/grpc"
 )
@@ -22,18 +26,98 @@ type Server struct {
 	Token   string `json:"token"`
 }
 
+// connectionKey identifies a cached connection. Connections to the same
+// server dialed with different TLS settings are kept apart.
+type connectionKey struct {
+	Server
+	tlsIdentity string
+}
+
+type connection struct {
+	*grpc.ClientConn
+	done chan struct{}
+	rpcs rpcTracker
+}
+
+func (c *connection) close() {
+	close(c.done)
+	c.ClientConn.Close()
+}
+
+// closeWhenIdle closes an evicted connection once its in-flight RPCs are
+// finished, or after timeout for RPCs that are never read to the end.
+func (c *connection) closeWhenIdle(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.rpcs.idle():
+	case <-timer.C:
+	}
+
+	c.ClientConn.Close()
+}
+
 type connectionsCache struct {
 	sync.RWMutex
-	connections map[Server]*grpc.ClientConn
+	connections map[connectionKey]*connection
+}
+
+type gitalySettings struct {
+	sync.RWMutex
+	certs  *certReloader
+	health healthSettings
 }
 
 var (
 	jsonUnMarshaler = jsonpb.Unmarshaler{AllowUnknownFields: true}
 	cache           = connectionsCache{
-		connections: make(map[Server]*grpc.ClientConn),
+		connections: make(map[connectionKey]*connection),
 	}
+	settings = gitalySettings{health: defaultHealthSettings}
 )
 
+// Configure sets up TLS, health checks and circuit breaking for Gitaly
+// connections. Passing a nil config, or one without a TLS section, makes
+// workhorse fall back to the system certificate pool without a client
+// certificate for tls:// addresses.
+func Configure(cfg *config.GitalyConfig) error {
+	var certs *certReloader
+	health := defaultHealthSettings
+
+	if cfg != nil {
+		var err error
+		if cfg.TLS != nil {
+			if certs, err = newCertReloader(*cfg.TLS); err != nil {
+				return fmt.Errorf("gitaly.Configure: %v", err)
+			}
+		}
+
+		if health, err = newHealthSettings(cfg); err != nil {
+			return fmt.Errorf("gitaly.Configure: %v", err)
+		}
+	}
+
+	settings.Lock()
+	defer settings.Unlock()
+	settings.certs = certs
+	settings.health = health
+
+	return nil
+}
+
+func currentCertReloader() *certReloader {
+	settings.RLock()
+	defer settings.RUnlock()
+	return settings.certs
+}
+
+func currentHealthSettings() healthSettings {
+	settings.RLock()
+	defer settings.RUnlock()
+	return settings.health
+}
+
 func NewSmartHTTPClient(server Server) (*SmartHTTPClient, error) {
 	conn, err := getOrCreateConnection(server)
 	if err != nil {
@@ -81,60 +165,109 @@ func NewDiffClient(server Server) (*DiffClient, error) {
 }
 
 func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
+	if err := CheckAvailable(server); err != nil {
+		return nil, err
+	}
+
+	key := connectionKey{Server: server}
+
+	certs := currentCertReloader()
+	if certs != nil && isTLSAddress(server.Address) {
+		key.tlsIdentity = certs.identity()
+	} else {
+		certs = nil
+	}
+
 	cache.RLock()
-	conn := cache.connections[server]
+	conn := cache.connections[key]
 	cache.RUnlock()
 
 	if conn != nil {
-		return conn, nil
+		return conn.ClientConn, nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
-	if conn := cache.connections[server]; conn != nil {
-		return conn, nil
+	if conn := cache.connections[key]; conn != nil {
+		return conn.ClientConn, nil
 	}
 
-	conn, err := newConnection(server)
+	conn = &connection{done: make(chan struct{})}
+	breaker := breakerFor(server.Address)
+	clientConn, err := newConnection(server, certs, breaker, &conn.rpcs)
 	if err != nil {
 		return nil, err
 	}
 
-	cache.connections[server] = conn
+	conn.ClientConn = clientConn
+	if health := currentHealthSettings(); health.interval > 0 {
+		go conn.healthCheckLoop(breaker, health.interval, health.timeout)
+	}
 
-	return conn, nil
+	cache.connections[key] = conn
+
+	return clientConn, nil
 }
 
 func CloseConnections() {
 	cache.Lock()
 	defer cache.Unlock()
 
-	for _, conn := range cache.connections {
-		conn.Close()
+	for key, conn := range cache.connections {
+		delete(cache.connections, key)
+		conn.close()
+	}
+}
+
+// evictConnections removes all cached connections to address so that the
+// next request dials a fresh one. The connections are closed in the
+// background once the RPCs that are still using them are finished.
+func evictConnections(address string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	for key, conn := range cache.connections {
+		if key.Address != address {
+			continue
+		}
+
+		delete(cache.connections, key)
+		close(conn.done)
+		go conn.closeWhenIdle(evictedConnectionTimeout)
+		evictedConnections.WithLabelValues(address).Inc()
 	}
 }
 
-func newConnection(server Server) (*grpc.ClientConn, error) {
+func newConnection(server Server, certs *certReloader, breaker *circuitBreaker, rpcs *rpcTracker) (*grpc.ClientConn, error) {
 	connOpts := append(gitalyclient.DefaultDialOpts,
 		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
 		grpc.WithStreamInterceptor(
 			grpc_middleware.ChainStreamClient(
+				retryBudgetFor(server.Address).streamInterceptor,
+				rpcs.streamInterceptor,
 				grpctracing.StreamClientTracingInterceptor(),
 				grpc_prometheus.StreamClientInterceptor,
+				breaker.streamInterceptor,
 				grpccorrelation.StreamClientCorrelationInterceptor(),
 			),
 		),
 
 		grpc.WithUnaryInterceptor(
 			grpc_middleware.ChainUnaryClient(
+				rpcs.unaryInterceptor,
 				grpctracing.UnaryClientTracingInterceptor(),
 				grpc_prometheus.UnaryClientInterceptor,
+				breaker.unaryInterceptor,
 				grpccorrelation.UnaryClientCorrelationInterceptor(),
 			),
 		),
 	)
 
+	if certs != nil {
+		return dialTLS(server.Address, certs, connOpts)
+	}
+
 	return gitalyclient.Dial(server.Address, connOpts)
 }
 
@@ -0,0 +1,404 @@
+package gitaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// ErrUnavailable is returned instead of a client while the circuit breaker
+// of a Gitaly server is open.
+var ErrUnavailable = errors.New("gitaly server unavailable: circuit breaker open")
+
+type healthSettings struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	cooldown  time.Duration
+}
+
+var (
+	defaultHealthSettings = healthSettings{
+		interval:  10 * time.Second,
+		timeout:   5 * time.Second,
+		threshold: 5,
+		cooldown:  10 * time.Second,
+	}
+
+	// evictedConnectionTimeout bounds how long an evicted connection is
+	// kept open for RPCs that are still using it
+	evictedConnectionTimeout = 5 * time.Minute
+
+	breakers = struct {
+		sync.Mutex
+		byAddress map[string]*circuitBreaker
+	}{byAddress: make(map[string]*circuitBreaker)}
+
+	healthChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_health_checks",
+			Help: "How many health checks were sent to each Gitaly server, by result",
+		},
+		[]string{"address", "status"},
+	)
+	circuitBreakerOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_gitaly_circuit_breaker_open",
+			Help: "Whether requests to a Gitaly server are currently rejected by the circuit breaker",
+		},
+		[]string{"address"},
+	)
+	circuitBreakerRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_circuit_breaker_rejections",
+			Help: "How many requests were failed fast because the circuit breaker of a Gitaly server was open",
+		},
+		[]string{"address"},
+	)
+	evictedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_evicted_connections",
+			Help: "How many broken connections to a Gitaly server were removed from the connection cache",
+		},
+		[]string{"address"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(healthChecks)
+	prometheus.MustRegister(circuitBreakerOpen)
+	prometheus.MustRegister(circuitBreakerRejections)
+	prometheus.MustRegister(evictedConnections)
+}
+
+// CheckAvailable returns ErrUnavailable while the circuit breaker of server
+// is open.
+func CheckAvailable(server Server) error {
+	if !breakerFor(server.Address).allow() {
+		circuitBreakerRejections.WithLabelValues(server.Address).Inc()
+		return ErrUnavailable
+	}
+
+	return nil
+}
+
+func newHealthSettings(cfg *config.GitalyConfig) (healthSettings, error) {
+	s := defaultHealthSettings
+
+	if cfg.HealthCheckInterval != nil {
+		s.interval = cfg.HealthCheckInterval.Duration
+	}
+	if cfg.HealthCheckTimeout != nil {
+		s.timeout = cfg.HealthCheckTimeout.Duration
+	}
+	if cfg.CircuitBreakerThreshold != nil {
+		s.threshold = *cfg.CircuitBreakerThreshold
+	}
+	if cfg.CircuitBreakerCooldown != nil {
+		s.cooldown = cfg.CircuitBreakerCooldown.Duration
+	}
+
+	if s.interval > 0 && s.timeout <= 0 {
+		return s, errors.New("HealthCheckTimeout must be positive")
+	}
+	if s.threshold < 0 {
+		return s, errors.New("CircuitBreakerThreshold must not be negative")
+	}
+
+	return s, nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the health of a single Gitaly address. It opens
+// after a number of consecutive failed health checks or Unavailable RPCs,
+// rejects all requests during the cooldown and then lets requests through
+// again until the next success closes it or the next failure reopens it.
+type circuitBreaker struct {
+	address string
+
+	sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func breakerFor(address string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b := breakers.byAddress[address]
+	if b == nil {
+		b = &circuitBreaker{address: address}
+		breakers.byAddress[address] = b
+		circuitBreakerOpen.WithLabelValues(address).Set(0)
+	}
+
+	return b
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == circuitOpen && time.Since(b.openedAt) >= currentHealthSettings().cooldown {
+		b.setState(circuitHalfOpen)
+	}
+
+	return b.state != circuitOpen
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	if b.state != circuitClosed {
+		log.NoContext().WithField("address", b.address).Info("gitaly: server recovered, closing circuit breaker")
+		b.setState(circuitClosed)
+	}
+}
+
+// recordFailure returns true if this failure opened the circuit.
+func (b *circuitBreaker) recordFailure() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	threshold := currentHealthSettings().threshold
+	if threshold == 0 || b.state == circuitOpen {
+		return false
+	}
+
+	b.failures++
+	if b.state == circuitClosed && b.failures < threshold {
+		return false
+	}
+
+	log.NoContext().WithField("address", b.address).WithField("failures", b.failures).Error("gitaly: server unavailable, opening circuit breaker")
+
+	b.openedAt = time.Now()
+	b.setState(circuitOpen)
+
+	return true
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+
+	open := 0.0
+	if state == circuitOpen {
+		open = 1
+	}
+	circuitBreakerOpen.WithLabelValues(b.address).Set(open)
+}
+
+// observe feeds the outcome of an RPC into the circuit breaker. Only
+// Unavailable counts as a failure; any other status means the server
+// answered. Cancellations and deadlines say nothing about the server.
+func (b *circuitBreaker) observe(err error) {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		if b.recordFailure() {
+			evictConnections(b.address)
+		}
+	case codes.Canceled, codes.DeadlineExceeded:
+	default:
+		b.recordSuccess()
+	}
+}
+
+func (b *circuitBreaker) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if method != healthCheckMethod {
+		b.observe(err)
+	}
+	return err
+}
+
+func (b *circuitBreaker) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		b.observe(err)
+		return nil, err
+	}
+
+	return &observedStream{ClientStream: stream, breaker: b}, nil
+}
+
+// observedStream reports the first response, and any Unavailable error
+// after it, to the circuit breaker.
+type observedStream struct {
+	grpc.ClientStream
+	breaker  *circuitBreaker
+	observed bool
+}
+
+func (s *observedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+
+	if !s.observed || status.Code(err) == codes.Unavailable {
+		s.observed = true
+		if err == io.EOF {
+			s.breaker.observe(nil)
+		} else {
+			s.breaker.observe(err)
+		}
+	}
+
+	return err
+}
+
+// healthCheckLoop runs the gRPC health check against the server of conn
+// until the connection is closed.
+func (c *connection) healthCheckLoop(breaker *circuitBreaker, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := checkHealth(c.ClientConn, timeout)
+
+		select {
+		case <-c.done:
+			// Closing the connection makes the check fail
+			return
+		default:
+		}
+
+		if err != nil {
+			healthChecks.WithLabelValues(breaker.address, "unhealthy").Inc()
+			log.NoContext().WithError(err).WithField("address", breaker.address).Warning("gitaly: health check failed")
+
+			if breaker.recordFailure() {
+				evictConnections(breaker.address)
+			}
+			continue
+		}
+
+		healthChecks.WithLabelValues(breaker.address, "healthy").Inc()
+		breaker.recordSuccess()
+	}
+}
+
+func checkHealth(conn *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		// The server answered, it just does not offer health checks
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %v", response.Status)
+	}
+
+	return nil
+}
+
+// rpcTracker counts the RPCs in flight on a connection so that an evicted
+// connection is not closed under them.
+type rpcTracker struct {
+	sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+func (t *rpcTracker) start() {
+	t.Lock()
+	defer t.Unlock()
+	t.active++
+}
+
+func (t *rpcTracker) finish() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.active--
+	if t.active > 0 {
+		return
+	}
+
+	for _, w := range t.waiters {
+		close(w)
+	}
+	t.waiters = nil
+}
+
+// idle returns a channel that is closed once no RPCs are in flight.
+func (t *rpcTracker) idle() <-chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+
+	ch := make(chan struct{})
+	if t.active == 0 {
+		close(ch)
+	} else {
+		t.waiters = append(t.waiters, ch)
+	}
+	return ch
+}
+
+func (t *rpcTracker) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	t.start()
+	defer t.finish()
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (t *rpcTracker) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	t.start()
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		t.finish()
+		return nil, err
+	}
+
+	return &trackedStream{ClientStream: stream, tracker: t}, nil
+}
+
+// trackedStream counts as in flight until a receive fails, which includes
+// reaching the end of the stream.
+type trackedStream struct {
+	grpc.ClientStream
+	tracker  *rpcTracker
+	finished sync.Once
+}
+
+func (s *trackedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.finished.Do(s.tracker.finish)
+	}
+	return err
+}
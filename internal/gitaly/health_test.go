@@ -0,0 +1,252 @@
+package gitaly
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly-proto/go/gitalypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+type fakeHealthServer struct {
+	sync.Mutex
+	status healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (s *fakeHealthServer) setStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	s.Lock()
+	defer s.Unlock()
+	s.status = status
+}
+
+func (s *fakeHealthServer) Check(context.Context, *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	return &healthpb.HealthCheckResponse{Status: s.status}, nil
+}
+
+func (s *fakeHealthServer) Watch(*healthpb.HealthCheckRequest, healthpb.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "not implemented")
+}
+
+func startHealthCheckedGitalyServer(t *testing.T) (*grpc.Server, *fakeHealthServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	health := &fakeHealthServer{status: healthpb.HealthCheckResponse_SERVING}
+	server := grpc.NewServer()
+	gitalypb.RegisterSmartHTTPServiceServer(server, testhelper.NewGitalyServer(codes.OK))
+	healthpb.RegisterHealthServer(server, health)
+	go server.Serve(listener)
+
+	return server, health, "tcp://" + listener.Addr().String()
+}
+
+func configureHealthChecks(t *testing.T, threshold int, cooldown time.Duration) {
+	require.NoError(t, Configure(&config.GitalyConfig{
+		HealthCheckInterval:     &config.TomlDuration{Duration: 10 * time.Millisecond},
+		HealthCheckTimeout:      &config.TomlDuration{Duration: time.Second},
+		CircuitBreakerThreshold: &threshold,
+		CircuitBreakerCooldown:  &config.TomlDuration{Duration: cooldown},
+	}))
+}
+
+func waitForAvailability(t *testing.T, server Server, available bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if (CheckAvailable(server) == nil) == available {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("server %q did not become available=%v", server.Address, available)
+}
+
+func cachedConnections(address string) int {
+	cache.RLock()
+	defer cache.RUnlock()
+
+	n := 0
+	for key := range cache.connections {
+		if key.Address == address {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUnhealthyServerOpensCircuit(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 2, 200*time.Millisecond)
+
+	grpcServer, health, address := startHealthCheckedGitalyServer(t)
+	defer grpcServer.Stop()
+	server := Server{Address: address}
+
+	_, err := infoRefs(server)
+	require.NoError(t, err)
+	require.Equal(t, 1, cachedConnections(address))
+
+	health.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	waitForAvailability(t, server, false)
+
+	_, err = NewSmartHTTPClient(server)
+	require.Equal(t, ErrUnavailable, err)
+	require.Equal(t, 0, cachedConnections(address), "broken connection should be evicted")
+
+	health.setStatus(healthpb.HealthCheckResponse_SERVING)
+	waitForAvailability(t, server, true)
+
+	data, err := infoRefs(server)
+	require.NoError(t, err)
+	require.Contains(t, data, testhelper.GitalyInfoRefsResponseMock)
+
+	b := breakerFor(address)
+	b.Lock()
+	defer b.Unlock()
+	require.Equal(t, circuitClosed, b.state)
+}
+
+func TestEvictedConnectionIsClosedWhenIdle(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 2, time.Hour)
+
+	grpcServer, _, address := startHealthCheckedGitalyServer(t)
+	defer grpcServer.Stop()
+	server := Server{Address: address}
+
+	conn, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+	client, err := NewSmartHTTPClient(server)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	repo := &gitalypb.Repository{StorageName: "default", RelativePath: "foo/bar.git"}
+	reader, err := client.InfoRefsResponseReader(ctx, repo, "git-upload-pack", nil, "")
+	require.NoError(t, err)
+
+	evictConnections(address)
+	require.Equal(t, 0, cachedConnections(address))
+
+	time.Sleep(50 * time.Millisecond)
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState(), "connection with an RPC in flight should stay open")
+
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Contains(t, string(data), testhelper.GitalyInfoRefsResponseMock)
+
+	waitForState(t, conn, connectivity.Shutdown)
+}
+
+func TestEvictedConnectionIsClosedAfterTimeout(t *testing.T) {
+	defer Configure(nil)
+	defer func(timeout time.Duration) { evictedConnectionTimeout = timeout }(evictedConnectionTimeout)
+	evictedConnectionTimeout = 100 * time.Millisecond
+	configureHealthChecks(t, 2, time.Hour)
+
+	grpcServer, _, address := startHealthCheckedGitalyServer(t)
+	defer grpcServer.Stop()
+	server := Server{Address: address}
+
+	conn, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+	client, err := NewSmartHTTPClient(server)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The stream is never read, so it stays in flight
+	repo := &gitalypb.Repository{StorageName: "default", RelativePath: "foo/bar.git"}
+	_, err = client.InfoRefsResponseReader(ctx, repo, "git-upload-pack", nil, "")
+	require.NoError(t, err)
+
+	evictConnections(address)
+	waitForState(t, conn, connectivity.Shutdown)
+}
+
+func waitForState(t *testing.T, conn *grpc.ClientConn, state connectivity.State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn.GetState() == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("connection did not reach state %v", state)
+}
+
+func TestUnavailableRPCsOpenCircuit(t *testing.T) {
+	defer Configure(nil)
+	threshold := 3
+	require.NoError(t, Configure(&config.GitalyConfig{
+		HealthCheckInterval:     &config.TomlDuration{},
+		CircuitBreakerThreshold: &threshold,
+		CircuitBreakerCooldown:  &config.TomlDuration{Duration: time.Hour},
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := Server{Address: "tcp://" + listener.Addr().String()}
+	// Nothing listens on this address any more
+	require.NoError(t, listener.Close())
+
+	// InfoRefs is retried, so a single request makes three attempts
+	_, err = infoRefs(server)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = infoRefs(server)
+	require.Equal(t, ErrUnavailable, err)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 2, 50*time.Millisecond)
+
+	b := &circuitBreaker{address: "test"}
+	require.True(t, b.allow())
+
+	require.False(t, b.recordFailure())
+	b.recordSuccess()
+	require.False(t, b.recordFailure(), "a success resets the failure count")
+	require.True(t, b.recordFailure())
+	require.False(t, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, b.allow(), "allow a request after the cooldown")
+	require.True(t, b.recordFailure(), "one failure reopens a half-open circuit")
+	require.False(t, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, b.allow())
+	b.recordSuccess()
+	require.True(t, b.allow())
+	require.Equal(t, circuitClosed, b.state)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 0, time.Hour)
+
+	b := &circuitBreaker{address: "test"}
+	for i := 0; i < 10; i++ {
+		require.False(t, b.recordFailure())
+	}
+	require.True(t, b.allow())
+}
@@ -0,0 +1,228 @@
+package gitaly
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	// maxRetryAttempts includes the first attempt
+	maxRetryAttempts = 3
+
+	// Every call earns retryBudgetRatio retries, up to retryBudgetMax
+	// saved up retries per Gitaly address. This keeps retries from
+	// multiplying the load on a server that is failing for real.
+	retryBudgetRatio = 0.2
+	retryBudgetMax   = 10
+)
+
+var (
+	// idempotentMethods are read-only server streaming RPCs that can be
+	// sent again as long as no response message has been received.
+	idempotentMethods = map[string]bool{
+		"/gitaly.BlobService/GetBlob":                  true,
+		"/gitaly.DiffService/RawDiff":                  true,
+		"/gitaly.RepositoryService/GetArchive":         true,
+		"/gitaly.RepositoryService/CreateBundle":       true,
+		"/gitaly.SmartHTTPService/InfoRefsUploadPack":  true,
+		"/gitaly.SmartHTTPService/InfoRefsReceivePack": true,
+	}
+
+	retryBackoff = backoff.Backoff{
+		Min:    50 * time.Millisecond,
+		Max:    time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	retryBudgets = struct {
+		sync.Mutex
+		byAddress map[string]*retryBudget
+	}{byAddress: make(map[string]*retryBudget)}
+)
+
+type retryBudget struct {
+	address string
+
+	sync.Mutex
+	tokens float64
+}
+
+func retryBudgetFor(address string) *retryBudget {
+	retryBudgets.Lock()
+	defer retryBudgets.Unlock()
+
+	b := retryBudgets.byAddress[address]
+	if b == nil {
+		b = &retryBudget{address: address, tokens: retryBudgetMax}
+		retryBudgets.byAddress[address] = b
+	}
+
+	return b
+}
+
+func (b *retryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens += retryBudgetRatio
+	if b.tokens > retryBudgetMax {
+		b.tokens = retryBudgetMax
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// streamInterceptor retries idempotent RPCs that fail with Unavailable
+// before the first response message. It must be the first interceptor in
+// the chain: the chained streamer can only be called again after it
+// returned by the outermost interceptor. Every attempt then goes through
+// grpc_prometheus and shows up in the client metrics.
+func (b *retryBudget) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if !idempotentMethods[method] || desc.ClientStreams {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	b.deposit()
+
+	s := &retryingStream{
+		ctx:    ctx,
+		budget: b,
+		method: method,
+		newStream: func() (grpc.ClientStream, error) {
+			return streamer(ctx, desc, cc, method, opts...)
+		},
+	}
+
+	stream, err := s.newStream()
+	for err != nil && s.shouldRetry(err) {
+		stream, err = s.newStream()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.ClientStream = stream
+	return s, nil
+}
+
+// retryingStream keeps the request of a server streaming RPC so that it can
+// be sent again on a new stream.
+type retryingStream struct {
+	grpc.ClientStream
+
+	ctx       context.Context
+	budget    *retryBudget
+	method    string
+	newStream func() (grpc.ClientStream, error)
+
+	attempt  int
+	request  interface{}
+	sendDone bool
+	received bool
+}
+
+func (s *retryingStream) SendMsg(m interface{}) error {
+	s.request = m
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *retryingStream) CloseSend() error {
+	s.sendDone = true
+	return s.ClientStream.CloseSend()
+}
+
+func (s *retryingStream) RecvMsg(m interface{}) error {
+	for {
+		err := s.ClientStream.RecvMsg(m)
+		if err == nil {
+			s.received = true
+			return nil
+		}
+
+		if s.received || !s.shouldRetry(err) {
+			return err
+		}
+
+		if err := s.restart(); err != nil {
+			return err
+		}
+	}
+}
+
+// restart opens a new stream and replays the request on it.
+func (s *retryingStream) restart() error {
+	for {
+		stream, err := s.newStream()
+		if err == nil {
+			s.ClientStream = stream
+			break
+		}
+
+		if !s.shouldRetry(err) {
+			return err
+		}
+	}
+
+	if s.request != nil {
+		if err := s.ClientStream.SendMsg(s.request); err != nil {
+			return err
+		}
+	}
+
+	if s.sendDone {
+		return s.ClientStream.CloseSend()
+	}
+
+	return nil
+}
+
+// shouldRetry waits for the next attempt and returns true if err is
+// transient and both the attempts and the retry budget allow another one.
+func (s *retryingStream) shouldRetry(err error) bool {
+	s.attempt++
+
+	if status.Code(err) != codes.Unavailable || s.attempt >= maxRetryAttempts {
+		return false
+	}
+
+	if !s.budget.withdraw() {
+		log.WithContext(s.ctx).WithField("method", s.method).Warning("gitaly: retry budget exhausted")
+		return false
+	}
+
+	delay := time.NewTimer(retryBackoff.ForAttempt(float64(s.attempt - 1)))
+	defer delay.Stop()
+
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-delay.C:
+	}
+
+	if !breakerFor(s.budget.address).allow() {
+		// The connection is being evicted, give up with the last error
+		return false
+	}
+
+	log.WithContext(s.ctx).WithError(err).WithField("method", s.method).WithField("attempt", s.attempt+1).Info("gitaly: retrying RPC")
+	return true
+}
@@ -0,0 +1,123 @@
+package gitaly
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly-proto/go/gitalypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+// flakyGitalyServer fails the first InfoRefsUploadPack calls with
+// Unavailable.
+type flakyGitalyServer struct {
+	*testhelper.GitalyTestServer
+
+	failures          int
+	failAfterResponse bool
+
+	sync.Mutex
+	calls int
+}
+
+func (s *flakyGitalyServer) InfoRefsUploadPack(in *gitalypb.InfoRefsRequest, stream gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+	s.Lock()
+	s.calls++
+	fail := s.calls <= s.failures
+	s.Unlock()
+
+	if !fail {
+		return s.GitalyTestServer.InfoRefsUploadPack(in, stream)
+	}
+
+	if s.failAfterResponse {
+		if err := stream.Send(&gitalypb.InfoRefsResponse{Data: []byte("partial")}); err != nil {
+			return err
+		}
+	}
+
+	return status.Error(codes.Unavailable, "failing over")
+}
+
+func (s *flakyGitalyServer) callCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+func startFlakyGitalyServer(t *testing.T, flaky *flakyGitalyServer) (*grpc.Server, Server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	flaky.GitalyTestServer = testhelper.NewGitalyServer(codes.OK)
+	server := grpc.NewServer()
+	gitalypb.RegisterSmartHTTPServiceServer(server, flaky)
+	go server.Serve(listener)
+
+	return server, Server{Address: "tcp://" + listener.Addr().String()}
+}
+
+func TestRetryIdempotentRPC(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 0, time.Hour)
+
+	flaky := &flakyGitalyServer{failures: 2}
+	grpcServer, server := startFlakyGitalyServer(t, flaky)
+	defer grpcServer.Stop()
+
+	data, err := infoRefs(server)
+	require.NoError(t, err)
+	require.Contains(t, data, testhelper.GitalyInfoRefsResponseMock)
+	require.Equal(t, 3, flaky.callCount())
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 0, time.Hour)
+
+	flaky := &flakyGitalyServer{failures: 10}
+	grpcServer, server := startFlakyGitalyServer(t, flaky)
+	defer grpcServer.Stop()
+
+	_, err := infoRefs(server)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, maxRetryAttempts, flaky.callCount())
+}
+
+func TestNoRetryAfterFirstResponse(t *testing.T) {
+	defer Configure(nil)
+	configureHealthChecks(t, 0, time.Hour)
+
+	flaky := &flakyGitalyServer{failures: 1, failAfterResponse: true}
+	grpcServer, server := startFlakyGitalyServer(t, flaky)
+	defer grpcServer.Stop()
+
+	data, err := infoRefs(server)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, "partial", data)
+	require.Equal(t, 1, flaky.callCount())
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{tokens: 1}
+
+	require.True(t, b.withdraw())
+	require.False(t, b.withdraw(), "budget should be spent")
+
+	for i := 0; i < 5; i++ {
+		b.deposit()
+	}
+	require.True(t, b.withdraw(), "five calls earn one retry")
+
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+	}
+	require.Equal(t, float64(retryBudgetMax), b.tokens)
+}
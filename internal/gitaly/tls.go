@@ -0,0 +1,231 @@
+package gitaly
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const tlsScheme = "tls"
+
+func isTLSAddress(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && u.Scheme == tlsScheme
+}
+
+// certReloader keeps the CA bundle and the client key pair used for Gitaly
+// TLS connections. Files are checked for modifications on every handshake,
+// so rotated certificates are picked up without restarting workhorse and
+// without dropping cached connections.
+type certReloader struct {
+	cfg config.GitalyTLSConfig
+
+	sync.Mutex
+	caModTime   time.Time
+	certModTime time.Time
+	keyModTime  time.Time
+	rootCAs     *x509.CertPool
+	cert        *tls.Certificate
+}
+
+func newCertReloader(cfg config.GitalyTLSConfig) (*certReloader, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("TLS CertFile and KeyFile must be set together")
+	}
+
+	r := &certReloader{cfg: cfg}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// identity distinguishes connections dialed with different TLS settings in
+// the connections cache.
+func (r *certReloader) identity() string {
+	return fmt.Sprintf("ca=%s cert=%s key=%s servername=%s", r.cfg.CAFile, r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ServerName)
+}
+
+// reload reads the CA bundle and the client key pair again if any of the
+// files changed since they were last loaded. When reading fails the
+// previously loaded material stays in use.
+func (r *certReloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.cfg.CAFile == "" {
+		if r.rootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				return fmt.Errorf("load system cert pool: %v", err)
+			}
+			r.rootCAs = pool
+		}
+	} else if modTime, err := modificationTime(r.cfg.CAFile); err != nil {
+		return err
+	} else if r.rootCAs == nil || !modTime.Equal(r.caModTime) {
+		pool, err := loadCertPool(r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		r.rootCAs = pool
+		r.caModTime = modTime
+	}
+
+	if r.cfg.CertFile == "" {
+		return nil
+	}
+
+	certModTime, err := modificationTime(r.cfg.CertFile)
+	if err != nil {
+		return err
+	}
+	keyModTime, err := modificationTime(r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if r.cert != nil && certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load client key pair: %v", err)
+	}
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+
+	return nil
+}
+
+func (r *certReloader) reloadAndLog() {
+	if err := r.reload(); err != nil {
+		log.NoContext().WithError(err).Error("gitaly: reload TLS certificates, keeping the previous ones")
+	}
+}
+
+func (r *certReloader) currentRootCAs() *x509.CertPool {
+	r.Lock()
+	defer r.Unlock()
+	return r.rootCAs
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.reloadAndLog()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.cert == nil {
+		// An empty certificate tells crypto/tls not to send one
+		return &tls.Certificate{}, nil
+	}
+
+	return r.cert, nil
+}
+
+// verifyPeerCertificate replaces the standard crypto/tls verification so
+// that a reloaded CA bundle applies to handshakes of cached connections.
+func (r *certReloader) verifyPeerCertificate(serverName string, rawCerts [][]byte) error {
+	r.reloadAndLog()
+
+	if len(rawCerts) == 0 {
+		return errors.New("gitaly TLS: server did not present a certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("gitaly TLS: parse server certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         r.currentRootCAs(),
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("gitaly TLS: %v", err)
+	}
+
+	return nil
+}
+
+func (r *certReloader) clientTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// The chain is verified in VerifyPeerCertificate against the
+		// current, possibly reloaded, CA bundle.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return r.verifyPeerCertificate(serverName, rawCerts)
+		},
+		GetClientCertificate: r.getClientCertificate,
+	}
+}
+
+func dialTLS(address string, certs *certReloader, connOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid gitaly TLS address: %q", address)
+	}
+
+	serverName := certs.cfg.ServerName
+	if serverName == "" {
+		if serverName, _, err = net.SplitHostPort(u.Host); err != nil {
+			serverName = u.Host
+		}
+	}
+
+	creds := credentials.NewTLS(certs.clientTLSConfig(serverName))
+	return grpc.Dial(u.Host, append(connOpts, grpc.WithTransportCredentials(creds))...)
+}
+
+func modificationTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+
+	return pool, nil
+}
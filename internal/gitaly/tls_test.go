@@ -0,0 +1,226 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly-proto/go/gitalypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string) {
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+
+	if keyFile == "" {
+		return
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func startTLSGitalyServer(t *testing.T, ca, serverCert *testCert) (*grpc.Server, string) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(grpc.Creds(creds))
+	gitalypb.RegisterSmartHTTPServiceServer(server, testhelper.NewGitalyServer(codes.OK))
+	go server.Serve(listener)
+
+	return server, "tls://" + listener.Addr().String()
+}
+
+func infoRefs(server Server) (string, error) {
+	client, err := NewSmartHTTPClient(server)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	repo := &gitalypb.Repository{StorageName: "default", RelativePath: "foo/bar.git"}
+	reader, err := client.InfoRefsResponseReader(ctx, repo, "git-upload-pack", nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	return string(data), err
+}
+
+func TestMutualTLSConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer Configure(nil)
+
+	ca := newTestCert(t, "Test CA", nil, true)
+	serverCert := newTestCert(t, "gitaly.test", ca, false)
+	clientCert := newTestCert(t, "workhorse", ca, false)
+
+	caFile := path.Join(dir, "ca.pem")
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client.key")
+	ca.writeFiles(t, caFile, "")
+	clientCert.writeFiles(t, certFile, keyFile)
+
+	server, address := startTLSGitalyServer(t, ca, serverCert)
+	defer server.Stop()
+
+	testCases := []struct {
+		desc    string
+		tls     config.GitalyTLSConfig
+		success bool
+	}{
+		{
+			desc:    "with client certificate",
+			tls:     config.GitalyTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "gitaly.test"},
+			success: true,
+		},
+		{
+			desc: "without client certificate",
+			tls:  config.GitalyTLSConfig{CAFile: caFile, ServerName: "gitaly.test"},
+		},
+		{
+			desc: "with wrong server name",
+			tls:  config.GitalyTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "other.test"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.NoError(t, Configure(&config.GitalyConfig{TLS: &tc.tls}))
+
+			data, err := infoRefs(Server{Address: address})
+			if !tc.success {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.True(t, strings.HasSuffix(data, testhelper.GitalyInfoRefsResponseMock), "unexpected InfoRefs response")
+		})
+	}
+}
+
+func TestConfigureRequiresKeyPair(t *testing.T) {
+	err := Configure(&config.GitalyConfig{TLS: &config.GitalyTLSConfig{CertFile: "/cert.pem"}})
+	require.Error(t, err)
+}
+
+func TestCertReloaderPicksUpNewFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "Test CA", nil, true)
+	first := newTestCert(t, "first", ca, false)
+	second := newTestCert(t, "second", ca, false)
+
+	caFile := path.Join(dir, "ca.pem")
+	certFile := path.Join(dir, "client.pem")
+	keyFile := path.Join(dir, "client.key")
+	ca.writeFiles(t, caFile, "")
+	first.writeFiles(t, certFile, keyFile)
+
+	certs, err := newCertReloader(config.GitalyTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+
+	cert, err := certs.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, first.der, cert.Certificate[0])
+
+	second.writeFiles(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	cert, err = certs.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.der, cert.Certificate[0])
+
+	// A broken file must not replace working certificates
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(certFile, future.Add(time.Minute), future.Add(time.Minute)))
+
+	cert, err = certs.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.der, cert.Certificate[0])
+}
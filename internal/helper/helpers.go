@@ -42,6 +42,13 @@ func RequestEntityTooLarge(w http.ResponseWriter, r *http.Request, err error) {
 	CaptureAndFail(w, r, err, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 }
 
+// ServiceUnavailable is for expected outages of a backend service, so the
+// error is logged but not sent to Sentry.
+func ServiceUnavailable(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	http.Error(w, msg, http.StatusServiceUnavailable)
+	printError(r, err)
+}
+
 func CaptureAndFail(w http.ResponseWriter, r *http.Request, err error, msg string, code int) {
 	http.Error(w, msg, code)
 	captureRavenError(r, err)
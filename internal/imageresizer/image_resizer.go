@@ -0,0 +1,245 @@
+/*
+Package imageresizer serves PNG and JPEG images scaled down to the width
+requested by GitLab Rails, so avatars and logos are not sent at full
+resolution.
+*/
+package imageresizer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/tracing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+type resizer struct{ senddata.Prefix }
+
+type resizeParams struct {
+	// Location is the path of the original image on disk or its object
+	// storage URL
+	Location string
+	Width    int
+	// CachePath is where the scaled image is cached, caching is disabled
+	// if it is empty
+	CachePath string
+}
+
+const (
+	// Larger originals are sent as they are
+	maxSourceSize = 8 * 1024 * 1024
+	maxWidth      = 2048
+
+	defaultCacheControl = "private, no-cache"
+)
+
+var (
+	SendScaledImage = &resizer{"send-scaled-img:"}
+
+	// scalers limits how many images are scaled at the same time. If all
+	// are busy the original image is sent.
+	scalers = make(chan struct{}, runtime.NumCPU())
+
+	httpClient = &http.Client{
+		Transport: tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(http.DefaultTransport)),
+		Timeout:   30 * time.Second,
+	}
+
+	imageResizeRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_image_resize_requests",
+			Help: "How many image resize requests have been processed, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(imageResizeRequests)
+}
+
+func (rs *resizer) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params resizeParams
+	if err := rs.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendScaledImage: unpack sendData: %v", err))
+		return
+	}
+
+	if params.Location == "" || params.Width <= 0 || params.Width > maxWidth {
+		helper.Fail500(w, r, fmt.Errorf("SendScaledImage: invalid parameters: width %d", params.Width))
+		return
+	}
+
+	if params.CachePath != "" {
+		if cached, err := ioutil.ReadFile(params.CachePath); err == nil {
+			imageResizeRequests.WithLabelValues("cache-hit").Inc()
+			serveImage(w, r, cached)
+			return
+		} else if !os.IsNotExist(err) {
+			helper.LogError(r, fmt.Errorf("SendScaledImage: read cache: %v", err))
+		}
+	}
+
+	source, err := openSource(r, params.Location)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendScaledImage: %v", err))
+		return
+	}
+	defer source.Close()
+
+	original, err := ioutil.ReadAll(io.LimitReader(source, maxSourceSize+1))
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendScaledImage: read image: %v", err))
+		return
+	}
+
+	if len(original) > maxSourceSize {
+		imageResizeRequests.WithLabelValues("original").Inc()
+		streamOriginal(w, r, io.MultiReader(bytes.NewReader(original), source))
+		return
+	}
+
+	select {
+	case scalers <- struct{}{}:
+	default:
+		imageResizeRequests.WithLabelValues("throttled").Inc()
+		serveImage(w, r, original)
+		return
+	}
+	scaled, err := scaleImage(original, params.Width)
+	<-scalers
+
+	if err == errNotScalable {
+		imageResizeRequests.WithLabelValues("original").Inc()
+		serveImage(w, r, original)
+		return
+	} else if err != nil {
+		imageResizeRequests.WithLabelValues("failed").Inc()
+		helper.Fail500(w, r, fmt.Errorf("SendScaledImage: scale image: %v", err))
+		return
+	}
+
+	imageResizeRequests.WithLabelValues("scaled").Inc()
+	if params.CachePath != "" {
+		if err := writeCache(params.CachePath, scaled); err != nil {
+			helper.LogError(r, fmt.Errorf("SendScaledImage: write cache: %v", err))
+		}
+	}
+
+	log.WithFields(r.Context(), log.Fields{
+		"width":        params.Width,
+		"originalSize": len(original),
+		"scaledSize":   len(scaled),
+	}).Print("SendScaledImage: sending")
+
+	serveImage(w, r, scaled)
+}
+
+// openSource opens the image at location, a local path or an object
+// storage URL
+func openSource(r *http.Request, location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.Open(location)
+	}
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NewRequest: %v", err)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return nil, fmt.Errorf("get image: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get image %s: %s", helper.ScrubURLParams(location), resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func setCacheControl(w http.ResponseWriter) {
+	// Rails may have set caching headers for the image
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", defaultCacheControl)
+	}
+}
+
+// setContentHeaders sets the content headers of an image from its first
+// bytes. Originals are uploaded by users, they may be HTML or SVG documents
+// that mustn't be rendered inline.
+func setContentHeaders(w http.ResponseWriter, head []byte) {
+	contentType, contentDisposition := headers.SafeContentHeaders(head, w.Header().Get(headers.ContentDispositionHeader))
+	w.Header().Set(headers.ContentTypeHeader, contentType)
+	w.Header().Set(headers.ContentDispositionHeader, contentDisposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// serveImage sends data with an ETag based on its contents, which makes
+// conditional requests work for scaled and original images alike
+func serveImage(w http.ResponseWriter, r *http.Request, data []byte) {
+	sum := sha256.Sum256(data)
+
+	setContentHeaders(w, data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	setCacheControl(w)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func streamOriginal(w http.ResponseWriter, r *http.Request, original io.Reader) {
+	header := make([]byte, headers.MaxDetectSize)
+	n, _ := io.ReadFull(original, header)
+	header = header[:n]
+
+	setContentHeaders(w, header)
+	setCacheControl(w)
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(header), original)); err != nil {
+		helper.LogError(r, fmt.Errorf("SendScaledImage: send original image: %v", err))
+	}
+}
+
+// writeCache atomically writes the scaled image to path
+func writeCache(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
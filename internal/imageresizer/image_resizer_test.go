@@ -0,0 +1,210 @@
+package imageresizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func sendData(t *testing.T, params resizeParams) string {
+	data, err := json.Marshal(params)
+	require.NoError(t, err)
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func inject(t *testing.T, params resizeParams, header http.Header) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", "/uploads/-/system/user/avatar/1/avatar.png?width=64", nil)
+	require.NoError(t, err)
+	if header != nil {
+		r.Header = header
+	}
+
+	w := httptest.NewRecorder()
+	SendScaledImage.Inject(w, r, sendData(t, params))
+	return w
+}
+
+func writeTempImage(t *testing.T, dir string, data []byte) string {
+	path := filepath.Join(dir, "avatar.png")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func requireWidth(t *testing.T, data []byte, width int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, width, cfg.Width)
+}
+
+func TestSendScaledImageFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	location := writeTempImage(t, dir, testPNG(t, 200, 100))
+
+	response := inject(t, resizeParams{Location: location, Width: 64}, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	require.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	require.Equal(t, defaultCacheControl, response.Header().Get("Cache-Control"))
+	require.NotEmpty(t, response.Header().Get("ETag"))
+	requireWidth(t, response.Body.Bytes(), 64)
+}
+
+func TestSendScaledImageFromURL(t *testing.T) {
+	original := testJPEG(t, 200, 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "GET", r.Method)
+		if r.URL.Path != "/avatar.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(original)
+	}))
+	defer ts.Close()
+
+	response := inject(t, resizeParams{Location: ts.URL + "/avatar.jpg", Width: 64}, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	require.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	requireWidth(t, response.Body.Bytes(), 64)
+
+	response = inject(t, resizeParams{Location: ts.URL + "/missing.jpg", Width: 64}, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+}
+
+func TestSendScaledImageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	location := writeTempImage(t, dir, testPNG(t, 200, 100))
+	cachePath := filepath.Join(dir, "cache", "avatar-64.png")
+	params := resizeParams{Location: location, Width: 64, CachePath: cachePath}
+
+	response := inject(t, params, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+
+	cached, err := ioutil.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Equal(t, response.Body.Bytes(), cached)
+
+	// The cached image is served even if the original is gone
+	require.NoError(t, os.Remove(location))
+
+	header := http.Header{}
+	header.Set("If-None-Match", response.Header().Get("ETag"))
+	response = inject(t, params, header)
+	testhelper.AssertResponseCode(t, response, http.StatusNotModified)
+
+	response = inject(t, params, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	require.Equal(t, cached, response.Body.Bytes())
+}
+
+func TestSendScaledImageSendsOriginal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := testPNG(t, 32, 32)
+	location := writeTempImage(t, dir, original)
+
+	response := inject(t, resizeParams{Location: location, Width: 64}, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	require.Equal(t, original, response.Body.Bytes())
+
+	// All scalers are busy
+	for i := 0; i < cap(scalers); i++ {
+		scalers <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(scalers); i++ {
+			<-scalers
+		}
+	}()
+
+	original = testPNG(t, 200, 100)
+	location = writeTempImage(t, dir, original)
+
+	response = inject(t, resizeParams{Location: location, Width: 64}, nil)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	require.Equal(t, original, response.Body.Bytes())
+}
+
+func TestSendScaledImageOriginalContentHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name               string
+		original           []byte
+		contentType        string
+		contentDisposition string
+	}{
+		{"png", testPNG(t, 32, 32), "image/png", "inline"},
+		{"html", []byte("<html><script>alert(1)</script></html>"), "text/plain; charset=utf-8", "inline"},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), "image/svg+xml", "attachment"},
+		{"large html", append([]byte("<html>"), bytes.Repeat([]byte(" "), maxSourceSize)...), "text/plain; charset=utf-8", "inline"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			location := writeTempImage(t, dir, tc.original)
+
+			response := inject(t, resizeParams{Location: location, Width: 64}, nil)
+			testhelper.AssertResponseCode(t, response, http.StatusOK)
+			require.Equal(t, tc.contentType, response.Header().Get("Content-Type"))
+			require.Equal(t, tc.contentDisposition, response.Header().Get("Content-Disposition"))
+			require.Equal(t, "nosniff", response.Header().Get("X-Content-Type-Options"))
+			require.Equal(t, tc.original, response.Body.Bytes())
+		})
+	}
+}
+
+func TestSendScaledImageKeepsCacheControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	location := writeTempImage(t, dir, testPNG(t, 200, 100))
+
+	r, err := http.NewRequest("GET", "/avatar.png", nil)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	w.Header().Set("Cache-Control", "max-age=3600, public")
+	SendScaledImage.Inject(w, r, sendData(t, resizeParams{Location: location, Width: 64}))
+
+	testhelper.AssertResponseCode(t, w, http.StatusOK)
+	require.Equal(t, "max-age=3600, public", w.Header().Get("Cache-Control"))
+}
+
+func TestSendScaledImageInvalidParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params resizeParams
+	}{
+		{"no location", resizeParams{Width: 64}},
+		{"no width", resizeParams{Location: "/avatar.png"}},
+		{"width too large", resizeParams{Location: "/avatar.png", Width: maxWidth + 1}},
+		{"missing file", resizeParams{Location: "/does/not/exist.png", Width: 64}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			response := inject(t, tc.params, nil)
+			testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package imageresizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// Larger images are not decoded to limit memory use
+	maxSourcePixels = 4096 * 4096
+
+	jpegQuality = 85
+)
+
+// errNotScalable means the original image should be sent instead
+var errNotScalable = errors.New("image can't be scaled")
+
+// scaleImage returns data scaled to width, keeping the aspect ratio. It
+// returns errNotScalable for images that are not PNG or JPEG, too large
+// to decode or not wider than width.
+func scaleImage(data []byte, width int) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return nil, errNotScalable
+	}
+
+	if cfg.Width <= width || cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxSourcePixels {
+		return nil, errNotScalable
+	}
+
+	// Scaled JPEGs lose their EXIF data, the browser would no longer
+	// rotate them
+	if format == "jpeg" && jpegOrientation(data) > 1 {
+		return nil, errNotScalable
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	height := (cfg.Height*width + cfg.Width/2) / cfg.Width
+	if height < 1 {
+		height = 1
+	}
+	dst := scale(src, width, height)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// scale downscales src to width x height by averaging the source pixels
+// covered by each destination pixel.
+func scale(src image.Image, width int, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, height, srcHeight)
+
+		for x := 0; x < width; x++ {
+			x0, x1 := span(x, width, srcWidth)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8((r + n/2) / n)
+			d[1] = uint8((g + n/2) / n)
+			d[2] = uint8((b + n/2) / n)
+			d[3] = uint8((a + n/2) / n)
+		}
+	}
+
+	return dst
+}
+
+// span returns the source pixels covered by destination pixel i
+func span(i int, dstSize int, srcSize int) (int, int) {
+	start := i * srcSize / dstSize
+	end := (i + 1) * srcSize / dstSize
+	if end <= start {
+		end = start + 1
+	}
+
+	return start, end
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 0 if
+// it has none
+func jpegOrientation(data []byte) int {
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xff {
+		marker := data[1]
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if marker == 0xda || length < 2 || len(data) < 2+length {
+			return 0
+		}
+
+		segment := data[4 : 2+length]
+		data = data[2+length:]
+		if marker != 0xe1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+
+		return tiffOrientation(segment[6:])
+	}
+
+	return 0
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	entries := tiff[offset+2:]
+	for i := 0; i < count && len(entries) >= (i+1)*12; i++ {
+		entry := entries[i*12:]
+		if order.Uint16(entry) == 274 {
+			return int(order.Uint16(entry[8:]))
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,122 @@
+package imageresizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testImage(width int, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width int, height int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(width, height)))
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T, width int, height int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, testImage(width, height), nil))
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF segment with the orientation tag after
+// the SOI marker
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00*\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, 274)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+
+	result := append([]byte{}, data[:2]...)
+	result = append(append(result, header...), segment...)
+	return append(result, data[2:]...)
+}
+
+func TestScaleImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"png", testPNG(t, 200, 100), "png"},
+		{"jpeg", testJPEG(t, 200, 100), "jpeg"},
+		{"jpeg with default orientation", withOrientation(testJPEG(t, 200, 100), 1), "jpeg"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			scaled, err := scaleImage(tc.data, 64)
+			require.NoError(t, err)
+
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(scaled))
+			require.NoError(t, err)
+			require.Equal(t, tc.format, format)
+			require.Equal(t, 64, cfg.Width)
+			require.Equal(t, 32, cfg.Height)
+		})
+	}
+}
+
+func TestScaleImageNotScalable(t *testing.T) {
+	var gifData bytes.Buffer
+	require.NoError(t, gif.Encode(&gifData, testImage(200, 100), nil))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not wider than the width", testPNG(t, 64, 64)},
+		{"narrower than the width", testPNG(t, 32, 64)},
+		{"gif", gifData.Bytes()},
+		{"not an image", []byte("hello world")},
+		{"rotated jpeg", withOrientation(testJPEG(t, 200, 100), 6)},
+		{"too many pixels", testPNG(t, 4097, 4096)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := scaleImage(tc.data, 64)
+			require.Equal(t, errNotScalable, err)
+		})
+	}
+}
+
+func TestScaleAveragesPixels(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(0, 0, color.RGBA{0, 0, 0, 0xff})
+	src.Set(1, 0, color.RGBA{0xff, 0, 0, 0xff})
+	src.Set(0, 1, color.RGBA{0, 0xff, 0, 0xff})
+	src.Set(1, 1, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	dst := scale(src, 1, 1)
+	require.Equal(t, color.RGBA{0x80, 0x80, 0x40, 0xff}, dst.At(0, 0))
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	data := testJPEG(t, 8, 8)
+	require.Equal(t, 0, jpegOrientation(data))
+	require.Equal(t, 8, jpegOrientation(withOrientation(data, 8)))
+}
@@ -0,0 +1,196 @@
+package imports
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// maxEntries is the largest number of entries of an import archive
+	maxEntries = 100000
+	// maxExpansionRatio is the largest allowed ratio between the extracted
+	// and the compressed size of an archive...
+	maxExpansionRatio = 100
+	// ...once more than minRatioCheckSize bytes were extracted, small
+	// archives of JSON compress well
+	minRatioCheckSize = 10 * 1024 * 1024
+	// maxTopLevelEntries is the largest number of top-level entries listed
+	// in the manifest
+	maxTopLevelEntries = 100
+)
+
+// Manifest summarizes the contents of an import archive for GitLab Rails
+type Manifest struct {
+	Entries     int64 `json:"entries"`
+	Files       int64 `json:"files"`
+	Directories int64 `json:"directories"`
+	// Size is the total size of the files once extracted
+	Size int64 `json:"size"`
+	// TopLevel are the names of the top-level entries, sorted
+	TopLevel []string `json:"top_level"`
+}
+
+// archiveValidator checks the tar.gz archive written to it in a goroutine.
+// Writes fail once the archive is found to be invalid.
+type archiveValidator struct {
+	pw         *io.PipeWriter
+	compressed int64
+	done       chan error
+	manifest   Manifest
+}
+
+func newArchiveValidator() *archiveValidator {
+	pr, pw := io.Pipe()
+	v := &archiveValidator{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		err := v.validate(pr)
+		// Stop the upload or, once the archive ended, drain the rest
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			io.Copy(ioutil.Discard, pr)
+		}
+		v.done <- err
+	}()
+
+	return v
+}
+
+func (v *archiveValidator) Write(p []byte) (int, error) {
+	atomic.AddInt64(&v.compressed, int64(len(p)))
+	return v.pw.Write(p)
+}
+
+// Close waits for the validation of the archive to finish and returns
+// why it is invalid, if it is
+func (v *archiveValidator) Close() error {
+	v.pw.Close()
+	return <-v.done
+}
+
+func (v *archiveValidator) validate(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("import archive is not gzipped: %v", err)
+	}
+
+	extracted := &countingReader{r: gz, check: v.checkExpansion}
+	tr := tar.NewReader(extracted)
+	topLevel := make(map[string]bool)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid import archive: %v", err)
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		v.manifest.Entries++
+		if v.manifest.Entries > maxEntries {
+			return fmt.Errorf("import archive has more than %d entries", maxEntries)
+		}
+
+		if err := checkName(hdr.Name); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			v.manifest.Files++
+			v.manifest.Size += hdr.Size
+		case tar.TypeDir:
+			v.manifest.Directories++
+		case tar.TypeSymlink:
+			return fmt.Errorf("import archive contains a symlink: %q", hdr.Name)
+		case tar.TypeLink:
+			return fmt.Errorf("import archive contains a hard link: %q", hdr.Name)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return fmt.Errorf("import archive contains a device file: %q", hdr.Name)
+		default:
+			return fmt.Errorf("import archive contains an entry of type %q: %q", hdr.Typeflag, hdr.Name)
+		}
+
+		if name := topLevelName(hdr.Name); name != "" && len(topLevel) < maxTopLevelEntries {
+			topLevel[name] = true
+		}
+
+		// Reading the contents of entries makes the expansion check see them
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return fmt.Errorf("invalid import archive: %v", err)
+		}
+	}
+
+	for name := range topLevel {
+		v.manifest.TopLevel = append(v.manifest.TopLevel, name)
+	}
+	sort.Strings(v.manifest.TopLevel)
+
+	return nil
+}
+
+func (v *archiveValidator) checkExpansion(extracted int64) error {
+	if extracted > minRatioCheckSize && extracted > maxExpansionRatio*atomic.LoadInt64(&v.compressed) {
+		return fmt.Errorf("import archive expands more than %d times", maxExpansionRatio)
+	}
+
+	return nil
+}
+
+func checkName(name string) error {
+	if name == "" {
+		return errors.New("import archive contains an entry without name")
+	}
+	if strings.HasPrefix(name, "/") {
+		return fmt.Errorf("import archive contains an absolute path: %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("import archive contains a path outside of it: %q", name)
+		}
+	}
+
+	return nil
+}
+
+func topLevelName(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "." {
+		return ""
+	}
+
+	return name
+}
+
+// countingReader calls check with the number of bytes read so far
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	check func(n int64) error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if checkErr := c.check(c.n); checkErr != nil {
+		return n, checkErr
+	}
+
+	return n, err
+}
@@ -0,0 +1,83 @@
+/*
+Package imports handles the upload of project import archives. Archives
+are validated while they are stored, so that GitLab Rails only extracts
+archives without links, device files or paths outside of the archive.
+*/
+package imports
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+)
+
+// ManifestField is the form field with the signed Manifest of the archive
+const ManifestField = "file.manifest"
+
+type manifestClaims struct {
+	Manifest Manifest `json:"manifest"`
+	jwt.StandardClaims
+}
+
+type importUploadProcessor struct {
+	validator *archiveValidator
+	stored    bool
+}
+
+func (p *importUploadProcessor) InspectFile(_ context.Context, formName string) (io.WriteCloser, error) {
+	//  InspectFile for imports requires file form-data field name to eq `file`
+
+	if formName != "file" {
+		return nil, fmt.Errorf("invalid form field: %q", formName)
+	}
+	if p.validator != nil {
+		return nil, fmt.Errorf("import request contains more than one file")
+	}
+
+	p.validator = newArchiveValidator()
+	return p.validator, nil
+}
+
+func (p *importUploadProcessor) ProcessFile(_ context.Context, formName string, _ *filestore.FileHandler, writer *multipart.Writer) error {
+	if formName != "file" || p.validator == nil || p.stored {
+		return fmt.Errorf("invalid form field: %q", formName)
+	}
+	p.stored = true
+
+	claims := manifestClaims{Manifest: p.validator.manifest, StandardClaims: secret.DefaultClaims}
+	tokenString, err := secret.JWTTokenString(claims)
+	if err != nil {
+		return fmt.Errorf("ProcessFile: %v", err)
+	}
+
+	return writer.WriteField(ManifestField, tokenString)
+}
+
+func (p *importUploadProcessor) ProcessField(_ context.Context, _ string, _ *multipart.Writer) error {
+	return nil
+}
+
+func (p *importUploadProcessor) Finalize(_ context.Context) error {
+	return nil
+}
+
+func (p *importUploadProcessor) Name() string {
+	return "import"
+}
+
+// UploadImport validates the uploaded import archive and passes its
+// manifest to Rails
+func UploadImport(rails filestore.PreAuthorizer, h http.Handler) http.Handler {
+	return rails.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		upload.HandleFileUploads(w, r, h, a, &importUploadProcessor{})
+	}, "/authorize")
+}
@@ -0,0 +1,193 @@
+package imports
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+type rails struct {
+	tempPath string
+}
+
+func (r *rails) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next(w, req, &api.Response{TempPath: r.tempPath})
+	})
+}
+
+func tarGz(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, hdr := range headers {
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func validArchive(t *testing.T) []byte {
+	return tarGz(t,
+		&tar.Header{Name: "VERSION", Typeflag: tar.TypeReg, Size: 5},
+		&tar.Header{Name: "project.json", Typeflag: tar.TypeReg, Size: 100},
+		&tar.Header{Name: "tree/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "tree/project.json", Typeflag: tar.TypeReg, Size: 20},
+	)
+}
+
+func uploadImport(t *testing.T, archive []byte, backend http.HandlerFunc) *httptest.ResponseRecorder {
+	tempPath, err := ioutil.TempDir("", "imports")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	require.NoError(t, writer.WriteField("path", "imported-project"))
+	file, err := writer.CreateFormFile("file", "project.tar.gz")
+	require.NoError(t, err)
+	_, err = file.Write(archive)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if backend == nil {
+			t.Fatal("request proxied upstream")
+		}
+
+		// The rewritten body can only be parsed by a new request
+		proxied := httptest.NewRequest(r.Method, r.URL.String(), r.Body)
+		proxied.Header = r.Header
+		backend(w, proxied)
+	})
+
+	req := httptest.NewRequest("POST", "/import/gitlab_project", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	UploadImport(&rails{tempPath: tempPath}, proxy).ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadImport(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	response := uploadImport(t, validArchive(t), func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(100000))
+		require.Equal(t, "imported-project", r.FormValue("path"))
+		require.NotEmpty(t, r.FormValue("file.path"))
+
+		var claims manifestClaims
+		_, err := jwt.ParseWithClaims(r.FormValue(ManifestField), &claims, testhelper.ParseJWT)
+		require.NoError(t, err)
+		require.Equal(t, Manifest{
+			Entries:     4,
+			Files:       3,
+			Directories: 1,
+			Size:        125,
+			TopLevel:    []string{"VERSION", "project.json", "tree"},
+		}, claims.Manifest)
+
+		w.WriteHeader(200)
+	})
+
+	testhelper.AssertResponseCode(t, response, 200)
+}
+
+func TestUploadImportRejectsInvalidArchives(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tests := []struct {
+		name    string
+		archive []byte
+		reason  string
+	}{
+		{
+			name:    "symlink",
+			archive: tarGz(t, &tar.Header{Name: "project.json", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}),
+			reason:  "symlink",
+		},
+		{
+			name:    "hard link",
+			archive: tarGz(t, &tar.Header{Name: "project.json", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}),
+			reason:  "hard link",
+		},
+		{
+			name:    "absolute path",
+			archive: tarGz(t, &tar.Header{Name: "/etc/cron.d/job", Typeflag: tar.TypeReg, Size: 1}),
+			reason:  "absolute path",
+		},
+		{
+			name:    "parent directory",
+			archive: tarGz(t, &tar.Header{Name: "tree/../../job", Typeflag: tar.TypeReg, Size: 1}),
+			reason:  "outside",
+		},
+		{
+			name:    "character device",
+			archive: tarGz(t, &tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}),
+			reason:  "device file",
+		},
+		{
+			name:    "fifo",
+			archive: tarGz(t, &tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}),
+			reason:  "device file",
+		},
+		{
+			name:    "not gzipped",
+			archive: []byte("not an archive"),
+			reason:  "not gzipped",
+		},
+		{
+			name:    "truncated",
+			archive: validArchive(t)[:100],
+			reason:  "invalid import archive",
+		},
+		{
+			name:    "expansion ratio",
+			archive: tarGz(t, &tar.Header{Name: "project.json", Typeflag: tar.TypeReg, Size: 2 * minRatioCheckSize}),
+			reason:  "expands more than",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			response := uploadImport(t, tc.archive, nil)
+			testhelper.AssertResponseCode(t, response, http.StatusUnprocessableEntity)
+			require.Contains(t, response.Body.String(), tc.reason)
+		})
+	}
+}
+
+func TestUploadImportTooManyEntries(t *testing.T) {
+	headers := make([]*tar.Header, maxEntries+1)
+	for i := range headers {
+		headers[i] = &tar.Header{Name: fmt.Sprintf("uploads/%d", i), Typeflag: tar.TypeReg}
+	}
+
+	response := uploadImport(t, tarGz(t, headers...), nil)
+	testhelper.AssertResponseCode(t, response, http.StatusUnprocessableEntity)
+	require.Contains(t, response.Body.String(), fmt.Sprintf("more than %d entries", maxEntries))
+}
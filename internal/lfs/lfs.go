@@ -14,7 +14,6 @@ import (
 
 type object struct {
 	size int64
-	oid  string
 }
 
 func (l *object) Verify(fh *filestore.FileHandler) error {
@@ -22,10 +21,6 @@ func (l *object) Verify(fh *filestore.FileHandler) error {
 		return fmt.Errorf("LFSObject: expected size %d, wrote %d", l.size, fh.Size)
 	}
 
-	if fh.SHA256() != l.oid {
-		return fmt.Errorf("LFSObject: expected sha256 %s, got %s", l.oid, fh.SHA256())
-	}
-
 	return nil
 }
 
@@ -35,7 +30,12 @@ func (l *uploadPreparer) Prepare(a *api.Response) (*filestore.SaveFileOpts, file
 	opts := filestore.GetOpts(a)
 	opts.TempFilePrefix = a.LfsOid
 
-	return opts, &object{oid: a.LfsOid, size: a.LfsSize}, nil
+	// The object ID is the SHA256 checksum of the object
+	if err := opts.ExpectChecksum("sha256", a.LfsOid); err != nil {
+		return nil, nil, fmt.Errorf("LFSObject: %v", err)
+	}
+
+	return opts, &object{size: a.LfsSize}, nil
 }
 
 func PutStore(a *api.API, h http.Handler) http.Handler {
@@ -0,0 +1,298 @@
+/*
+In this file we handle npm package publishing. The npm client embeds the
+package tarball as a base64 string in the JSON package metadata, we store
+it like any other upload so that GitLab Rails only parses the metadata.
+*/
+
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/progress"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+)
+
+const (
+	// MetadataField is the form field with the package metadata, without
+	// the tarball
+	MetadataField = "package"
+
+	// The metadata, which includes the readme of every version, is kept
+	// in memory
+	maxMetadataSize = 10 * 1024 * 1024
+)
+
+// metadataError means the request body is not valid package metadata
+type metadataError struct{ error }
+
+var errMetadataTooLarge = errors.New("package metadata is too large")
+
+// Publish stores the tarball of the published package and sends the
+// metadata to Rails as a multipart form, with the tarball as the "file"
+// field. Requests without a tarball, like dist-tag updates, are sent to
+// Rails as they are.
+func Publish(rails filestore.PreAuthorizer, h http.Handler) http.Handler {
+	return rails.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		opts := filestore.GetOpts(a)
+		if !opts.IsLocal() && !opts.IsRemote() {
+			helper.Fail500(w, r, fmt.Errorf("npm.Publish: missing destination storage"))
+			return
+		}
+
+		metadata, fh, err := extractTarball(r, opts)
+		if err != nil {
+			if _, ok := err.(metadataError); ok {
+				helper.CaptureAndFail(w, r, err, "Invalid package metadata", http.StatusBadRequest)
+			} else if _, ok := err.(base64.CorruptInputError); ok {
+				helper.CaptureAndFail(w, r, err, "Invalid package metadata", http.StatusBadRequest)
+			} else if err == filestore.ErrEntityTooLarge || err == errMetadataTooLarge {
+				helper.RequestEntityTooLarge(w, r, err)
+			} else if filestore.IsChecksumError(err) {
+				helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			} else if filestore.IsContentTypeError(err) {
+				helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnsupportedMediaType)
+			} else if clamd.IsInfected(err) {
+				helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
+			} else {
+				helper.Fail500(w, r, fmt.Errorf("npm.Publish: %v", err))
+			}
+			return
+		}
+
+		if fh == nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(metadata))
+			r.ContentLength = int64(len(metadata))
+		} else if err := upload.RewriteMultipartWithFields(r, fh, map[string]string{MetadataField: string(metadata)}); err != nil {
+			helper.Fail500(w, r, fmt.Errorf("npm.Publish: rewrite request: %v", err))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}, "/authorize")
+}
+
+// extractTarball saves the tarball in the "_attachments" of the package
+// metadata in r. It returns the metadata without the tarball data, and a
+// nil FileHandler if there was no tarball.
+func extractTarball(r *http.Request, opts *filestore.SaveFileOpts) ([]byte, *filestore.FileHandler, error) {
+	p := &parser{r: bufio.NewReaderSize(r.Body, 64*1024)}
+
+	var fh *filestore.FileHandler
+	// versions precede the tarball in the metadata sent by the npm client
+	var versions json.RawMessage
+	saveAttachment := func(filename string) (json.RawMessage, error) {
+		length := int64(-1)
+		var attachment bytes.Buffer
+		err := p.copyObject(&attachment, func(key string) (json.RawMessage, error) {
+			switch key {
+			case "data":
+				if fh != nil {
+					return nil, metadataError{errors.New("more than one tarball")}
+				}
+
+				if err := expectDistChecksums(opts, versions, filename); err != nil {
+					return nil, err
+				}
+
+				var err error
+				fh, err = p.saveTarball(r, filename, opts)
+				return nil, err
+			case "length":
+				value, err := p.readValue()
+				if err != nil {
+					return nil, err
+				}
+				if err := json.Unmarshal(value, &length); err != nil {
+					return nil, metadataError{fmt.Errorf("invalid tarball length: %v", err)}
+				}
+				return value, nil
+			default:
+				return p.readValue()
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if fh != nil && length >= 0 && fh.Size != length {
+			return nil, metadataError{fmt.Errorf("expected a tarball of %d bytes but got %d", length, fh.Size)}
+		}
+
+		return attachment.Bytes(), nil
+	}
+
+	var metadata bytes.Buffer
+	err := p.copyObject(&metadata, func(key string) (json.RawMessage, error) {
+		if key == "versions" {
+			var err error
+			versions, err = p.readValue()
+			return versions, err
+		} else if key != "_attachments" {
+			return p.readValue()
+		}
+
+		var attachments bytes.Buffer
+		err := p.copyObject(&attachments, saveAttachment)
+		return attachments.Bytes(), err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := p.next(); err != io.EOF {
+		return nil, nil, metadataError{errors.New("unexpected data after the package metadata")}
+	}
+
+	return metadata.Bytes(), fh, nil
+}
+
+func (p *parser) saveTarball(r *http.Request, filename string, opts *filestore.SaveFileOpts) (*filestore.FileHandler, error) {
+	if filename == "" || strings.Contains(filename, "/") || filename == "." || filename == ".." {
+		return nil, metadataError{fmt.Errorf("illegal tarball name: %q", filename)}
+	}
+
+	c, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if c != '"' {
+		return nil, metadataError{errors.New("tarball data is not a string")}
+	}
+
+	opts.TempFilePrefix = filename
+	opts.ProgressID = progress.ID(r)
+
+	data := base64.NewDecoder(base64.StdEncoding, &base64String{r: p.r})
+	return filestore.SaveFileFromReader(r.Context(), data, -1, opts)
+}
+
+type packageVersion struct {
+	Dist struct {
+		Shasum    string `json:"shasum"`
+		Integrity string `json:"integrity"`
+		Tarball   string `json:"tarball"`
+	} `json:"dist"`
+}
+
+// subresourceIntegrity maps the Subresource Integrity hash names used by
+// npm to our hash names
+var subresourceIntegrity = map[string]string{
+	"sha1":   "sha1",
+	"sha256": "sha256",
+	"sha512": "sha512",
+}
+
+// expectDistChecksums makes the upload of the tarball filename fail
+// unless it has the checksums of the version it belongs to
+func expectDistChecksums(opts *filestore.SaveFileOpts, rawVersions json.RawMessage, filename string) error {
+	if rawVersions == nil {
+		return nil
+	}
+
+	var versions map[string]packageVersion
+	if err := json.Unmarshal(rawVersions, &versions); err != nil {
+		return metadataError{fmt.Errorf("invalid versions: %v", err)}
+	}
+
+	var version *packageVersion
+	for _, v := range versions {
+		v := v
+		if len(versions) == 1 || strings.HasSuffix(v.Dist.Tarball, "/"+filename) {
+			version = &v
+			break
+		}
+	}
+	if version == nil {
+		return nil
+	}
+
+	if version.Dist.Shasum != "" {
+		if err := opts.ExpectChecksum("sha1", version.Dist.Shasum); err != nil {
+			return err
+		}
+	}
+
+	for _, integrity := range strings.Fields(version.Dist.Integrity) {
+		parts := strings.SplitN(integrity, "-", 2)
+		name, ok := subresourceIntegrity[parts[0]]
+		if !ok || len(parts) != 2 {
+			continue
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return &filestore.ChecksumError{Hash: name, Expected: parts[1]}
+		}
+		if err := opts.ExpectChecksum(name, hex.EncodeToString(digest)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// base64String reads a JSON string up to its closing quote. Base64 data
+// needs no escaping, but a slash may be escaped.
+type base64String struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (s *base64String) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+
+	if _, err := s.r.Peek(1); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	buf, _ := s.r.Peek(s.r.Buffered())
+	if i := bytes.IndexAny(buf, `"\`); i >= 0 {
+		buf = buf[:i]
+	}
+
+	if len(buf) > 0 {
+		n := copy(p, buf)
+		s.r.Discard(n)
+		return n, nil
+	}
+
+	if c, _ := s.r.ReadByte(); c == '"' {
+		s.done = true
+		return 0, io.EOF
+	}
+
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if c != '/' {
+		return 0, metadataError{errors.New("invalid character in tarball data")}
+	}
+
+	p[0] = '/'
+	return 1, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return metadataError{io.ErrUnexpectedEOF}
+	}
+	return err
+}
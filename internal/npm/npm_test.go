@@ -0,0 +1,230 @@
+package npm
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+)
+
+const (
+	tarball         = "package tarball contents, not really gzipped"
+	publishPath     = "/api/v4/projects/1/packages/npm/@root%2fnpm-test"
+	tarballFilename = "npm-test-1.0.1.tgz"
+)
+
+var testMetadata = `{
+  "_id": "@root/npm-test",
+  "name": "@root/npm-test",
+  "versions": {"1.0.1": {"name": "@root/npm-test", "version": "1.0.1", "readme": "# npm-test\n\"quoted\" {braces}"}},
+  "dist-tags": {"latest": "1.0.1"},
+  "_attachments": {
+    "npm-test-1.0.1.tgz": {
+      "content_type": "application/octet-stream",
+      "data": %s,
+      "length": %d
+    }
+  },
+  "count": 1, "private": false, "deprecated": null
+}`
+
+type rails struct {
+	tempPath    string
+	maximumSize int64
+}
+
+func (r *rails) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next(w, req, &api.Response{TempPath: r.tempPath, MaximumSize: r.maximumSize})
+	})
+}
+
+func metadataWithData(data string, length int) string {
+	quoted, _ := json.Marshal(data)
+	return fmt.Sprintf(testMetadata, quoted, length)
+}
+
+func publish(t *testing.T, r *rails, body string, backend http.HandlerFunc) *httptest.ResponseRecorder {
+	if backend == nil {
+		backend = func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("request proxied upstream")
+		}
+	}
+
+	req := httptest.NewRequest("PUT", publishPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	Publish(r, backend).ServeHTTP(w, req)
+	return w
+}
+
+func newRails(t *testing.T) *rails {
+	tempPath, err := ioutil.TempDir("", "npm")
+	require.NoError(t, err)
+
+	return &rails{tempPath: tempPath}
+}
+
+func TestPublish(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	r := newRails(t)
+	defer os.RemoveAll(r.tempPath)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(tarball))
+	escaped := strings.Replace(encoded, "/", `\/`, -1)
+
+	for _, data := range []string{`"` + encoded + `"`, `"` + escaped + `"`} {
+		body := fmt.Sprintf(testMetadata, data, len(tarball))
+
+		proxied := false
+		response := publish(t, r, body, func(w http.ResponseWriter, req *http.Request) {
+			proxied = true
+			require.NoError(t, req.ParseMultipartForm(1<<20))
+			require.NotEmpty(t, req.Header.Get(upload.RewrittenFieldsHeader))
+
+			require.Equal(t, tarballFilename, req.FormValue("file.name"))
+			require.Equal(t, fmt.Sprint(len(tarball)), req.FormValue("file.size"))
+			contents, err := ioutil.ReadFile(req.FormValue("file.path"))
+			require.NoError(t, err)
+			require.Equal(t, tarball, string(contents))
+
+			var metadata map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(req.FormValue(MetadataField)), &metadata))
+			require.Equal(t, "@root/npm-test", metadata["name"])
+			require.Equal(t, "# npm-test\n\"quoted\" {braces}", metadata["versions"].(map[string]interface{})["1.0.1"].(map[string]interface{})["readme"])
+			require.Equal(t, nil, metadata["deprecated"])
+			require.Equal(t, map[string]interface{}{
+				tarballFilename: map[string]interface{}{
+					"content_type": "application/octet-stream",
+					"length":       float64(len(tarball)),
+				},
+			}, metadata["_attachments"])
+
+			w.WriteHeader(200)
+		})
+
+		testhelper.AssertResponseCode(t, response, 200)
+		require.True(t, proxied)
+	}
+}
+
+func TestPublishWithoutTarball(t *testing.T) {
+	r := newRails(t)
+	defer os.RemoveAll(r.tempPath)
+
+	body := `{"name": "@root/npm-test", "dist-tags": {"latest": "1.0.1"}}`
+	response := publish(t, r, body, func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		data, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, body, string(data))
+		require.Equal(t, int64(len(data)), req.ContentLength)
+
+		w.WriteHeader(200)
+	})
+
+	testhelper.AssertResponseCode(t, response, 200)
+}
+
+func TestPublishInvalidMetadata(t *testing.T) {
+	r := newRails(t)
+	defer os.RemoveAll(r.tempPath)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(tarball))
+	twoTarballs := fmt.Sprintf(`{"_attachments": {"a.tgz": {"data": %q}, "b.tgz": {"data": %q}}}`, encoded, encoded)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not an object", `["name"]`},
+		{"truncated", `{"name": "@root/npm-test"`},
+		{"invalid value", `{"name": @root}`},
+		{"trailing comma", `{"name": "@root/npm-test",}`},
+		{"trailing data", `{"name": "@root/npm-test"} {}`},
+		{"invalid base64", metadataWithData("not base64!", len(tarball))},
+		{"escaped data", metadataWithData("\n"+encoded, len(tarball))},
+		{"data is not a string", fmt.Sprintf(testMetadata, "42", len(tarball))},
+		{"wrong length", metadataWithData(encoded, len(tarball)+1)},
+		{"two tarballs", twoTarballs},
+		{"illegal tarball name", fmt.Sprintf(`{"_attachments": {"../a.tgz": {"data": %q}}}`, encoded)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			response := publish(t, r, tc.body, nil)
+			testhelper.AssertResponseCode(t, response, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestPublishTooLarge(t *testing.T) {
+	r := newRails(t)
+	defer os.RemoveAll(r.tempPath)
+
+	r.maximumSize = int64(len(tarball) - 1)
+	body := metadataWithData(base64.StdEncoding.EncodeToString([]byte(tarball)), len(tarball))
+	testhelper.AssertResponseCode(t, publish(t, r, body, nil), http.StatusRequestEntityTooLarge)
+
+	r.maximumSize = 0
+	body = fmt.Sprintf(`{"readme": %q}`, strings.Repeat("x", maxMetadataSize))
+	testhelper.AssertResponseCode(t, publish(t, r, body, nil), http.StatusRequestEntityTooLarge)
+}
+
+func TestPublishVerifiesDistChecksums(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	r := newRails(t)
+	defer os.RemoveAll(r.tempPath)
+
+	sha1Sum := sha1.Sum([]byte(tarball))
+	sha512Sum := sha512.Sum512([]byte(tarball))
+	shasum := hex.EncodeToString(sha1Sum[:])
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:])
+	wrongIntegrity := "sha512-" + base64.StdEncoding.EncodeToString(make([]byte, sha512.Size))
+
+	tests := []struct {
+		name      string
+		shasum    string
+		integrity string
+		code      int
+	}{
+		{name: "matching checksums", shasum: shasum, integrity: integrity, code: 200},
+		{name: "wrong shasum", shasum: strings.Repeat("0", 40), integrity: integrity, code: 400},
+		{name: "wrong integrity", shasum: shasum, integrity: wrongIntegrity, code: 400},
+		{name: "invalid shasum", shasum: "not a shasum", code: 400},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body := fmt.Sprintf(
+				`{"name": "npm-test", "versions": {"1.0.1": {"dist": {"shasum": %q, "integrity": %q, "tarball": "http://example.com/npm-test/-/%s"}}}, "_attachments": {%q: {"data": %q}}}`,
+				tc.shasum, tc.integrity, tarballFilename, tarballFilename, base64.StdEncoding.EncodeToString([]byte(tarball)),
+			)
+
+			var backend http.HandlerFunc
+			if tc.code == 200 {
+				backend = func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) }
+			}
+
+			testhelper.AssertResponseCode(t, publish(t, r, body, backend), tc.code)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// parser walks the package metadata without holding the tarball data in
+// memory
+type parser struct {
+	r *bufio.Reader
+	// n is the size of the metadata read so far
+	n int
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (p *parser) readByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	p.n++
+	if p.n > maxMetadataSize {
+		return 0, errMetadataTooLarge
+	}
+
+	return c, nil
+}
+
+// next returns the next byte that is not whitespace
+func (p *parser) next() (byte, error) {
+	for {
+		c, err := p.readByte()
+		if err != nil || !isSpace(c) {
+			return c, err
+		}
+	}
+}
+
+// copyObject reads a JSON object and writes it to w. The value of each key
+// is read by value, which returns the value to write or nil to drop the
+// key.
+func (p *parser) copyObject(w *bytes.Buffer, value func(key string) (json.RawMessage, error)) error {
+	c, err := p.next()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if c != '{' {
+		return metadataError{fmt.Errorf("expected an object but got %q", c)}
+	}
+
+	w.WriteByte('{')
+	empty := true
+	for {
+		c, err := p.next()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if c == '}' && empty {
+			break
+		}
+		p.unreadByte()
+
+		rawKey, err := p.readValue()
+		if err != nil {
+			return err
+		}
+
+		var key string
+		if err := json.Unmarshal(rawKey, &key); err != nil {
+			return metadataError{fmt.Errorf("invalid object key: %v", err)}
+		}
+
+		if c, err := p.next(); err != nil {
+			return unexpectedEOF(err)
+		} else if c != ':' {
+			return metadataError{fmt.Errorf("expected ':' after object key but got %q", c)}
+		}
+
+		v, err := value(key)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			if w.Len() > 1 {
+				w.WriteByte(',')
+			}
+			w.Write(rawKey)
+			w.WriteByte(':')
+			w.Write(v)
+		}
+		empty = false
+
+		c, err = p.next()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if c == '}' {
+			break
+		}
+		if c != ',' {
+			return metadataError{fmt.Errorf("expected ',' or '}' in object but got %q", c)}
+		}
+	}
+	w.WriteByte('}')
+
+	return nil
+}
+
+func (p *parser) unreadByte() {
+	p.r.UnreadByte()
+	p.n--
+}
+
+// readValue returns the next JSON value
+func (p *parser) readValue() (json.RawMessage, error) {
+	c, err := p.next()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	value := []byte{c}
+	depth := 0
+	inString := c == '"'
+	escaped := false
+
+	switch c {
+	case '{', '[':
+		depth++
+	case '}', ']', ',', ':':
+		return nil, metadataError{fmt.Errorf("expected a value but got %q", c)}
+	}
+
+	for inString || depth > 0 || !endOfScalar(value) {
+		c, err := p.readByte()
+		if err == io.EOF && !inString && depth == 0 {
+			// A number at the end of the input
+			break
+		} else if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if !inString && depth == 0 && (isSpace(c) || c == ',' || c == '}' || c == ']') {
+			p.unreadByte()
+			break
+		}
+		value = append(value, c)
+
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case inString && c == '"':
+			inString = false
+		case inString:
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+
+	if !json.Valid(value) {
+		return nil, metadataError{errors.New("invalid JSON value")}
+	}
+
+	return value, nil
+}
+
+// endOfScalar reports whether value is a complete string, object or
+// array. Numbers, booleans and null end at the next delimiter.
+func endOfScalar(value []byte) bool {
+	first, last := value[0], value[len(value)-1]
+	switch first {
+	case '"':
+		return len(value) > 1 && last == '"'
+	case '{':
+		return last == '}'
+	case '[':
+		return last == ']'
+	}
+	return false
+}
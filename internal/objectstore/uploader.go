@@ -17,6 +17,8 @@ import (
 type Upload interface {
 	io.WriteCloser
 	ETag() string
+	// Abort stops the upload without completing it
+	Abort(err error)
 }
 
 // uploader is an io.WriteCloser that can be used as write end of the uploading pipe.
@@ -27,8 +29,8 @@ type uploader struct {
 	// md5 is an optional hasher for calculating md5 on the fly
 	md5 hash.Hash
 
-	w io.Writer
-	c io.Closer
+	w  io.Writer
+	pw *io.PipeWriter
 
 	// uploadError is the last error occourred during upload
 	uploadError error
@@ -36,20 +38,20 @@ type uploader struct {
 	ctx context.Context
 }
 
-func newUploader(ctx context.Context, w io.WriteCloser) uploader {
-	return uploader{w: w, c: w, ctx: ctx}
+func newUploader(ctx context.Context, pw *io.PipeWriter) uploader {
+	return uploader{w: pw, pw: pw, ctx: ctx}
 }
 
-func newMD5Uploader(ctx context.Context, w io.WriteCloser) uploader {
+func newMD5Uploader(ctx context.Context, pw *io.PipeWriter) uploader {
 	hasher := md5.New()
-	mw := io.MultiWriter(w, hasher)
-	return uploader{w: mw, c: w, md5: hasher, ctx: ctx}
+	mw := io.MultiWriter(pw, hasher)
+	return uploader{w: mw, pw: pw, md5: hasher, ctx: ctx}
 }
 
 // Close implements the standard io.Closer interface: it closes the http client request.
 // This method will also wait for the connection to terminate and return any error occurred during the upload
 func (u *uploader) Close() error {
-	if err := u.c.Close(); err != nil {
+	if err := u.pw.Close(); err != nil {
 		return err
 	}
 
@@ -66,6 +68,12 @@ func (u *uploader) Write(p []byte) (int, error) {
 	return u.w.Write(p)
 }
 
+// Abort fails the upload request with err, so that a partially written
+// object is never completed. Cleanup happens as for any failed upload.
+func (u *uploader) Abort(err error) {
+	u.pw.CloseWithError(err)
+}
+
 // syncAndDelete wait for Context to be Done and then performs the requested HTTP call
 func (u *uploader) syncAndDelete(url string) {
 	if url == "" {
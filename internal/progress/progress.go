@@ -0,0 +1,230 @@
+/*
+Package progress publishes the progress of uploads to Redis so that
+browsers can poll it while they upload large files.
+
+The client picks a random upload ID and sends it in the X-Progress-ID
+header or query parameter of the upload, the progress is then available
+at /-/upload_progress/<id> until a while after the upload finished.
+
+The progress is stored under a hash of the upload ID and the credentials
+of the upload request, its session cookie or its token. Only requests with
+the same credentials see it, other clients get a 404 even if they know the
+upload ID. Uploads without credentials are not tracked.
+*/
+package progress
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	// IDParam is the header or query parameter with the upload ID
+	IDParam = "X-Progress-ID"
+
+	StateUploading = "uploading"
+	StateDone      = "done"
+	StateError     = "error"
+
+	keyPrefix = "workhorse:upload_progress:"
+	// sessionCookie is the cookie of the sessions of GitLab Rails
+	sessionCookie = "_gitlab_session"
+	// The progress is kept for a while after the last update so that
+	// polling clients see the final state
+	expire = 5 * time.Minute
+)
+
+var (
+	// Upload IDs are long enough not to be guessed
+	idPattern = regexp.MustCompile(`\A[a-zA-Z0-9_-]{32,64}\z`)
+
+	// publishInterval is how often the progress of an upload is published
+	publishInterval = time.Second
+
+	// These are replaced in tests
+	setString = redis.SetString
+	getString = redis.GetString
+)
+
+// Progress is the state of an upload as served to clients
+type Progress struct {
+	State string `json:"state"`
+	// Received is the number of bytes stored so far
+	Received int64 `json:"received"`
+	// Size is the expected size of the file, -1 if unknown
+	Size int64 `json:"size"`
+	// Rate is the average number of bytes received per second
+	Rate int64 `json:"rate"`
+}
+
+// ID returns the ID the progress of the upload r is published for, which
+// is bound to the credentials of r. It returns an empty string if r has no
+// valid upload ID or no credentials.
+func ID(r *http.Request) string {
+	id := r.Header.Get(IDParam)
+	if id == "" {
+		id = r.URL.Query().Get(IDParam)
+	}
+
+	return sessionID(r, id)
+}
+
+func sessionID(r *http.Request, id string) string {
+	session := credentials(r)
+	if !idPattern.MatchString(id) || session == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(session + "\x00" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// credentials returns what identifies the user of r to GitLab Rails
+func credentials(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		return "cookie:" + cookie.Value
+	}
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		return "authorization:" + authorization
+	}
+	if token := r.Header.Get("Private-Token"); token != "" {
+		return "token:" + token
+	}
+	return ""
+}
+
+// Tracker counts the bytes written to it and periodically publishes the
+// progress until Finish is called or ctx is done
+type Tracker struct {
+	key      string
+	size     int64
+	received int64
+	start    time.Time
+	finished chan string
+	stopped  chan struct{}
+	failed   bool
+}
+
+// NewTracker starts tracking the upload id, of size bytes or -1 if the size
+// is unknown. It returns nil if id is empty.
+func NewTracker(ctx context.Context, id string, size int64) *Tracker {
+	if id == "" {
+		return nil
+	}
+
+	t := &Tracker{
+		key:      keyPrefix + id,
+		size:     size,
+		start:    time.Now(),
+		finished: make(chan string, 1),
+		stopped:  make(chan struct{}),
+	}
+	go t.run(ctx)
+
+	return t
+}
+
+func (t *Tracker) Write(p []byte) (int, error) {
+	atomic.AddInt64(&t.received, int64(len(p)))
+	return len(p), nil
+}
+
+// Finish publishes the final state of the upload, err is the error it
+// failed with if any. It must be called only once.
+func (t *Tracker) Finish(err error) {
+	state := StateDone
+	if err != nil {
+		state = StateError
+	}
+
+	t.finished <- state
+	<-t.stopped
+}
+
+func (t *Tracker) run(ctx context.Context) {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(publishInterval)
+	defer ticker.Stop()
+
+	t.publish(ctx, StateUploading)
+	for {
+		select {
+		case <-ticker.C:
+			t.publish(ctx, StateUploading)
+		case state := <-t.finished:
+			t.publish(ctx, state)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) publish(ctx context.Context, state string) {
+	p := Progress{
+		State:    state,
+		Received: atomic.LoadInt64(&t.received),
+		Size:     t.size,
+	}
+	if elapsed := time.Since(t.start); elapsed > 0 {
+		p.Rate = int64(float64(p.Received) / elapsed.Seconds())
+	}
+
+	data, err := json.Marshal(p)
+	if err == nil {
+		err = setString(t.key, string(data), expire)
+	}
+
+	// Don't log every interval if Redis is unavailable
+	if err != nil && !t.failed {
+		t.failed = true
+		log.WithError(ctx, err).Print("progress: failed to publish upload progress")
+	}
+}
+
+// Handler serves the progress of the upload whose ID is the last element
+// of the request path, if it was uploaded with the credentials of the
+// request
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadID := path.Base(r.URL.Path)
+		if !idPattern.MatchString(uploadID) {
+			helper.HTTPError(w, r, "Invalid upload ID", http.StatusBadRequest)
+			return
+		}
+
+		// The progress of uploads of other users is not found
+		id := sessionID(r, uploadID)
+		if id == "" {
+			helper.HTTPError(w, r, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := getString(keyPrefix + id)
+		if err == redigo.ErrNil {
+			helper.HTTPError(w, r, "Upload not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			helper.Fail500(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(data))
+	})
+}
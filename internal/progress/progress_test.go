@@ -0,0 +1,215 @@
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const (
+	testID      = "0123456789abcdef0123456789abcdef"
+	testSession = "session-cookie"
+)
+
+var (
+	// testSessionID is the ID the progress of testID is published for with
+	// testSession, testKey its Redis key
+	testSessionID = sessionID(newSessionRequest("GET", "/", testSession), testID)
+	testKey       = keyPrefix + testSessionID
+)
+
+func newSessionRequest(method string, target string, session string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	}
+	return r
+}
+
+type fakeRedis struct {
+	sync.Mutex
+	values  map[string]string
+	expires map[string]time.Duration
+}
+
+func setupFakeRedis() (*fakeRedis, func()) {
+	r := &fakeRedis{values: make(map[string]string), expires: make(map[string]time.Duration)}
+
+	setString = func(key string, value string, expire time.Duration) error {
+		r.Lock()
+		defer r.Unlock()
+		r.values[key] = value
+		r.expires[key] = expire
+		return nil
+	}
+	getString = func(key string) (string, error) {
+		r.Lock()
+		defer r.Unlock()
+		value, ok := r.values[key]
+		if !ok {
+			return "", redigo.ErrNil
+		}
+		return value, nil
+	}
+
+	return r, func() {
+		setString = redisSetString
+		getString = redisGetString
+	}
+}
+
+var (
+	redisSetString = setString
+	redisGetString = getString
+)
+
+func (r *fakeRedis) progress(t *testing.T, key string) Progress {
+	r.Lock()
+	defer r.Unlock()
+
+	var p Progress
+	if value, ok := r.values[key]; ok {
+		require.NoError(t, json.Unmarshal([]byte(value), &p))
+	}
+	return p
+}
+
+func TestID(t *testing.T) {
+	otherID := "fedcba9876543210fedcba9876543210"
+
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		session string
+		id      string
+	}{
+		{name: "header", header: testID, session: testSession, id: testID},
+		{name: "query", query: testID, session: testSession, id: testID},
+		{name: "header first", header: testID, query: otherID, session: testSession, id: testID},
+		{name: "none", session: testSession},
+		{name: "too short", header: "0123456789abcdef", session: testSession},
+		{name: "invalid characters", header: "../../../../../../../../etc/passwd", session: testSession},
+		{name: "no credentials", header: testID},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newSessionRequest("POST", "/upload?"+IDParam+"="+tc.query, tc.session)
+			r.Header.Set(IDParam, tc.header)
+
+			if tc.id == "" {
+				require.Empty(t, ID(r))
+			} else {
+				require.Equal(t, testSessionID, ID(r))
+			}
+		})
+	}
+}
+
+func TestIDCredentials(t *testing.T) {
+	withCookie := newSessionRequest("POST", "/upload", testSession)
+	withOtherCookie := newSessionRequest("POST", "/upload", "other-session")
+	withToken := newSessionRequest("POST", "/upload", "")
+	withToken.Header.Set("Private-Token", testSession)
+	withAuthorization := newSessionRequest("POST", "/upload", "")
+	withAuthorization.Header.Set("Authorization", "Bearer "+testSession)
+
+	ids := make(map[string]bool)
+	for _, r := range []*http.Request{withCookie, withOtherCookie, withToken, withAuthorization} {
+		r.Header.Set(IDParam, testID)
+		id := ID(r)
+		require.NotEmpty(t, id)
+		require.NotContains(t, id, testID)
+		ids[id] = true
+	}
+
+	// Different credentials never share the progress of an upload ID
+	require.Len(t, ids, 4)
+}
+
+func TestNewTrackerWithoutID(t *testing.T) {
+	require.Nil(t, NewTracker(context.Background(), "", 10))
+}
+
+func TestTracker(t *testing.T) {
+	r, teardown := setupFakeRedis()
+	defer teardown()
+
+	defer func(interval time.Duration) { publishInterval = interval }(publishInterval)
+	publishInterval = 10 * time.Millisecond
+
+	tracker := NewTracker(context.Background(), testSessionID, 10)
+	_, err := tracker.Write([]byte("12345"))
+	require.NoError(t, err)
+
+	var p Progress
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(publishInterval) {
+		if p = r.progress(t, testKey); p.Received == 5 {
+			break
+		}
+	}
+	require.Equal(t, int64(5), p.Received)
+	require.Equal(t, StateUploading, p.State)
+	require.Equal(t, int64(10), p.Size)
+
+	tracker.Write([]byte("67890"))
+	tracker.Finish(nil)
+
+	p = r.progress(t, testKey)
+	require.Equal(t, Progress{State: StateDone, Received: 10, Size: 10, Rate: p.Rate}, p)
+	require.Equal(t, expire, r.expires[testKey])
+}
+
+func TestTrackerFailedUpload(t *testing.T) {
+	r, teardown := setupFakeRedis()
+	defer teardown()
+
+	tracker := NewTracker(context.Background(), testSessionID, -1)
+	tracker.Finish(context.Canceled)
+
+	require.Equal(t, StateError, r.progress(t, testKey).State)
+	require.Equal(t, int64(-1), r.progress(t, testKey).Size)
+}
+
+func TestHandler(t *testing.T) {
+	r, teardown := setupFakeRedis()
+	defer teardown()
+
+	NewTracker(context.Background(), testSessionID, 3).Finish(nil)
+
+	tests := []struct {
+		name    string
+		path    string
+		session string
+		code    int
+	}{
+		{name: "existing upload", path: "/-/upload_progress/" + testID, session: testSession, code: http.StatusOK},
+		{name: "unknown upload", path: "/-/upload_progress/fedcba9876543210fedcba9876543210", session: testSession, code: http.StatusNotFound},
+		{name: "other session", path: "/-/upload_progress/" + testID, session: "other-session", code: http.StatusNotFound},
+		{name: "no credentials", path: "/-/upload_progress/" + testID, code: http.StatusNotFound},
+		{name: "invalid ID", path: "/-/upload_progress/abc", session: testSession, code: http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, newSessionRequest("GET", tc.path, tc.session))
+			testhelper.AssertResponseCode(t, w, tc.code)
+
+			if tc.code == http.StatusOK {
+				require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				require.JSONEq(t, r.values[testKey], w.Body.String())
+			}
+		})
+	}
+}
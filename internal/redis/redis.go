@@ -299,3 +299,15 @@ func GetString(key string) (string, error) {
 
 	return redis.String(conn.Do("GET", key))
 }
+
+// SetString sets a key in Redis which expires after expire
+func SetString(key string, value string, expire time.Duration) error {
+	conn := Get()
+	if conn == nil {
+		return fmt.Errorf("redis: could not get connection from pool")
+	}
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, value, "PX", int64(expire/time.Millisecond))
+	return err
+}
@@ -104,6 +104,12 @@ func (s *sendFileResponseWriter) WriteHeader(status int) {
 	s.rw.WriteHeader(s.status)
 }
 
+// ServeFile sends file the same way as an X-Sendfile response, including
+// support for Range requests.
+func ServeFile(w http.ResponseWriter, r *http.Request, file string) {
+	sendFileFromDisk(w, r, file)
+}
+
 func sendFileFromDisk(w http.ResponseWriter, r *http.Request, file string) {
 	log.WithFields(r.Context(), log.Fields{
 		"file":   file,
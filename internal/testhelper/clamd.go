@@ -0,0 +1,120 @@
+package testhelper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// ClamdTestSignature is reported for streams containing ClamdTestVirus
+const ClamdTestSignature = "Eicar-Test-Signature"
+
+// ClamdTestVirus is the EICAR test file
+const ClamdTestVirus = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// ClamdTestServer is a fake clamd that answers the INSTREAM command
+type ClamdTestServer struct {
+	listener net.Listener
+
+	// StreamMaxLength makes the server refuse longer streams, like clamd
+	StreamMaxLength int
+
+	mutex sync.Mutex
+	scans int
+}
+
+// StartClamdServer starts a fake clamd listening on a local TCP port
+func StartClamdServer(t *testing.T) *ClamdTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &ClamdTestServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+// Config returns the Workhorse configuration to use this server
+func (s *ClamdTestServer) Config() *config.ClamdConfig {
+	return &config.ClamdConfig{
+		URL: config.TomlURL{URL: url.URL{Scheme: "tcp", Host: s.listener.Addr().String()}},
+	}
+}
+
+// Scans returns how many streams have been scanned
+func (s *ClamdTestServer) Scans() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.scans
+}
+
+// Close stops accepting connections
+func (s *ClamdTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ClamdTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream []byte
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint32(header))
+		if length == 0 {
+			break
+		}
+
+		if s.StreamMaxLength > 0 && len(stream)+length > s.StreamMaxLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return
+		}
+		stream = append(stream, chunk...)
+	}
+
+	s.mutex.Lock()
+	s.scans++
+	s.mutex.Unlock()
+
+	if bytes.Contains(stream, []byte(ClamdTestVirus)) {
+		conn.Write([]byte("stream: " + ClamdTestSignature + " FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
@@ -29,7 +29,8 @@ var (
 	GitalyGetDiffResponseMock    = strings.Repeat("Mock Gitaly GetDiffResponse data", 100000)
 	GitalyGetPatchResponseMock   = strings.Repeat("Mock Gitaly GetPatchResponse data", 100000)
 
-	GitalyGetSnapshotResponseMock = strings.Repeat("Mock Gitaly GetSnapshotResponse data", 100000)
+	GitalyGetSnapshotResponseMock  = strings.Repeat("Mock Gitaly GetSnapshotResponse data", 100000)
+	GitalyCreateBundleResponseMock = strings.Repeat("Mock Gitaly CreateBundleResponse data", 100000)
 
 	GitalyReceivePackResponseMock []byte
 	GitalyUploadPackResponseMock  []byte
@@ -332,6 +333,27 @@ func (s *GitalyTestServer) GetSnapshot(in *gitalypb.GetSnapshotRequest, stream g
 	return s.finalError()
 }
 
+func (s *GitalyTestServer) CreateBundle(in *gitalypb.CreateBundleRequest, stream gitalypb.RepositoryService_CreateBundleServer) error {
+	s.WaitGroup.Add(1)
+	defer s.WaitGroup.Done()
+
+	if err := validateRepository(in.GetRepository()); err != nil {
+		return err
+	}
+
+	nSends, err := sendBytes([]byte(GitalyCreateBundleResponseMock), 100, func(p []byte) error {
+		return stream.Send(&gitalypb.CreateBundleResponse{Data: p})
+	})
+	if err != nil {
+		return err
+	}
+	if nSends <= 1 {
+		panic("should have sent more than one message")
+	}
+
+	return s.finalError()
+}
+
 // sendBytes returns the number of times the 'sender' function was called and an error.
 func sendBytes(data []byte, chunkSize int, sender func([]byte) error) (int, error) {
 	i := 0
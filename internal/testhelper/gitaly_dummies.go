@@ -85,10 +85,6 @@ func (s *GitalyTestServer) CalculateChecksum(context.Context, *gitalypb.Calculat
 	return nil, nil
 }
 
-func (s *GitalyTestServer) CreateBundle(*gitalypb.CreateBundleRequest, gitalypb.RepositoryService_CreateBundleServer) error {
-	return nil
-}
-
 func (s *GitalyTestServer) CreateRepositoryFromBundle(gitalypb.RepositoryService_CreateRepositoryFromBundleServer) error {
 	return nil
 }
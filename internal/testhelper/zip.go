@@ -0,0 +1,46 @@
+package testhelper
+
+import (
+	"archive/zip"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// CreateZipArchive writes a zip archive of files, which maps entry names to
+// their contents, to path in the order of the names. Entries are deflated
+// unless their names are in stored.
+func CreateZipArchive(t *testing.T, path string, files map[string]string, stored ...string) string {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	methods := make(map[string]uint16)
+	for _, name := range stored {
+		methods[name] = zip.Store
+	}
+
+	archive := zip.NewWriter(f)
+	for _, name := range names {
+		method, ok := methods[name]
+		if !ok {
+			method = zip.Deflate
+		}
+
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	return f.Name()
+}
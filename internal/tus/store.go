@@ -0,0 +1,239 @@
+package tus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// uploadTTL is how long partial uploads are kept after the last write
+const uploadTTL = 24 * time.Hour
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadLocked   = errors.New("upload is in use")
+	errTooMuchData    = errors.New("data exceeds upload length")
+	uploadIDPattern   = regexp.MustCompile(`\A[0-9a-f]{32}\z`)
+)
+
+// upload is a partial upload stored on disk. Its offset is the size of the
+// data file, so it survives interrupted requests and restarts.
+type upload struct {
+	ID string
+	// Path is the URL path the upload was created for
+	Path     string
+	Length   int64
+	Metadata string
+
+	dir string
+	// data is the locked data file
+	data *os.File
+}
+
+func createUpload(dir string, urlPath string, length int64, metadata string) (*upload, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		ID:       hex.EncodeToString(id),
+		Path:     urlPath,
+		Length:   length,
+		Metadata: metadata,
+		dir:      dir,
+	}
+
+	data, err := os.OpenFile(u.dataPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := data.Close(); err != nil {
+		return nil, err
+	}
+
+	info, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(u.infoPath(), info, 0600); err != nil {
+		os.Remove(u.dataPath())
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func loadUpload(dir string, id string) (*upload, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, errUploadNotFound
+	}
+
+	info, err := ioutil.ReadFile(path.Join(dir, infoFileName(id)))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	u := &upload{dir: dir}
+	if err := json.Unmarshal(info, u); err != nil {
+		return nil, fmt.Errorf("loadUpload: %v", err)
+	}
+
+	return u, nil
+}
+
+func dataFileName(id string) string {
+	return "tus-" + id
+}
+
+func infoFileName(id string) string {
+	return "tus-" + id + ".info"
+}
+
+func (u *upload) dataPath() string {
+	return path.Join(u.dir, dataFileName(u.ID))
+}
+
+func (u *upload) infoPath() string {
+	return path.Join(u.dir, infoFileName(u.ID))
+}
+
+func (u *upload) offset() (int64, error) {
+	fi, err := os.Stat(u.dataPath())
+	if os.IsNotExist(err) {
+		return 0, errUploadNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (u *upload) remove() error {
+	if err := os.Remove(u.infoPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(u.dataPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// lock takes an flock on the data file so that only one request at a time
+// writes to the upload, also across gitlab-workhorse processes sharing the
+// upload directory. It returns errUploadLocked if another request holds
+// the lock.
+func (u *upload) lock() error {
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if os.IsNotExist(err) {
+		return errUploadNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return errUploadLocked
+		}
+		return err
+	}
+
+	// The upload may have been removed by the previous lock holder
+	locked, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	current, err := os.Stat(u.dataPath())
+	if os.IsNotExist(err) || (err == nil && !os.SameFile(locked, current)) {
+		f.Close()
+		return errUploadNotFound
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+
+	u.data = f
+	return nil
+}
+
+// unlock releases the lock by closing the data file
+func (u *upload) unlock() {
+	if u.data != nil {
+		u.data.Close()
+		u.data = nil
+	}
+}
+
+// removeExpiredUploads removes the uploads in dir that have not been
+// written to for uploadTTL.
+func removeExpiredUploads(dir string) (int, error) {
+	infoFiles, err := filepath.Glob(path.Join(dir, infoFileName("*")))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, infoFile := range infoFiles {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(infoFile), "tus-"), ".info")
+		u := &upload{ID: id, dir: dir}
+
+		fi, err := os.Stat(u.dataPath())
+		if err == nil && time.Since(fi.ModTime()) < uploadTTL {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+
+		err = u.lock()
+		if err == errUploadLocked {
+			continue
+		} else if err != nil && err != errUploadNotFound {
+			return removed, err
+		}
+		err = u.remove()
+		u.unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// append writes body to the locked upload at offset and returns the new
+// offset. Requests with more data than Upload-Length allows are dropped.
+func (u *upload) append(body io.Reader, offset int64) (int64, error) {
+	f := u.data
+	remaining := u.Length - offset
+	n, err := io.Copy(f, io.LimitReader(body, remaining+1))
+	if n > remaining {
+		if err := f.Truncate(offset); err != nil {
+			return offset, err
+		}
+		return offset, errTooMuchData
+	}
+
+	return offset + n, err
+}
@@ -0,0 +1,347 @@
+/*
+Package tus implements the tus resumable upload protocol
+(https://tus.io/protocols/resumable-upload.html) in front of the regular
+upload handlers.
+
+Partial uploads are stored on disk. Once the last byte has arrived the file
+goes through filestore like any other upload and the request is finalized
+with GitLab Rails the same way the wrapped upload handler would.
+*/
+package tus
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	// Version is the only tus protocol version we support
+	Version = "1.0.0"
+
+	uploadIDParam     = "upload_id"
+	offsetContentType = "application/offset+octet-stream"
+)
+
+// Finalizer rewrites the request that completed the upload of fh into the
+// request GitLab Rails expects to finalize an upload.
+type Finalizer func(r *http.Request, fh *filestore.FileHandler) error
+
+var tusUploads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_tus_uploads",
+		Help: "How many tus uploads have been created, completed, terminated or expired by gitlab-workhorse.",
+	},
+	[]string{"event"},
+)
+
+func init() {
+	prometheus.MustRegister(tusUploads)
+}
+
+// IsTusRequest reports whether r is part of a tus upload
+func IsTusRequest(r *http.Request) bool {
+	return r.Header.Get("Tus-Resumable") != ""
+}
+
+type handler struct {
+	next     http.Handler
+	method   string
+	finalize Finalizer
+}
+
+// Uploader handles tus requests for an upload endpoint that is normally
+// requested with method. Every request is pre-authorized like a regular
+// upload to the endpoint, and the completed upload is finalized by
+// rewriting the last request with finalize and passing it to h.
+func Uploader(rails filestore.PreAuthorizer, h http.Handler, method string, finalize Finalizer) http.Handler {
+	t := &handler{next: h, method: method, finalize: finalize}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", Version)
+
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Tus-Version", Version)
+			w.Header().Set("Tus-Extension", "creation,termination")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Header.Get("Tus-Resumable") != Version {
+			w.Header().Set("Tus-Version", Version)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		authRequest := r.WithContext(r.Context())
+		authRequest.Method = method
+
+		rails.PreAuthorizeHandler(func(w http.ResponseWriter, _ *http.Request, a *api.Response) {
+			t.serve(w, r, a)
+		}, "/authorize").ServeHTTP(w, authRequest)
+	})
+}
+
+func (t *handler) serve(w http.ResponseWriter, r *http.Request, a *api.Response) {
+	// Partial uploads are kept in the temporary directory Rails authorized,
+	// uploads that go to object storage only have none
+	if a.TempPath == "" {
+		http.Error(w, "Resumable uploads to object storage only are not supported", http.StatusNotImplemented)
+		return
+	}
+	dir := a.TempPath
+
+	if r.Method == "POST" {
+		t.create(w, r, dir, a.MaximumSize)
+		return
+	}
+
+	u, err := loadUpload(dir, r.URL.Query().Get(uploadIDParam))
+	if err == nil && u.Path != r.URL.Path {
+		// Uploads can only be continued at the endpoint they were created for
+		err = errUploadNotFound
+	}
+	if err == errUploadNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: %v", err))
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		t.head(w, r, u)
+	case "PATCH":
+		t.patch(w, r, a, u)
+	case "DELETE":
+		t.terminate(w, r, u)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *handler) create(w http.ResponseWriter, r *http.Request, dir string, maximumSize int64) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if maximumSize > 0 && length > maximumSize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	if _, err := parseFilename(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if removed, err := removeExpiredUploads(dir); err != nil {
+		helper.LogError(r, fmt.Errorf("tus: remove expired uploads: %v", err))
+	} else {
+		tusUploads.WithLabelValues("expired").Add(float64(removed))
+	}
+
+	u, err := createUpload(dir, r.URL.Path, length, metadata)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: create upload: %v", err))
+		return
+	}
+	tusUploads.WithLabelValues("created").Inc()
+
+	location := *r.URL
+	query := location.Query()
+	query.Set(uploadIDParam, u.ID)
+	location.RawQuery = query.Encode()
+
+	w.Header().Set("Location", location.RequestURI())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *handler) head(w http.ResponseWriter, r *http.Request, u *upload) {
+	offset, err := u.offset()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: %v", err))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *handler) terminate(w http.ResponseWriter, r *http.Request, u *upload) {
+	if err := u.lock(); err != nil {
+		t.failLock(w, r, err)
+		return
+	}
+	defer u.unlock()
+
+	if err := u.remove(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: terminate upload: %v", err))
+		return
+	}
+	tusUploads.WithLabelValues("terminated").Inc()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *handler) failLock(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errUploadLocked:
+		http.Error(w, "Upload is in use", http.StatusLocked)
+	case errUploadNotFound:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	default:
+		helper.Fail500(w, r, fmt.Errorf("tus: lock upload: %v", err))
+	}
+}
+
+func (t *handler) patch(w http.ResponseWriter, r *http.Request, a *api.Response, u *upload) {
+	if !helper.IsContentType(offsetContentType, r.Header.Get("Content-Type")) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if err := u.lock(); err != nil {
+		t.failLock(w, r, err)
+		return
+	}
+	defer u.unlock()
+
+	offset, err := u.offset()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: %v", err))
+		return
+	}
+
+	if requestOffset != offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	offset, err = u.append(r.Body, offset)
+	if err == errTooMuchData {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		// Everything up to the new offset is kept, the client can resume
+		helper.Fail500(w, r, fmt.Errorf("tus: append to upload: %v", err))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if offset < u.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	t.complete(w, r, a, u)
+}
+
+// complete saves the upload to its destination and finalizes it with
+// Rails. The partial upload is only removed once Rails accepted it, so a
+// failed finalization can be retried with an empty PATCH request.
+func (t *handler) complete(w http.ResponseWriter, r *http.Request, a *api.Response, u *upload) {
+	filename, _ := parseFilename(u.Metadata)
+
+	opts := filestore.GetOpts(a)
+	opts.TempFilePrefix = filename
+
+	fh, err := filestore.SaveFileFromDisk(r.Context(), u.dataPath(), opts)
+	if err != nil {
+		if err == filestore.ErrEntityTooLarge {
+			helper.RequestEntityTooLarge(w, r, err)
+		} else if clamd.IsInfected(err) {
+			// The upload can't be completed, don't keep it around
+			u.remove()
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
+		} else if filestore.IsChecksumError(err) {
+			u.remove()
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+		} else if filestore.IsContentTypeError(err) {
+			u.remove()
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnsupportedMediaType)
+		} else {
+			helper.Fail500(w, r, fmt.Errorf("tus: save upload: %v", err))
+		}
+		return
+	}
+
+	r.Method = t.method
+	query := r.URL.Query()
+	query.Del(uploadIDParam)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+
+	if err := t.finalize(r, fh); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: finalize upload: %v", err))
+		return
+	}
+
+	cw := helper.NewCountingResponseWriter(w)
+	t.next.ServeHTTP(cw, r)
+
+	if cw.Status() < 200 || cw.Status() >= 300 {
+		return
+	}
+
+	if err := u.remove(); err != nil {
+		log.WithContext(r.Context()).WithError(err).Error("tus: remove completed upload")
+	}
+	tusUploads.WithLabelValues("completed").Inc()
+}
+
+// parseFilename returns the filename from the Upload-Metadata header.
+// Uploads without a filename are called "upload".
+func parseFilename(metadata string) (string, error) {
+	for _, pair := range strings.Split(metadata, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) != 2 || fields[0] != "filename" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid filename metadata: %v", err)
+		}
+
+		filename := string(decoded)
+		if filename == "" || strings.Contains(filename, "/") || filename == "." || filename == ".." {
+			return "", fmt.Errorf("illegal filename: %q", filename)
+		}
+
+		return filename, nil
+	}
+
+	return "upload", nil
+}
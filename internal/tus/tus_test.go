@@ -0,0 +1,287 @@
+package tus
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const uploadPath = "/api/v4/projects/1/packages/maven/foo/bar/1.0/bar-1.0.jar"
+
+type fakeAuthorizer struct {
+	tempPath    string
+	maximumSize int64
+	methods     []string
+}
+
+func (f *fakeAuthorizer) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.methods = append(f.methods, r.Method)
+		next(w, r, &api.Response{TempPath: f.tempPath, MaximumSize: f.maximumSize})
+	})
+}
+
+type finalizedUpload struct {
+	method   string
+	url      string
+	name     string
+	contents string
+}
+
+func startTusServer(t *testing.T) (*httptest.Server, *fakeAuthorizer, chan finalizedUpload) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "tus")
+	require.NoError(t, err)
+
+	finalized := make(chan finalizedUpload, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		contents, err := ioutil.ReadFile(r.PostForm.Get("file.path"))
+		require.NoError(t, err)
+
+		finalized <- finalizedUpload{
+			method:   r.Method,
+			url:      r.URL.String(),
+			name:     r.PostForm.Get("file.name"),
+			contents: string(contents),
+		}
+		w.WriteHeader(201)
+	})
+
+	authorizer := &fakeAuthorizer{tempPath: tempPath}
+	ts := httptest.NewServer(Uploader(authorizer, backend, "PUT", filestore.RewriteBody))
+
+	return ts, authorizer, finalized
+}
+
+func tusRequest(t *testing.T, method string, url string, headers map[string]string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	req.Header.Set("Tus-Resumable", Version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	return resp
+}
+
+func createTestUpload(t *testing.T, ts *httptest.Server, length string) string {
+	resp := tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("bar-1.0.jar")),
+	}, "")
+	require.Equal(t, 201, resp.StatusCode)
+	require.Equal(t, Version, resp.Header.Get("Tus-Resumable"))
+
+	location := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(location, uploadPath+"?upload_id="), "location: %q", location)
+
+	return ts.URL + location
+}
+
+func patchHeaders(offset string) map[string]string {
+	return map[string]string{
+		"Content-Type":  offsetContentType,
+		"Upload-Offset": offset,
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	ts, authorizer, finalized := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	uploadURL := createTestUpload(t, ts, "11")
+
+	resp := tusRequest(t, "PATCH", uploadURL, patchHeaders("0"), "hello")
+	require.Equal(t, 204, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("Upload-Offset"))
+
+	resp = tusRequest(t, "HEAD", uploadURL, nil, "")
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("Upload-Offset"))
+	require.Equal(t, "11", resp.Header.Get("Upload-Length"))
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	resp = tusRequest(t, "PATCH", uploadURL, patchHeaders("3"), "lo world")
+	require.Equal(t, 409, resp.StatusCode, "offset mismatch")
+
+	resp = tusRequest(t, "PATCH", uploadURL, patchHeaders("5"), " world")
+	require.Equal(t, 201, resp.StatusCode, "status from the backend")
+	require.Equal(t, "11", resp.Header.Get("Upload-Offset"))
+
+	upload := <-finalized
+	require.Equal(t, "PUT", upload.method)
+	require.Equal(t, uploadPath, upload.url)
+	require.Equal(t, "bar-1.0.jar", upload.name)
+	require.Equal(t, "hello world", upload.contents)
+
+	for _, method := range authorizer.methods {
+		require.Equal(t, "PUT", method, "pre-authorized like a regular upload")
+	}
+
+	resp = tusRequest(t, "HEAD", uploadURL, nil, "")
+	require.Equal(t, 404, resp.StatusCode, "completed uploads are removed")
+
+	files, err := ioutil.ReadDir(authorizer.tempPath)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestTerminateUpload(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	uploadURL := createTestUpload(t, ts, "11")
+
+	resp := tusRequest(t, "DELETE", uploadURL, nil, "")
+	require.Equal(t, 204, resp.StatusCode)
+
+	resp = tusRequest(t, "PATCH", uploadURL, patchHeaders("0"), "hello")
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestUploadTooMuchData(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	uploadURL := createTestUpload(t, ts, "5")
+
+	resp := tusRequest(t, "PATCH", uploadURL, patchHeaders("0"), "hello world")
+	require.Equal(t, 413, resp.StatusCode)
+
+	resp = tusRequest(t, "HEAD", uploadURL, nil, "")
+	require.Equal(t, "0", resp.Header.Get("Upload-Offset"), "rejected data is dropped")
+}
+
+func TestUploadLargerThanMaximumSize(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	authorizer.maximumSize = 5
+	createTestUpload(t, ts, "5")
+
+	resp := tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{"Upload-Length": "6"}, "")
+	require.Equal(t, 413, resp.StatusCode)
+}
+
+func TestUploadOnlyContinuesAtItsEndpoint(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	uploadURL := createTestUpload(t, ts, "5")
+	otherURL := strings.Replace(uploadURL, "bar-1.0.jar", "other.jar", 1)
+
+	resp := tusRequest(t, "HEAD", otherURL, nil, "")
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestInvalidTusRequests(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	resp := tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "5"}, "")
+	require.Equal(t, 412, resp.StatusCode)
+	require.Equal(t, Version, resp.Header.Get("Tus-Version"))
+
+	resp = tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{"Upload-Defer-Length": "1"}, "")
+	require.Equal(t, 400, resp.StatusCode)
+
+	resp = tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("../etc/passwd")),
+	}, "")
+	require.Equal(t, 400, resp.StatusCode)
+
+	uploadURL := createTestUpload(t, ts, "5")
+	resp = tusRequest(t, "PATCH", uploadURL, map[string]string{"Upload-Offset": "0"}, "hello")
+	require.Equal(t, 415, resp.StatusCode)
+
+	resp = tusRequest(t, "OPTIONS", ts.URL+uploadPath, nil, "")
+	require.Equal(t, 204, resp.StatusCode)
+	require.Equal(t, "creation,termination", resp.Header.Get("Tus-Extension"))
+}
+
+func TestLockedUpload(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	uploadURL := createTestUpload(t, ts, "5")
+	parsedURL, err := url.Parse(uploadURL)
+	require.NoError(t, err)
+
+	// Another process holds the lock on the data file
+	u, err := loadUpload(authorizer.tempPath, parsedURL.Query().Get(uploadIDParam))
+	require.NoError(t, err)
+	require.NoError(t, u.lock())
+
+	resp := tusRequest(t, "PATCH", uploadURL, patchHeaders("0"), "hello")
+	require.Equal(t, 423, resp.StatusCode)
+	resp = tusRequest(t, "DELETE", uploadURL, nil, "")
+	require.Equal(t, 423, resp.StatusCode)
+
+	require.NoError(t, u.remove())
+	u.unlock()
+
+	other := &upload{ID: u.ID, dir: u.dir}
+	require.Equal(t, errUploadNotFound, other.lock())
+}
+
+func TestObjectStorageOnlyUpload(t *testing.T) {
+	ts, authorizer, _ := startTusServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(authorizer.tempPath)
+
+	authorizer.tempPath = ""
+
+	resp := tusRequest(t, "POST", ts.URL+uploadPath, map[string]string{"Upload-Length": "5"}, "")
+	require.Equal(t, 501, resp.StatusCode)
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expired, err := createUpload(dir, uploadPath, 5, "")
+	require.NoError(t, err)
+	active, err := createUpload(dir, uploadPath, 5, "")
+	require.NoError(t, err)
+
+	lastWrite := time.Now().Add(-uploadTTL - time.Minute)
+	require.NoError(t, os.Chtimes(expired.dataPath(), lastWrite, lastWrite))
+
+	removed, err := removeExpiredUploads(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	_, err = loadUpload(dir, expired.ID)
+	require.Equal(t, errUploadNotFound, err)
+	_, err = loadUpload(dir, active.ID)
+	require.NoError(t, err)
+}
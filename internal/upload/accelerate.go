@@ -1,8 +1,10 @@
 package upload
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 
@@ -32,6 +34,71 @@ func Accelerate(rails filestore.PreAuthorizer, h http.Handler) http.Handler {
 	}, "/authorize")
 }
 
+// pypiDigestFields are the form fields with the checksum of the uploaded
+// package, as sent by PyPI clients
+var pypiDigestFields = map[string]string{
+	"md5_digest":    "md5",
+	"sha256_digest": "sha256",
+}
+
+// pypiFileTracker is a savedFileTracker that verifies the checksums sent by
+// PyPI clients
+type pypiFileTracker struct {
+	*savedFileTracker
+}
+
+func (p *pypiFileTracker) ChecksumFields() map[string]string {
+	return pypiDigestFields
+}
+
+// AcceleratePyPI is like Accelerate for PyPI uploads, packages are verified
+// against the md5_digest and sha256_digest fields
+func AcceleratePyPI(rails filestore.PreAuthorizer, h http.Handler) http.Handler {
+	return rails.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		s := &pypiFileTracker{&savedFileTracker{request: r}}
+		HandleFileUploads(w, r, h, a, s)
+	}, "/authorize")
+}
+
+// RewriteMultipart hijacks the body of r, replacing it with a multipart form
+// in which fh is the "file" field, the same way Accelerate rewrites uploaded
+// files.
+func RewriteMultipart(r *http.Request, fh *filestore.FileHandler) error {
+	return RewriteMultipartWithFields(r, fh, nil)
+}
+
+// RewriteMultipartWithFields is like RewriteMultipart, the form also
+// contains the given fields.
+func RewriteMultipartWithFields(r *http.Request, fh *filestore.FileHandler, fields map[string]string) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	finalizeFields, err := fh.GitLabFinalizeFields("file")
+	if err != nil {
+		return err
+	}
+	for key, value := range finalizeFields {
+		writer.WriteField(key, value)
+	}
+
+	s := &savedFileTracker{request: r}
+	if err := s.ProcessFile(r.Context(), "file", fh, writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(&body)
+	r.ContentLength = int64(body.Len())
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return s.Finalize(r.Context())
+}
+
 func (s *savedFileTracker) ProcessFile(_ context.Context, fieldName string, file *filestore.FileHandler, _ *multipart.Writer) error {
 	if s.rewrittenFields == nil {
 		s.rewrittenFields = make(map[string]string)
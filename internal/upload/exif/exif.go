@@ -1,105 +1,122 @@
+/*
+Package exif removes metadata from uploaded images.
+
+By default this is done in-process for JPEG, TIFF, PNG and WebP images.
+SetExiftool switches to running exiftool for JPEG and TIFF images instead.
+Both keep the same whitelist of tags.
+*/
 package exif
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
 	"regexp"
 
-	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var ErrRemovingExif = errors.New("error while removing EXIF")
 
-type cleaner struct {
-	ctx      context.Context
-	cmd      *exec.Cmd
-	stdout   io.Reader
-	stderr   bytes.Buffer
-	waitDone chan struct{}
-	waitErr  error
-}
+// ErrImageTooLarge means that the dimensions of an image exceed the
+// configured maximum
+var ErrImageTooLarge = errors.New("image dimensions are too large")
 
-func NewCleaner(ctx context.Context, stdin io.Reader) (io.Reader, error) {
-	c := &cleaner{
-		ctx:      ctx,
-		waitDone: make(chan struct{}),
-	}
+var (
+	useExiftool bool
 
-	if err := c.startProcessing(stdin); err != nil {
-		return nil, err
-	}
+	maxImageWidth  uint32
+	maxImageHeight uint32
+
+	exiftoolFilenames = regexp.MustCompile(`(?i)\.(jpg|jpeg|tiff)$`)
+	nativeFilenames   = regexp.MustCompile(`(?i)\.(jpg|jpeg|tiff|png|webp)$`)
 
-	return c, nil
+	exiftoolContentTypes = map[string]bool{"image/jpeg": true, "image/tiff": true}
+	nativeContentTypes   = map[string]bool{"image/jpeg": true, "image/tiff": true, "image/png": true, "image/webp": true}
+)
+
+var oversizedImages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_exif_oversized_images",
+		Help: "How many images gitlab-workhorse rejected because their dimensions exceed the configured maximum.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(oversizedImages)
 }
 
-func (c *cleaner) Read(p []byte) (int, error) {
-	n, err := c.stdout.Read(p)
-	if err == io.EOF {
-		if waitErr := c.wait(); waitErr != nil {
-			log.WithFields(c.ctx, log.Fields{
-				"command": c.cmd.Args,
-				"stderr":  c.stderr.String(),
-				"error":   waitErr.Error(),
-			}).Print("exiftool command failed")
-			return n, ErrRemovingExif
-		}
-	}
+// dimensionsError means that an image is larger than the maximum dimensions
+type dimensionsError struct {
+	width  uint32
+	height uint32
+}
 
-	return n, err
+func (e *dimensionsError) Error() string {
+	return fmt.Sprintf("image of %dx%d pixels exceeds %dx%d", e.width, e.height, maxImageWidth, maxImageHeight)
 }
 
-func (c *cleaner) startProcessing(stdin io.Reader) error {
-	var err error
-
-	whitelisted_tags := []string{
-		"-ResolutionUnit",
-		"-XResolution",
-		"-YResolution",
-		"-YCbCrSubSampling",
-		"-YCbCrPositioning",
-		"-BitsPerSample",
-		"-ImageHeight",
-		"-ImageWidth",
-		"-ImageSize",
-		"-Copyright",
-		"-CopyrightNotice",
-		"-Orientation",
+// checkDimensions returns a dimensionsError if the image is too large
+func checkDimensions(width uint32, height uint32) error {
+	if (maxImageWidth > 0 && width > maxImageWidth) || (maxImageHeight > 0 && height > maxImageHeight) {
+		return &dimensionsError{width: width, height: height}
 	}
 
-	args := append([]string{"-all=", "--IPTC:all", "--XMP-iptcExt:all", "-tagsFromFile", "@"}, whitelisted_tags...)
-	args = append(args, "-")
-	c.cmd = exec.CommandContext(c.ctx, "exiftool", args...)
+	return nil
+}
+
+// SetExiftool makes NewCleaner run exiftool instead of the built-in cleaner
+func SetExiftool(enabled bool) {
+	useExiftool = enabled
+}
 
-	c.cmd.Stderr = &c.stderr
-	c.cmd.Stdin = stdin
+// SetMaxImageDimensions makes the built-in cleaner reject images wider or
+// higher than the given number of pixels. Zero means no limit.
+func SetMaxImageDimensions(width uint32, height uint32) {
+	maxImageWidth = width
+	maxImageHeight = height
+}
 
-	c.stdout, err = c.cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %v", err)
+// NewCleaner returns a reader for the image read from stdin without its
+// metadata. Reading returns ErrRemovingExif if the image can't be cleaned
+// and ErrImageTooLarge if it is rejected because of its dimensions.
+func NewCleaner(ctx context.Context, stdin io.Reader) (io.Reader, error) {
+	if useExiftool {
+		return newExiftoolCleaner(ctx, stdin)
 	}
 
-	if err = c.cmd.Start(); err != nil {
-		return fmt.Errorf("start %v: %v", c.cmd.Args, err)
+	return newNativeCleaner(ctx, stdin), nil
+}
+
+// IsExifFile reports whether the metadata of filename should be removed
+func IsExifFile(filename string) bool {
+	if useExiftool {
+		return exiftoolFilenames.MatchString(filename)
 	}
-	go func() {
-		c.waitErr = c.cmd.Wait()
-		close(c.waitDone)
-	}()
 
-	return nil
+	return nativeFilenames.MatchString(filename)
 }
 
-func (c *cleaner) wait() error {
-	<-c.waitDone
-	return c.waitErr
+// IsExifContentType reports whether the metadata of a file with the
+// detected media type contentType should be removed
+func IsExifContentType(contentType string) bool {
+	if useExiftool {
+		return exiftoolContentTypes[contentType]
+	}
+
+	return nativeContentTypes[contentType]
 }
 
-func IsExifFile(filename string) bool {
-	filenameMatch := regexp.MustCompile(`(?i)\.(jpg|jpeg|tiff)$`)
+// IsExifImage reports whether the metadata of filename should be removed,
+// given the media type contentType detected from its first bytes. JPEG and
+// TIFF files are cleaned by name, PNG and WebP files only if they are one
+// of the supported images: they were stored as they are before the
+// built-in cleaner.
+func IsExifImage(filename string, contentType string) bool {
+	if exiftoolFilenames.MatchString(filename) {
+		return true
+	}
 
-	return filenameMatch.MatchString(filename)
+	return IsExifFile(filename) && IsExifContentType(contentType)
 }
@@ -32,6 +32,14 @@ func TestIsExifFile(t *testing.T) {
 			name:     "path.JPG",
 			expected: true,
 		},
+		{
+			name:     "path.png",
+			expected: true,
+		},
+		{
+			name:     "path.webp",
+			expected: true,
+		},
 		{
 			name:     "path.tar",
 			expected: false,
@@ -48,13 +56,41 @@ func TestIsExifFile(t *testing.T) {
 	}
 }
 
-func TestNewCleanerWithValidFile(t *testing.T) {
+func TestIsExifContentType(t *testing.T) {
+	require.True(t, IsExifContentType("image/jpeg"))
+	require.True(t, IsExifContentType("image/webp"))
+	require.False(t, IsExifContentType("image/gif"))
+	require.False(t, IsExifContentType("text/html"))
+}
+
+func TestIsExifImage(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		expected    bool
+	}{
+		{name: "photo.jpg", contentType: "image/jpeg", expected: true},
+		{name: "photo.jpg", contentType: "text/plain", expected: true},
+		{name: "photo.png", contentType: "image/png", expected: true},
+		{name: "photo.webp", contentType: "image/jpeg", expected: true},
+		{name: "photo.png", contentType: "text/plain", expected: false},
+		{name: "photo.webp", contentType: "application/octet-stream", expected: false},
+		{name: "photo", contentType: "image/jpeg", expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" "+test.contentType, func(t *testing.T) {
+			require.Equal(t, test.expected, IsExifImage(test.name, test.contentType))
+		})
+	}
+}
+
+func TestExiftoolCleanerWithValidFile(t *testing.T) {
 	input, err := os.Open("testdata/sample_exif.jpg")
 	require.NoError(t, err)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cleaner, err := NewCleaner(ctx, input)
+	cleaner, err := newExiftoolCleaner(ctx, input)
 	require.NoError(t, err, "Expected no error when creating cleaner command")
 
 	size, err := io.Copy(ioutil.Discard, cleaner)
@@ -64,11 +100,11 @@ func TestNewCleanerWithValidFile(t *testing.T) {
 	require.Equal(t, sizeAfterStrip, size, "Different size of converted image")
 }
 
-func TestNewCleanerWithInvalidFile(t *testing.T) {
+func TestExiftoolCleanerWithInvalidFile(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cleaner, err := NewCleaner(ctx, strings.NewReader("invalid image"))
+	cleaner, err := newExiftoolCleaner(ctx, strings.NewReader("invalid image"))
 	require.NoError(t, err, "Expected no error when creating cleaner command")
 
 	size, err := io.Copy(ioutil.Discard, cleaner)
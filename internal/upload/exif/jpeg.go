@@ -0,0 +1,234 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerAPP0  = 0xe0
+	markerAPP1  = 0xe1
+	markerAPP13 = 0xed
+	markerAPP14 = 0xee
+	markerAPP15 = 0xef
+	markerCOM   = 0xfe
+)
+
+var (
+	jfifHeader      = []byte("JFIF\x00")
+	exifHeader      = []byte("Exif\x00\x00")
+	xmpHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+	adobeHeader     = []byte("Adobe")
+)
+
+// cleanJPEG copies the JPEG image from r to w without the metadata
+// segments. Data after the end of the image is dropped.
+func cleanJPEG(w io.Writer, r *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return err
+	}
+	if soi[0] != 0xff || soi[1] != markerSOI {
+		return errors.New("JPEG: missing SOI marker")
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+
+	marker, err := readMarker(r)
+	for err == nil {
+		if marker == markerEOI {
+			_, err := w.Write([]byte{0xff, marker})
+			return err
+		}
+
+		marker, err = copySegment(w, r, marker)
+	}
+
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copySegment copies the segment starting with marker and returns the
+// marker of the next segment
+func copySegment(w io.Writer, r *bufio.Reader, marker byte) (byte, error) {
+	if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+		// Markers without a segment
+		if _, err := w.Write([]byte{0xff, marker}); err != nil {
+			return 0, err
+		}
+		return readMarker(r)
+	}
+
+	segment, err := readSegment(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// Start of frame segments, except DHT, JPG and DAC which share the range
+	if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc && len(segment) >= 5 {
+		height := uint32(binary.BigEndian.Uint16(segment[1:]))
+		width := uint32(binary.BigEndian.Uint16(segment[3:]))
+		if err := checkDimensions(width, height); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writeSegment(w, marker, cleanSegment(marker, segment)); err != nil {
+		return 0, err
+	}
+
+	if marker == markerSOS {
+		return copyScan(w, r)
+	}
+	return readMarker(r)
+}
+
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("JPEG: expected marker, got 0x%02x", b)
+	}
+
+	// Markers may be preceded by fill bytes
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+
+	return b, nil
+}
+
+func readSegment(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header))
+	if length < 2 {
+		return nil, errors.New("JPEG: invalid segment length")
+	}
+
+	segment := make([]byte, length-2)
+	_, err := io.ReadFull(r, segment)
+	return segment, err
+}
+
+func writeSegment(w io.Writer, marker byte, segment []byte) error {
+	if segment == nil {
+		return nil
+	}
+
+	header := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(segment)
+	return err
+}
+
+// cleanSegment returns the contents of the segment to write, or nil to
+// drop it
+func cleanSegment(marker byte, segment []byte) []byte {
+	switch {
+	case marker == markerAPP0:
+		if !bytes.HasPrefix(segment, jfifHeader) || len(segment) < 14 {
+			return nil
+		}
+		// Without the thumbnail
+		jfif := append([]byte(nil), segment[:14]...)
+		jfif[12], jfif[13] = 0, 0
+		return jfif
+
+	case marker == markerAPP1 && bytes.HasPrefix(segment, exifHeader):
+		exif, err := cleanEXIF(segment[len(exifHeader):])
+		if err != nil || exif == nil {
+			return nil
+		}
+		return limitSegment(append(append([]byte(nil), exifHeader...), exif...))
+
+	case marker == markerAPP1 && bytes.HasPrefix(segment, xmpHeader):
+		xmp, err := filterXMP(segment[len(xmpHeader):])
+		if err != nil || xmp == nil {
+			return nil
+		}
+		return limitSegment(append(append([]byte(nil), xmpHeader...), xmp...))
+
+	case marker == markerAPP13 && bytes.HasPrefix(segment, photoshopHeader):
+		iptc := filterPhotoshop(segment[len(photoshopHeader):])
+		if iptc == nil {
+			return nil
+		}
+		return append(append([]byte(nil), photoshopHeader...), iptc...)
+
+	case marker == markerAPP14 && bytes.HasPrefix(segment, adobeHeader):
+		// Needed to decode the colors correctly
+		return segment
+
+	case marker >= markerAPP0 && marker <= markerAPP15, marker == markerCOM:
+		return nil
+	}
+
+	return segment
+}
+
+func limitSegment(segment []byte) []byte {
+	if len(segment) > 0xffff-2 {
+		return nil
+	}
+	return segment
+}
+
+// copyScan copies entropy-coded data and returns the marker that follows it
+func copyScan(w io.Writer, r *bufio.Reader) (byte, error) {
+	for {
+		data, err := r.ReadSlice(0xff)
+		if err == bufio.ErrBufferFull {
+			if _, err := w.Write(data); err != nil {
+				return 0, err
+			}
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if _, err := w.Write(data[:len(data)-1]); err != nil {
+			return 0, err
+		}
+
+		b, err := r.ReadByte()
+		for err == nil && b == 0xff {
+			b, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Stuffed zero bytes and restart markers are part of the scan
+		if b == 0 || (b >= 0xd0 && b <= 0xd7) {
+			if _, err := w.Write([]byte{0xff, b}); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		return b, nil
+	}
+}
@@ -0,0 +1,192 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+// The tags kept from the EXIF IFD0, these are the tags exiftool is told
+// to copy back. CopyrightNotice is part of IPTC, which is kept as a whole
+// like the IPTC Extension XMP properties.
+var exifTags = map[uint16]bool{
+	256:   true, // ImageWidth
+	257:   true, // ImageHeight
+	258:   true, // BitsPerSample
+	274:   true, // Orientation
+	282:   true, // XResolution
+	283:   true, // YResolution
+	296:   true, // ResolutionUnit
+	530:   true, // YCbCrSubSampling
+	531:   true, // YCbCrPositioning
+	33432: true, // Copyright
+}
+
+// The tags kept in TIFF images: the whitelisted tags and everything needed
+// to display the image
+var tiffTags = map[uint16]bool{
+	254: true, // NewSubfileType
+	255: true, // SubfileType
+	259: true, // Compression
+	262: true, // PhotometricInterpretation
+	263: true, // Threshholding
+	264: true, // CellWidth
+	265: true, // CellLength
+	266: true, // FillOrder
+	273: true, // StripOffsets
+	277: true, // SamplesPerPixel
+	278: true, // RowsPerStrip
+	279: true, // StripByteCounts
+	280: true, // MinSampleValue
+	281: true, // MaxSampleValue
+	284: true, // PlanarConfiguration
+	290: true, // GrayResponseUnit
+	291: true, // GrayResponseCurve
+	292: true, // T4Options
+	293: true, // T6Options
+	301: true, // TransferFunction
+	317: true, // Predictor
+	318: true, // WhitePoint
+	319: true, // PrimaryChromaticities
+	320: true, // ColorMap
+	321: true, // HalftoneHints
+	322: true, // TileWidth
+	323: true, // TileLength
+	324: true, // TileOffsets
+	325: true, // TileByteCounts
+	332: true, // InkSet
+	334: true, // NumberOfInks
+	338: true, // ExtraSamples
+	339: true, // SampleFormat
+	340: true, // SMinSampleValue
+	341: true, // SMaxSampleValue
+	347: true, // JPEGTables
+	512: true, // JPEGProc
+	513: true, // JPEGInterchangeFormat
+	514: true, // JPEGInterchangeFormatLength
+	529: true, // YCbCrCoefficients
+	532: true, // ReferenceBlackWhite
+	// IPTC-NAA
+	33723: true,
+}
+
+func init() {
+	for tag := range exifTags {
+		tiffTags[tag] = true
+	}
+}
+
+// tiffImageFilter keeps the tiffTags, and the IPTC parts of XMP and
+// Photoshop tags
+func tiffImageFilter(tag uint16, value []byte) []byte {
+	switch tag {
+	case 700: // XMP
+		filtered, _ := filterXMP(value)
+		return filtered
+	case 34377: // Photoshop
+		return filterPhotoshop(value)
+	}
+
+	if tiffTags[tag] {
+		return value
+	}
+	return nil
+}
+
+// Larger metadata chunks are dropped instead of being cleaned
+const maxMetadataChunk = 16 * 1024 * 1024
+
+var errUnknownFormat = errors.New("unsupported image format")
+
+// newNativeCleaner removes the metadata in a goroutine
+func newNativeCleaner(ctx context.Context, stdin io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		// JPEG scans are copied in many small writes
+		w := bufio.NewWriterSize(pw, 32*1024)
+		err := clean(w, stdin)
+		if err == nil {
+			err = w.Flush()
+		}
+
+		if _, ok := err.(*dimensionsError); ok {
+			oversizedImages.Inc()
+			log.WithContext(ctx).WithError(err).Print("rejected image")
+			pw.CloseWithError(ErrImageTooLarge)
+			return
+		} else if err != nil {
+			log.WithContext(ctx).WithError(err).Print("failed to remove image metadata")
+			pw.CloseWithError(ErrRemovingExif)
+			return
+		}
+		pw.Close()
+	}()
+
+	go func() {
+		// Stops clean if nobody reads the output anymore
+		<-ctx.Done()
+		pr.CloseWithError(ctx.Err())
+	}()
+
+	return pr
+}
+
+func clean(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(12)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8, 0xff}):
+		return cleanJPEG(w, br)
+	case bytes.HasPrefix(magic, pngSignature):
+		return cleanPNG(w, br)
+	case bytes.HasPrefix(magic, []byte("II*\x00")), bytes.HasPrefix(magic, []byte("MM\x00*")):
+		return withTempFile(br, func(f *os.File, size int64) error {
+			return cleanTIFF(w, f, size)
+		})
+	case len(magic) == 12 && string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		return withTempFile(br, func(f *os.File, size int64) error {
+			return cleanWebP(w, f, size)
+		})
+	default:
+		return errUnknownFormat
+	}
+}
+
+// withTempFile stores r in a temporary file for formats that can't be
+// cleaned while streaming
+func withTempFile(r io.Reader, process func(f *os.File, size int64) error) error {
+	f, err := ioutil.TempFile("", "gitlab-workhorse-exif")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return process(f, size)
+}
+
+func cleanTIFF(w io.Writer, r io.ReaderAt, size int64) error {
+	f, err := readTIFF(r, size, tiffImageFilter, maxTIFFPages)
+	if err != nil {
+		return err
+	}
+
+	if err := f.checkDimensions(); err != nil {
+		return err
+	}
+
+	return f.writeTo(w)
+}
@@ -0,0 +1,494 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:ext="http://iptc.org/std/Iptc4xmpExt/2008-02-29/"
+    ext:DigitalSourceType="digitalCapture"
+    dc:format="image/jpeg">
+   <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li></rdf:Seq></dc:creator>
+   <ext:LocationShown><rdf:Bag><rdf:li rdf:parseType="Resource"><ext:City>Utrecht &amp; surroundings</ext:City></rdf:li></rdf:Bag></ext:LocationShown>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+type testTag struct {
+	tag   uint16
+	typ   uint16
+	value []byte
+}
+
+func shortTag(tag uint16, v uint16) testTag {
+	value := make([]byte, 2)
+	binary.LittleEndian.PutUint16(value, v)
+	return testTag{tag: tag, typ: tiffShort, value: value}
+}
+
+func longTag(tag uint16, v uint32) testTag {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, v)
+	return testTag{tag: tag, typ: tiffLong, value: value}
+}
+
+func asciiTag(tag uint16, v string) testTag {
+	return testTag{tag: tag, typ: 2, value: []byte(v + "\x00")}
+}
+
+// buildTIFF builds a little endian TIFF file with one IFD per page. The
+// image data of each page is referenced by StripOffsets.
+func buildTIFF(pages [][]testTag, strips [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+
+	// Where to store the offset of the next IFD
+	nextPointer := 4
+	for i, tags := range pages {
+		stripOffset := buf.Len()
+		buf.Write(strips[i])
+		if buf.Len()%2 == 1 {
+			buf.WriteByte(0)
+		}
+
+		tags = append(tags, longTag(273, uint32(stripOffset)), longTag(279, uint32(len(strips[i]))))
+		ifdOffset := buf.Len()
+		valueOffset := ifdOffset + 2 + 12*len(tags) + 4
+
+		ifd := new(bytes.Buffer)
+		values := new(bytes.Buffer)
+		binary.Write(ifd, binary.LittleEndian, uint16(len(tags)))
+		for _, t := range tags {
+			binary.Write(ifd, binary.LittleEndian, t.tag)
+			binary.Write(ifd, binary.LittleEndian, t.typ)
+			binary.Write(ifd, binary.LittleEndian, uint32(uint64(len(t.value))/tiffTypeSizes[t.typ]))
+			if len(t.value) <= 4 {
+				ifd.Write(append(t.value, make([]byte, 4-len(t.value))...))
+			} else {
+				binary.Write(ifd, binary.LittleEndian, uint32(valueOffset+values.Len()))
+				values.Write(t.value)
+				if values.Len()%2 == 1 {
+					values.WriteByte(0)
+				}
+			}
+		}
+		binary.Write(ifd, binary.LittleEndian, uint32(0))
+
+		data := buf.Bytes()
+		binary.LittleEndian.PutUint32(data[nextPointer:], uint32(ifdOffset))
+		nextPointer = ifdOffset + ifd.Len() - 4
+
+		buf.Write(ifd.Bytes())
+		buf.Write(values.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func testEXIF() []byte {
+	return buildTIFF([][]testTag{{
+		asciiTag(271, "Camera Maker"),
+		asciiTag(272, "Camera Model"),
+		shortTag(274, 6),
+		asciiTag(315, "Jane Doe"),
+		asciiTag(33432, "Copyright Jane Doe"),
+		longTag(34853, 8),
+	}}, [][]byte{nil})
+}
+
+func requireCleanEXIF(t *testing.T, exif []byte) {
+	f, err := readTIFF(bytes.NewReader(exif), int64(len(exif)), func(_ uint16, value []byte) []byte { return value }, 2)
+	require.NoError(t, err)
+	require.Len(t, f.ifds, 1, "thumbnails are removed")
+
+	var tags []uint16
+	for _, e := range f.ifds[0].entries {
+		tags = append(tags, e.tag)
+	}
+	require.Equal(t, []uint16{274, 33432}, tags)
+	require.Contains(t, string(exif), "Copyright Jane Doe")
+}
+
+func requireCleanXMP(t *testing.T, xmp []byte) {
+	require.Contains(t, string(xmp), "DigitalSourceType>digitalCapture<")
+	require.Contains(t, string(xmp), "Utrecht &amp; surroundings")
+	require.NotContains(t, string(xmp), "Jane Doe")
+	require.NotContains(t, string(xmp), "image/jpeg")
+}
+
+func cleanBytes(t *testing.T, input []byte) []byte {
+	var output bytes.Buffer
+	require.NoError(t, clean(&output, bytes.NewReader(input)))
+	return output.Bytes()
+}
+
+func testImage() image.Image {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	return img
+}
+
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+func jpegSegments(t *testing.T, data []byte) []jpegSegment {
+	var segments []jpegSegment
+	r := bufio.NewReader(bytes.NewReader(data[2:]))
+	for {
+		marker, err := readMarker(r)
+		require.NoError(t, err)
+		if marker == markerSOS || marker == markerEOI {
+			return segments
+		}
+
+		segment, err := readSegment(r)
+		require.NoError(t, err)
+		segments = append(segments, jpegSegment{marker, segment})
+	}
+}
+
+func TestCleanJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, jpeg.Encode(&encoded, testImage(), nil))
+
+	var input bytes.Buffer
+	input.Write(encoded.Bytes()[:2])
+	for _, s := range []jpegSegment{
+		{markerAPP0, []byte("JFIF\x00\x01\x01\x01\x00\x48\x00\x48\x01\x01\xff\xff\xff")},
+		{markerAPP1, append([]byte("Exif\x00\x00"), testEXIF()...)},
+		{markerAPP1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), testXMP...)},
+		{0xe2, []byte("ICC_PROFILE\x00\x01\x01profile")},
+		{markerAPP13, []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x04iptc8BIM\x04\x0c\x00\x00\x00\x00\x00\x05thumb\x00")},
+		{markerAPP14, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01")},
+		{markerCOM, []byte("a comment")},
+	} {
+		writeSegment(&input, s.marker, s.data)
+	}
+	input.Write(encoded.Bytes()[2:])
+	input.WriteString("trailer")
+
+	output := cleanBytes(t, input.Bytes())
+
+	segments := jpegSegments(t, output)
+	require.Equal(t, byte(markerAPP0), segments[0].marker)
+	require.Equal(t, "JFIF\x00\x01\x01\x01\x00\x48\x00\x48\x00\x00", string(segments[0].data), "thumbnail removed")
+
+	var exif, xmp, photoshop []byte
+	for _, s := range segments {
+		require.NotEqual(t, byte(0xe2), s.marker, "ICC profile removed")
+		require.NotEqual(t, byte(markerCOM), s.marker, "comment removed")
+
+		switch {
+		case bytes.HasPrefix(s.data, exifHeader):
+			exif = s.data[len(exifHeader):]
+		case bytes.HasPrefix(s.data, xmpHeader):
+			xmp = s.data[len(xmpHeader):]
+		case bytes.HasPrefix(s.data, photoshopHeader):
+			photoshop = s.data[len(photoshopHeader):]
+		}
+	}
+
+	requireCleanEXIF(t, exif)
+	requireCleanXMP(t, xmp)
+	require.Equal(t, "8BIM\x04\x04\x00\x00\x00\x00\x00\x04iptc", string(photoshop))
+	require.True(t, bytes.HasSuffix(output, []byte{0xff, markerEOI}), "trailer removed")
+
+	img, err := jpeg.Decode(bytes.NewReader(output))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 16, 16), img.Bounds())
+}
+
+func TestCleanJPEGSample(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/sample_exif.jpg")
+	require.NoError(t, err)
+
+	output := cleanBytes(t, input)
+	require.True(t, len(output) < len(input))
+	require.NotContains(t, string(output), "GIMP")
+
+	_, err = jpeg.Decode(bytes.NewReader(output))
+	require.NoError(t, err)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	var buf bytes.Buffer
+	writePNGChunk(&buf, chunkType, data)
+	return buf.Bytes()
+}
+
+func TestCleanPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, testImage()))
+
+	var compressedXMP bytes.Buffer
+	zw := zlib.NewWriter(&compressedXMP)
+	zw.Write([]byte(testXMP))
+	zw.Close()
+
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	var input bytes.Buffer
+	input.Write(encoded.Bytes()[:ihdrEnd])
+	input.Write(pngChunk("tEXt", []byte("Author\x00Jane Doe")))
+	input.Write(pngChunk("iTXt", append([]byte(pngXMPKeyword+"\x00\x01\x00en\x00\x00"), compressedXMP.Bytes()...)))
+	input.Write(pngChunk("eXIf", testEXIF()))
+	input.Write(pngChunk("tIME", []byte{0x07, 0xe3, 1, 2, 3, 4, 5}))
+	input.Write(pngChunk("pHYs", []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}))
+	input.Write(encoded.Bytes()[ihdrEnd:])
+	input.WriteString("trailer")
+
+	output := cleanBytes(t, input.Bytes())
+
+	chunks := make(map[string][]byte)
+	for data := output[len(pngSignature):]; len(data) > 0; {
+		length := binary.BigEndian.Uint32(data)
+		chunk := data[4 : 8+length]
+		require.Equal(t, crc32.ChecksumIEEE(chunk), binary.BigEndian.Uint32(data[8+length:]))
+		chunks[string(chunk[:4])] = chunk[4:]
+		data = data[12+length:]
+	}
+
+	require.NotContains(t, chunks, "tEXt")
+	require.NotContains(t, chunks, "tIME")
+	require.Contains(t, chunks, "pHYs")
+	requireCleanEXIF(t, chunks["eXIf"])
+	require.True(t, bytes.HasPrefix(chunks["iTXt"], []byte(pngXMPKeyword+"\x00\x00\x00\x00\x00")))
+	requireCleanXMP(t, chunks["iTXt"])
+
+	img, err := png.Decode(bytes.NewReader(output))
+	require.NoError(t, err)
+	require.Equal(t, testImage(), img)
+}
+
+func TestCleanTIFF(t *testing.T) {
+	page := []testTag{
+		longTag(256, 2),
+		longTag(257, 2),
+		shortTag(258, 8),
+		shortTag(259, 1),
+		shortTag(262, 1),
+		asciiTag(271, "Camera Maker"),
+		asciiTag(272, "Camera Model"),
+		shortTag(274, 6),
+		shortTag(277, 1),
+		longTag(278, 2),
+		asciiTag(305, "Image Editor"),
+		testTag{tag: 700, typ: 1, value: []byte(testXMP)},
+		asciiTag(33432, "Copyright Jane Doe"),
+		longTag(34665, 8),
+	}
+	input := buildTIFF([][]testTag{page, page}, [][]byte{[]byte("abcd"), []byte("efg")})
+
+	output := cleanBytes(t, input)
+
+	f, err := readTIFF(bytes.NewReader(output), int64(len(output)), func(_ uint16, value []byte) []byte { return value }, maxTIFFPages)
+	require.NoError(t, err)
+	require.Len(t, f.ifds, 2)
+
+	for i, strip := range []string{"abcd", "efg"} {
+		var tags []uint16
+		for _, e := range f.ifds[i].entries {
+			tags = append(tags, e.tag)
+			if e.tag == 700 {
+				requireCleanXMP(t, e.value)
+			}
+		}
+		require.Equal(t, []uint16{256, 257, 258, 259, 262, 273, 274, 277, 278, 279, 700, 33432}, tags)
+
+		section := f.ifds[i].data[273][0]
+		data := make([]byte, section.size)
+		_, err := bytes.NewReader(output).ReadAt(data, section.offset)
+		require.NoError(t, err)
+		require.Equal(t, strip, string(data))
+	}
+
+	require.NotContains(t, string(output), "Camera")
+	require.NotContains(t, string(output), "Image Editor")
+}
+
+func webpChunkBytes(fourCC string, data []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestCleanWebP(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagICC | webpFlagEXIF | webpFlagXMP | 0x10
+
+	body := []byte("WEBP")
+	body = append(body, webpChunkBytes("VP8X", vp8x)...)
+	body = append(body, webpChunkBytes("ICCP", []byte("profile"))...)
+	body = append(body, webpChunkBytes("ALPH", []byte("alpha"))...)
+	body = append(body, webpChunkBytes("VP8L", []byte("image data"))...)
+	body = append(body, webpChunkBytes("EXIF", testEXIF())...)
+	body = append(body, webpChunkBytes("XMP ", []byte(testXMP))...)
+	body = append(body, webpChunkBytes("JUNK", []byte("unknown"))...)
+
+	input := append([]byte("RIFF\x00\x00\x00\x00"), body...)
+	binary.LittleEndian.PutUint32(input[4:], uint32(len(body)))
+	input = append(input, "trailer"...)
+
+	output := cleanBytes(t, input)
+	require.Equal(t, "RIFF", string(output[:4]))
+	require.Equal(t, "WEBP", string(output[8:12]))
+	require.Equal(t, len(output)-8, int(binary.LittleEndian.Uint32(output[4:])))
+
+	var fourCCs []string
+	chunks := make(map[string][]byte)
+	for data := output[12:]; len(data) > 0; {
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		fourCC := string(data[:4])
+		fourCCs = append(fourCCs, fourCC)
+		chunks[fourCC] = data[8 : 8+size]
+		data = data[8+size+size%2:]
+	}
+
+	require.Equal(t, []string{"VP8X", "ALPH", "VP8L", "EXIF", "XMP "}, fourCCs)
+	require.Equal(t, byte(webpFlagEXIF|webpFlagXMP|0x10), chunks["VP8X"][0])
+	require.Equal(t, "image data", string(chunks["VP8L"]))
+	requireCleanEXIF(t, chunks["EXIF"])
+	requireCleanXMP(t, chunks["XMP "])
+}
+
+func TestCleanInvalidImages(t *testing.T) {
+	sample, err := ioutil.ReadFile("testdata/sample_exif.jpg")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "unknown format", input: []byte("invalid image")},
+		{name: "truncated JPEG", input: sample[:1000]},
+		{name: "truncated PNG", input: pngSignature},
+		{name: "invalid TIFF", input: []byte("II*\x00\xff\xff\xff\xff")},
+		{name: "TIFF IFD loop", input: []byte("II*\x00\x08\x00\x00\x00\x00\x00\x08\x00\x00\x00")},
+		{name: "truncated WebP", input: []byte("RIFF\xff\x00\x00\x00WEBPVP8L\xff\x00\x00\x00")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cleaner, err := NewCleaner(ctx, bytes.NewReader(test.input))
+			require.NoError(t, err)
+
+			_, err = io.Copy(ioutil.Discard, cleaner)
+			require.Equal(t, ErrRemovingExif, err)
+		})
+	}
+}
+
+func TestCleanImagesTooLarge(t *testing.T) {
+	SetMaxImageDimensions(8, 8)
+	defer SetMaxImageDimensions(0, 0)
+
+	var pngImage, jpegImage bytes.Buffer
+	require.NoError(t, png.Encode(&pngImage, testImage()))
+	require.NoError(t, jpeg.Encode(&jpegImage, testImage(), nil))
+
+	// A canvas of 16x2 pixels, both fields store the size minus one
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBP"), webpChunkBytes("VP8X", []byte{0, 0, 0, 0, 15, 0, 0, 1, 0, 0})...)
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "PNG", input: pngImage.Bytes()},
+		{name: "JPEG", input: jpegImage.Bytes()},
+		{name: "TIFF", input: buildTIFF([][]testTag{{longTag(256, 16), longTag(257, 2)}}, [][]byte{[]byte("strip")})},
+		{name: "WebP", input: webp},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleaner, err := NewCleaner(context.Background(), bytes.NewReader(test.input))
+			require.NoError(t, err)
+
+			_, err = io.Copy(ioutil.Discard, cleaner)
+			require.Equal(t, ErrImageTooLarge, err)
+		})
+	}
+}
+
+func TestNativeCleanerStopsWithContext(t *testing.T) {
+	sample, err := ioutil.ReadFile("testdata/sample_exif.jpg")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cleaner, err := NewCleaner(ctx, bytes.NewReader(sample))
+	require.NoError(t, err)
+	cancel()
+
+	_, err = io.Copy(ioutil.Discard, cleaner)
+	require.Error(t, err)
+}
+
+func TestSetExiftool(t *testing.T) {
+	SetExiftool(true)
+	defer SetExiftool(false)
+
+	require.True(t, IsExifFile("path.jpg"))
+	require.False(t, IsExifFile("path.png"), "exiftool is only used for JPEG and TIFF")
+}
+
+func benchmarkCleaner(b *testing.B) {
+	sample, err := ioutil.ReadFile("testdata/sample_exif.jpg")
+	require.NoError(b, err)
+
+	b.SetBytes(int64(len(sample)))
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cleaner, err := NewCleaner(ctx, bytes.NewReader(sample))
+		require.NoError(b, err)
+
+		_, err = io.Copy(ioutil.Discard, cleaner)
+		require.NoError(b, err)
+		cancel()
+	}
+}
+
+func BenchmarkNativeCleaner(b *testing.B) {
+	benchmarkCleaner(b)
+}
+
+func BenchmarkExiftoolCleaner(b *testing.B) {
+	if _, err := exec.LookPath("exiftool"); err != nil {
+		b.Skip("exiftool not found")
+	}
+
+	SetExiftool(true)
+	defer SetExiftool(false)
+
+	benchmarkCleaner(b)
+}
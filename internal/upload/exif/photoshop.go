@@ -0,0 +1,54 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The Photoshop image resource with the IPTC-NAA record
+const iptcResourceID = 0x0404
+
+// filterPhotoshop returns the Photoshop image resources in data with only
+// the IPTC-NAA record, or nil if there is none.
+func filterPhotoshop(data []byte) []byte {
+	var out bytes.Buffer
+
+	for len(data) >= 4 && string(data[:4]) == "8BIM" {
+		start := data
+		data = data[4:]
+		if len(data) < 3 {
+			return nil
+		}
+
+		id := binary.BigEndian.Uint16(data)
+
+		// The name is a Pascal string padded to an even size
+		nameSize := 1 + int(data[2])
+		nameSize += nameSize & 1
+		if len(data) < 2+nameSize+4 {
+			return nil
+		}
+		data = data[2+nameSize:]
+
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || size > len(data) {
+			return nil
+		}
+		size += size & 1
+		if size > len(data) {
+			size = len(data)
+		}
+		data = data[size:]
+
+		if id == iptcResourceID {
+			out.Write(start[:len(start)-len(data)])
+		}
+	}
+
+	if out.Len() == 0 {
+		return nil
+	}
+
+	return out.Bytes()
+}
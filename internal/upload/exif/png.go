@@ -0,0 +1,181 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Ancillary chunks needed to display the image. Unknown critical chunks
+// are always kept.
+var pngChunks = map[string]bool{
+	"tRNS": true,
+	"cHRM": true,
+	"gAMA": true,
+	"sBIT": true,
+	"sRGB": true,
+	"bKGD": true,
+	"hIST": true,
+	"pHYs": true,
+	"sPLT": true,
+	"acTL": true,
+	"fcTL": true,
+	"fdAT": true,
+}
+
+// cleanPNG copies the PNG image from r to w without the text and metadata
+// chunks. Data after the IEND chunk is dropped.
+func cleanPNG(w io.Writer, r *bufio.Reader) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return err
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return errors.New("PNG: invalid signature")
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		if length > 1<<31-1 {
+			return errors.New("PNG: invalid chunk length")
+		}
+
+		// The chunk data with its CRC
+		chunk := io.LimitReader(r, int64(length)+4)
+		chunkType := string(header[4:])
+
+		if chunkType == "IHDR" && length >= 8 {
+			ihdr, err := r.Peek(8)
+			if err != nil {
+				return err
+			}
+			if err := checkDimensions(binary.BigEndian.Uint32(ihdr), binary.BigEndian.Uint32(ihdr[4:])); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		switch {
+		case chunkType == "eXIf" || chunkType == "iTXt":
+			err = cleanPNGChunk(w, chunkType, chunk, length)
+		case pngChunks[chunkType] || (chunkType[0]&0x20) == 0:
+			err = copyPNGChunk(w, header, chunk, length)
+		default:
+			_, err = io.Copy(ioutil.Discard, chunk)
+		}
+		if err != nil {
+			return err
+		}
+
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+func copyPNGChunk(w io.Writer, header []byte, chunk io.Reader, length uint32) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, chunk)
+	if err == nil && n != int64(length)+4 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// cleanPNGChunk writes the whitelisted parts of EXIF and XMP chunks
+func cleanPNGChunk(w io.Writer, chunkType string, chunk io.Reader, length uint32) error {
+	if length > maxMetadataChunk {
+		_, err := io.Copy(ioutil.Discard, chunk)
+		return err
+	}
+
+	data := make([]byte, length+4)
+	if _, err := io.ReadFull(chunk, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	data = data[:length]
+
+	var cleaned []byte
+	if chunkType == "eXIf" {
+		cleaned, _ = cleanEXIF(data)
+	} else if xmp := pngXMP(data); xmp != nil {
+		if xmp, _ = filterXMP(xmp); xmp != nil {
+			// An uncompressed iTXt chunk without language
+			cleaned = append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), xmp...)
+		}
+	}
+
+	if cleaned == nil {
+		return nil
+	}
+
+	return writePNGChunk(w, chunkType, cleaned)
+}
+
+// pngXMP returns the XMP packet of an iTXt chunk, or nil if it is another
+// kind of text
+func pngXMP(data []byte) []byte {
+	fields := bytes.SplitN(data, []byte{0}, 2)
+	if len(fields) != 2 || string(fields[0]) != pngXMPKeyword || len(fields[1]) < 2 {
+		return nil
+	}
+
+	compressed := fields[1][0] == 1
+	// Skip the compression flag and method, the language and the
+	// translated keyword
+	text := bytes.SplitN(fields[1][2:], []byte{0}, 3)
+	if len(text) != 3 {
+		return nil
+	}
+
+	if !compressed {
+		return text[2]
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(text[2]))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+
+	xmp, err := ioutil.ReadAll(io.LimitReader(zr, maxMetadataChunk))
+	if err != nil {
+		return nil
+	}
+
+	return xmp
+}
+
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	chunk := make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	copy(chunk[8:], data)
+	binary.BigEndian.PutUint32(chunk[8+len(data):], crc32.ChecksumIEEE(chunk[4:8+len(data)]))
+
+	_, err := w.Write(chunk)
+	return err
+}
@@ -0,0 +1,446 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	tiffShort = 3
+	tiffLong  = 4
+
+	// Limits to protect against malicious files
+	maxTIFFPages      = 1024
+	maxTIFFIFDEntries = 4096
+)
+
+// Sizes of the TIFF field types
+var tiffTypeSizes = map[uint16]uint64{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+}
+
+// Tags pointing at image data, with the tag holding the size of the data
+var tiffDataTags = map[uint16]uint16{
+	273: 279, // StripOffsets, StripByteCounts
+	324: 325, // TileOffsets, TileByteCounts
+	513: 514, // JPEGInterchangeFormat, JPEGInterchangeFormatLength
+}
+
+var errNotTIFF = errors.New("invalid TIFF header")
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value is in the byte order of the file
+	value []byte
+}
+
+type tiffSection struct {
+	offset int64
+	size   int64
+}
+
+type tiffIFD struct {
+	entries []tiffEntry
+	// data are the sections of image data referenced by the data tags
+	data map[uint16][]tiffSection
+}
+
+// tiffFile is a TIFF file, or the TIFF structure of an EXIF block, with
+// only the whitelisted tags.
+type tiffFile struct {
+	r     io.ReaderAt
+	size  int64
+	order binary.ByteOrder
+	ifds  []*tiffIFD
+}
+
+// tiffFilter decides which tags are kept. It returns the new value for a
+// tag, or nil to remove it.
+type tiffFilter func(tag uint16, value []byte) []byte
+
+func whitelistFilter(tags map[uint16]bool) tiffFilter {
+	return func(tag uint16, value []byte) []byte {
+		if tags[tag] {
+			return value
+		}
+		return nil
+	}
+}
+
+// readTIFF reads at most maxPages IFDs of the TIFF structure in r and
+// applies filter to their entries.
+func readTIFF(r io.ReaderAt, size int64, filter tiffFilter, maxPages int) (*tiffFile, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errNotTIFF
+	}
+
+	f := &tiffFile{r: r, size: size}
+	switch string(header[:4]) {
+	case "II*\x00":
+		f.order = binary.LittleEndian
+	case "MM\x00*":
+		f.order = binary.BigEndian
+	default:
+		return nil, errNotTIFF
+	}
+
+	visited := make(map[uint32]bool)
+	offset := f.order.Uint32(header[4:])
+	for offset != 0 && len(f.ifds) < maxPages {
+		if visited[offset] {
+			return nil, errors.New("TIFF: IFD loop")
+		}
+		visited[offset] = true
+
+		ifd, next, err := f.readIFD(int64(offset))
+		if err != nil {
+			return nil, err
+		}
+
+		f.ifds = append(f.ifds, ifd)
+		offset = next
+	}
+
+	if len(f.ifds) == 0 {
+		return nil, errors.New("TIFF: no IFD")
+	}
+
+	for _, ifd := range f.ifds {
+		for i := range ifd.entries {
+			e := &ifd.entries[i]
+			if e.value = filter(e.tag, e.value); e.value == nil {
+				delete(ifd.data, e.tag)
+				continue
+			}
+			e.count = uint32(uint64(len(e.value)) / tiffTypeSizes[e.typ])
+		}
+	}
+
+	return f, nil
+}
+
+func (f *tiffFile) readAt(offset int64, size uint64) ([]byte, error) {
+	if offset < 0 || size > uint64(f.size) || uint64(offset)+size > uint64(f.size) {
+		return nil, errors.New("TIFF: offset out of bounds")
+	}
+
+	buf := make([]byte, size)
+	if _, err := f.r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("TIFF: %v", err)
+	}
+
+	return buf, nil
+}
+
+func (f *tiffFile) readIFD(offset int64) (*tiffIFD, uint32, error) {
+	countBytes, err := f.readAt(offset, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := f.order.Uint16(countBytes)
+	if count > maxTIFFIFDEntries {
+		return nil, 0, errors.New("TIFF: too many IFD entries")
+	}
+
+	raw, err := f.readAt(offset+2, uint64(count)*12+4)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ifd := &tiffIFD{data: make(map[uint16][]tiffSection)}
+	all := make(map[uint16]tiffEntry)
+	for i := 0; i < int(count); i++ {
+		field := raw[i*12 : (i+1)*12]
+		e := tiffEntry{
+			tag:   f.order.Uint16(field),
+			typ:   f.order.Uint16(field[2:]),
+			count: f.order.Uint32(field[4:]),
+		}
+
+		typeSize, ok := tiffTypeSizes[e.typ]
+		if !ok {
+			// Readers must skip unknown types
+			continue
+		}
+
+		valueSize := typeSize * uint64(e.count)
+		if valueSize <= 4 {
+			e.value = append([]byte(nil), field[8:8+valueSize]...)
+		} else if e.value, err = f.readAt(int64(f.order.Uint32(field[8:])), valueSize); err != nil {
+			return nil, 0, err
+		}
+
+		all[e.tag] = e
+		ifd.entries = append(ifd.entries, e)
+	}
+
+	for offsetsTag, sizesTag := range tiffDataTags {
+		offsets, hasOffsets := all[offsetsTag]
+		sizes, hasSizes := all[sizesTag]
+		if !hasOffsets {
+			continue
+		}
+
+		sections, err := f.dataSections(offsets, sizes, hasSizes)
+		if err != nil {
+			return nil, 0, err
+		}
+		ifd.data[offsetsTag] = sections
+	}
+
+	return ifd, f.order.Uint32(raw[len(raw)-4:]), nil
+}
+
+func (f *tiffFile) dataSections(offsets tiffEntry, sizes tiffEntry, hasSizes bool) ([]tiffSection, error) {
+	if !hasSizes {
+		return nil, fmt.Errorf("TIFF: tag %d without sizes", offsets.tag)
+	}
+
+	o, err := f.uints(offsets)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.uints(sizes)
+	if err != nil {
+		return nil, err
+	}
+	if len(o) != len(s) {
+		return nil, fmt.Errorf("TIFF: tag %d has %d offsets but %d sizes", offsets.tag, len(o), len(s))
+	}
+
+	sections := make([]tiffSection, len(o))
+	for i := range o {
+		if uint64(o[i])+uint64(s[i]) > uint64(f.size) {
+			return nil, errors.New("TIFF: image data out of bounds")
+		}
+		sections[i] = tiffSection{offset: int64(o[i]), size: int64(s[i])}
+	}
+
+	return sections, nil
+}
+
+func (f *tiffFile) uints(e tiffEntry) ([]uint32, error) {
+	values := make([]uint32, e.count)
+	for i := range values {
+		switch e.typ {
+		case tiffShort:
+			values[i] = uint32(f.order.Uint16(e.value[i*2:]))
+		case tiffLong:
+			values[i] = f.order.Uint32(e.value[i*4:])
+		default:
+			return nil, fmt.Errorf("TIFF: tag %d has type %d", e.tag, e.typ)
+		}
+	}
+
+	return values, nil
+}
+
+// empty reports whether no tags are left
+func (f *tiffFile) empty() bool {
+	for _, ifd := range f.ifds {
+		for _, e := range ifd.entries {
+			if e.value != nil {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+type tiffLayout struct {
+	offset  int64
+	entries []tiffEntry
+}
+
+// writeTo writes the TIFF structure with the image data placed right before
+// the IFD referencing it.
+func (f *tiffFile) writeTo(w io.Writer) error {
+	layouts := make([]tiffLayout, len(f.ifds))
+	pos := int64(8)
+	for i, ifd := range f.ifds {
+		var entries []tiffEntry
+		for _, e := range ifd.entries {
+			if sections, ok := ifd.data[e.tag]; ok {
+				value := make([]byte, 4*len(sections))
+				for j, s := range sections {
+					f.order.PutUint32(value[j*4:], uint32(pos))
+					pos += s.size
+				}
+				e = tiffEntry{tag: e.tag, typ: tiffLong, count: uint32(len(sections)), value: value}
+			}
+			if e.value != nil {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(a, b int) bool { return entries[a].tag < entries[b].tag })
+
+		pos += pos & 1
+		layouts[i] = tiffLayout{offset: pos, entries: entries}
+		pos += ifdSize(entries)
+	}
+
+	if pos > math.MaxUint32 {
+		return errors.New("TIFF: file too large")
+	}
+
+	header := make([]byte, 8)
+	if f.order == binary.LittleEndian {
+		copy(header, "II*\x00")
+	} else {
+		copy(header, "MM\x00*")
+	}
+	f.order.PutUint32(header[4:], uint32(layouts[0].offset))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	pos = int64(len(header))
+	for i, ifd := range f.ifds {
+		for _, tag := range sortedDataTags(ifd) {
+			for _, s := range ifd.data[tag] {
+				if _, err := io.Copy(w, io.NewSectionReader(f.r, s.offset, s.size)); err != nil {
+					return err
+				}
+				pos += s.size
+			}
+		}
+
+		if pos&1 == 1 {
+			if _, err := w.Write([]byte{0}); err != nil {
+				return err
+			}
+		}
+
+		var next int64
+		if i+1 < len(layouts) {
+			next = layouts[i+1].offset
+		}
+
+		encoded := f.encodeIFD(layouts[i].entries, layouts[i].offset, next)
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		pos = layouts[i].offset + int64(len(encoded))
+	}
+
+	return nil
+}
+
+// sortedDataTags returns the data tags of ifd in the order their entries
+// come in the IFD, which is the order writeTo assigned the offsets in.
+func sortedDataTags(ifd *tiffIFD) []uint16 {
+	var tags []uint16
+	for _, e := range ifd.entries {
+		if _, ok := ifd.data[e.tag]; ok {
+			tags = append(tags, e.tag)
+		}
+	}
+
+	return tags
+}
+
+func ifdSize(entries []tiffEntry) int64 {
+	size := int64(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += int64(len(e.value) + len(e.value)&1)
+		}
+	}
+
+	return size
+}
+
+func (f *tiffFile) encodeIFD(entries []tiffEntry, offset int64, next int64) []byte {
+	buf := make([]byte, 2+12*len(entries)+4, ifdSize(entries))
+	f.order.PutUint16(buf, uint16(len(entries)))
+
+	for i, e := range entries {
+		field := buf[2+i*12:]
+		f.order.PutUint16(field, e.tag)
+		f.order.PutUint16(field[2:], e.typ)
+		f.order.PutUint32(field[4:], e.count)
+
+		if len(e.value) <= 4 {
+			copy(field[8:12], e.value)
+			continue
+		}
+
+		f.order.PutUint32(field[8:], uint32(offset)+uint32(len(buf)))
+		buf = append(buf, e.value...)
+		if len(e.value)&1 == 1 {
+			buf = append(buf, 0)
+		}
+	}
+	f.order.PutUint32(buf[2+12*len(entries):], uint32(next))
+
+	return buf
+}
+
+// cleanEXIF returns the EXIF block exif with only the whitelisted tags of
+// IFD0, or nil if none of them are present.
+func cleanEXIF(exif []byte) ([]byte, error) {
+	f, err := readTIFF(bytes.NewReader(exif), int64(len(exif)), whitelistFilter(exifTags), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.empty() {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := f.writeTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// checkDimensions checks the ImageWidth and ImageLength of every page
+func (f *tiffFile) checkDimensions() error {
+	for _, ifd := range f.ifds {
+		var width, height uint32
+		for _, e := range ifd.entries {
+			if (e.tag != 256 && e.tag != 257) || e.count == 0 {
+				continue
+			}
+
+			values, err := f.uints(e)
+			if err != nil {
+				return err
+			}
+			if e.tag == 256 {
+				width = values[0]
+			} else {
+				height = values[0]
+			}
+		}
+
+		if err := checkDimensions(width, height); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
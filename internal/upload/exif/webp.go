@@ -0,0 +1,211 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// VP8X flags for the optional chunks
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// Chunks with image data, other chunks are dropped
+var webpChunks = map[string]bool{
+	"VP8 ": true,
+	"VP8L": true,
+	"VP8X": true,
+	"ALPH": true,
+	"ANIM": true,
+	"ANMF": true,
+}
+
+type webpChunk struct {
+	fourCC string
+	offset int64
+	size   int64
+	// data replaces the chunk data when set
+	data []byte
+}
+
+// cleanWebP copies the WebP image in r to w without the ICC profile and
+// only the whitelisted EXIF and XMP metadata
+func cleanWebP(w io.Writer, r io.ReaderAt, size int64) error {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	riffSize := int64(binary.LittleEndian.Uint32(header[4:]))
+	if riffSize+8 < size {
+		// Data after the RIFF chunk is dropped
+		size = riffSize + 8
+	}
+
+	var chunks []*webpChunk
+	var vp8x *webpChunk
+	for offset := int64(12); offset < size; {
+		chunkHeader := make([]byte, 8)
+		if _, err := r.ReadAt(chunkHeader, offset); err != nil {
+			return errors.New("WebP: truncated chunk header")
+		}
+
+		c := &webpChunk{
+			fourCC: string(chunkHeader[:4]),
+			offset: offset + 8,
+			size:   int64(binary.LittleEndian.Uint32(chunkHeader[4:])),
+		}
+		if c.offset+c.size > size {
+			return errors.New("WebP: truncated chunk")
+		}
+		offset = c.offset + c.size + c.size&1
+
+		var err error
+		switch {
+		case c.fourCC == "EXIF" || c.fourCC == "XMP ":
+			c.data, err = cleanWebPMetadata(r, c)
+			if err != nil || c.data == nil {
+				continue
+			}
+		case !webpChunks[c.fourCC]:
+			continue
+		case c.fourCC == "VP8X":
+			if c.size < 10 {
+				return errors.New("WebP: invalid VP8X chunk")
+			}
+			if c.data, err = readWebPChunk(r, c); err != nil {
+				return err
+			}
+			vp8x = c
+		}
+
+		if err := checkWebPDimensions(r, c); err != nil {
+			return err
+		}
+
+		chunks = append(chunks, c)
+	}
+
+	if vp8x != nil {
+		vp8x.data[0] &^= webpFlagICC | webpFlagEXIF | webpFlagXMP
+	}
+
+	riffSize = 4
+	for _, c := range chunks {
+		if c.data != nil {
+			c.size = int64(len(c.data))
+		}
+		riffSize += 8 + c.size + c.size&1
+
+		if vp8x != nil && c.fourCC == "EXIF" {
+			vp8x.data[0] |= webpFlagEXIF
+		} else if vp8x != nil && c.fourCC == "XMP " {
+			vp8x.data[0] |= webpFlagXMP
+		}
+	}
+	if riffSize > math.MaxUint32 {
+		return errors.New("WebP: file too large")
+	}
+
+	binary.LittleEndian.PutUint32(header[4:], uint32(riffSize))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if err := writeWebPChunk(w, r, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readWebPChunk(r io.ReaderAt, c *webpChunk) ([]byte, error) {
+	if c.size > maxMetadataChunk {
+		return nil, errors.New("WebP: metadata chunk too large")
+	}
+
+	data := make([]byte, c.size)
+	_, err := r.ReadAt(data, c.offset)
+	return data, err
+}
+
+func cleanWebPMetadata(r io.ReaderAt, c *webpChunk) ([]byte, error) {
+	data, err := readWebPChunk(r, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.fourCC == "XMP " {
+		return filterXMP(data)
+	}
+
+	// Some writers include the JPEG EXIF header
+	return cleanEXIF(bytes.TrimPrefix(data, exifHeader))
+}
+
+func writeWebPChunk(w io.Writer, r io.ReaderAt, c *webpChunk) error {
+	header := make([]byte, 8)
+	copy(header, c.fourCC)
+	binary.LittleEndian.PutUint32(header[4:], uint32(c.size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	var err error
+	if c.data != nil {
+		_, err = w.Write(c.data)
+	} else {
+		_, err = io.Copy(w, io.NewSectionReader(r, c.offset, c.size))
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.size&1 == 1 {
+		_, err = w.Write([]byte{0})
+	}
+	return err
+}
+
+// checkWebPDimensions checks the canvas size in the VP8X chunk and the
+// frame size in VP8 and VP8L bitstreams
+func checkWebPDimensions(r io.ReaderAt, c *webpChunk) error {
+	switch c.fourCC {
+	case "VP8X":
+		width := uint32(c.data[4]) | uint32(c.data[5])<<8 | uint32(c.data[6])<<16
+		height := uint32(c.data[7]) | uint32(c.data[8])<<8 | uint32(c.data[9])<<16
+		return checkDimensions(width+1, height+1)
+
+	case "VP8 ":
+		header := make([]byte, 10)
+		if c.size < 10 {
+			return errors.New("WebP: invalid VP8 chunk")
+		}
+		if _, err := r.ReadAt(header, c.offset); err != nil {
+			return err
+		}
+		width := uint32(binary.LittleEndian.Uint16(header[6:])) & 0x3fff
+		height := uint32(binary.LittleEndian.Uint16(header[8:])) & 0x3fff
+		return checkDimensions(width, height)
+
+	case "VP8L":
+		header := make([]byte, 5)
+		if c.size < 5 {
+			return errors.New("WebP: invalid VP8L chunk")
+		}
+		if _, err := r.ReadAt(header, c.offset); err != nil {
+			return err
+		}
+		bits := binary.LittleEndian.Uint32(header[1:])
+		return checkDimensions(bits&0x3fff+1, (bits>>14)&0x3fff+1)
+	}
+
+	return nil
+}
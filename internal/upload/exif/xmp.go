@@ -0,0 +1,168 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	rdfNamespace     = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmlNamespace     = "http://www.w3.org/XML/1998/namespace"
+	iptcExtNamespace = "http://iptc.org/std/Iptc4xmpExt/2008-02-29/"
+)
+
+// xmpWriter serializes the XML tokens of the properties that are kept. Go's
+// xml.Encoder can't be used because it doesn't preserve prefixes.
+type xmpWriter struct {
+	buf      bytes.Buffer
+	prefixes map[string]string
+}
+
+func (w *xmpWriter) name(n xml.Name) string {
+	switch n.Space {
+	case "":
+		return n.Local
+	case xmlNamespace:
+		return "xml:" + n.Local
+	}
+
+	prefix, ok := w.prefixes[n.Space]
+	if !ok {
+		prefix = fmt.Sprintf("ns%d", len(w.prefixes))
+		w.prefixes[n.Space] = prefix
+	}
+
+	return prefix + ":" + n.Local
+}
+
+func (w *xmpWriter) attrs(attrs []xml.Attr) {
+	for _, a := range attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			// Namespaces are declared on the root element
+			continue
+		}
+
+		fmt.Fprintf(&w.buf, ` %s="`, w.name(a.Name))
+		xml.EscapeText(&w.buf, []byte(a.Value))
+		w.buf.WriteByte('"')
+	}
+}
+
+func (w *xmpWriter) token(t xml.Token) {
+	switch t := t.(type) {
+	case xml.StartElement:
+		fmt.Fprintf(&w.buf, "<%s", w.name(t.Name))
+		w.attrs(t.Attr)
+		w.buf.WriteByte('>')
+	case xml.EndElement:
+		fmt.Fprintf(&w.buf, "</%s>", w.name(t.Name))
+	case xml.CharData:
+		xml.EscapeText(&w.buf, t)
+	}
+}
+
+// filterXMP returns an XMP packet with only the IPTC Extension properties
+// of packet, or nil if there are none.
+func filterXMP(packet []byte) ([]byte, error) {
+	w := &xmpWriter{prefixes: map[string]string{
+		rdfNamespace:     "rdf",
+		iptcExtNamespace: "Iptc4xmpExt",
+	}}
+	kept := 0
+
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("XMP: %v", err)
+		}
+
+		description, ok := t.(xml.StartElement)
+		if !ok || description.Name.Space != rdfNamespace || description.Name.Local != "Description" {
+			continue
+		}
+
+		for _, a := range description.Attr {
+			if a.Name.Space == iptcExtNamespace {
+				w.token(xml.StartElement{Name: a.Name})
+				w.token(xml.CharData(a.Value))
+				w.token(xml.EndElement{Name: a.Name})
+				kept++
+			}
+		}
+
+		n, err := copyProperties(d, w)
+		if err != nil {
+			return nil, fmt.Errorf("XMP: %v", err)
+		}
+		kept += n
+	}
+
+	if kept == 0 {
+		return nil, nil
+	}
+
+	var namespaces []string
+	for namespace := range w.prefixes {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var out bytes.Buffer
+	out.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	out.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF`)
+	for _, namespace := range namespaces {
+		fmt.Fprintf(&out, ` xmlns:%s="`, w.prefixes[namespace])
+		xml.EscapeText(&out, []byte(namespace))
+		out.WriteByte('"')
+	}
+	out.WriteString(`><rdf:Description rdf:about="">`)
+	out.Write(w.buf.Bytes())
+	out.WriteString("</rdf:Description></rdf:RDF></x:xmpmeta>\n")
+	out.WriteString(`<?xpacket end="w"?>`)
+
+	return out.Bytes(), nil
+}
+
+// copyProperties copies the IPTC Extension properties of the current
+// rdf:Description to w and returns how many there were.
+func copyProperties(d *xml.Decoder, w *xmpWriter) (int, error) {
+	kept := 0
+	depth := 0
+	copying := false
+
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return kept, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Space == iptcExtNamespace {
+				copying = true
+				kept++
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				return kept, nil
+			}
+			depth--
+			if depth == 0 && copying {
+				w.token(t)
+				copying = false
+				continue
+			}
+		}
+
+		if copying {
+			w.token(xml.CopyToken(t))
+		}
+	}
+}
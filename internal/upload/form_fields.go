@@ -0,0 +1,79 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxFileParts is the largest number of files in a multipart request
+// unless SetMaxFileParts is called
+const DefaultMaxFileParts = 100
+
+var (
+	maxFileParts = DefaultMaxFileParts
+
+	// ErrTooManyFileParts means that a multipart request has more files
+	// than allowed
+	ErrTooManyFileParts = errors.New("upload request contains too many files")
+
+	// fileFieldName matches the names of file fields: a name optionally
+	// followed by nested keys, e.g. package[file], and "[]" for arrays
+	fileFieldName = regexp.MustCompile(`\A[^\[\]]+(\[[^\[\]]+\])*(\[\])?\z`)
+)
+
+// SetMaxFileParts sets the largest number of files in a multipart request,
+// zero or less means no limit
+func SetMaxFileParts(n int) {
+	maxFileParts = n
+}
+
+// FormFieldError means that the name of a file field is invalid or used more
+// than once
+type FormFieldError struct {
+	Name   string
+	Reason string
+}
+
+func (e *FormFieldError) Error() string {
+	return fmt.Sprintf("invalid file field %q: %s", e.Name, e.Reason)
+}
+
+// fileFields gives every file of a multipart request a unique field name.
+// The files of array fields are numbered, files[] becomes files[0],
+// files[1] and so on, other fields can only have one file.
+type fileFields struct {
+	count int
+	used  map[string]bool
+	next  map[string]int
+}
+
+func (f *fileFields) add(name string) (string, error) {
+	if !fileFieldName.MatchString(name) {
+		return "", &FormFieldError{Name: name, Reason: "malformed name"}
+	}
+
+	f.count++
+	if maxFileParts > 0 && f.count > maxFileParts {
+		return "", ErrTooManyFileParts
+	}
+
+	if f.used == nil {
+		f.used = make(map[string]bool)
+		f.next = make(map[string]int)
+	}
+
+	if base := strings.TrimSuffix(name, "[]"); base != name {
+		name = base + "[" + strconv.Itoa(f.next[base]) + "]"
+		f.next[base]++
+	}
+
+	if f.used[name] {
+		return "", &FormFieldError{Name: name, Reason: "more than one file"}
+	}
+	f.used[name] = true
+
+	return name, nil
+}
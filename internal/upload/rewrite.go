@@ -1,7 +1,10 @@
 package upload
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha512"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -11,8 +14,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/progress"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload/exif"
 )
 
@@ -43,10 +48,21 @@ var (
 	)
 )
 
+// maxDigestFieldLength is the length of the longest hex digest we compute,
+// of SHA-512
+const maxDigestFieldLength = 2 * sha512.Size
+
 type rewriter struct {
 	writer  *multipart.Writer
 	preauth *api.Response
 	filter  MultipartFormProcessor
+	// checksumFields are the fields of the filter with checksums
+	checksumFields map[string]string
+	// checksums from the checksumFields, they apply to the files after them
+	checksums map[string]string
+	// progressID is the upload ID to publish the progress of files for
+	progressID string
+	fileFields fileFields
 }
 
 func init() {
@@ -69,9 +85,13 @@ func rewriteFormFilesFromMultipart(r *http.Request, writer *multipart.Writer, pr
 	multipartUploadRequests.WithLabelValues(filter.Name()).Inc()
 
 	rew := &rewriter{
-		writer:  writer,
-		preauth: preauth,
-		filter:  filter,
+		writer:     writer,
+		preauth:    preauth,
+		filter:     filter,
+		progressID: progress.ID(r),
+	}
+	if cv, ok := filter.(ChecksumVerifier); ok {
+		rew.checksumFields = cv.ChecksumFields()
 	}
 
 	for {
@@ -106,42 +126,102 @@ func rewriteFormFilesFromMultipart(r *http.Request, writer *multipart.Writer, pr
 func (rew *rewriter) handleFilePart(ctx context.Context, name string, p *multipart.Part) error {
 	multipartFiles.WithLabelValues(rew.filter.Name()).Inc()
 
+	// The finalize fields and processors see the unique name of the file
+	formName := name
+	name, err := rew.fileFields.add(formName)
+	if err != nil {
+		return err
+	}
+
 	filename := p.FileName()
 
 	if strings.Contains(filename, "/") || filename == "." || filename == ".." {
 		return fmt.Errorf("illegal filename: %q", filename)
 	}
 
-	opts := filestore.GetOpts(rew.preauth)
+	opts := filestore.GetOpts(rew.preauth.ForField(name, formName))
+	if !opts.IsLocal() && !opts.IsRemote() {
+		return &FormFieldError{Name: name, Reason: "unexpected file field"}
+	}
 	opts.TempFilePrefix = filename
+	opts.ProgressID = rew.progressID
+
+	for hashName, digest := range rew.checksums {
+		if err := opts.ExpectChecksum(hashName, digest); err != nil {
+			return err
+		}
+	}
+	if err := opts.ExpectHeaderChecksums(http.Header(p.Header)); err != nil {
+		return err
+	}
+
+	// Images are cleaned by filename so that files of other uploads, e.g.
+	// packages, are stored as they are. The detected content type only
+	// keeps PNG and WebP files that aren't images from failing, filestore
+	// checks it against the allowed content types.
+	part := bufio.NewReader(p)
+	head, err := part.Peek(512)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read multipart file: %v", err)
+	}
+	contentType := filestore.DetectContentType(head)
 
 	var inputReader io.Reader
-	if exif.IsExifFile(filename) {
+	if exif.IsExifImage(filename, contentType) {
 		log.WithFields(ctx, log.Fields{
-			"filename": filename,
-		}).Print("running exiftool to remove any metadata")
+			"filename":     filename,
+			"content_type": contentType,
+		}).Print("removing image metadata")
 
-		cleaner, err := exif.NewCleaner(ctx, p)
+		cleaner, err := exif.NewCleaner(ctx, part)
 		if err != nil {
 			return fmt.Errorf("failed to start EXIF metadata cleaner: %v", err)
 		}
 
 		inputReader = cleaner
 	} else {
-		inputReader = p
+		inputReader = part
+	}
+
+	var inspector io.WriteCloser
+	if fi, ok := rew.filter.(FileInspector); ok {
+		inspector, err = fi.InspectFile(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		inputReader = io.TeeReader(inputReader, &inspectWriter{w: inspector})
 	}
 
 	fh, err := filestore.SaveFileFromReader(ctx, inputReader, -1, opts)
+	if inspector != nil {
+		// Closing the inspector also stops it if the upload failed
+		if closeErr := inspector.Close(); err == nil && closeErr != nil {
+			err = &InvalidFileError{Err: closeErr}
+		}
+	}
 	if err != nil {
+		if _, ok := err.(*InvalidFileError); ok {
+			return err
+		}
+		if clamd.IsInfected(err) || filestore.IsChecksumError(err) || filestore.IsContentTypeError(err) {
+			return err
+		}
+
 		switch err {
-		case filestore.ErrEntityTooLarge, exif.ErrRemovingExif:
+		case filestore.ErrEntityTooLarge, exif.ErrRemovingExif, exif.ErrImageTooLarge:
 			return err
 		default:
 			return fmt.Errorf("persisting multipart file: %v", err)
 		}
 	}
 
-	for key, value := range fh.GitLabFinalizeFields(name) {
+	fields, err := fh.GitLabFinalizeFields(name)
+	if err != nil {
+		return fmt.Errorf("failed to finalize fields: %v", err)
+	}
+
+	for key, value := range fields {
 		rew.writer.WriteField(key, value)
 	}
 
@@ -156,13 +236,62 @@ func (rew *rewriter) copyPart(ctx context.Context, name string, p *multipart.Par
 		return fmt.Errorf("create multipart field: %v", err)
 	}
 
-	if _, err := io.Copy(np, p); err != nil {
+	var value digestBuffer
+	w := io.Writer(np)
+	hashName, isDigest := rew.checksumFields[name]
+	if isDigest {
+		w = io.MultiWriter(np, &value)
+	}
+
+	if _, err := io.Copy(w, p); err != nil {
 		return fmt.Errorf("duplicate multipart field: %v", err)
 	}
 
+	if isDigest && value.Len() > 0 {
+		digest := strings.TrimSpace(value.String())
+		if value.Len() > maxDigestFieldLength {
+			return &filestore.ChecksumError{Hash: hashName, Expected: digest}
+		}
+
+		if rew.checksums == nil {
+			rew.checksums = make(map[string]string)
+		}
+		rew.checksums[hashName] = digest
+	}
+
 	if err := rew.filter.ProcessField(ctx, name, rew.writer); err != nil {
 		return fmt.Errorf("process multipart field: %v", err)
 	}
 
 	return nil
 }
+
+// inspectWriter marks the errors of a FileInspector writer
+type inspectWriter struct {
+	w io.Writer
+}
+
+func (i *inspectWriter) Write(p []byte) (int, error) {
+	n, err := i.w.Write(p)
+	if err != nil {
+		return n, &InvalidFileError{Err: err}
+	}
+
+	return n, nil
+}
+
+// digestBuffer keeps the first bytes of a checksum field, one more than
+// the longest digest so that longer values are recognized
+type digestBuffer struct {
+	bytes.Buffer
+}
+
+func (d *digestBuffer) Write(p []byte) (int, error) {
+	if room := maxDigestFieldLength + 1 - d.Len(); room < len(p) {
+		d.Buffer.Write(p[:room])
+	} else {
+		d.Buffer.Write(p)
+	}
+
+	return len(p), nil
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload/exif"
@@ -22,9 +24,35 @@ type MultipartFormProcessor interface {
 	Name() string
 }
 
+// FileInspector can be implemented by a MultipartFormProcessor to inspect
+// file fields while they are stored. The returned writer receives the
+// contents of the file, the upload is rejected with an InvalidFileError
+// if writing to or closing it fails.
+type FileInspector interface {
+	InspectFile(ctx context.Context, formName string) (io.WriteCloser, error)
+}
+
+// ChecksumVerifier can be implemented by a MultipartFormProcessor to verify
+// the files of an upload against checksums sent in form fields before them.
+// ChecksumFields maps the names of these fields to hash names, e.g.
+// "md5_digest" to "md5".
+type ChecksumVerifier interface {
+	ChecksumFields() map[string]string
+}
+
+// InvalidFileError means that an uploaded file was rejected because of its
+// contents, e.g. by a FileInspector
+type InvalidFileError struct {
+	Err error
+}
+
+func (e *InvalidFileError) Error() string {
+	return e.Err.Error()
+}
+
 func HandleFileUploads(w http.ResponseWriter, r *http.Request, h http.Handler, preauth *api.Response, filter MultipartFormProcessor) {
 	opts := filestore.GetOpts(preauth)
-	if !opts.IsLocal() && !opts.IsRemote() {
+	if !opts.IsLocal() && !opts.IsRemote() && len(preauth.UploadFields) == 0 {
 		helper.Fail500(w, r, fmt.Errorf("handleFileUploads: missing destination storage"))
 		return
 	}
@@ -36,13 +64,38 @@ func HandleFileUploads(w http.ResponseWriter, r *http.Request, h http.Handler, p
 	// Rewrite multipart form data
 	err := rewriteFormFilesFromMultipart(r, writer, preauth, filter)
 	if err != nil {
+		if clamd.IsInfected(err) {
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if filestore.IsChecksumError(err) {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := err.(*InvalidFileError); ok {
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if _, ok := err.(*FormFieldError); ok {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filestore.IsContentTypeError(err) {
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
 		switch err {
 		case http.ErrNotMultipart:
 			h.ServeHTTP(w, r)
 		case filestore.ErrEntityTooLarge:
 			helper.RequestEntityTooLarge(w, r, err)
+		case ErrTooManyFileParts:
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
 		case exif.ErrRemovingExif:
 			helper.CaptureAndFail(w, r, err, "Failed to process image", http.StatusUnprocessableEntity)
+		case exif.ErrImageTooLarge:
+			helper.CaptureAndFail(w, r, err, "Upload rejected, "+err.Error(), http.StatusUnprocessableEntity)
 		default:
 			helper.Fail500(w, r, fmt.Errorf("handleFileUploads: extract files from multipart: %v", err))
 		}
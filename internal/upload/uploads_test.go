@@ -17,9 +17,11 @@ import (
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
@@ -100,6 +102,8 @@ func TestUploadHandlerForwardingRawData(t *testing.T) {
 }
 
 func TestUploadHandlerRewritingMultiPartData(t *testing.T) {
+	testhelper.ConfigureSecret()
+
 	var filePath string
 
 	tempPath, err := ioutil.TempDir("", "uploads")
@@ -152,8 +156,12 @@ func TestUploadHandlerRewritingMultiPartData(t *testing.T) {
 			}
 		}
 
-		if valueCnt := len(r.MultipartForm.Value); valueCnt != 8 {
-			t.Fatal("Expected to receive exactly 8 values but got", valueCnt)
+		if r.FormValue("file.content_type") != "text/plain" {
+			t.Error("Expected to receive the detected content type")
+		}
+
+		if valueCnt := len(r.MultipartForm.Value); valueCnt != 10 {
+			t.Fatal("Expected to receive exactly 10 values but got", valueCnt)
 		}
 
 		w.WriteHeader(202)
@@ -228,6 +236,8 @@ func TestUploadProcessingField(t *testing.T) {
 }
 
 func TestUploadProcessingFile(t *testing.T) {
+	testhelper.ConfigureSecret()
+
 	tempPath, err := ioutil.TempDir("", "uploads")
 	if err != nil {
 		t.Fatal(err)
@@ -413,7 +423,428 @@ func TestUploadHandlerRemovingInvalidExif(t *testing.T) {
 	testhelper.AssertResponseCode(t, response, 422)
 }
 
+func TestUploadHandlerPassingInvalidImages(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	const content = "this is not valid image data"
+
+	for _, filename := range []string{"test.png", "test.webp"} {
+		t.Run(filename, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreateFormFile("file", filename)
+			require.NoError(t, err)
+			fmt.Fprint(file, content)
+			require.NoError(t, writer.Close())
+
+			ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, r.ParseMultipartForm(100000))
+				require.Equal(t, strconv.Itoa(len(content)), r.FormValue("file.size"), "Expected the file to be stored as it is")
+			})
+			defer ts.Close()
+
+			httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := httptest.NewRecorder()
+			HandleFileUploads(response, httpRequest, newProxy(ts.URL), &api.Response{TempPath: tempPath}, &testFormProcessor{})
+			testhelper.AssertResponseCode(t, response, 200)
+		})
+	}
+}
+
+func TestUploadHandlerVirusFound(t *testing.T) {
+	clamdServer := testhelper.StartClamdServer(t)
+	defer clamdServer.Close()
+
+	require.NoError(t, clamd.Configure(clamdServer.Config()))
+	defer clamd.Configure(nil)
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "eicar.com")
+	require.NoError(t, err)
+
+	fmt.Fprint(file, testhelper.ClamdTestVirus)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("infected upload was proxied")
+	})
+	defer ts.Close()
+
+	httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.ContentLength = int64(buffer.Len())
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+	response := httptest.NewRecorder()
+
+	handler := newProxy(ts.URL)
+	HandleFileUploads(response, httpRequest, handler, &api.Response{TempPath: tempPath}, &testFormProcessor{})
+	testhelper.AssertResponseCode(t, response, 422)
+	require.Contains(t, response.Body.String(), testhelper.ClamdTestSignature)
+}
+
+func TestUploadHandlerMaximumSize(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "my.file")
+	require.NoError(t, err)
+
+	fmt.Fprint(file, "test")
+	err = writer.Close()
+	require.NoError(t, err)
+
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("too large upload was proxied")
+	})
+	defer ts.Close()
+
+	httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.ContentLength = int64(buffer.Len())
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+	response := httptest.NewRecorder()
+
+	handler := newProxy(ts.URL)
+	HandleFileUploads(response, httpRequest, handler, &api.Response{TempPath: tempPath, MaximumSize: 3}, &testFormProcessor{})
+	testhelper.AssertResponseCode(t, response, http.StatusRequestEntityTooLarge)
+}
+
 func newProxy(url string) *proxy.Proxy {
 	parsedURL := helper.URLMustParse(url)
 	return proxy.NewProxy(parsedURL, "123", roundtripper.NewTestBackendRoundTripper(parsedURL))
 }
+
+func TestUploadHandlerChecksumFields(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	tests := []struct {
+		name    string
+		field   string
+		digest  string
+		code    int
+		notPyPI bool
+	}{
+		{name: "md5", field: "md5_digest", digest: "098f6bcd4621d373cade4e832627b4f6", code: 200},
+		{name: "sha256", field: "sha256_digest", digest: "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08", code: 200},
+		{name: "wrong md5", field: "md5_digest", digest: "00000000000000000000000000000000", code: 400},
+		{name: "invalid sha256", field: "sha256_digest", digest: "not a digest", code: 400},
+		{name: "too long sha256", field: "sha256_digest", digest: strings.Repeat("9f86d081", 1000), code: 400},
+		{name: "wrong md5 of another upload", field: "md5_digest", digest: "00000000000000000000000000000000", code: 200, notPyPI: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			require.NoError(t, writer.WriteField(tc.field, tc.digest))
+			file, err := writer.CreateFormFile("content", "my.whl")
+			require.NoError(t, err)
+			fmt.Fprint(file, "test")
+			require.NoError(t, writer.Close())
+
+			httpRequest, err := http.NewRequest("POST", "/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			var filter MultipartFormProcessor = &pypiFileTracker{&savedFileTracker{request: httpRequest}}
+			if tc.notPyPI {
+				filter = &savedFileTracker{request: httpRequest}
+			}
+
+			response := httptest.NewRecorder()
+			HandleFileUploads(response, httpRequest, nilHandler, &api.Response{TempPath: tempPath}, filter)
+			testhelper.AssertResponseCode(t, response, tc.code)
+		})
+	}
+}
+
+func TestUploadHandlerAllowedContentTypes(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	image, err := ioutil.ReadFile("exif/testdata/sample_exif.jpg")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		filename    string
+		content     string
+		code        int
+		contentType string
+		cleaned     bool
+	}{
+		{name: "image", filename: "avatar.jpg", content: string(image), code: 200, contentType: "image/jpeg", cleaned: true},
+		{name: "image without extension", filename: "avatar", content: string(image), code: 200, contentType: "image/jpeg"},
+		{name: "html named as image", filename: "avatar.gif", content: "<html><script>alert(1)</script></html>", code: 415},
+		{name: "executable named as image", filename: "avatar.gif", content: "MZ\x90\x00\x03\x00\x00\x00", code: 415},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreateFormFile("avatar", tc.filename)
+			require.NoError(t, err)
+			fmt.Fprint(file, tc.content)
+			require.NoError(t, writer.Close())
+
+			ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+				require.NotEqual(t, 415, tc.code, "rejected upload was proxied")
+				require.NoError(t, r.ParseMultipartForm(100000))
+				require.Equal(t, tc.contentType, r.FormValue("avatar.content_type"))
+
+				size, err := strconv.Atoi(r.FormValue("avatar.size"))
+				require.NoError(t, err)
+				if tc.cleaned {
+					require.True(t, size < len(image), "Expected the metadata to be removed")
+				} else {
+					require.Equal(t, len(image), size, "Expected images named otherwise to be stored as they are")
+				}
+			})
+			defer ts.Close()
+
+			httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := httptest.NewRecorder()
+			preauth := &api.Response{TempPath: tempPath, AllowedContentTypes: []string{"image/jpeg", "image/png"}}
+			HandleFileUploads(response, httpRequest, newProxy(ts.URL), preauth, &testFormProcessor{})
+			testhelper.AssertResponseCode(t, response, tc.code)
+		})
+	}
+}
+
+func TestUploadHandlerMultipleFiles(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	for _, part := range []struct{ field, filename string }{
+		{"files[]", "first.txt"},
+		{"files[]", "second.txt"},
+		{"package[file]", "package.tgz"},
+	} {
+		file, err := writer.CreateFormFile(part.field, part.filename)
+		require.NoError(t, err)
+		fmt.Fprint(file, part.filename)
+	}
+	require.NoError(t, writer.Close())
+
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(100000))
+
+		for field, filename := range map[string]string{
+			"files[0]":      "first.txt",
+			"files[1]":      "second.txt",
+			"package[file]": "package.tgz",
+		} {
+			require.Equal(t, filename, r.FormValue(field+".name"))
+			require.Equal(t, strconv.Itoa(len(filename)), r.FormValue(field+".size"))
+
+			var claims testhelper.UploadClaims
+			_, err := jwt.ParseWithClaims(r.FormValue(field+"."+filestore.SignedFieldsKey), &claims, testhelper.ParseJWT)
+			require.NoError(t, err)
+			require.Equal(t, filename, claims.Upload["name"])
+		}
+
+		var claims MultipartClaims
+		_, err := jwt.ParseWithClaims(r.Header.Get(RewrittenFieldsHeader), &claims, testhelper.ParseJWT)
+		require.NoError(t, err)
+		require.Len(t, claims.RewrittenFields, 3)
+		require.Equal(t, r.FormValue("files[1].path"), claims.RewrittenFields["files[1]"])
+	})
+	defer ts.Close()
+
+	httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+	require.NoError(t, err)
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+	response := httptest.NewRecorder()
+	HandleFileUploads(response, httpRequest, newProxy(ts.URL), &api.Response{TempPath: tempPath}, &savedFileTracker{request: httpRequest})
+	testhelper.AssertResponseCode(t, response, 200)
+}
+
+func TestUploadHandlerInvalidFileFields(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	SetMaxFileParts(3)
+	defer SetMaxFileParts(DefaultMaxFileParts)
+
+	tests := []struct {
+		name   string
+		fields []string
+		code   int
+	}{
+		{name: "maximum files", fields: []string{"files[]", "files[]", "file"}, code: 200},
+		{name: "too many files", fields: []string{"files[]", "files[]", "files[]", "files[]"}, code: 400},
+		{name: "duplicate field", fields: []string{"file", "file"}, code: 400},
+		{name: "array and index", fields: []string{"files[]", "files[0]"}, code: 400},
+		{name: "array in the middle", fields: []string{"files[][file]"}, code: 400},
+		{name: "unbalanced brackets", fields: []string{"files[file"}, code: 400},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			for _, field := range tc.fields {
+				file, err := writer.CreateFormFile(field, "my.file")
+				require.NoError(t, err)
+				fmt.Fprint(file, "test")
+			}
+			require.NoError(t, writer.Close())
+
+			httpRequest, err := http.NewRequest("POST", "/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := httptest.NewRecorder()
+			HandleFileUploads(response, httpRequest, nilHandler, &api.Response{TempPath: tempPath}, &testFormProcessor{})
+			testhelper.AssertResponseCode(t, response, tc.code)
+		})
+	}
+}
+
+func TestUploadHandlerFieldDestinations(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	signaturePath, err := ioutil.TempDir("", "signatures")
+	require.NoError(t, err)
+	defer os.RemoveAll(signaturePath)
+
+	objectStore, objectStoreServer := test.StartObjectStore()
+	defer objectStoreServer.Close()
+
+	preauth := &api.Response{
+		UploadFields: map[string]*api.UploadDestination{
+			"package": {
+				RemoteObject: api.RemoteObject{
+					ID:       "package-id",
+					GetURL:   objectStoreServer.URL + test.ObjectPath,
+					StoreURL: objectStoreServer.URL + test.ObjectPath,
+				},
+			},
+			"signatures[]": {TempPath: signaturePath, MaximumSize: 10},
+		},
+		// Applies to the package, its destination has no MaximumSize
+		MaximumSize: int64(len(test.ObjectContent)),
+	}
+
+	tests := []struct {
+		name      string
+		pkg       string
+		signature string
+		code      int
+	}{
+		{name: "stored", pkg: test.ObjectContent, signature: "signature", code: 200},
+		{name: "signature too large", pkg: test.ObjectContent, signature: "a very large signature", code: 413},
+		{name: "package too large", pkg: test.ObjectContent + "!", signature: "signature", code: 413},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreateFormFile("package", "package.tgz")
+			require.NoError(t, err)
+			fmt.Fprint(file, tc.pkg)
+			file, err = writer.CreateFormFile("signatures[]", "package.tgz.asc")
+			require.NoError(t, err)
+			fmt.Fprint(file, tc.signature)
+			require.NoError(t, writer.Close())
+
+			ts := testhelper.TestServerWithHandler(regexp.MustCompile(`/url/path\z`), func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, r.ParseMultipartForm(100000))
+
+				require.Empty(t, r.FormValue("package.path"))
+				require.Equal(t, "package-id", r.FormValue("package.remote_id"))
+				require.Equal(t, 1, objectStore.PutsCnt())
+
+				require.True(t, strings.HasPrefix(r.FormValue("signatures[0].path"), signaturePath))
+				require.Empty(t, r.FormValue("signatures[0].remote_id"))
+			})
+			defer ts.Close()
+
+			httpRequest, err := http.NewRequest("POST", ts.URL+"/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := httptest.NewRecorder()
+			HandleFileUploads(response, httpRequest, newProxy(ts.URL), preauth, &testFormProcessor{})
+			testhelper.AssertResponseCode(t, response, tc.code)
+		})
+	}
+}
+
+func TestUploadHandlerFieldWithoutDestination(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "my.file")
+	require.NoError(t, err)
+	fmt.Fprint(file, "test")
+	require.NoError(t, writer.Close())
+
+	httpRequest, err := http.NewRequest("POST", "/url/path", &buffer)
+	require.NoError(t, err)
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+	preauth := &api.Response{
+		UploadFields: map[string]*api.UploadDestination{"signature": {TempPath: tempPath}},
+	}
+
+	response := httptest.NewRecorder()
+	HandleFileUploads(response, httpRequest, nilHandler, preauth, &testFormProcessor{})
+	testhelper.AssertResponseCode(t, response, 400)
+}
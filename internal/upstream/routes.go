@@ -17,7 +17,11 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/imageresizer"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/imports"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/npm"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/progress"
 	proxypkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/proxy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
@@ -26,6 +30,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendurl"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/staticpages"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tus"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 )
 
@@ -141,8 +146,12 @@ func buildProxy(backend *url.URL, version string, rt http.RoundTripper) http.Han
 		git.SendDiff,
 		git.SendPatch,
 		git.SendSnapshot,
+		git.SendBundle,
 		artifacts.SendEntry,
+		artifacts.SendSite,
+		artifacts.SendDirectory,
 		sendurl.SendURL,
+		imageresizer.SendScaledImage,
 	)
 }
 
@@ -178,6 +187,7 @@ func (u *upstream) configureRoutes() {
 	u.Routes = []routeEntry{
 		// Git Clone
 		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
+		route("GET", gitProjectPattern+`(HEAD|objects/.+)\z`, git.DumbHTTP(api)),
 		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), withMatcher(isContentType("application/x-git-upload-pack-request"))),
 		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), withMatcher(isContentType("application/x-git-receive-pack-request"))),
 		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, signingProxy), withMatcher(isContentType("application/octet-stream"))),
@@ -198,8 +208,28 @@ func (u *upstream) configureRoutes() {
 		route("", ciAPIPattern+`v1/builds/register.json\z`, ciAPILongPolling),
 
 		// Maven Artifact Repository
+		route("", apiPattern+`v4/projects/[0-9]+/packages/maven/`, tus.Uploader(api, proxy, "PUT", filestore.RewriteBody), withMatcher(tus.IsTusRequest)),
 		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/maven/`, filestore.BodyUploader(api, proxy, nil)),
 
+		// Conan Artifact Repository
+		route("PUT", apiPattern+`v4/packages/conan/v1/files/`, filestore.BodyUploader(api, proxy, nil)),
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/conan/v1/files/`, filestore.BodyUploader(api, proxy, nil)),
+
+		// Generic Packages Repository
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/generic/`, filestore.BodyUploader(api, proxy, nil)),
+
+		// NuGet Artifact Repository
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/nuget(/|\z)`, upload.Accelerate(api, proxy)),
+
+		// PyPI Artifact Repository
+		route("POST", apiPattern+`v4/projects/[0-9]+/packages/pypi\z`, upload.AcceleratePyPI(api, proxy)),
+
+		// npm Package Registry
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/npm/`, npm.Publish(api, proxy), withMatcher(isContentType("application/json"))),
+
+		// Project imports
+		route("POST", apiPattern+`v4/projects/import\z`, imports.UploadImport(api, proxy)),
+
 		// Explicitly proxy API requests
 		route("", apiPattern, proxy),
 		route("", ciAPIPattern, proxy),
@@ -216,14 +246,21 @@ func (u *upstream) configureRoutes() {
 		),
 
 		// Uploads
+		route("", projectPattern+`uploads\z`, tus.Uploader(api, proxy, "POST", upload.RewriteMultipart), withMatcher(tus.IsTusRequest)),
 		route("POST", projectPattern+`uploads\z`, upload.Accelerate(api, proxy)),
 
+		// Project imports
+		route("POST", `^/import/gitlab_project\z`, imports.UploadImport(api, proxy)),
+
 		// For legacy reasons, user uploads are stored under the document root.
 		// To prevent anybody who knows/guesses the URL of a user-uploaded file
 		// from downloading it we make sure requests to /uploads/ do _not_ pass
 		// through static.ServeExisting.
 		route("", `^/uploads/`, static.ErrorPagesUnless(u.DevelopmentMode, proxy)),
 
+		// Upload progress, see package progress
+		route("GET", `^/-/upload_progress/[^/]+\z`, progress.Handler()),
+
 		// This route lets us filter out health checks from our metrics.
 		route("", "^/-/", defaultUpstream),
 
@@ -0,0 +1,379 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// ErrDirectoryTooLarge means that the central directory of an archive has
+// more entries than an ArchiveCache can keep
+var ErrDirectoryTooLarge = errors.New("central directory too large")
+
+// maxDirectoryRecordSize is the average size of the central directory
+// records of an archive beyond which it isn't cached, so that the number of
+// entries limits the memory the central directory takes
+const maxDirectoryRecordSize = 1024
+
+// ArchiveCache keeps the parsed central directory of recently opened zip
+// archives, so that serving several files of an archive doesn't read its
+// central directory every time. Archives are identified by their path or
+// their URL without query parameters, the last URL an archive was opened
+// with is used to read it.
+type ArchiveCache struct {
+	max        int
+	maxEntries int
+	ttl        time.Duration
+
+	mu       sync.Mutex
+	archives map[string]*CachedArchive
+	entries  int
+}
+
+// NewArchiveCache returns an ArchiveCache of up to max archives with up to
+// maxEntries entries in total, which are kept for ttl
+func NewArchiveCache(max int, maxEntries int, ttl time.Duration) *ArchiveCache {
+	return &ArchiveCache{max: max, maxEntries: maxEntries, ttl: ttl, archives: make(map[string]*CachedArchive)}
+}
+
+// CachedArchive is a zip archive of which only the central directory is
+// kept in memory
+type CachedArchive struct {
+	created time.Time
+
+	files         map[string]*zip.File
+	directories   map[string]bool
+	headerOffsets map[*zip.File]int64
+
+	mu          sync.Mutex
+	location    string
+	dataOffsets map[*zip.File]int64
+}
+
+// Open returns the archive at a local path or a remote object store URL.
+// If the path does not exist the error will be ErrArchiveNotFound, if the
+// file isn't a zip archive the error will be ErrNotAZip and if it has too
+// many entries ErrDirectoryTooLarge.
+func (c *ArchiveCache) Open(ctx context.Context, archivePath string) (*CachedArchive, error) {
+	key := archivePath
+	if isURL(archivePath) {
+		key = helper.ScrubURLParams(archivePath)
+	}
+
+	c.mu.Lock()
+	archive := c.archives[key]
+	if archive != nil && time.Since(archive.created) > c.ttl {
+		c.remove(key)
+		archive = nil
+	}
+	c.mu.Unlock()
+
+	if archive != nil {
+		archive.setLocation(archivePath)
+		return archive, nil
+	}
+
+	archive, err := openCachedArchive(ctx, archivePath, c.maxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	for len(c.archives) > 0 && (len(c.archives) >= c.max || c.entries+len(archive.files) > c.maxEntries) {
+		c.evictOldest()
+	}
+	c.archives[key] = archive
+	c.entries += len(archive.files)
+
+	return archive, nil
+}
+
+func (c *ArchiveCache) remove(key string) {
+	if archive, ok := c.archives[key]; ok {
+		c.entries -= len(archive.files)
+		delete(c.archives, key)
+	}
+}
+
+func (c *ArchiveCache) evictOldest() {
+	var oldestKey string
+	var oldest *CachedArchive
+	for key, archive := range c.archives {
+		if oldest == nil || archive.created.Before(oldest.created) {
+			oldestKey, oldest = key, archive
+		}
+	}
+	c.remove(oldestKey)
+}
+
+// openCachedArchive reads the end of the archive and then its central
+// directory with a single ranged request
+func openCachedArchive(ctx context.Context, archivePath string, maxEntries int) (*CachedArchive, error) {
+	size, err := archiveSize(ctx, archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tailOffset := size - (maxDirectoryEndSearch + directory64LocatorLen)
+	if tailOffset < 0 {
+		tailOffset = 0
+	}
+	tail, err := readRange(ctx, archivePath, tailOffset, size-tailOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := findDirectory(ctx, archivePath, tail, tailOffset)
+	if err != nil {
+		return nil, err
+	}
+	if location.offset < 0 || location.size < 0 || location.offset+location.size > size {
+		return nil, ErrNotAZip
+	}
+	if location.entries > int64(maxEntries) || location.size > location.entries*maxDirectoryRecordSize {
+		return nil, ErrDirectoryTooLarge
+	}
+
+	// The central directory and what follows it, up to the tail
+	if location.offset < tailOffset {
+		directory, err := readRange(ctx, archivePath, location.offset, tailOffset-location.offset)
+		if err != nil {
+			return nil, err
+		}
+		tail = append(directory, tail...)
+		tailOffset = location.offset
+	}
+
+	zipReader, err := zip.NewReader(&tailReaderAt{tail: tail, offset: tailOffset}, size)
+	if err != nil {
+		return nil, ErrNotAZip
+	}
+
+	directoryStart := location.offset - tailOffset
+	offsets, err := readHeaderOffsets(tail[directoryStart : directoryStart+location.size])
+	if err != nil {
+		return nil, err
+	}
+	if len(offsets) != len(zipReader.File) {
+		return nil, ErrNotAZip
+	}
+
+	archive := &CachedArchive{
+		created:       time.Now(),
+		location:      archivePath,
+		files:         make(map[string]*zip.File, len(zipReader.File)),
+		directories:   make(map[string]bool),
+		headerOffsets: make(map[*zip.File]int64, len(zipReader.File)),
+		dataOffsets:   make(map[*zip.File]int64),
+	}
+	for i, file := range zipReader.File {
+		archive.headerOffsets[file] = offsets[i]
+
+		// The first entry wins, like FindEntry
+		if _, ok := archive.files[file.Name]; !ok {
+			archive.files[file.Name] = file
+		}
+
+		for dir := file.Name; strings.Contains(dir, "/"); {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			archive.directories[dir+"/"] = true
+		}
+	}
+
+	return archive, nil
+}
+
+// findDirectory returns the location of the central directory from the
+// tail of an archive, which starts at tailOffset
+func findDirectory(ctx context.Context, archivePath string, tail []byte, tailOffset int64) (directoryLocation, error) {
+	end := findDirectoryEnd(tail)
+	if end < 0 {
+		return directoryLocation{}, ErrNotAZip
+	}
+
+	location, zip64 := readDirectoryEnd(tail[end:])
+	if !zip64 {
+		return location, nil
+	}
+
+	if end < directory64LocatorLen {
+		return directoryLocation{}, ErrNotAZip
+	}
+	recordOffset := readDirectory64Locator(tail[end-directory64LocatorLen:])
+	if recordOffset < 0 {
+		return directoryLocation{}, ErrNotAZip
+	}
+
+	var record []byte
+	if recordOffset >= tailOffset && recordOffset+directory64EndLen <= tailOffset+int64(len(tail)) {
+		record = tail[recordOffset-tailOffset:]
+	} else {
+		var err error
+		if record, err = readRange(ctx, archivePath, recordOffset, directory64EndLen); err != nil {
+			return directoryLocation{}, err
+		}
+	}
+
+	location, ok := readDirectory64End(record)
+	if !ok {
+		return directoryLocation{}, ErrNotAZip
+	}
+	return location, nil
+}
+
+func (a *CachedArchive) setLocation(location string) {
+	a.mu.Lock()
+	a.location = location
+	a.mu.Unlock()
+}
+
+func (a *CachedArchive) getLocation() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.location
+}
+
+// File returns the entry named name, or nil if there is none
+func (a *CachedArchive) File(name string) *zip.File {
+	return a.files[name]
+}
+
+// IsDirectory tells if dir, which ends with a slash, is a directory of the
+// archive. Directories don't need an entry of their own.
+func (a *CachedArchive) IsDirectory(dir string) bool {
+	return a.directories[dir]
+}
+
+// OpenFile returns the uncompressed contents of file, which are read with
+// a single ranged request once the offset of its data is known
+func (a *CachedArchive) OpenFile(ctx context.Context, file *zip.File) (io.ReadCloser, error) {
+	offset, err := a.dataOffset(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := OpenRange(ctx, a.getLocation(), offset, int64(file.CompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+
+	switch file.Method {
+	case zip.Store:
+		return data, nil
+	case zip.Deflate:
+		return &rangeReadCloser{Reader: flate.NewReader(data), Closer: data}, nil
+	default:
+		data.Close()
+		return nil, zip.ErrAlgorithm
+	}
+}
+
+// dataOffset reads the local header of file to find where its data starts
+func (a *CachedArchive) dataOffset(ctx context.Context, file *zip.File) (int64, error) {
+	a.mu.Lock()
+	offset, ok := a.dataOffsets[file]
+	a.mu.Unlock()
+	if ok {
+		return offset, nil
+	}
+
+	headerOffset, ok := a.headerOffsets[file]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+
+	header, err := readRange(ctx, a.getLocation(), headerOffset, localHeaderLen)
+	if err != nil {
+		return 0, err
+	}
+	offset, err = localDataOffset(header, headerOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	a.mu.Lock()
+	a.dataOffsets[file] = offset
+	a.mu.Unlock()
+	return offset, nil
+}
+
+// readRange reads length bytes at offset of the archive with OpenRange
+func readRange(ctx context.Context, archivePath string, offset int64, length int64) ([]byte, error) {
+	data, err := OpenRange(ctx, archivePath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(data, buf); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, ErrNotAZip
+	} else if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// archiveSize returns the size of a local file or asks the object store
+// for the size of a remote one with a ranged request for its first byte
+func archiveSize(ctx context.Context, archivePath string) (int64, error) {
+	if !isURL(archivePath) {
+		fi, err := os.Stat(archivePath)
+		if os.IsNotExist(err) {
+			return 0, ErrArchiveNotFound
+		} else if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+
+	scrubbedArchivePath := helper.ScrubURLParams(archivePath)
+	req, err := http.NewRequest(http.MethodGet, archivePath, nil)
+	if err != nil {
+		return 0, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<size>
+		contentRange := resp.Header.Get("Content-Range")
+		size, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("HTTP GET %q: invalid Content-Range %q", scrubbedArchivePath, contentRange)
+		}
+		return size, nil
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return 0, fmt.Errorf("HTTP GET %q: unknown size", scrubbedArchivePath)
+		}
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, ErrArchiveNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The file is empty
+		return 0, ErrNotAZip
+	default:
+		return 0, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
+	}
+}
@@ -0,0 +1,240 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+var cacheTestFiles = map[string]string{
+	"index.html":        "<html>index</html>",
+	"css/style.css":     "body { color: red; }",
+	"deep/dir/data.txt": "some data",
+}
+
+func createCacheTestArchive(t *testing.T, dir string) string {
+	return testhelper.CreateZipArchive(t, filepath.Join(dir, "archive.zip"), cacheTestFiles, "index.html")
+}
+
+func TestArchiveCacheOpen(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := createCacheTestArchive(t, tempDir)
+
+	var requests int32
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.FileServer(http.Dir(tempDir)).ServeHTTP(w, r)
+	}))
+	defer fileServer.Close()
+
+	for _, location := range []string{archivePath, fileServer.URL + "/archive.zip"} {
+		cache := zipartifacts.NewArchiveCache(10, 1000, time.Minute)
+
+		archive, err := cache.Open(context.Background(), location)
+		require.NoError(t, err)
+
+		for name, contents := range cacheTestFiles {
+			file := archive.File(name)
+			require.NotNil(t, file, name)
+
+			rc, err := archive.OpenFile(context.Background(), file)
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			require.Equal(t, contents, string(data), name)
+		}
+
+		require.Nil(t, archive.File("missing.html"))
+		require.True(t, archive.IsDirectory("deep/"))
+		require.True(t, archive.IsDirectory("deep/dir/"))
+		require.False(t, archive.IsDirectory("css/style.css/"))
+
+		cached, err := cache.Open(context.Background(), location)
+		require.NoError(t, err)
+		require.True(t, archive == cached)
+	}
+
+	// The same object with other query parameters is cached
+	cache := zipartifacts.NewArchiveCache(10, 1000, time.Minute)
+	archive, err := cache.Open(context.Background(), fileServer.URL+"/archive.zip?X-Amz-Signature=first")
+	require.NoError(t, err)
+
+	before := atomic.LoadInt32(&requests)
+	cached, err := cache.Open(context.Background(), fileServer.URL+"/archive.zip?X-Amz-Signature=second")
+	require.NoError(t, err)
+	require.True(t, archive == cached)
+	require.Equal(t, before, atomic.LoadInt32(&requests))
+}
+
+func TestArchiveCacheExpiry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := createCacheTestArchive(t, tempDir)
+	otherPath := filepath.Join(tempDir, "other.zip")
+	require.NoError(t, os.Link(archivePath, otherPath))
+
+	cache := zipartifacts.NewArchiveCache(1, 1000, time.Minute)
+	archive, err := cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+
+	cached, err := cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+	require.True(t, archive == cached)
+
+	// Opening another archive evicts the first one
+	_, err = cache.Open(context.Background(), otherPath)
+	require.NoError(t, err)
+	reopened, err := cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+	require.False(t, archive == reopened)
+
+	cache = zipartifacts.NewArchiveCache(10, 1000, 0)
+	archive, err = cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+	reopened, err = cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+	require.False(t, archive == reopened)
+}
+
+func TestArchiveCacheErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	notAZip := filepath.Join(tempDir, "not-a-zip.txt")
+	require.NoError(t, ioutil.WriteFile(notAZip, []byte("not a zip"), 0600))
+
+	fileServer := httptest.NewServer(http.FileServer(http.Dir(tempDir)))
+	defer fileServer.Close()
+
+	cache := zipartifacts.NewArchiveCache(10, 1000, time.Minute)
+
+	_, err = cache.Open(context.Background(), filepath.Join(tempDir, "missing.zip"))
+	require.Equal(t, zipartifacts.ErrArchiveNotFound, err)
+	_, err = cache.Open(context.Background(), fileServer.URL+"/missing.zip")
+	require.Equal(t, zipartifacts.ErrArchiveNotFound, err)
+
+	_, err = cache.Open(context.Background(), notAZip)
+	require.Equal(t, zipartifacts.ErrNotAZip, err)
+	_, err = cache.Open(context.Background(), fileServer.URL+"/not-a-zip.txt")
+	require.Equal(t, zipartifacts.ErrNotAZip, err)
+}
+
+func TestArchiveCacheLargeDirectory(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// The central directory is larger than the comment of an archive can be
+	f, err := os.Create(filepath.Join(tempDir, "archive.zip"))
+	require.NoError(t, err)
+	archive := zip.NewWriter(f)
+	for i := 0; i < 2000; i++ {
+		w, err := archive.Create(fmt.Sprintf("public/some/long/directory/name/file-%04d.html", i))
+		require.NoError(t, err)
+		fmt.Fprintf(w, "file %d", i)
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, f.Close())
+
+	var requests int32
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.FileServer(http.Dir(tempDir)).ServeHTTP(w, r)
+	}))
+	defer fileServer.Close()
+
+	cache := zipartifacts.NewArchiveCache(10, 2000, time.Minute)
+	cached, err := cache.Open(context.Background(), fileServer.URL+"/archive.zip")
+	require.NoError(t, err)
+	// The size, the end of the archive and the central directory
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	file := cached.File("public/some/long/directory/name/file-1234.html")
+	require.NotNil(t, file)
+	rc, err := cached.OpenFile(context.Background(), file)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "file 1234", string(data))
+
+	cache = zipartifacts.NewArchiveCache(10, 1999, time.Minute)
+	_, err = cache.Open(context.Background(), fileServer.URL+"/archive.zip")
+	require.Equal(t, zipartifacts.ErrDirectoryTooLarge, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = zipartifacts.NewArchiveCache(10, 2000, time.Minute).Open(ctx, fileServer.URL+"/archive.zip")
+	require.Error(t, err)
+}
+
+func TestArchiveCacheMaxEntries(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	archivePath := createCacheTestArchive(t, tempDir)
+	otherPath := filepath.Join(tempDir, "other.zip")
+	require.NoError(t, os.Link(archivePath, otherPath))
+
+	// Room for the entries of a single archive
+	cache := zipartifacts.NewArchiveCache(10, len(cacheTestFiles)+1, time.Minute)
+	archive, err := cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+
+	_, err = cache.Open(context.Background(), otherPath)
+	require.NoError(t, err)
+	reopened, err := cache.Open(context.Background(), archivePath)
+	require.NoError(t, err)
+	require.False(t, archive == reopened)
+}
+
+func TestArchiveCacheZip64(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Archives with more than 65535 entries have a zip64 end of central
+	// directory record
+	f, err := os.Create(filepath.Join(tempDir, "archive.zip"))
+	require.NoError(t, err)
+	archive := zip.NewWriter(f)
+	for i := 0; i < 0x10000; i++ {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%05d", i), Method: zip.Store})
+		require.NoError(t, err)
+		fmt.Fprintf(w, "%d", i)
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, f.Close())
+
+	cache := zipartifacts.NewArchiveCache(10, 0x10000, time.Minute)
+	cached, err := cache.Open(context.Background(), f.Name())
+	require.NoError(t, err)
+
+	rc, err := cached.OpenFile(context.Background(), cached.File("65535"))
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "65535", string(data))
+}
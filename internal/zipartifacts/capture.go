@@ -0,0 +1,107 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+)
+
+// ErrDirectoryNotCaptured means that the central directory of an archive
+// starts before the bytes kept by a DirectoryCapture
+var ErrDirectoryNotCaptured = errors.New("central directory not captured")
+
+// DirectoryCapture keeps the last bytes of a zip archive written to it, so
+// that its central directory can be read without reading the archive again
+type DirectoryCapture struct {
+	max  int
+	tail []byte
+	// start is the index of the oldest byte once tail is full
+	start int
+	size  int64
+}
+
+// NewDirectoryCapture returns a DirectoryCapture that keeps up to max bytes.
+// Unless max is larger than 64 KiB, files that aren't zip archives may
+// not be recognized.
+func NewDirectoryCapture(max int) *DirectoryCapture {
+	return &DirectoryCapture{max: max}
+}
+
+func (c *DirectoryCapture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.size += int64(n)
+
+	if len(p) >= c.max {
+		c.tail = append(c.tail[:0], p[len(p)-c.max:]...)
+		c.start = 0
+		return n, nil
+	}
+
+	if room := c.max - len(c.tail); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.tail = append(c.tail, p[:room]...)
+		p = p[room:]
+	}
+
+	for len(p) > 0 {
+		copied := copy(c.tail[c.start:], p)
+		p = p[copied:]
+		c.start = (c.start + copied) % c.max
+	}
+
+	return n, nil
+}
+
+// Close implements io.Closer, it does nothing
+func (c *DirectoryCapture) Close() error {
+	return nil
+}
+
+// Archive returns the archive written to c. Only the central directory of
+// the archive can be read, unless c kept the whole archive. The error is
+// ErrDirectoryNotCaptured if the central directory wasn't kept and
+// ErrNotAZip if the archive is invalid.
+func (c *DirectoryCapture) Archive() (*zip.Reader, error) {
+	tail := make([]byte, 0, len(c.tail))
+	tail = append(tail, c.tail[c.start:]...)
+	tail = append(tail, c.tail[:c.start]...)
+
+	r := &tailReaderAt{tail: tail, offset: c.size - int64(len(tail))}
+	archive, err := zip.NewReader(r, c.size)
+	if r.outside {
+		return nil, ErrDirectoryNotCaptured
+	} else if err != nil {
+		return nil, ErrNotAZip
+	}
+
+	return archive, nil
+}
+
+// tailReaderAt reads the tail of a file that starts at offset
+type tailReaderAt struct {
+	tail   []byte
+	offset int64
+	// outside is set if a read started before the tail
+	outside bool
+}
+
+func (r *tailReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.offset {
+		r.outside = true
+		return 0, ErrDirectoryNotCaptured
+	}
+
+	off -= r.offset
+	if off >= int64(len(r.tail)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.tail[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
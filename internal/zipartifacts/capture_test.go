@@ -0,0 +1,86 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+func captureTestArchive(t *testing.T, entries int) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for i := 0; i < entries; i++ {
+		f, err := archive.Create(fmt.Sprintf("dir/file-%d.txt", i))
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(f, "contents of file %d", i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	return buf.Bytes()
+}
+
+func capture(t *testing.T, data []byte, max int, chunkSize int) *zipartifacts.DirectoryCapture {
+	c := zipartifacts.NewDirectoryCapture(max)
+	for r := bytes.NewReader(data); r.Len() > 0; {
+		_, err := io.CopyN(c, r, int64(chunkSize))
+		if err != io.EOF {
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, c.Close())
+
+	return c
+}
+
+func TestDirectoryCapture(t *testing.T) {
+	data := captureTestArchive(t, 100)
+	expected, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	var expectedMetadata bytes.Buffer
+	require.NoError(t, zipartifacts.GenerateZipMetadata(&expectedMetadata, expected))
+
+	tests := []struct {
+		name      string
+		max       int
+		chunkSize int
+	}{
+		{name: "whole archive", max: len(data), chunkSize: 1000},
+		{name: "central directory", max: len(data) / 2, chunkSize: 1000},
+		{name: "small writes", max: len(data) / 2, chunkSize: 7},
+		{name: "large writes", max: len(data) / 2, chunkSize: len(data)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			archive, err := capture(t, data, tc.max, tc.chunkSize).Archive()
+			require.NoError(t, err)
+			require.Len(t, archive.File, 100)
+
+			var metadata bytes.Buffer
+			require.NoError(t, zipartifacts.GenerateZipMetadata(&metadata, archive))
+			require.Equal(t, expectedMetadata.Bytes(), metadata.Bytes())
+		})
+	}
+}
+
+func TestDirectoryCaptureTooSmall(t *testing.T) {
+	data := captureTestArchive(t, 100)
+
+	_, err := capture(t, data, 1024, 1000).Archive()
+	require.Equal(t, zipartifacts.ErrDirectoryNotCaptured, err)
+}
+
+func TestDirectoryCaptureNotAZip(t *testing.T) {
+	// Enough to find out there is no end of central directory record
+	_, err := capture(t, bytes.Repeat([]byte("not a zip "), 10000), 70*1024, 1000).Archive()
+	require.Equal(t, zipartifacts.ErrNotAZip, err)
+}
@@ -0,0 +1,164 @@
+package zipartifacts
+
+import (
+	"encoding/binary"
+)
+
+const (
+	directoryEndSignature       = 0x06054b50
+	directory64LocatorSignature = 0x07064b50
+	directory64EndSignature     = 0x06064b50
+	directoryHeaderSignature    = 0x02014b50
+
+	directoryEndLen       = 22
+	directory64LocatorLen = 20
+	directory64EndLen     = 56
+	directoryHeaderLen    = 46
+
+	// The end of central directory record is followed by a comment of up
+	// to 64 KiB
+	maxDirectoryEndSearch = directoryEndLen + 0xffff
+
+	uint16Max = 0xffff
+)
+
+// directoryLocation is where the central directory of an archive is and
+// how many entries it has
+type directoryLocation struct {
+	offset  int64
+	size    int64
+	entries int64
+}
+
+// findDirectoryEnd returns the index of the end of central directory record
+// in the tail of an archive, or -1 if there is none
+func findDirectoryEnd(tail []byte) int {
+	for i := len(tail) - directoryEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) != directoryEndSignature {
+			continue
+		}
+
+		commentLen := int(binary.LittleEndian.Uint16(tail[i+20:]))
+		if i+directoryEndLen+commentLen <= len(tail) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// readDirectoryEnd returns the location of the central directory from the
+// end of central directory record. If zip64 is true the location doesn't
+// fit in the record, it is in the zip64 end of central directory record.
+func readDirectoryEnd(record []byte) (location directoryLocation, zip64 bool) {
+	location = directoryLocation{
+		entries: int64(binary.LittleEndian.Uint16(record[10:])),
+		size:    int64(binary.LittleEndian.Uint32(record[12:])),
+		offset:  int64(binary.LittleEndian.Uint32(record[16:])),
+	}
+
+	zip64 = location.entries == uint16Max || location.size == uint32Max || location.offset == uint32Max
+	return location, zip64
+}
+
+// readDirectory64Locator returns the offset of the zip64 end of central
+// directory record, or -1 if locator isn't valid
+func readDirectory64Locator(locator []byte) int64 {
+	if binary.LittleEndian.Uint32(locator) != directory64LocatorSignature {
+		return -1
+	}
+
+	return int64(binary.LittleEndian.Uint64(locator[8:]))
+}
+
+// readDirectory64End returns the location of the central directory from
+// the zip64 end of central directory record
+func readDirectory64End(record []byte) (directoryLocation, bool) {
+	if binary.LittleEndian.Uint32(record) != directory64EndSignature {
+		return directoryLocation{}, false
+	}
+
+	return directoryLocation{
+		entries: int64(binary.LittleEndian.Uint64(record[32:])),
+		size:    int64(binary.LittleEndian.Uint64(record[40:])),
+		offset:  int64(binary.LittleEndian.Uint64(record[48:])),
+	}, true
+}
+
+// readHeaderOffsets returns the offsets of the local headers of the entries
+// of a central directory, in the order of the directory
+func readHeaderOffsets(directory []byte) ([]int64, error) {
+	var offsets []int64
+
+	for len(directory) >= directoryHeaderLen && binary.LittleEndian.Uint32(directory) == directoryHeaderSignature {
+		compressedSize := binary.LittleEndian.Uint32(directory[20:])
+		uncompressedSize := binary.LittleEndian.Uint32(directory[24:])
+		nameLen := int(binary.LittleEndian.Uint16(directory[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(directory[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(directory[32:]))
+		offset := int64(binary.LittleEndian.Uint32(directory[42:]))
+
+		recordLen := directoryHeaderLen + nameLen + extraLen + commentLen
+		if recordLen > len(directory) {
+			return nil, ErrNotAZip
+		}
+
+		if offset == uint32Max {
+			extra := directory[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen]
+			if offset = zip64HeaderOffset(extra, compressedSize, uncompressedSize); offset < 0 {
+				return nil, ErrNotAZip
+			}
+		}
+
+		offsets = append(offsets, offset)
+		directory = directory[recordLen:]
+	}
+
+	return offsets, nil
+}
+
+// zip64HeaderOffset returns the offset of the local header in the zip64
+// extra field, which has the sizes first if they don't fit in the header
+func zip64HeaderOffset(extra []byte, compressedSize, uncompressedSize uint32) int64 {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			return -1
+		}
+
+		field := extra[:size]
+		extra = extra[size:]
+		if id != zip64ExtraID {
+			continue
+		}
+
+		for _, value := range []uint32{uncompressedSize, compressedSize} {
+			if value == uint32Max {
+				if len(field) < 8 {
+					return -1
+				}
+				field = field[8:]
+			}
+		}
+		if len(field) < 8 {
+			return -1
+		}
+		return int64(binary.LittleEndian.Uint64(field))
+	}
+
+	return -1
+}
+
+// localDataOffset returns the offset of the data of an entry after its
+// local header, which starts at offset
+func localDataOffset(header []byte, offset int64) (int64, error) {
+	if len(header) < localHeaderLen || binary.LittleEndian.Uint32(header) != localHeaderSignature {
+		return 0, ErrNotAZip
+	}
+
+	nameLen := int64(binary.LittleEndian.Uint16(header[26:]))
+	extraLen := int64(binary.LittleEndian.Uint16(header[28:]))
+	return offset + localHeaderLen + nameLen + extraLen, nil
+}
@@ -4,4 +4,5 @@ package zipartifacts
 const (
 	StatusNotZip = 10 + iota
 	StatusEntryNotFound
+	StatusLimitExceeded
 )
@@ -0,0 +1,276 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// errUnreadableEntry means that the end of a zip entry can't be found
+var errUnreadableEntry = errors.New("unreadable zip entry")
+
+const (
+	localHeaderSignature    = 0x04034b50
+	dataDescriptorSignature = 0x08074b50
+	localHeaderLen          = 30
+	zip64ExtraID            = 0x0001
+	uint32Max               = 0xffffffff
+
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+)
+
+// Compression methods of entries whose data can be read directly
+const (
+	MethodStore   = "store"
+	MethodDeflate = "deflate"
+)
+
+var methodNames = map[uint16]string{
+	zip.Store:   MethodStore,
+	zip.Deflate: MethodDeflate,
+}
+
+// EntryDigest tells where the data of a zip entry is and its SHA-256
+type EntryDigest struct {
+	// Offset is the position of the compressed data in the archive
+	Offset int64
+	// Method is MethodStore or MethodDeflate
+	Method         string
+	CompressedSize uint64
+	SHA256         string
+
+	// The CRC-32 and size of the uncompressed data, to match the entry of
+	// the central directory
+	crc32            uint32
+	uncompressedSize uint64
+}
+
+// ZipDigests has the EntryDigest of the entries of a zip archive, by name
+type ZipDigests struct {
+	entries map[string]*EntryDigest
+}
+
+// Get returns the digest of the entry, or nil if it is unknown
+func (d *ZipDigests) Get(entry *zip.File) *EntryDigest {
+	if d == nil {
+		return nil
+	}
+
+	digest := d.entries[entry.Name]
+	// The central directory and the local header may disagree, the digest
+	// must describe the data that is served for the entry
+	if digest == nil || digest.CompressedSize != entry.CompressedSize64 ||
+		digest.uncompressedSize != entry.UncompressedSize64 || digest.crc32 != entry.CRC32 {
+		return nil
+	}
+
+	return digest
+}
+
+// ReadZipDigests reads the entries of the zip archive r in order, as
+// described by their local headers. Reading stops at the first entry it
+// can't read, e.g. a stored entry of unknown size, or when limits are
+// exceeded, the digests of the entries before are returned.
+func ReadZipDigests(r io.Reader, limits Limits) *ZipDigests {
+	digests := &ZipDigests{entries: make(map[string]*EntryDigest)}
+	compressed := &countingReader{r: r}
+	br := bufio.NewReader(compressed)
+
+	var extracted int64
+	check := func(n int64) error { return limits.checkStream(extracted+n, compressed.n) }
+	for {
+		// The offset in the archive of the next byte of br
+		offset := compressed.n - int64(br.Buffered())
+
+		digest, name, uncompressed, err := readZipEntry(br, offset, check)
+		if err != nil || name == "" {
+			break
+		}
+		extracted += uncompressed
+		if digest == nil {
+			continue
+		}
+
+		if _, ok := digests.entries[name]; ok {
+			// The metadata has only one entry per name, don't guess which
+			digests.entries[name] = nil
+		} else {
+			digests.entries[name] = digest
+		}
+	}
+
+	// Let the writer finish
+	io.Copy(ioutil.Discard, br)
+	return digests
+}
+
+// readZipEntry reads the entry at the start of br, which is at offset in
+// the archive, and returns its name and uncompressed size. The name is
+// empty if there are no more entries, the digest is nil if the entry was
+// skipped. check is called with the number of bytes extracted so far.
+func readZipEntry(br *bufio.Reader, offset int64, check func(int64) error) (*EntryDigest, string, int64, error) {
+	var header [localHeaderLen]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, "", 0, err
+	}
+	if binary.LittleEndian.Uint32(header[0:]) != localHeaderSignature {
+		// The central directory follows the last entry
+		return nil, "", 0, nil
+	}
+
+	flags := binary.LittleEndian.Uint16(header[6:])
+	method := binary.LittleEndian.Uint16(header[8:])
+	compressedSize := uint64(binary.LittleEndian.Uint32(header[18:]))
+	uncompressedSize := uint64(binary.LittleEndian.Uint32(header[22:]))
+	nameLen := int(binary.LittleEndian.Uint16(header[26:]))
+	extraLen := int(binary.LittleEndian.Uint16(header[28:]))
+
+	nameAndExtra := make([]byte, nameLen+extraLen)
+	if _, err := io.ReadFull(br, nameAndExtra); err != nil {
+		return nil, "", 0, err
+	}
+	name := string(nameAndExtra[:nameLen])
+
+	zip64 := false
+	for extra := nameAndExtra[nameLen:]; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra)-4 {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != zip64ExtraID {
+			continue
+		}
+
+		zip64 = true
+		if uncompressedSize == uint32Max && len(field) >= 8 {
+			uncompressedSize = binary.LittleEndian.Uint64(field)
+			field = field[8:]
+		}
+		if compressedSize == uint32Max && len(field) >= 8 {
+			compressedSize = binary.LittleEndian.Uint64(field)
+		}
+	}
+
+	dataOffset := offset + localHeaderLen + int64(nameLen+extraLen)
+	hasDescriptor := flags&flagDataDescriptor != 0
+	methodName, supported := methodNames[method]
+
+	if flags&flagEncrypted != 0 || !supported {
+		if hasDescriptor {
+			return nil, "", 0, errUnreadableEntry
+		}
+		_, err := io.CopyN(ioutil.Discard, br, int64(compressedSize))
+		return nil, name, 0, err
+	}
+
+	h := sha256.New()
+	crc := crc32.NewIEEE()
+	w := &checkedWriter{w: io.MultiWriter(h, crc), check: check}
+	var read, written int64
+	var err error
+	switch method {
+	case zip.Store:
+		if hasDescriptor {
+			return nil, "", 0, errUnreadableEntry
+		}
+		written, err = io.CopyN(w, br, int64(compressedSize))
+		read = written
+	case zip.Deflate:
+		read, written, err = inflate(w, br)
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if hasDescriptor {
+		zip64 = zip64 || read >= uint32Max || written >= uint32Max
+		if err := skipDataDescriptor(br, zip64); err != nil {
+			return nil, "", 0, err
+		}
+	} else if uint64(read) != compressedSize || uint64(written) != uncompressedSize {
+		return nil, "", 0, errUnreadableEntry
+	}
+
+	return &EntryDigest{
+		Offset:         dataOffset,
+		Method:         methodName,
+		CompressedSize: uint64(read),
+		SHA256:         hex.EncodeToString(h.Sum(nil)),
+
+		crc32:            crc.Sum32(),
+		uncompressedSize: uint64(written),
+	}, name, written, nil
+}
+
+// inflate writes the inflated deflate stream at the start of br to w. A
+// bufio.Reader is an io.ByteReader, flate doesn't read past the stream.
+func inflate(w io.Writer, br *bufio.Reader) (int64, int64, error) {
+	counter := &countingByteReader{r: br}
+	fr := flate.NewReader(counter)
+	defer fr.Close()
+
+	written, err := io.Copy(w, fr)
+	return counter.n, written, err
+}
+
+func skipDataDescriptor(br *bufio.Reader, zip64 bool) error {
+	if signature, err := br.Peek(4); err == nil && binary.LittleEndian.Uint32(signature) == dataDescriptorSignature {
+		br.Discard(4)
+	}
+
+	// CRC-32 and the compressed and uncompressed sizes
+	size := 4 + 4 + 4
+	if zip64 {
+		size = 4 + 8 + 8
+	}
+	_, err := br.Discard(size)
+	return err
+}
+
+// countingByteReader counts the bytes read from an io.ByteReader
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// checkedWriter calls check with the number of bytes written so far
+type checkedWriter struct {
+	w     io.Writer
+	n     int64
+	check func(n int64) error
+}
+
+func (c *checkedWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.check(c.n)
+}
@@ -0,0 +1,247 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+var digestTestFiles = map[string]string{
+	"stored.txt":           "stored contents",
+	"deflated.txt":         strings.Repeat("deflated contents ", 1000),
+	"descriptor.txt":       strings.Repeat("data descriptor ", 1000),
+	"some/dir/nested.json": `{"nested": true}`,
+}
+
+// rawZipEntry is an entry of a zip archive written by writeRawZip
+type rawZipEntry struct {
+	name   string
+	method uint16
+	// descriptor puts the CRC-32 and sizes in a data descriptor after the
+	// data instead of the local header
+	descriptor bool
+	contents   []byte
+}
+
+// writeRawZip writes the zip archive of entries by hand, archive/zip
+// always writes data descriptors before Go 1.17
+func writeRawZip(t *testing.T, entries []rawZipEntry) []byte {
+	var buf, directory bytes.Buffer
+	le := binary.LittleEndian
+
+	for _, entry := range entries {
+		data := entry.contents
+		if entry.method == zip.Deflate {
+			data = deflate(t, entry.contents)
+		}
+		crc := crc32.ChecksumIEEE(entry.contents)
+		offset := uint32(buf.Len())
+
+		var flags uint16
+		local := []uint32{crc, uint32(len(data)), uint32(len(entry.contents))}
+		if entry.descriptor {
+			flags = 0x8
+			local = []uint32{0, 0, 0}
+		}
+
+		binary.Write(&buf, le, uint32(0x04034b50))
+		binary.Write(&buf, le, []uint16{20, flags, entry.method, 0, 0})
+		binary.Write(&buf, le, local)
+		binary.Write(&buf, le, []uint16{uint16(len(entry.name)), 0})
+		buf.WriteString(entry.name)
+		buf.Write(data)
+		if entry.descriptor {
+			binary.Write(&buf, le, []uint32{0x08074b50, crc, uint32(len(data)), uint32(len(entry.contents))})
+		}
+
+		binary.Write(&directory, le, uint32(0x02014b50))
+		binary.Write(&directory, le, []uint16{20, 20, flags, entry.method, 0, 0})
+		binary.Write(&directory, le, []uint32{crc, uint32(len(data)), uint32(len(entry.contents))})
+		binary.Write(&directory, le, []uint16{uint16(len(entry.name)), 0, 0, 0, 0})
+		binary.Write(&directory, le, []uint32{0, offset})
+		directory.WriteString(entry.name)
+	}
+
+	directoryOffset := uint32(buf.Len())
+	directorySize := uint32(directory.Len())
+	buf.Write(directory.Bytes())
+
+	binary.Write(&buf, le, uint32(0x06054b50))
+	binary.Write(&buf, le, []uint16{0, 0, uint16(len(entries)), uint16(len(entries))})
+	binary.Write(&buf, le, []uint32{directorySize, directoryOffset})
+	binary.Write(&buf, le, uint16(0))
+
+	return buf.Bytes()
+}
+
+func generateDigestTestArchive(t *testing.T) []byte {
+	var entries []rawZipEntry
+
+	// Known sizes in the local header, without data descriptor
+	for _, name := range []string{"stored.txt", "deflated.txt", "some/dir/nested.json"} {
+		method := uint16(zip.Deflate)
+		if name == "stored.txt" {
+			method = zip.Store
+		}
+		entries = append(entries, rawZipEntry{name: name, method: method, contents: []byte(digestTestFiles[name])})
+	}
+
+	entries = append(entries, rawZipEntry{
+		name:       "descriptor.txt",
+		method:     zip.Deflate,
+		descriptor: true,
+		contents:   []byte(digestTestFiles["descriptor.txt"]),
+	})
+
+	return writeRawZip(t, entries)
+}
+
+func deflate(t *testing.T, contents []byte) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = fw.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, fw.Close())
+
+	return buf.Bytes()
+}
+
+func TestReadZipDigests(t *testing.T) {
+	data := generateDigestTestArchive(t)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	digests := zipartifacts.ReadZipDigests(bytes.NewReader(data), zipartifacts.Limits{})
+
+	for _, file := range archive.File {
+		digest := digests.Get(file)
+		require.NotNil(t, digest, file.Name)
+
+		offset, err := file.DataOffset()
+		require.NoError(t, err)
+		require.Equal(t, offset, digest.Offset, file.Name)
+		require.Equal(t, file.CompressedSize64, digest.CompressedSize, file.Name)
+
+		sum := sha256.Sum256([]byte(digestTestFiles[file.Name]))
+		require.Equal(t, hex.EncodeToString(sum[:]), digest.SHA256, file.Name)
+
+		if file.Method == zip.Store {
+			require.Equal(t, zipartifacts.MethodStore, digest.Method, file.Name)
+		} else {
+			require.Equal(t, zipartifacts.MethodDeflate, digest.Method, file.Name)
+		}
+	}
+}
+
+func TestReadZipDigestsDuplicateNames(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, contents := range []string{"first", "second"} {
+		w, err := archive.Create("file.txt")
+		require.NoError(t, err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	digests := zipartifacts.ReadZipDigests(bytes.NewReader(buf.Bytes()), zipartifacts.Limits{})
+	for _, file := range reader.File {
+		require.Nil(t, digests.Get(file))
+	}
+}
+
+func TestReadZipDigestsStoredWithDataDescriptor(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range []string{"stored.txt", "after.txt"} {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	// The end of the data is unknown, reading stops
+	digests := zipartifacts.ReadZipDigests(bytes.NewReader(buf.Bytes()), zipartifacts.Limits{})
+	for _, file := range reader.File {
+		require.Nil(t, digests.Get(file))
+	}
+}
+
+func TestReadZipDigestsMismatchingDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		field int
+	}{
+		{desc: "CRC-32", field: 16},
+		{desc: "uncompressed size", field: 24},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			data := writeRawZip(t, []rawZipEntry{
+				{name: "deflated.txt", method: zip.Deflate, contents: []byte(digestTestFiles["deflated.txt"])},
+			})
+
+			// The central directory describes other data than the local
+			// header, with the same name and compressed size
+			directory := bytes.Index(data, []byte{0x50, 0x4b, 0x01, 0x02})
+			require.True(t, directory > 0)
+			data[directory+tc.field]++
+
+			archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+
+			digests := zipartifacts.ReadZipDigests(bytes.NewReader(data), zipartifacts.Limits{})
+			require.Nil(t, digests.Get(archive.File[0]))
+		})
+	}
+}
+
+func TestReadZipDigestsExceedingLimits(t *testing.T) {
+	data := generateDigestTestArchive(t)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	digests := zipartifacts.ReadZipDigests(bytes.NewReader(data), zipartifacts.Limits{MaxUncompressedSize: 100})
+
+	// Reading stops at the first entry exceeding the limits
+	require.NotNil(t, digests.Get(archive.File[0]))
+	require.Nil(t, digests.Get(archive.File[1]))
+}
+
+func TestGenerateZipMetadataV3(t *testing.T) {
+	data := generateDigestTestArchive(t)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	digests := zipartifacts.ReadZipDigests(bytes.NewReader(data), zipartifacts.Limits{})
+
+	var metaBuffer bytes.Buffer
+	require.NoError(t, zipartifacts.GenerateZipMetadataV3(&metaBuffer, archive, digests))
+
+	metadata := readMetadata(t, metaBuffer.Bytes())
+	require.True(t, bytes.HasPrefix(metadata, []byte(zipartifacts.MetadataHeaderPrefix+zipartifacts.MetadataHeaderV3)))
+
+	offset, err := archive.File[0].DataOffset()
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte(digestTestFiles["stored.txt"]))
+	require.Contains(t, string(metadata), fmt.Sprintf(`"offset":%d,"method":"store","sha256":"%s"`, offset, hex.EncodeToString(sum[:])))
+	require.Contains(t, string(metadata), `"method":"deflate"`)
+	require.Contains(t, string(metadata), "some/dir/")
+}
@@ -0,0 +1,127 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errNegativeSeek = errors.New("seek to a negative position")
+
+// FindEntry returns the first entry of archive named fileName, or nil if
+// there is none
+func FindEntry(archive *zip.Reader, fileName string) *zip.File {
+	for _, file := range archive.File {
+		if file.Name == fileName {
+			return file
+		}
+	}
+	return nil
+}
+
+// EntryReader reads the uncompressed contents of a zip entry. Stored
+// entries are read directly from the archive, deflated entries are
+// decompressed again from their start when seeking backwards.
+type EntryReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// OpenEntry returns an EntryReader for file of the zip archive read from
+// archive, see OpenArchiveReaderAt
+func OpenEntry(archive io.ReaderAt, file *zip.File) (EntryReader, error) {
+	if file.Method == zip.Store {
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return &storedEntryReader{io.NewSectionReader(archive, offset, int64(file.CompressedSize64))}, nil
+	}
+
+	return &inflatingEntryReader{file: file, size: int64(file.UncompressedSize64)}, nil
+}
+
+type storedEntryReader struct {
+	io.ReadSeeker
+}
+
+func (r *storedEntryReader) Close() error {
+	return nil
+}
+
+// inflatingEntryReader opens file lazily, so that seeking to the end to
+// find the size doesn't decompress anything
+type inflatingEntryReader struct {
+	file *zip.File
+	size int64
+
+	rc io.ReadCloser
+	// pos is the position of rc, offset the position of the next Read
+	pos    int64
+	offset int64
+}
+
+func (r *inflatingEntryReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil || r.offset < r.pos {
+		if err := r.reopen(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.offset > r.pos {
+		n, err := io.CopyN(ioutil.Discard, r.rc, r.offset-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, err
+}
+
+func (r *inflatingEntryReader) reopen() error {
+	r.Close()
+
+	rc, err := r.file.Open()
+	if err != nil {
+		return err
+	}
+
+	r.rc = rc
+	r.pos = 0
+	return nil
+}
+
+func (r *inflatingEntryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	if offset < 0 {
+		return 0, errNegativeSeek
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *inflatingEntryReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
@@ -0,0 +1,63 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+func TestOpenEntry(t *testing.T) {
+	contents := strings.Repeat("0123456789", 1000)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: methodNames[method], Method: method})
+		require.NoError(t, err)
+		_, err = io.WriteString(w, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		t.Run(methodNames[method], func(t *testing.T) {
+			file := zipartifacts.FindEntry(reader, methodNames[method])
+			require.NotNil(t, file)
+
+			entry, err := zipartifacts.OpenEntry(bytes.NewReader(buf.Bytes()), file)
+			require.NoError(t, err)
+			defer entry.Close()
+
+			size, err := entry.Seek(0, io.SeekEnd)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(contents)), size)
+
+			for _, offset := range []int64{5000, 10, 9995} {
+				_, err = entry.Seek(offset, io.SeekStart)
+				require.NoError(t, err)
+
+				data, err := ioutil.ReadAll(io.LimitReader(entry, 5))
+				require.NoError(t, err)
+				require.Equal(t, contents[offset:offset+5], string(data))
+			}
+
+			data, err := ioutil.ReadAll(entry)
+			require.NoError(t, err)
+			require.Empty(t, data)
+		})
+	}
+
+	require.Nil(t, zipartifacts.FindEntry(reader, "missing"))
+}
+
+var methodNames = map[uint16]string{zip.Store: "stored.txt", zip.Deflate: "deflated.txt"}
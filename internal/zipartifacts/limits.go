@@ -0,0 +1,67 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"fmt"
+)
+
+// minRatioCheckSize is the uncompressed size from which the compression
+// ratio of an entry is checked, smaller entries can't exhaust resources
+const minRatioCheckSize = 1024 * 1024
+
+// Limits guard against archives that expand to more than their consumers
+// can handle. Zero values mean no limit.
+type Limits struct {
+	// MaxCompressionRatio is the largest allowed ratio between the
+	// uncompressed and compressed size of an entry
+	MaxCompressionRatio uint64
+	// MaxUncompressedSize is the largest allowed total size of the entries
+	MaxUncompressedSize uint64
+}
+
+// LimitError means that an archive exceeds the Limits
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return "archive exceeds the decompression limits: " + e.Reason
+}
+
+// Check returns a LimitError if archive exceeds l. It trusts the sizes
+// in the central directory of the archive.
+func (l Limits) Check(archive *zip.Reader) error {
+	var total uint64
+	for _, entry := range archive.File {
+		size := entry.UncompressedSize64
+
+		if l.MaxCompressionRatio > 0 && size > minRatioCheckSize && size/l.MaxCompressionRatio > entry.CompressedSize64 {
+			return &LimitError{Reason: fmt.Sprintf("%q is compressed more than %d times", entry.Name, l.MaxCompressionRatio)}
+		}
+
+		// Overflowing sizes are too large anyway
+		if total+size < total {
+			total = ^uint64(0)
+		} else {
+			total += size
+		}
+		if l.MaxUncompressedSize > 0 && total > l.MaxUncompressedSize {
+			return &LimitError{Reason: fmt.Sprintf("uncompressed size is more than %d bytes", l.MaxUncompressedSize)}
+		}
+	}
+
+	return nil
+}
+
+// checkStream returns a LimitError if an archive of which compressed bytes
+// were read to extract extracted bytes exceeds l
+func (l Limits) checkStream(extracted int64, compressed int64) error {
+	if l.MaxUncompressedSize > 0 && uint64(extracted) > l.MaxUncompressedSize {
+		return &LimitError{Reason: fmt.Sprintf("uncompressed size is more than %d bytes", l.MaxUncompressedSize)}
+	}
+	if l.MaxCompressionRatio > 0 && extracted > minRatioCheckSize && uint64(extracted)/l.MaxCompressionRatio > uint64(compressed) {
+		return &LimitError{Reason: fmt.Sprintf("archive is compressed more than %d times", l.MaxCompressionRatio)}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+func limitsTestArchive(t *testing.T) *zip.Reader {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for name, size := range map[string]int{"small": 1024, "zeros": 2 * 1024 * 1024} {
+		f, err := archive.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(make([]byte, size))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	return r
+}
+
+func TestLimitsCheck(t *testing.T) {
+	archive := limitsTestArchive(t)
+
+	tests := []struct {
+		name   string
+		limits zipartifacts.Limits
+		ok     bool
+	}{
+		{name: "no limits", ok: true},
+		{name: "compression ratio exceeded", limits: zipartifacts.Limits{MaxCompressionRatio: 100}},
+		{name: "compression ratio", limits: zipartifacts.Limits{MaxCompressionRatio: 10000}, ok: true},
+		{name: "uncompressed size exceeded", limits: zipartifacts.Limits{MaxUncompressedSize: 2 * 1024 * 1024}},
+		{name: "uncompressed size", limits: zipartifacts.Limits{MaxUncompressedSize: 2*1024*1024 + 1024}, ok: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.Check(archive)
+			if tc.ok {
+				require.NoError(t, err)
+			} else {
+				require.IsType(t, &zipartifacts.LimitError{}, err)
+			}
+		})
+	}
+}
@@ -18,11 +18,21 @@ type metadata struct {
 	Size     uint64 `json:"size,omitempty"`
 	Zipped   uint64 `json:"zipped,omitempty"`
 	Comment  string `json:"comment,omitempty"`
+	// Offset, Method and SHA256 are only in MetadataHeaderV3 metadata, for
+	// the entries whose data can be read directly
+	Offset int64  `json:"offset,omitempty"`
+	Method string `json:"method,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 const MetadataHeaderPrefix = "\x00\x00\x00&" // length of string below, encoded properly
 const MetadataHeader = "GitLab Build Artifacts Metadata 0.0.2\n"
 
+// MetadataHeaderV3 is the header of metadata with the offset, compression
+// method and SHA-256 of the entries. It has the same length as
+// MetadataHeader.
+const MetadataHeaderV3 = "GitLab Build Artifacts Metadata 0.0.3\n"
+
 func newMetadata(file *zip.File) metadata {
 	if file == nil {
 		return metadata{}
@@ -48,12 +58,12 @@ func (m metadata) writeEncoded(output io.Writer) error {
 	return writeBytes(output, j)
 }
 
-func writeZipEntryMetadata(output io.Writer, path string, entry *zip.File) error {
+func writeEntryMetadata(output io.Writer, path string, entry metadata) error {
 	if err := writeString(output, path); err != nil {
 		return err
 	}
 
-	if err := newMetadata(entry).writeEncoded(output); err != nil {
+	if err := entry.writeEncoded(output); err != nil {
 		return err
 	}
 
@@ -61,10 +71,38 @@ func writeZipEntryMetadata(output io.Writer, path string, entry *zip.File) error
 }
 
 func GenerateZipMetadata(w io.Writer, archive *zip.Reader) error {
+	entries := make(map[string]metadata, len(archive.File))
+	for _, entry := range archive.File {
+		entries[entry.Name] = newMetadata(entry)
+	}
+
+	return writeMetadata(w, MetadataHeader, entries)
+}
+
+// GenerateZipMetadataV3 is GenerateZipMetadata with the digests of the
+// entries, in the MetadataHeaderV3 format
+func GenerateZipMetadataV3(w io.Writer, archive *zip.Reader, digests *ZipDigests) error {
+	entries := make(map[string]metadata, len(archive.File))
+	for _, entry := range archive.File {
+		m := newMetadata(entry)
+		if digest := digests.Get(entry); digest != nil {
+			m.Offset = digest.Offset
+			m.Method = digest.Method
+			m.SHA256 = digest.SHA256
+		}
+		entries[entry.Name] = m
+	}
+
+	return writeMetadata(w, MetadataHeaderV3, entries)
+}
+
+// writeMetadata writes the metadata of the archive entries, including the
+// parent directories missing from entries
+func writeMetadata(w io.Writer, header string, entries map[string]metadata) error {
 	output := gzip.NewWriter(w)
 	defer output.Close()
 
-	if err := writeString(output, MetadataHeader); err != nil {
+	if err := writeString(output, header); err != nil {
 		return err
 	}
 
@@ -73,31 +111,26 @@ func GenerateZipMetadata(w io.Writer, archive *zip.Reader) error {
 		return err
 	}
 
-	// Create map of files in zip archive
-	zipMap := make(map[string]*zip.File, len(archive.File))
-
 	// Add missing entries
-	for _, entry := range archive.File {
-		zipMap[entry.Name] = entry
-
-		for d := path.Dir(entry.Name); d != "." && d != "/"; d = path.Dir(d) {
+	for name := range entries {
+		for d := path.Dir(name); d != "." && d != "/"; d = path.Dir(d) {
 			entryDir := d + "/"
-			if _, ok := zipMap[entryDir]; !ok {
-				zipMap[entryDir] = nil
+			if _, ok := entries[entryDir]; !ok {
+				entries[entryDir] = metadata{}
 			}
 		}
 	}
 
 	// Sort paths
-	sortedPaths := make([]string, 0, len(zipMap))
-	for path := range zipMap {
+	sortedPaths := make([]string, 0, len(entries))
+	for path := range entries {
 		sortedPaths = append(sortedPaths, path)
 	}
 	sort.Strings(sortedPaths)
 
 	// Write all files
 	for _, path := range sortedPaths {
-		if err := writeZipEntryMetadata(output, path, zipMap[path]); err != nil {
+		if err := writeEntryMetadata(output, path, entries[path]); err != nil {
 			return err
 		}
 	}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -44,6 +46,14 @@ var httpClient = &http.Client{
 // If the path do not exists error will be ErrArchiveNotFound,
 // if the file isn't a zip archive error will be ErrNotAZip
 func OpenArchive(ctx context.Context, archivePath string) (*zip.Reader, error) {
+	archive, _, err := OpenArchiveReaderAt(ctx, archivePath)
+	return archive, err
+}
+
+// OpenArchiveReaderAt is like OpenArchive, it also returns the ReaderAt the
+// archive is read with, so that the data of entries can be read directly,
+// e.g. with OpenEntry
+func OpenArchiveReaderAt(ctx context.Context, archivePath string) (*zip.Reader, io.ReaderAt, error) {
 	if isURL(archivePath) {
 		return openHTTPArchive(ctx, archivePath)
 	}
@@ -51,25 +61,113 @@ func OpenArchive(ctx context.Context, archivePath string) (*zip.Reader, error) {
 	return openFileArchive(ctx, archivePath)
 }
 
+// OpenReader opens the archive at a local path or a remote object store
+// URL for reading it from start to end. If the path does not exist the
+// error will be ErrArchiveNotFound.
+func OpenReader(ctx context.Context, archivePath string) (io.ReadCloser, error) {
+	if !isURL(archivePath) {
+		file, err := os.Open(archivePath)
+		if os.IsNotExist(err) {
+			return nil, ErrArchiveNotFound
+		}
+		return file, err
+	}
+
+	scrubbedArchivePath := helper.ScrubURLParams(archivePath)
+	req, err := http.NewRequest(http.MethodGet, archivePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrArchiveNotFound
+		}
+		return nil, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// OpenRange opens length bytes at offset of the archive at a local path or
+// a remote object store URL, with a single ranged request. If the path
+// does not exist the error will be ErrArchiveNotFound.
+func OpenRange(ctx context.Context, archivePath string, offset int64, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	if !isURL(archivePath) {
+		file, err := os.Open(archivePath)
+		if os.IsNotExist(err) {
+			return nil, ErrArchiveNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &rangeReadCloser{Reader: io.NewSectionReader(file, offset, length), Closer: file}, nil
+	}
+
+	scrubbedArchivePath := helper.ScrubURLParams(archivePath)
+	req, err := http.NewRequest(http.MethodGet, archivePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+		}
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrArchiveNotFound
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
+	}
+
+	return &rangeReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func isURL(path string) bool {
 	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
 }
 
-func openHTTPArchive(ctx context.Context, archivePath string) (*zip.Reader, error) {
+func openHTTPArchive(ctx context.Context, archivePath string) (*zip.Reader, io.ReaderAt, error) {
 	scrubbedArchivePath := helper.ScrubURLParams(archivePath)
 	req, err := http.NewRequest(http.MethodGet, archivePath, nil)
 	if err != nil {
-		return nil, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
+		return nil, nil, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
 	}
 	req = req.WithContext(ctx)
 
 	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+		return nil, nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
 	} else if resp.StatusCode == http.StatusNotFound {
-		return nil, ErrArchiveNotFound
+		return nil, nil, ErrArchiveNotFound
 	} else if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
+		return nil, nil, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
 	}
 
 	rs := httprs.NewHttpReadSeeker(resp, httpClient)
@@ -82,26 +180,37 @@ func openHTTPArchive(ctx context.Context, archivePath string) (*zip.Reader, erro
 
 	archive, err := zip.NewReader(rs, resp.ContentLength)
 	if err != nil {
-		return nil, ErrNotAZip
+		return nil, nil, ErrNotAZip
 	}
 
-	return archive, nil
+	return archive, rs, nil
 }
 
-func openFileArchive(ctx context.Context, archivePath string) (*zip.Reader, error) {
-	archive, err := zip.OpenReader(archivePath)
+func openFileArchive(ctx context.Context, archivePath string) (*zip.Reader, io.ReaderAt, error) {
+	file, err := os.Open(archivePath)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrArchiveNotFound
+	} else if err != nil {
+		return nil, nil, ErrNotAZip
+	}
+
+	fi, err := file.Stat()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, ErrArchiveNotFound
-		}
-		return nil, ErrNotAZip
+		file.Close()
+		return nil, nil, err
+	}
+
+	archive, err := zip.NewReader(file, fi.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, ErrNotAZip
 	}
 
 	go func() {
 		<-ctx.Done()
-		// We close the archive from this goroutine so that we can safely return a *zip.Reader instead of a *zip.ReadCloser
-		archive.Close()
+		// We close the file from this goroutine so that we can safely return a *zip.Reader instead of a *zip.ReadCloser
+		file.Close()
 	}()
 
-	return &archive.Reader, nil
+	return archive, file, nil
 }
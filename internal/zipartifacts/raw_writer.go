@@ -0,0 +1,195 @@
+package zipartifacts
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	extendedTimestampExtraID = 0x5455
+
+	zipVersion20 = 20
+	zipVersion45 = 45
+)
+
+// RawWriter writes a zip archive of entries whose data is copied compressed
+// as it is, e.g. from another archive. It writes the headers itself because
+// archive/zip can only write compressed data as it is since Go 1.17.
+type RawWriter struct {
+	w       *countingWriter
+	entries []rawEntry
+	closed  bool
+}
+
+type rawEntry struct {
+	header zip.FileHeader
+	offset uint64
+}
+
+// NewRawWriter returns a RawWriter writing to w
+func NewRawWriter(w io.Writer) *RawWriter {
+	return &RawWriter{w: &countingWriter{w: w}}
+}
+
+// CopyEntry writes an entry with the name, method, flags, times, CRC-32,
+// sizes and external attributes of header, and data as its compressed
+// data. The sizes and CRC-32 follow the data in a data descriptor if the
+// flags of header say so, like in the archive header comes from.
+func (rw *RawWriter) CopyEntry(header *zip.FileHeader, data io.Reader) error {
+	entry := rawEntry{header: *header, offset: uint64(rw.w.n)}
+	descriptor := entry.header.Flags&flagDataDescriptor != 0
+	zip64 := isZip64(&entry.header)
+
+	crc32 := entry.header.CRC32
+	var compressedSize, uncompressedSize uint32 = uint32Max, uint32Max
+	var extra []byte
+	if descriptor {
+		crc32, compressedSize, uncompressedSize = 0, 0, 0
+	} else if zip64 {
+		extra = zip64Extra(entry.header.UncompressedSize64, entry.header.CompressedSize64)
+	} else {
+		compressedSize, uncompressedSize = uint32(entry.header.CompressedSize64), uint32(entry.header.UncompressedSize64)
+	}
+	extra = append(extra, timestampExtra(&entry.header)...)
+
+	var buf bytes.Buffer
+	writeLE(&buf, uint32(localHeaderSignature), versionNeeded(zip64), entry.header.Flags, entry.header.Method,
+		entry.header.ModifiedTime, entry.header.ModifiedDate, crc32, compressedSize, uncompressedSize,
+		uint16(len(entry.header.Name)), uint16(len(extra)))
+	buf.WriteString(entry.header.Name)
+	buf.Write(extra)
+	if _, err := rw.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(rw.w, data)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != entry.header.CompressedSize64 {
+		return zip.ErrFormat
+	}
+
+	if descriptor {
+		buf.Reset()
+		writeLE(&buf, uint32(dataDescriptorSignature), entry.header.CRC32)
+		if zip64 {
+			writeLE(&buf, entry.header.CompressedSize64, entry.header.UncompressedSize64)
+		} else {
+			writeLE(&buf, uint32(entry.header.CompressedSize64), uint32(entry.header.UncompressedSize64))
+		}
+		if _, err := rw.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	rw.entries = append(rw.entries, entry)
+	return nil
+}
+
+// Close writes the central directory. It doesn't close the underlying
+// writer.
+func (rw *RawWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+
+	directoryOffset := uint64(rw.w.n)
+	var buf bytes.Buffer
+	for _, entry := range rw.entries {
+		writeDirectoryHeader(&buf, &entry)
+		if _, err := rw.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	directorySize := uint64(rw.w.n) - directoryOffset
+	records := uint64(len(rw.entries))
+
+	if records >= uint16Max || directorySize >= uint32Max || directoryOffset >= uint32Max {
+		directory64Offset := uint64(rw.w.n)
+		writeLE(&buf, uint32(directory64EndSignature), uint64(directory64EndLen-12),
+			uint16(zipVersion45), uint16(zipVersion45), uint32(0), uint32(0),
+			records, records, directorySize, directoryOffset)
+		writeLE(&buf, uint32(directory64LocatorSignature), uint32(0), directory64Offset, uint32(1))
+
+		records, directorySize, directoryOffset = uint16Max, uint32Max, uint32Max
+	}
+
+	writeLE(&buf, uint32(directoryEndSignature), uint16(0), uint16(0), uint16(records), uint16(records),
+		uint32(directorySize), uint32(directoryOffset), uint16(0))
+	_, err := rw.w.Write(buf.Bytes())
+	return err
+}
+
+func writeDirectoryHeader(buf *bytes.Buffer, entry *rawEntry) {
+	header := &entry.header
+	zip64 := isZip64(header) || entry.offset >= uint32Max
+
+	var compressedSize, uncompressedSize, offset uint32 = uint32Max, uint32Max, uint32Max
+	var extra []byte
+	if zip64 {
+		extra = zip64Extra(header.UncompressedSize64, header.CompressedSize64, entry.offset)
+	} else {
+		compressedSize, uncompressedSize, offset = uint32(header.CompressedSize64), uint32(header.UncompressedSize64), uint32(entry.offset)
+	}
+	extra = append(extra, timestampExtra(header)...)
+
+	writeLE(buf, uint32(directoryHeaderSignature), header.CreatorVersion&0xff00|versionNeeded(zip64), versionNeeded(zip64),
+		header.Flags, header.Method, header.ModifiedTime, header.ModifiedDate, header.CRC32,
+		compressedSize, uncompressedSize, uint16(len(header.Name)), uint16(len(extra)),
+		uint16(0), uint16(0), uint16(0), header.ExternalAttrs, offset)
+	buf.WriteString(header.Name)
+	buf.Write(extra)
+}
+
+func isZip64(header *zip.FileHeader) bool {
+	return header.CompressedSize64 >= uint32Max || header.UncompressedSize64 >= uint32Max
+}
+
+func versionNeeded(zip64 bool) uint16 {
+	if zip64 {
+		return zipVersion45
+	}
+	return zipVersion20
+}
+
+// zip64Extra returns a zip64 extra field with values
+func zip64Extra(values ...uint64) []byte {
+	var buf bytes.Buffer
+	writeLE(&buf, uint16(zip64ExtraID), uint16(8*len(values)), values)
+	return buf.Bytes()
+}
+
+// timestampExtra returns the extended timestamp extra field with the
+// modification time of header, like archive/zip writes it
+func timestampExtra(header *zip.FileHeader) []byte {
+	if header.Modified.IsZero() {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	writeLE(&buf, uint16(extendedTimestampExtraID), uint16(5), uint8(1), uint32(header.Modified.Unix()))
+	return buf.Bytes()
+}
+
+func writeLE(buf *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		// Writing fixed-size values to a bytes.Buffer can't fail
+		binary.Write(buf, binary.LittleEndian, value)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
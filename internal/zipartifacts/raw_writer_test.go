@@ -0,0 +1,106 @@
+package zipartifacts_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+// copyArchive copies the entries of data with a RawWriter
+func copyArchive(t *testing.T, data []byte) *zip.Reader {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	rw := zipartifacts.NewRawWriter(&buf)
+	for _, file := range archive.File {
+		offset, err := file.DataOffset()
+		require.NoError(t, err)
+
+		header := file.FileHeader
+		header.Name = "copy/" + file.Name
+		require.NoError(t, rw.CopyEntry(&header, io.NewSectionReader(bytes.NewReader(data), offset, int64(file.CompressedSize64))))
+	}
+	require.NoError(t, rw.Close())
+
+	copied, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, copied.File, len(archive.File))
+
+	return copied
+}
+
+func readZipFile(t *testing.T, file *zip.File) string {
+	rc, err := file.Open()
+	require.NoError(t, err)
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestRawWriter(t *testing.T) {
+	modified := time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		header := &zip.FileHeader{Name: "executable/" + methodNames[method], Method: method}
+		header.SetModTime(modified)
+		header.SetMode(0755)
+		w, err := archive.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, digestTestFiles["deflated.txt"])
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+
+	// Entries with and without data descriptor
+	for _, data := range [][]byte{buf.Bytes(), generateDigestTestArchive(t)} {
+		for _, file := range copyArchive(t, data).File {
+			require.Contains(t, file.Name, "copy/")
+
+			name := file.Name[len("copy/"):]
+			if contents, ok := digestTestFiles[name]; ok {
+				require.Equal(t, contents, readZipFile(t, file), name)
+				continue
+			}
+
+			require.Equal(t, digestTestFiles["deflated.txt"], readZipFile(t, file), name)
+			require.Equal(t, os.FileMode(0755), file.Mode().Perm(), name)
+			require.True(t, modified.Equal(file.ModTime()), name)
+		}
+	}
+}
+
+func TestRawWriterZip64(t *testing.T) {
+	// Archives with more than 65535 entries have a zip64 end of central
+	// directory record
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i := 0; i < 0x10000; i++ {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%05d", i), Method: zip.Store})
+		require.NoError(t, err)
+		fmt.Fprintf(w, "%d", i)
+	}
+	require.NoError(t, archive.Close())
+
+	copied := copyArchive(t, buf.Bytes())
+	require.Equal(t, "65535", readZipFile(t, copied.File[0xffff]))
+}
+
+func TestRawWriterShortData(t *testing.T) {
+	rw := zipartifacts.NewRawWriter(ioutil.Discard)
+	err := rw.CopyEntry(&zip.FileHeader{Name: "short.txt", Method: zip.Store, CompressedSize64: 10, UncompressedSize64: 10}, bytes.NewReader([]byte("short")))
+	require.Equal(t, zip.ErrFormat, err)
+}
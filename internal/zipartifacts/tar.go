@@ -0,0 +1,247 @@
+package zipartifacts
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotATar will be used when the file is neither a tar archive nor a
+// gzip file
+var ErrNotATar = errors.New("not a tar")
+
+const (
+	// FormatZip and FormatTar are the archive formats of artifacts.
+	// Tar archives can be gzip compressed, a gzip file that doesn't
+	// contain a tar archive is read as an archive of the file it contains.
+	FormatZip = "zip"
+	FormatTar = "tar"
+
+	// tarMagicOffset is where a tar header has the "ustar" magic
+	tarMagicOffset = 257
+	// DetectFormatLen is how many bytes DetectFormat needs
+	DetectFormatLen = tarMagicOffset + 5
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	tarMagic  = []byte("ustar")
+)
+
+// DetectFormat returns the format of the archive starting with head. Zip
+// archives are found by their central directory at the end, they may start
+// with other data, e.g. self-extracting archives, so anything that is
+// neither a gzip file nor a tar archive is read as a zip archive.
+func DetectFormat(head []byte) string {
+	if bytes.HasPrefix(head, gzipMagic) || isTarHeader(head) {
+		return FormatTar
+	}
+	return FormatZip
+}
+
+func isTarHeader(head []byte) bool {
+	return len(head) >= DetectFormatLen && bytes.Equal(head[tarMagicOffset:DetectFormatLen], tarMagic)
+}
+
+// TarArchive has the entries of a tar archive or gzip file that can be
+// served: regular files and directories
+type TarArchive struct {
+	entries map[string]metadata
+}
+
+// ReadTarArchive reads the tar archive or gzip file r. The error is a
+// LimitError if the archive exceeds limits, which are checked as r is read,
+// and ErrNotATar if r is neither a tar archive nor a gzip file.
+func ReadTarArchive(r io.Reader, limits Limits) (*TarArchive, error) {
+	archive := &TarArchive{entries: make(map[string]metadata)}
+
+	err := walkTar(r, limits, func(hdr *tar.Header, contents io.Reader) (bool, error) {
+		name, ok := tarEntryName(hdr)
+		if !ok {
+			return false, nil
+		}
+		// The first entry wins, like FindTarEntry
+		if _, ok := archive.entries[name]; ok {
+			return false, nil
+		}
+
+		size := hdr.Size
+		if size < 0 {
+			n, err := io.Copy(ioutil.Discard, contents)
+			if err != nil {
+				return false, err
+			}
+			size = n
+		}
+
+		archive.entries[name] = metadata{
+			Modified: hdr.ModTime.Unix(),
+			Mode:     strconv.FormatUint(uint64(hdr.FileInfo().Mode().Perm()), 8),
+			Size:     uint64(size),
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// GenerateTarMetadata writes the metadata of archive in the format of
+// GenerateZipMetadata, without checksums and compressed sizes
+func GenerateTarMetadata(w io.Writer, archive *TarArchive) error {
+	entries := make(map[string]metadata, len(archive.entries))
+	for name, entry := range archive.entries {
+		entries[name] = entry
+	}
+
+	return writeMetadata(w, MetadataHeader, entries)
+}
+
+// FindTarEntry calls found with the header and contents of the regular
+// file fileName in the tar archive or gzip file r. It returns
+// os.ErrNotExist if there is no such file. The size in the header of a
+// gzip file is -1.
+func FindTarEntry(r io.Reader, fileName string, found func(*tar.Header, io.Reader) error) error {
+	var foundErr error
+	ok := false
+
+	err := walkTar(r, Limits{}, func(hdr *tar.Header, contents io.Reader) (bool, error) {
+		if name, _ := tarEntryName(hdr); name != fileName || hdr.Typeflag == tar.TypeDir {
+			return false, nil
+		}
+
+		ok = true
+		foundErr = found(hdr, contents)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	return foundErr
+}
+
+// walkTar calls fn for every entry of r until it returns true or an error
+func walkTar(r io.Reader, limits Limits, fn func(*tar.Header, io.Reader) (bool, error)) error {
+	compressed := &countingReader{r: r}
+	br := bufio.NewReader(compressed)
+	head, _ := br.Peek(DetectFormatLen)
+	if DetectFormat(head) != FormatTar {
+		return ErrNotATar
+	}
+
+	var contents io.Reader = br
+	var gzipHeader *gzip.Header
+	if bytes.HasPrefix(head, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return ErrNotATar
+		}
+
+		gzipHeader = &gz.Header
+		contents = gz
+	}
+
+	extracted := &countingReader{r: contents}
+	extracted.check = func(n int64) error { return limits.checkStream(n, compressed.n) }
+	tarReader := bufio.NewReader(extracted)
+
+	if gzipHeader != nil {
+		if head, _ := tarReader.Peek(DetectFormatLen); !isTarHeader(head) {
+			return walkGzipFile(gzipHeader, tarReader, fn)
+		}
+	}
+
+	tr := tar.NewReader(tarReader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*LimitError); ok {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("read tar: %v", err)
+		}
+
+		done, err := fn(hdr, tr)
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// walkGzipFile calls fn for the file of a gzip file. Its size is -1, it
+// isn't known before the file is read.
+func walkGzipFile(gzipHeader *gzip.Header, r io.Reader, fn func(*tar.Header, io.Reader) (bool, error)) error {
+	if gzipHeader.Name == "" {
+		return ErrNotATar
+	}
+
+	hdr := &tar.Header{
+		Name:     gzipHeader.Name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     -1,
+		ModTime:  gzipHeader.ModTime,
+	}
+	_, err := fn(hdr, r)
+	return err
+}
+
+// tarEntryName returns the name of a regular file or directory in the
+// metadata, directories end with a slash. Other entries and unsafe names
+// are skipped.
+func tarEntryName(hdr *tar.Header) (string, bool) {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA && hdr.Typeflag != tar.TypeDir {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(hdr.Name, "./")
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || name == "." || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		name += "/"
+	}
+	return name, true
+}
+
+// countingReader calls check, if set, with the number of bytes read so far
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	check func(n int64) error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.check != nil {
+		if checkErr := c.check(c.n); checkErr != nil {
+			return n, checkErr
+		}
+	}
+
+	return n, err
+}
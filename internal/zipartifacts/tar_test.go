@@ -0,0 +1,173 @@
+package zipartifacts_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+func generateTestTar(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	w := io.Writer(&buf)
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	// Unsafe paths and links are left out of the metadata
+	files := []string{"file1", "some/file/dir/", "some/file/dir/file2", "../../test12/test", "/usr/bin/test", "./f/asd"}
+	for _, file := range files {
+		hdr := &tar.Header{Name: file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file)), ModTime: time.Now()}
+		if file[len(file)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := io.WriteString(tw, file)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}))
+	require.NoError(t, tw.Close())
+
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func generateTestGzip(t *testing.T, name string, contents []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Name = name
+	_, err := gz.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+func readMetadata(t *testing.T, metadata []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(metadata))
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestDetectFormat(t *testing.T) {
+	var zipBuf bytes.Buffer
+	require.NoError(t, generateTestArchive(&zipBuf))
+
+	require.Equal(t, zipartifacts.FormatZip, zipartifacts.DetectFormat(zipBuf.Bytes()))
+	require.Equal(t, zipartifacts.FormatTar, zipartifacts.DetectFormat(generateTestTar(t, false)))
+	require.Equal(t, zipartifacts.FormatTar, zipartifacts.DetectFormat(generateTestTar(t, true)))
+	// Zip archives may start with other data
+	require.Equal(t, zipartifacts.FormatZip, zipartifacts.DetectFormat([]byte("#!/bin/sh self-extracting archive")))
+}
+
+func TestGenerateTarMetadata(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		archive, err := zipartifacts.ReadTarArchive(bytes.NewReader(generateTestTar(t, compress)), zipartifacts.Limits{})
+		require.NoError(t, err)
+
+		var metadata bytes.Buffer
+		require.NoError(t, zipartifacts.GenerateTarMetadata(&metadata, archive))
+		require.NoError(t, validateMetadata(bytes.NewReader(metadata.Bytes())))
+
+		data := readMetadata(t, metadata.Bytes())
+		require.Contains(t, string(data), "f/asd\x00")
+		require.NotContains(t, string(data), "test12")
+		require.NotContains(t, string(data), "usr/bin")
+		require.NotContains(t, string(data), "link")
+	}
+}
+
+func TestGenerateTarMetadataFromGzipFile(t *testing.T) {
+	archive, err := zipartifacts.ReadTarArchive(bytes.NewReader(generateTestGzip(t, "report.xml", []byte("<report/>"))), zipartifacts.Limits{})
+	require.NoError(t, err)
+
+	var metadata bytes.Buffer
+	require.NoError(t, zipartifacts.GenerateTarMetadata(&metadata, archive))
+	data := readMetadata(t, metadata.Bytes())
+	require.Contains(t, string(data), "report.xml\x00")
+	require.Contains(t, string(data), `"size":9`)
+
+	_, err = zipartifacts.ReadTarArchive(bytes.NewReader(generateTestGzip(t, "", []byte("<report/>"))), zipartifacts.Limits{})
+	require.Equal(t, zipartifacts.ErrNotATar, err, "gzip files without name have no entries")
+}
+
+func TestTarDuplicateNames(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, contents := range []string{"first", "second entry"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	archive, err := zipartifacts.ReadTarArchive(bytes.NewReader(buf.Bytes()), zipartifacts.Limits{})
+	require.NoError(t, err)
+
+	var metadata bytes.Buffer
+	require.NoError(t, zipartifacts.GenerateTarMetadata(&metadata, archive))
+	require.Contains(t, string(readMetadata(t, metadata.Bytes())), `"size":5`)
+
+	var contents []byte
+	err = zipartifacts.FindTarEntry(bytes.NewReader(buf.Bytes()), "file.txt", func(hdr *tar.Header, r io.Reader) error {
+		contents, err = ioutil.ReadAll(r)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, "first", string(contents))
+}
+
+func TestReadTarArchiveErrors(t *testing.T) {
+	_, err := zipartifacts.ReadTarArchive(bytes.NewReader([]byte("not a tar")), zipartifacts.Limits{})
+	require.Equal(t, zipartifacts.ErrNotATar, err)
+
+	bomb := generateTestGzip(t, "zeros", make([]byte, 4*1024*1024))
+	_, err = zipartifacts.ReadTarArchive(bytes.NewReader(bomb), zipartifacts.Limits{MaxCompressionRatio: 100})
+	require.IsType(t, &zipartifacts.LimitError{}, err)
+
+	_, err = zipartifacts.ReadTarArchive(bytes.NewReader(generateTestTar(t, true)), zipartifacts.Limits{MaxUncompressedSize: 1024})
+	require.IsType(t, &zipartifacts.LimitError{}, err)
+}
+
+func TestFindTarEntry(t *testing.T) {
+	archive := generateTestTar(t, true)
+
+	var contents []byte
+	err := zipartifacts.FindTarEntry(bytes.NewReader(archive), "some/file/dir/file2", func(hdr *tar.Header, r io.Reader) error {
+		require.Equal(t, int64(len("some/file/dir/file2")), hdr.Size)
+
+		var err error
+		contents, err = ioutil.ReadAll(r)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, "some/file/dir/file2", string(contents))
+
+	for _, name := range []string{"missing", "some/file/dir/", "link"} {
+		err = zipartifacts.FindTarEntry(bytes.NewReader(archive), name, func(*tar.Header, io.Reader) error {
+			t.Fatal("found", name)
+			return nil
+		})
+		require.Equal(t, os.ErrNotExist, err)
+	}
+}
@@ -27,12 +27,19 @@ import (
 
 	"gitlab.com/gitlab-org/labkit/tracing"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/artifacts"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/clamd"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload/exif"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
 )
 
 // Version is the current version of GitLab Workhorse
@@ -55,6 +62,10 @@ var apiQueueLimit = flag.Uint("apiQueueLimit", 0, "Number of API requests allowe
 var apiQueueTimeout = flag.Duration("apiQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of requests")
 var apiCiLongPollingDuration = flag.Duration("apiCiLongPollingDuration", 50, "Long polling duration for job requesting for runners (default 50s - enabled)")
 
+var gitGenerationTimeout = flag.Duration("gitGenerationTimeout", git.DefaultGenerationTimeout, "Maximum duration of the generation of cached git bundles and packs")
+
+var useExiftool = flag.Bool("exiftool", false, "Remove image metadata with exiftool instead of the built-in cleaner")
+
 var prometheusListenAddr = flag.String("prometheusListenAddr", "", "Prometheus listening address, e.g. 'localhost:9229'")
 
 var logConfig = logConfiguration{}
@@ -124,6 +135,8 @@ func main() {
 	}
 
 	secret.SetPath(*secretPath)
+	exif.SetExiftool(*useExiftool)
+	git.SetGenerationTimeout(*gitGenerationTimeout)
 	cfg := config.Config{
 		Backend:                  backendURL,
 		Socket:                   *authSocket,
@@ -144,11 +157,33 @@ func main() {
 		}
 
 		cfg.Redis = cfgFromFile.Redis
+		cfg.Gitaly = cfgFromFile.Gitaly
+		cfg.Clamd = cfgFromFile.Clamd
+		cfg.UploadLimits = cfgFromFile.UploadLimits
 
 		if cfg.Redis != nil {
 			redis.Configure(cfg.Redis, redis.DefaultDialFunc)
 			go redis.Process()
 		}
+
+		if err := gitaly.Configure(cfg.Gitaly); err != nil {
+			logger.WithError(err).Fatal("Can not configure Gitaly connections")
+		}
+
+		if err := clamd.Configure(cfg.Clamd); err != nil {
+			logger.WithError(err).Fatal("Can not configure clamd")
+		}
+
+		if limits := cfg.UploadLimits; limits != nil {
+			artifacts.SetArchiveLimits(zipartifacts.Limits{
+				MaxCompressionRatio: limits.ArchiveMaxCompressionRatio,
+				MaxUncompressedSize: limits.ArchiveMaxUncompressedSize,
+			})
+			exif.SetMaxImageDimensions(limits.ImageMaxWidth, limits.ImageMaxHeight)
+			if limits.MultipartMaxFiles > 0 {
+				upload.SetMaxFileParts(limits.MultipartMaxFiles)
+			}
+		}
 	}
 
 	up := wrapRaven(upstream.NewUpstream(cfg))
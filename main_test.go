@@ -425,6 +425,8 @@ func TestAPIFalsePositivesAreProxied(t *testing.T) {
 		path   string
 	}{
 		{"GET", "/nested/group/project/blob/master/foo.git/info/refs"},
+		{"GET", "/nested/group/project/blob/master/foo.git/HEAD"},
+		{"GET", "/nested/group/project/blob/master/foo.git/objects/info/packs"},
 		{"POST", "/nested/group/project/blob/master/foo.git/git-upload-pack"},
 		{"POST", "/nested/group/project/blob/master/foo.git/git-receive-pack"},
 		{"PUT", "/nested/group/project/blob/master/foo.git/gitlab-lfs/objects/0000000000000000000000000000000000000000000000000000000000000000/0"},
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -72,7 +73,7 @@ func uploadTestServer(t *testing.T, extraTests func(r *http.Request)) *httptest.
 		if err != nil {
 			t.Fatal(err)
 		}
-		nValues := 7 // file name, path, size, md5, sha1, sha256, sha512 for just the upload (no metadata because we are not POSTing a valid zip file)
+		nValues := 9 // file name, path, size, md5, sha1, sha256, sha512, content_type and the signed fields for just the upload (no metadata because we are not POSTing a valid zip file)
 		if len(r.MultipartForm.Value) != nValues {
 			t.Errorf("Expected to receive exactly %d values", nValues)
 		}
@@ -86,28 +87,13 @@ func uploadTestServer(t *testing.T, extraTests func(r *http.Request)) *httptest.
 	})
 }
 
-func parseJWT(token *jwt.Token) (interface{}, error) {
-	// Don't forget to validate the alg is what you expect:
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-	}
-
-	testhelper.ConfigureSecret()
-	secretBytes, err := secret.Bytes()
-	if err != nil {
-		return nil, fmt.Errorf("read secret from file: %v", err)
-	}
-
-	return secretBytes, nil
-}
-
 func TestAcceleratedUpload(t *testing.T) {
 	reqBody, contentType, err := multipartBodyWithFile()
 	if err != nil {
 		t.Fatal(err)
 	}
 	ts := uploadTestServer(t, func(r *http.Request) {
-		jwtToken, err := jwt.Parse(r.Header.Get(upload.RewrittenFieldsHeader), parseJWT)
+		jwtToken, err := jwt.Parse(r.Header.Get(upload.RewrittenFieldsHeader), testhelper.ParseJWT)
 		require.NoError(t, err)
 
 		rewrittenFields := jwtToken.Claims.(jwt.MapClaims)["rewritten_fields"].(map[string]interface{})
@@ -210,7 +196,7 @@ func TestLfsUpload(t *testing.T) {
 		switch r.RequestURI {
 		case resource + "/authorize":
 			// Expect the authorization call to be signed
-			_, err := jwt.Parse(r.Header.Get(secret.RequestHeader), parseJWT)
+			_, err := jwt.Parse(r.Header.Get(secret.RequestHeader), testhelper.ParseJWT)
 			require.NoError(t, err)
 
 			// Instruct workhorse to accept the upload
@@ -220,7 +206,7 @@ func TestLfsUpload(t *testing.T) {
 
 		case resource:
 			// Expect the finalization call to be signed
-			_, err := jwt.Parse(r.Header.Get(secret.RequestHeader), parseJWT)
+			_, err := jwt.Parse(r.Header.Get(secret.RequestHeader), testhelper.ParseJWT)
 			require.NoError(t, err)
 
 			// Expect the request to point to a file on disk containing the data
@@ -259,3 +245,132 @@ func TestLfsUpload(t *testing.T) {
 	require.Equal(t, 200, resp.StatusCode)
 	require.Equal(t, rspBody, string(rspData))
 }
+
+func TestPackageUploads(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	const packageData = "package contents"
+
+	multipartBody := func() (io.Reader, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		file, err := writer.CreateFormFile("content", "package.whl")
+		require.NoError(t, err)
+		fmt.Fprint(file, packageData)
+		require.NoError(t, writer.Close())
+		return body, writer.FormDataContentType()
+	}
+
+	npmBody := fmt.Sprintf(
+		`{"name":"npm-test","_attachments":{"npm-test-1.0.0.tgz":{"data":%q,"length":%d}}}`,
+		base64.StdEncoding.EncodeToString([]byte(packageData)), len(packageData),
+	)
+
+	tests := []struct {
+		name      string
+		method    string
+		resource  string
+		body      func() (io.Reader, string)
+		fileField string
+	}{
+		{
+			name:     "conan",
+			method:   "PUT",
+			resource: "/api/v4/packages/conan/v1/files/pkg/1.0/user/stable/0/export/conanfile.py",
+		},
+		{
+			name:     "project conan",
+			method:   "PUT",
+			resource: "/api/v4/projects/1/packages/conan/v1/files/pkg/1.0/user/stable/0/export/conanfile.py",
+		},
+		{
+			name:     "generic",
+			method:   "PUT",
+			resource: "/api/v4/projects/1/packages/generic/pkg/1.0/file.txt",
+		},
+		{
+			name:      "nuget",
+			method:    "PUT",
+			resource:  "/api/v4/projects/1/packages/nuget",
+			body:      multipartBody,
+			fileField: "content",
+		},
+		{
+			name:      "pypi",
+			method:    "POST",
+			resource:  "/api/v4/projects/1/packages/pypi",
+			body:      multipartBody,
+			fileField: "content",
+		},
+		{
+			name:     "npm",
+			method:   "PUT",
+			resource: "/api/v4/projects/1/packages/npm/npm-test",
+			body: func() (io.Reader, string) {
+				return strings.NewReader(npmBody), "application/json"
+			},
+			fileField: "file",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalized := false
+			ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, tc.method, r.Method)
+
+				switch r.URL.Path {
+				case tc.resource + "/authorize":
+					w.Header().Set("Content-Type", api.ResponseContentType)
+					_, err := fmt.Fprintf(w, `{"TempPath":%q}`, scratchDir)
+					require.NoError(t, err)
+				case tc.resource:
+					var path string
+					if tc.fileField == "" {
+						require.NoError(t, r.ParseForm())
+						path = r.Form.Get("file.path")
+					} else {
+						require.NoError(t, r.ParseMultipartForm(100000))
+						require.Empty(t, r.MultipartForm.File, "files should be on disk, not in the form")
+
+						jwtToken, err := jwt.Parse(r.Header.Get(upload.RewrittenFieldsHeader), testhelper.ParseJWT)
+						require.NoError(t, err)
+						rewrittenFields := jwtToken.Claims.(jwt.MapClaims)["rewritten_fields"].(map[string]interface{})
+						require.Contains(t, rewrittenFields, tc.fileField)
+
+						path = r.FormValue(tc.fileField + ".path")
+					}
+
+					contents, err := ioutil.ReadFile(path)
+					require.NoError(t, err)
+					require.Equal(t, packageData, string(contents))
+
+					finalized = true
+					w.WriteHeader(200)
+				default:
+					t.Fatalf("Unexpected request to upstream! %v %q", r.Method, r.RequestURI)
+				}
+			})
+			defer ts.Close()
+
+			ws := startWorkhorseServer(ts.URL)
+			defer ws.Close()
+
+			body, contentType := io.Reader(strings.NewReader(packageData)), "application/octet-stream"
+			if tc.body != nil {
+				body, contentType = tc.body()
+			}
+
+			req, err := http.NewRequest(tc.method, ws.URL+tc.resource, body)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentType)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, 200, resp.StatusCode)
+			require.True(t, finalized, "upload not finalized")
+		})
+	}
+}